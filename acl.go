@@ -23,6 +23,7 @@
 package lib
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -58,19 +59,67 @@ func CreateACLValue(priority string, read, write, execute, admin string) (code u
 	return code, nil
 }
 
+// tokenACL содержимое токена: models.TokenACL и поля для отзыва (см. ACLRevocationStore)
+// в токенах, выпущенных до появления полей, они пустые
+type tokenACL struct {
+	models.TokenACL
+	// ID идентификатор токена для отзыва
+	ID string `json:"id,omitempty"`
+	// Issued время выпуска (unix nano)
+	Issued int64 `json:"issued,omitempty"`
+	// Version версия ACL объекта, для которой выпущен токен
+	Version int64 `json:"version,omitempty"`
+	// Rights именованные права в порядке кодирования страниц (только для ACL со страницами прав, см. SetACLRights)
+	Rights []string `json:"rights,omitempty"`
+}
+
+// clone копия токена с собственными ACL-листом и списком прав (токены из кеша не должны изменяться вызывающим)
+func (t tokenACL) clone() tokenACL {
+	if t.ACL != nil {
+		acl := make(map[string]uint16, len(t.ACL))
+		for k, v := range t.ACL {
+			acl[k] = v
+		}
+		t.ACL = acl
+	}
+	if t.Rights != nil {
+		t.Rights = append([]string(nil), t.Rights...)
+	}
+
+	return t
+}
+
 // GenTokenACL создаем токен
 // ACL - список субъектов с правами доступа (см. описание models.XACLKey)
 func GenTokenACL(acl map[string]uint16, projectKey []byte, uid string, tokenInterval time.Duration) (token string, err error) {
+	token, _, err = genTokenACL(acl, projectKeyCipher(projectKey), uid, tokenInterval, 0)
+	return token, err
+}
+
+// GenTokenACLVersion создаем токен для версии ACL объекта version (см. ACLRevocationStore.SetACLVersion)
+// id - идентификатор токена для отзыва через RevokeTokenACL
+func GenTokenACLVersion(acl map[string]uint16, projectKey []byte, uid string, tokenInterval time.Duration, version int64) (token, id string, err error) {
+	return genTokenACL(acl, projectKeyCipher(projectKey), uid, tokenInterval, version)
+}
+
+func genTokenACL(acl map[string]uint16, c tokenCipher, uid string, tokenInterval time.Duration, version int64) (token, id string, err error) {
 	if tokenInterval == 0 {
 		tokenInterval = 100000 * time.Hour // 12 лет
 	}
-	t := models.TokenACL{
-		ACL:     acl,
-		Expired: time.Now().Add(tokenInterval).Unix(),
-		Uid:     uid,
+	now := time.Now()
+	t := tokenACL{
+		TokenACL: models.TokenACL{
+			ACL:     acl,
+			Expired: now.Add(tokenInterval).Unix(),
+			Uid:     uid,
+		},
+		ID:      UUID(),
+		Issued:  now.UnixNano(),
+		Version: version,
 	}
 
-	return encodeACLKey(t, projectKey)
+	token, err = encodeACLKey(t, c)
+	return token, t.ID, err
 }
 
 // ParseTokenACL - возвращаем права для заданного объекта для данного токена
@@ -79,102 +128,170 @@ func GenTokenACL(acl map[string]uint16, projectKey []byte, uid string, tokenInte
 // subjects - список субьектов доступа к объекту (чей токен) - списком через запятую (,)
 // r, w, x, a - read/write/execute/admin
 func ParseTokenACL(token, uid, subjects string, projectKey []byte) (r, w, x, a bool, err error) {
-	var res = map[string][4]string{} // ключ - приоритет, значения - права
+	return parseTokenACL(context.Background(), token, uid, subjects, projectKeyCipher(projectKey))
+}
 
-	valid, acl, err := verifyTokenACL(token, uid, projectKey)
+// ParseTokenACLContext ParseTokenACL с контекстом запроса для проверки отзыва токена
+func ParseTokenACLContext(ctx context.Context, token, uid, subjects string, projectKey []byte) (r, w, x, a bool, err error) {
+	return parseTokenACL(ctx, token, uid, subjects, projectKeyCipher(projectKey))
+}
+
+func parseTokenACL(ctx context.Context, token, uid, subjects string, c tokenCipher) (r, w, x, a bool, err error) {
+	valid, acl, err := verifyTokenACL(ctx, token, uid, c)
 	if !valid || err != nil {
 		return false, false, false, false, err
 	}
 
+	// если права не заданы - то разрешаем false
+	final := evalACL(acl, subjects).final
+	return final[0] == ACLPermissionAllow, final[1] == ACLPermissionAllow, final[2] == ACLPermissionAllow, final[3] == ACLPermissionAllow, err
+}
+
+// aclEval ход расчета прав (используется в ParseTokenACL и ExplainTokenACL)
+type aclEval struct {
+	// matched найденные в ACL субъекты в порядке запроса
+	matched []aclMatch
+	// levels права, рассчитанные в рамках каждого приоритета, levelBy - субъекты, задавшие это значение
+	levels  map[string][4]string
+	levelBy map[string][4]string
+	// final итоговые права, finalBy - приоритет, которым они заданы ("" - никем)
+	final   [4]string
+	finalBy [4]string
+}
+
+type aclMatch struct {
+	subject    string
+	priority   string
+	permission [4]string
+}
+
+// evalACL рассчитывает права списка субъектов (через запятую) по ACL-листу
+func evalACL(acl map[string]uint16, subjects string) (e aclEval) {
+	return evalACLSubjects(acl, strings.Split(subjects, ","))
+}
+
+// evalACLSubjects рассчитывает права субъектов по ACL-листу
+func evalACLSubjects(acl map[string]uint16, subjects []string) (e aclEval) {
+	e.levels = map[string][4]string{} // ключ - приоритет, значения - права
+	e.levelBy = map[string][4]string{}
+
 	// пробегаем переданных субъекты, ищем каждый из них в списке доступа и рассчитываем права
-	for _, v := range strings.Split(subjects, ",") {
+	for _, v := range subjects {
 		// если в acl есть указанный пользователь - сохраняем его права
-		if rights, ok := acl[v]; ok {
-			var currentPer = [4]string{}
-			var found bool
+		rights, ok := acl[v]
+		if !ok {
+			continue
+		}
 
-			// делим значение на два байта
-			priorityByte, permissionByte := byte(rights>>8), byte(rights&0xFF)
+		// делим значение на два байта
+		priorityByte, permissionByte := byte(rights>>8), byte(rights&0xFF)
 
-			// получаем права на объект (текстовом виде)
-			permission := DecodeFromByte(permissionByte)
-			priority := DecodePriority(priorityByte)
+		// получаем права на объект (текстовом виде)
+		permission := DecodeFromByte(permissionByte)
+		priority := DecodePriority(priorityByte)
+		e.matched = append(e.matched, aclMatch{subject: v, priority: priority, permission: permission})
 
-			if currentPer, found = res[priority]; !found {
-				res[priority] = [4]string{}
+		currentPer, by := e.levels[priority], e.levelBy[priority]
+		for i := 0; i < len(currentPer); i++ {
+			// пропускаем, если нет значения, которое могло бы поменять статус
+			if permission[i] == "" {
+				continue
+			}
+			// пропускаем если для данного приоритета уже задано Deny
+			if currentPer[i] == ACLPermissionDeny {
+				continue
 			}
-			for i := 0; i < len(currentPer); i++ {
-				// пропускаем, если нет значения, которое могло бы поменять статус
-				if permission[i] == "" {
-					continue
-				}
-				// пропускаем если для данного приоритета уже задано Deny
-				if currentPer[i] == ACLPermissionDeny {
-					continue
-				}
-				// Не обнуляем, а заменяем следующим значением
-				if permission[i] != ACLPermissionNull {
-					currentPer[i] = permission[i]
-				}
+			// Не обнуляем, а заменяем следующим значением
+			if permission[i] != ACLPermissionNull {
+				currentPer[i] = permission[i]
+				by[i] = v
 			}
-			res[priority] = currentPer
 		}
+		e.levels[priority], e.levelBy[priority] = currentPer, by
 	}
 
 	// складываем права согласно приоритетам
 	// тут я могу заменять запрещающие права на более высоком приоритете
-	finalPermission := [4]string{}
 	for _, pr := range []string{ACLPriorityOthers, ACLPriorityRole, ACLPriorityGroup, ACLPriorityUser} {
 		for i := 0; i < 4; i++ {
-			if res[pr][i] != ACLPermissionNull && res[pr][i] != "" {
-				finalPermission[i] = res[pr][i]
+			if e.levels[pr][i] != ACLPermissionNull && e.levels[pr][i] != "" {
+				e.final[i] = e.levels[pr][i]
+				e.finalBy[i] = pr
 			}
 		}
 	}
 
-	// если права не заданы - то разрешаем false
-	return finalPermission[0] == ACLPermissionAllow, finalPermission[1] == ACLPermissionAllow, finalPermission[2] == ACLPermissionAllow, finalPermission[3] == ACLPermissionAllow, err
+	return e
 }
 
 // verifyTokenACL берем X-ACL-Key. если он есть, то он должен быть расшифровать и валидируем содержимое
 // acl - возвращает ACL-лист
-func verifyTokenACL(token, uid string, projectKey []byte) (valid bool, acl map[string]uint16, err error) {
-	xsKey, err := decodeACLKey(projectKey, token)
+func verifyTokenACL(ctx context.Context, token, uid string, c tokenCipher) (valid bool, acl map[string]uint16, err error) {
+	xsKey, err := verifyTokenACLKey(ctx, token, uid, c)
 	if err != nil {
-		return false, nil, ErrInvalidACLKey
+		return false, nil, err
+	}
+
+	return true, xsKey.ACL, nil
+}
+
+// verifyTokenACLKey проверяет токен как verifyTokenACL и возвращает его содержимое целиком
+func verifyTokenACLKey(ctx context.Context, token, uid string, c tokenCipher) (xsKey tokenACL, err error) {
+	xsKey, err = decodeACLKey(c, token)
+	if err != nil {
+		return xsKey, ErrInvalidACLKey
 	}
 
 	if time.Now().Unix() > xsKey.Expired {
-		return false, nil, ErrExpiredACLKey
+		return xsKey, ErrExpiredACLKey
 	}
 
 	if xsKey.Uid != uid {
-		return false, nil, ErrInvalidACLKey
+		return xsKey, ErrInvalidACLKey
 	}
 
-	return true, xsKey.ACL, nil
+	if err = checkACLRevocation(ctx, xsKey); err != nil {
+		return xsKey, err
+	}
+
+	return xsKey, nil
 }
 
 // decodeACLKey расшифровывает модель XACLKey из токена
 // если токен протух - возвращаем ошибку
-func decodeACLKey(projectKey []byte, xACLKey string) (xsKey models.TokenACL, err error) {
+func decodeACLKey(c tokenCipher, xACLKey string) (xsKey tokenACL, err error) {
 	if xACLKey == "" {
 		return xsKey, ErrNoACLKey
 	}
 
-	v, err := Decrypt(projectKey, xACLKey)
+	// расшифрованные токены кешируются (см. SetACLTokenCacheSize), кеш хранит и отдает копии токенов
+	// ключ, которым расшифрован токен, мог быть выведен из связки, а прием старого формата - отключен,
+	// поэтому при попадании в кеш проверяем и то и другое
+	cacheKey := aclTokenCacheKey(c.cacheID(), xACLKey)
+	if entry, ok := aclTokenCache.get(cacheKey); ok && c.secret(entry.keyID) != nil && (!entry.legacy || LegacyDecryptAllowed()) {
+		return entry.token, nil
+	}
+
+	v, keyID, err := c.decrypt(xACLKey)
+	if err != nil {
+		return xsKey, err
+	}
 	err = json.Unmarshal([]byte(v), &xsKey)
+	if err == nil {
+		aclTokenCache.put(aclTokenCacheEntry{key: cacheKey, token: xsKey, keyID: keyID, legacy: isLegacyCiphertext(xACLKey)})
+	}
 	return
 }
 
 // encodeACLKey шифрует модель XACLKey в токен
-func encodeACLKey(xsKey models.TokenACL, projectKey []byte) (token string, err error) {
+func encodeACLKey(xsKey tokenACL, c tokenCipher) (token string, err error) {
+	xsKey.Rights = aclRightsLayout(xsKey.ACL)
 	strJson, err := json.Marshal(xsKey)
 	if err != nil {
 		return "", fmt.Errorf("error Marshal XACLKey, err: %s", err)
 	}
 
-	token, err = Encrypt(projectKey, string(strJson))
+	token, err = c.encrypt(string(strJson))
 	if err != nil {
 		return "", fmt.Errorf("error Encrypt XACLKey, err: %s", err)
 	}
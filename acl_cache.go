@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultACLTokenCacheSize размер кеша расшифрованных ACL-токенов по-умолчанию
+const defaultACLTokenCacheSize = 4096
+
+var aclTokenCache = newACLTokenCache(defaultACLTokenCacheSize)
+
+// aclTokenCacheEntry расшифрованный токен, key - хеш ключа проекта и токена
+type aclTokenCacheEntry struct {
+	key   [sha256.Size]byte
+	token tokenACL
+	// keyID ключ связки, которым расшифрован токен
+	keyID string
+	// legacy токен может быть старого формата AES-CFB (см. isLegacyCiphertext, SetLegacyDecrypt)
+	legacy bool
+}
+
+// aclTokenLRU кеш расшифрованных ACL-токенов с вытеснением давно не использованных
+type aclTokenLRU struct {
+	mx    sync.Mutex
+	size  int
+	order *list.List
+	items map[[sha256.Size]byte]*list.Element
+}
+
+func newACLTokenCache(size int) *aclTokenLRU {
+	return &aclTokenLRU{
+		size:  size,
+		order: list.New(),
+		items: map[[sha256.Size]byte]*list.Element{},
+	}
+}
+
+// SetACLTokenCacheSize задаем размер кеша расшифрованных ACL-токенов (0 - кеш отключен)
+// токены хранятся до истечения Expired или вытеснения, отзыв (ACLRevocationStore) проверяется при каждом разборе
+func SetACLTokenCacheSize(size int) {
+	aclTokenCache.mx.Lock()
+	defer aclTokenCache.mx.Unlock()
+
+	aclTokenCache.size = size
+	aclTokenCache.shrink()
+}
+
+// aclTokenCacheKey ключ кеша: токен, расшифрованный другим ключом проекта или связкой, не должен находиться
+func aclTokenCacheKey(cipherID []byte, token string) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(cipherID)
+	h.Write([]byte{0})
+	h.Write([]byte(token))
+
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+
+	return key
+}
+
+func (c *aclTokenLRU) get(key [sha256.Size]byte) (entry aclTokenCacheEntry, ok bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return entry, false
+	}
+	entry = *e.Value.(*aclTokenCacheEntry)
+	if time.Now().Unix() > entry.token.Expired {
+		c.order.Remove(e)
+		delete(c.items, key)
+		return aclTokenCacheEntry{}, false
+	}
+	c.order.MoveToFront(e)
+	entry.token = entry.token.clone()
+
+	return entry, true
+}
+
+func (c *aclTokenLRU) put(entry aclTokenCacheEntry) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.size <= 0 {
+		return
+	}
+	entry.token = entry.token.clone()
+	if e, ok := c.items[entry.key]; ok {
+		*e.Value.(*aclTokenCacheEntry) = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[entry.key] = c.order.PushFront(&entry)
+	c.shrink()
+}
+
+// shrink вытесняем записи сверх размера кеша (вызывается под блокировкой)
+func (c *aclTokenLRU) shrink() {
+	for c.order.Len() > 0 && c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*aclTokenCacheEntry).key)
+	}
+}
+
+// ACLAccess права на объект, рассчитанные ParseTokenACLMany
+type ACLAccess struct {
+	Read, Write, Execute, Admin bool
+	// Err ошибка токена объекта (права при этом false)
+	Err error
+}
+
+// ParseTokenACLMany - возвращаем права списка субъектов (через запятую) на несколько объектов за один проход
+// tokens[i] - токен объекта uids[i], ошибки токенов возвращаются в ACLAccess.Err и не прерывают расчет
+// одинаковые токены рассчитываются один раз
+func ParseTokenACLMany(tokens []string, subjects string, uids []string, projectKey []byte) (access []ACLAccess, err error) {
+	return parseTokenACLMany(context.Background(), tokens, subjects, uids, projectKeyCipher(projectKey))
+}
+
+// ParseTokenACLManyContext ParseTokenACLMany с контекстом запроса для проверки отзыва токенов
+func ParseTokenACLManyContext(ctx context.Context, tokens []string, subjects string, uids []string, projectKey []byte) (access []ACLAccess, err error) {
+	return parseTokenACLMany(ctx, tokens, subjects, uids, projectKeyCipher(projectKey))
+}
+
+func parseTokenACLMany(ctx context.Context, tokens []string, subjects string, uids []string, c tokenCipher) (access []ACLAccess, err error) {
+	if len(tokens) != len(uids) {
+		return nil, fmt.Errorf("error ParseTokenACLMany, err: %d tokens for %d uids", len(tokens), len(uids))
+	}
+
+	subjectList := strings.Split(subjects, ",")
+	done := make(map[string]ACLAccess, len(tokens))
+	access = make([]ACLAccess, len(tokens))
+	for i, token := range tokens {
+		key := uids[i] + "\x00" + token
+		if a, ok := done[key]; ok {
+			access[i] = a
+			continue
+		}
+
+		valid, acl, err := verifyTokenACL(ctx, token, uids[i], c)
+		if !valid || err != nil {
+			access[i] = ACLAccess{Err: err}
+		} else {
+			final := evalACLSubjects(acl, subjectList).final
+			access[i] = ACLAccess{
+				Read:    final[0] == ACLPermissionAllow,
+				Write:   final[1] == ACLPermissionAllow,
+				Execute: final[2] == ACLPermissionAllow,
+				Admin:   final[3] == ACLPermissionAllow,
+			}
+		}
+		done[key] = access[i]
+	}
+
+	return access, nil
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLTokenCache(t *testing.T) {
+	defer SetACLTokenCacheSize(defaultACLTokenCacheSize)
+	SetACLTokenCacheSize(2)
+
+	key := []byte("POIlhb123Y09olUi")
+	acl := map[string]uint16{}
+	acl["u1"], _ = CreateACLValue(ACLPriorityUser, ACLPermissionAllow, ACLPermissionDeny, ACLPermissionNull, ACLPermissionNull)
+
+	tokens := make([]string, 3)
+	for i := range tokens {
+		tokens[i], _ = GenTokenACL(acl, key, "doc"+strconv.Itoa(i), 0)
+		_, _, _, _, err := ParseTokenACL(tokens[i], "doc"+strconv.Itoa(i), "u1", key)
+		assert.NoError(t, err)
+	}
+
+	// вытеснен самый старый токен
+	_, ok := aclTokenCache.get(aclTokenCacheKey(key, tokens[0]))
+	assert.False(t, ok)
+	_, ok = aclTokenCache.get(aclTokenCacheKey(key, tokens[2]))
+	assert.True(t, ok)
+	// чужой ключ проекта не находит расшифрованный токен
+	_, ok = aclTokenCache.get(aclTokenCacheKey([]byte("0123456789abcdef"), tokens[2]))
+	assert.False(t, ok)
+
+	// истекший токен не возвращается из кеша
+	expired, _ := GenTokenACL(acl, key, "doc", time.Second)
+	_, _, _, _, err := ParseTokenACL(expired, "doc", "u1", key)
+	assert.NoError(t, err)
+	time.Sleep(2 * time.Second)
+	_, ok = aclTokenCache.get(aclTokenCacheKey(key, expired))
+	assert.False(t, ok)
+	_, _, _, _, err = ParseTokenACL(expired, "doc", "u1", key)
+	assert.ErrorIs(t, err, ErrExpiredACLKey)
+
+	SetACLTokenCacheSize(0)
+	assert.Equal(t, 0, aclTokenCache.order.Len())
+}
+
+func TestParseTokenACLMany(t *testing.T) {
+	key := []byte("POIlhb123Y09olUi")
+	acl := map[string]uint16{}
+	acl["all"], _ = CreateACLValue(ACLPriorityOthers, ACLPermissionAllow, ACLPermissionNull, ACLPermissionNull, ACLPermissionNull)
+	acl["u1"], _ = CreateACLValue(ACLPriorityUser, ACLPermissionNull, ACLPermissionAllow, ACLPermissionNull, ACLPermissionNull)
+	t1, _ := GenTokenACL(acl, key, "doc1", 0)
+	t2, _ := GenTokenACL(map[string]uint16{}, key, "doc2", 0)
+
+	access, err := ParseTokenACLMany([]string{t1, t2, t1, ""}, "all,u1", []string{"doc1", "doc2", "other", "doc4"}, key)
+	assert.NoError(t, err)
+	assert.Equal(t, ACLAccess{Read: true, Write: true}, access[0])
+	assert.Equal(t, ACLAccess{}, access[1])
+	assert.ErrorIs(t, access[2].Err, ErrInvalidACLKey)
+	assert.Error(t, access[3].Err)
+
+	_, err = ParseTokenACLMany([]string{t1}, "all", nil, key)
+	assert.Error(t, err)
+}
+
+func benchmarkACLTokens(b *testing.B, n int) (tokens, uids []string, key []byte) {
+	key = []byte("POIlhb123Y09olUi")
+	acl := map[string]uint16{}
+	for i := 0; i < 20; i++ {
+		acl["group"+strconv.Itoa(i)], _ = CreateACLValue(ACLPriorityGroup, ACLPermissionAllow, ACLPermissionNull, ACLPermissionDeny, ACLPermissionNull)
+	}
+	for i := 0; i < n; i++ {
+		uids = append(uids, "doc"+strconv.Itoa(i))
+		token, err := GenTokenACL(acl, key, uids[i], 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, uids, key
+}
+
+func BenchmarkParseTokenACL(b *testing.B) {
+	tokens, uids, key := benchmarkACLTokens(b, 1)
+	defer SetACLTokenCacheSize(defaultACLTokenCacheSize)
+
+	for _, size := range []int{0, defaultACLTokenCacheSize} {
+		b.Run("cache="+strconv.Itoa(size), func(b *testing.B) {
+			SetACLTokenCacheSize(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, _, _, _ = ParseTokenACL(tokens[0], uids[0], "user1,group3,group7", key)
+			}
+		})
+	}
+}
+
+func BenchmarkParseTokenACLMany(b *testing.B) {
+	tokens, uids, key := benchmarkACLTokens(b, 200)
+	defer SetACLTokenCacheSize(defaultACLTokenCacheSize)
+
+	for _, size := range []int{0, defaultACLTokenCacheSize} {
+		b.Run("cache="+strconv.Itoa(size), func(b *testing.B) {
+			SetACLTokenCacheSize(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = ParseTokenACLMany(tokens, "user1,group3,group7", uids, key)
+			}
+		})
+	}
+}
+
+func TestACLTokenCacheCopy(t *testing.T) {
+	key := []byte("POIlhb123Y09olUi")
+	acl := map[string]uint16{}
+	acl["alice"], _ = CreateACLValue(ACLPriorityUser, ACLPermissionAllow, ACLPermissionNull, ACLPermissionNull, ACLPermissionNull)
+	admin, _ := CreateACLValue(ACLPriorityUser, ACLPermissionAllow, ACLPermissionAllow, ACLPermissionAllow, ACLPermissionAllow)
+	token, _ := GenTokenACL(acl, key, "obj1", 0)
+
+	// изменение токена, полученного при промахе и при попадании в кеш, не меняет закешированный ACL-лист
+	for i := 0; i < 2; i++ {
+		xsKey, err := decodeACLKey(projectKeyCipher(key), token)
+		assert.NoError(t, err)
+		xsKey.ACL["mallory"] = admin
+	}
+
+	r, w, x, a, err := ParseTokenACL(token, "obj1", "mallory", key)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false, false, false, false}, []bool{r, w, x, a})
+}
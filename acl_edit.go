@@ -0,0 +1,355 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.lowcodeplatform.net/packages/models"
+)
+
+const (
+	ACLChangeAdd      = "add"
+	ACLChangeRemove   = "remove"
+	ACLChangePriority = "priority"
+	ACLChangeRight    = "right"
+	ACLChangeConflict = "conflict"
+	ACLChangeMarker   = "marker"
+)
+
+// ACLList ACL-лист токена (models.TokenACL.ACL) с операциями редактирования
+type ACLList map[string]uint16
+
+// ACLChange изменение ACL-листа (для журнала аудита) или конфликт при объединении
+type ACLChange struct {
+	Action  string `json:"action"`
+	Subject string `json:"subject"`
+	// Right право для ACLChangeRight и ACLChangeConflict (пусто - конфликт приоритетов)
+	Right string `json:"right,omitempty"`
+	// Old, New состояния права или приоритеты субъекта до и после изменения
+	// для конфликта - значения первого и второго листа, Result - итоговое значение
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+	Result string `json:"result,omitempty"`
+}
+
+// String описание изменения
+func (c ACLChange) String() string {
+	what := c.Right
+	if what == "" {
+		what = "priority"
+	}
+
+	switch c.Action {
+	case ACLChangeAdd:
+		return fmt.Sprintf("add %s (%s)", c.Subject, c.New)
+	case ACLChangeRemove:
+		return fmt.Sprintf("remove %s (%s)", c.Subject, c.Old)
+	case ACLChangeMarker:
+		if c.New == "" {
+			return fmt.Sprintf("remove marker %s", c.Subject)
+		}
+		return fmt.Sprintf("add marker %s", c.Subject)
+	case ACLChangeConflict:
+		return fmt.Sprintf("conflict %s of %s: %s / %s -> %s", what, c.Subject, c.Old, c.New, c.Result)
+	default:
+		return fmt.Sprintf("change %s of %s: %s -> %s", what, c.Subject, c.Old, c.New)
+	}
+}
+
+// Grant задаем права субъекту: указанные права заменяют текущие (ACLPermissionNull - сбрасывает право),
+// остальные права субъекта сохраняются, приоритет заменяется
+func (l ACLList) Grant(subject, priority string, rights ACLRights) (err error) {
+	_, current, err := GetACLRights(l, subject)
+	if err != nil {
+		return err
+	}
+
+	merged := ACLRights{}
+	for name, state := range current {
+		merged[name] = state
+	}
+	for name, state := range rights {
+		merged[name] = state
+	}
+
+	return SetACLRights(l, subject, priority, merged)
+}
+
+// Revoke удаляем субъекта из ACL-листа вместе с его именованными правами и маркером override
+func (l ACLList) Revoke(subject string) {
+	delete(l, subject)
+	delete(l, ACLOverride+":"+subject)
+	for key := range l {
+		if s, _, ok := parseACLPageKey(key); ok && s == subject {
+			delete(l, key)
+		}
+	}
+}
+
+// subjects субъекты ACL-листа по алфавиту (без служебных ключей)
+func (l ACLList) subjects() (list []string) {
+	for key := range l {
+		if _, _, page := parseACLPageKey(key); !page && !isACLMarker(key) {
+			list = append(list, key)
+		}
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// markers маркеры наследования ACL-листа по алфавиту
+func (l ACLList) markers() (list []string) {
+	for key := range l {
+		if isACLMarker(key) {
+			list = append(list, key)
+		}
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// MergeACL объединяем два ACL-листа (например при слиянии объектов или импорте прав)
+// права субъекта, заданные в обоих листах: пустое право берется из другого листа,
+// при расхождении allow и deny побеждает deny; из приоритетов выбирается более высокий
+// расхождения возвращаются в conflicts, маркеры наследования объединяются
+func MergeACL(a, b ACLList) (merged ACLList, conflicts []ACLChange, err error) {
+	merged = ACLList{}
+	for key, v := range a {
+		merged[key] = v
+	}
+
+	for _, subject := range b.subjects() {
+		if _, ok := a[subject]; !ok {
+			merged.copySubject(b, subject)
+			continue
+		}
+
+		pa, ra, err := GetACLRights(a, subject)
+		if err != nil {
+			return nil, nil, err
+		}
+		pb, rb, err := GetACLRights(b, subject)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		priority := pa
+		if pa != pb {
+			if EncodePriority(pb) > EncodePriority(pa) {
+				priority = pb
+			}
+			conflicts = append(conflicts, ACLChange{Action: ACLChangeConflict, Subject: subject, Old: pa, New: pb, Result: priority})
+		}
+
+		rights := ACLRights{}
+		for _, name := range ACLRightNames() {
+			sa, sb := aclState(ra, name), aclState(rb, name)
+			state := sa
+			switch {
+			case sa == sb:
+			case sa == ACLPermissionNull:
+				state = sb
+			case sb == ACLPermissionNull:
+			default:
+				state = ACLPermissionDeny
+				if sa == ACLPermissionConflict || sb == ACLPermissionConflict {
+					state = ACLPermissionConflict
+				}
+				conflicts = append(conflicts, ACLChange{Action: ACLChangeConflict, Subject: subject, Right: name, Old: sa, New: sb, Result: state})
+			}
+			if state != ACLPermissionNull {
+				rights[name] = state
+			}
+		}
+		merged.Revoke(subject)
+		if err = SetACLRights(merged, subject, priority, rights); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, marker := range b.markers() {
+		merged[marker] = b[marker]
+	}
+
+	return merged, conflicts, nil
+}
+
+// copySubject копируем субъекта со всеми страницами прав из другого листа
+func (l ACLList) copySubject(from ACLList, subject string) {
+	l[subject] = from[subject]
+	for key, v := range from {
+		if s, _, ok := parseACLPageKey(key); ok && s == subject {
+			l[key] = v
+		}
+	}
+}
+
+// DiffACL изменения между двумя версиями ACL-листа для журнала аудита
+// изменения упорядочены по субъекту, права - в порядке ACLRightNames
+func DiffACL(old, new ACLList) (changes []ACLChange, err error) {
+	subjects := append(old.subjects(), new.subjects()...)
+	sort.Strings(subjects)
+
+	for i, subject := range subjects {
+		if i > 0 && subjects[i-1] == subject {
+			continue
+		}
+
+		po, ro, err := GetACLRights(old, subject)
+		if err != nil {
+			return nil, err
+		}
+		pn, rn, err := GetACLRights(new, subject)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case po == "":
+			changes = append(changes, ACLChange{Action: ACLChangeAdd, Subject: subject, New: pn})
+		case pn == "":
+			changes = append(changes, ACLChange{Action: ACLChangeRemove, Subject: subject, Old: po})
+		case po != pn:
+			changes = append(changes, ACLChange{Action: ACLChangePriority, Subject: subject, Old: po, New: pn})
+		}
+		for _, name := range ACLRightNames() {
+			if so, sn := aclState(ro, name), aclState(rn, name); so != sn {
+				changes = append(changes, ACLChange{Action: ACLChangeRight, Subject: subject, Right: name, Old: so, New: sn})
+			}
+		}
+	}
+
+	for _, marker := range old.markers() {
+		if _, ok := new[marker]; !ok {
+			changes = append(changes, ACLChange{Action: ACLChangeMarker, Subject: marker, Old: marker})
+		}
+	}
+	for _, marker := range new.markers() {
+		if _, ok := old[marker]; !ok {
+			changes = append(changes, ACLChange{Action: ACLChangeMarker, Subject: marker, New: marker})
+		}
+	}
+
+	return changes, nil
+}
+
+// aclState состояние права (отсутствующее - ACLPermissionNull)
+func aclState(rights ACLRights, name string) string {
+	if state, ok := rights[name]; ok {
+		return state
+	}
+
+	return ACLPermissionNull
+}
+
+// DecodeTokenACL расшифровываем токен без проверки срока действия и uid объекта
+// возвращается копия ACL-листа: ее можно изменить и зашифровать заново
+func DecodeTokenACL(token string, projectKey []byte) (t models.TokenACL, err error) {
+	return decodeTokenACL(token, projectKeyCipher(projectKey))
+}
+
+func decodeTokenACL(token string, c tokenCipher) (t models.TokenACL, err error) {
+	xsKey, err := decodeACLKey(c, token)
+	if err != nil {
+		return t, ErrInvalidACLKey
+	}
+
+	// копия, чтобы изменения вызывающего не попали в кеш токенов
+	return xsKey.clone().TokenACL, nil
+}
+
+// EditTokenACL изменяем ACL-лист токена и выпускаем новый токен того же объекта с тем же сроком действия и версией
+// токен проверяется как в ParseTokenACL (срок действия и отзыв)
+// changes - изменения для журнала аудита
+// при использовании связки ключей (Keyring.EditTokenACL) новый токен подписывается активным ключом
+func EditTokenACL(token string, projectKey []byte, edit func(acl ACLList) error) (newToken string, changes []ACLChange, err error) {
+	return editTokenACL(context.Background(), token, projectKeyCipher(projectKey), edit)
+}
+
+func editTokenACL(ctx context.Context, token string, c tokenCipher, edit func(acl ACLList) error) (newToken string, changes []ACLChange, err error) {
+	xsKey, err := decodeACLKey(c, token)
+	if err != nil {
+		return "", nil, ErrInvalidACLKey
+	}
+	// истекший, отозванный или устаревший токен не перевыпускается
+	if _, _, err = verifyTokenACL(ctx, token, xsKey.Uid, c); err != nil {
+		return "", nil, err
+	}
+	// страницы прав токена переписываются по списку прав этого процесса
+	if err = checkACLRightsLayout(xsKey.Rights); err != nil {
+		return "", nil, err
+	}
+
+	// ACL-лист из кеша токенов изменять нельзя - редактируем копию
+	acl := ACLList{}
+	for k, v := range xsKey.ACL {
+		acl[k] = v
+	}
+	if err = edit(acl); err != nil {
+		return "", nil, err
+	}
+	if changes, err = DiffACL(xsKey.ACL, acl); err != nil {
+		return "", nil, err
+	}
+
+	xsKey.ACL, xsKey.ID, xsKey.Issued = acl, UUID(), time.Now().UnixNano()
+	newToken, err = encodeACLKey(xsKey, c)
+
+	return newToken, changes, err
+}
+
+// InspectTokenACL описание токена для людей: объект, срок действия, маркеры и права субъектов
+func InspectTokenACL(token string, projectKey []byte) (listing string, err error) {
+	return inspectTokenACL(token, projectKeyCipher(projectKey))
+}
+
+func inspectTokenACL(token string, c tokenCipher) (listing string, err error) {
+	xsKey, err := decodeACLKey(c, token)
+	if err != nil {
+		return "", ErrInvalidACLKey
+	}
+	acl := ACLList(xsKey.ACL)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "object:  %s\n", xsKey.Uid)
+	expired := time.Unix(xsKey.Expired, 0).UTC().Format(time.RFC3339)
+	if time.Now().Unix() > xsKey.Expired {
+		expired += " (expired)"
+	}
+	fmt.Fprintf(&buf, "expires: %s\n", expired)
+	if xsKey.ID != "" {
+		fmt.Fprintf(&buf, "id:      %s\n", xsKey.ID)
+		fmt.Fprintf(&buf, "issued:  %s\n", time.Unix(0, xsKey.Issued).UTC().Format(time.RFC3339))
+	}
+	if xsKey.Version != 0 {
+		fmt.Fprintf(&buf, "version: %d\n", xsKey.Version)
+	}
+	if markers := acl.markers(); len(markers) > 0 {
+		fmt.Fprintf(&buf, "markers: %s\n", strings.Join(markers, ", "))
+	}
+
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SUBJECT\tPRIORITY\tRIGHTS")
+	for _, subject := range acl.subjects() {
+		priority, rights, err := GetACLRights(acl, subject)
+		if err != nil {
+			return "", err
+		}
+		var list []string
+		for _, name := range ACLRightNames() {
+			if state, ok := rights[name]; ok {
+				list = append(list, name+"="+state)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", subject, priority, strings.Join(list, " "))
+	}
+	tw.Flush()
+
+	return buf.String(), nil
+}
@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ExampleEditTokenACL() {
+	key := []byte("POIlhb123Y09olUi")
+	acl := ACLList{}
+	_ = acl.Grant("editors", ACLPriorityGroup, ACLRights{ACLRightRead: ACLPermissionAllow, ACLRightWrite: ACLPermissionAllow})
+	_ = acl.Grant("guest", ACLPriorityUser, ACLRights{ACLRightRead: ACLPermissionAllow})
+	token, _ := GenTokenACL(acl, key, "doc1", 0)
+
+	token, changes, err := EditTokenACL(token, key, func(acl ACLList) error {
+		acl.Revoke("guest")
+		return acl.Grant("editors", ACLPriorityGroup, ACLRights{ACLRightWrite: ACLPermissionDeny, ACLRightShare: ACLPermissionAllow})
+	})
+	fmt.Println(err)
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+
+	r, w, _, _, err := ParseTokenACL(token, "doc1", "editors", key)
+	fmt.Println(r, w, err)
+
+	// Output:
+	// <nil>
+	// change write of editors: allow -> deny
+	// change share of editors: null -> allow
+	// remove guest (user)
+	// change read of guest: allow -> null
+	// true false <nil>
+}
+
+func TestMergeACL(t *testing.T) {
+	a, b := ACLList{}, ACLList{}
+	_ = a.Grant("editors", ACLPriorityRole, ACLRights{ACLRightRead: ACLPermissionAllow, ACLRightDelete: ACLPermissionAllow})
+	_ = a.Grant("ivan", ACLPriorityUser, ACLRights{ACLRightAdmin: ACLPermissionAllow})
+	_ = b.Grant("editors", ACLPriorityGroup, ACLRights{ACLRightWrite: ACLPermissionAllow, ACLRightDelete: ACLPermissionDeny})
+	_ = b.Grant("petr", ACLPriorityUser, ACLRights{ACLRightExport: ACLPermissionAllow})
+	BreakACLInheritance(b)
+
+	merged, conflicts, err := MergeACL(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []ACLChange{
+		{Action: ACLChangeConflict, Subject: "editors", Old: ACLPriorityRole, New: ACLPriorityGroup, Result: ACLPriorityGroup},
+		{Action: ACLChangeConflict, Subject: "editors", Right: ACLRightDelete, Old: ACLPermissionAllow, New: ACLPermissionDeny, Result: ACLPermissionDeny},
+	}, conflicts)
+	assert.Equal(t, "conflict delete of editors: allow / deny -> deny", conflicts[1].String())
+
+	priority, rights, _ := GetACLRights(merged, "editors")
+	assert.Equal(t, ACLPriorityGroup, priority)
+	assert.Equal(t, ACLRights{ACLRightRead: ACLPermissionAllow, ACLRightWrite: ACLPermissionAllow, ACLRightDelete: ACLPermissionDeny}, rights)
+	_, rights, _ = GetACLRights(merged, "petr")
+	assert.Equal(t, ACLRights{ACLRightExport: ACLPermissionAllow}, rights)
+	assert.Contains(t, merged, ACLBreakInheritance)
+
+	changes, err := DiffACL(a, merged)
+	assert.NoError(t, err)
+	assert.Contains(t, changes, ACLChange{Action: ACLChangeAdd, Subject: "petr", New: ACLPriorityUser})
+	assert.Contains(t, changes, ACLChange{Action: ACLChangeMarker, Subject: ACLBreakInheritance, New: ACLBreakInheritance})
+
+	// Revoke удаляет страницы прав субъекта
+	merged.Revoke("petr")
+	for key := range merged {
+		assert.NotContains(t, key, "petr")
+	}
+}
+
+func TestInspectTokenACL(t *testing.T) {
+	key := []byte("POIlhb123Y09olUi")
+	acl := ACLList{}
+	_ = acl.Grant("editors", ACLPriorityGroup, ACLRights{ACLRightRead: ACLPermissionAllow, ACLRightComment: ACLPermissionDeny})
+	OverrideACL(acl)
+	token, id, _ := GenTokenACLVersion(acl, key, "doc1", 0, 3)
+
+	listing, err := InspectTokenACL(token, key)
+	assert.NoError(t, err)
+	assert.Contains(t, listing, "object:  doc1\n")
+	assert.Contains(t, listing, "id:      "+id+"\n")
+	assert.Contains(t, listing, "version: 3\n")
+	assert.Contains(t, listing, "markers: "+ACLOverride+"\n")
+	assert.Contains(t, listing, "editors  group     read=allow comment=deny\n")
+
+	_, err = InspectTokenACL("broken", key)
+	assert.ErrorIs(t, err, ErrInvalidACLKey)
+
+	decoded, err := DecodeTokenACL(token, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "doc1", decoded.Uid)
+}
+
+func TestEditTokenACLRevoked(t *testing.T) {
+	ctx := context.Background()
+	key := []byte("POIlhb123Y09olUi")
+	acl := ACLList{}
+	_ = acl.Grant("editors", ACLPriorityGroup, ACLRights{ACLRightRead: ACLPermissionAllow})
+	grant := func(acl ACLList) error {
+		return acl.Grant("guest", ACLPriorityUser, ACLRights{ACLRightRead: ACLPermissionAllow})
+	}
+
+	store := NewMemoryACLRevocationStore()
+	SetACLRevocationStore(store)
+	defer SetACLRevocationStore(nil)
+	SetACLRevocationCacheTTL(0)
+	defer SetACLRevocationCacheTTL(defaultACLRevocationCacheTTL)
+
+	token, _, _ := GenTokenACLVersion(acl, key, "doc1", time.Hour, 1)
+	edited, _, err := EditTokenACL(token, key, grant)
+	assert.NoError(t, err)
+	decoded, _ := DecodeTokenACL(token, key)
+	editedDecoded, _ := DecodeTokenACL(edited, key)
+	assert.Equal(t, decoded.Expired, editedDecoded.Expired)
+
+	// отозванный токен не перевыпускается
+	assert.NoError(t, RevokeTokenACL(ctx, store, token, key))
+	_, _, err = EditTokenACL(token, key, grant)
+	assert.ErrorIs(t, err, ErrRevokedACLKey)
+
+	// токен устаревшей версии ACL объекта
+	assert.NoError(t, store.SetACLVersion(ctx, "doc1", 2))
+	_, _, err = EditTokenACL(edited, key, grant)
+	assert.ErrorIs(t, err, ErrOutdatedACLKey)
+
+	// токены объекта отозваны
+	current, _, _ := GenTokenACLVersion(acl, key, "doc1", time.Hour, 2)
+	assert.NoError(t, store.RevokeObject(ctx, "doc1"))
+	_, _, err = EditTokenACL(current, key, grant)
+	assert.ErrorIs(t, err, ErrRevokedACLKey)
+}
+
+func TestDecodeTokenACLCopy(t *testing.T) {
+	key := []byte("POIlhb123Y09olUi")
+	acl := map[string]uint16{}
+	acl["alice"], _ = CreateACLValue(ACLPriorityUser, ACLPermissionAllow, ACLPermissionNull, ACLPermissionNull, ACLPermissionNull)
+	admin, _ := CreateACLValue(ACLPriorityUser, ACLPermissionAllow, ACLPermissionAllow, ACLPermissionAllow, ACLPermissionAllow)
+	token, _ := GenTokenACL(acl, key, "obj1", 0)
+	_, _, _, _, _ = ParseTokenACL(token, "obj1", "alice", key)
+
+	// расшифровать, изменить ACL-лист и зашифровать заново - исходный токен не меняется
+	decoded, err := DecodeTokenACL(token, key)
+	assert.NoError(t, err)
+	decoded.ACL["mallory"] = admin
+	edited, err := GenTokenACL(decoded.ACL, key, "obj1", 0)
+	assert.NoError(t, err)
+
+	r, _, _, a, err := ParseTokenACL(token, "obj1", "mallory", key)
+	assert.NoError(t, err)
+	assert.False(t, r || a)
+	_, _, _, a, _ = ParseTokenACL(edited, "obj1", "mallory", key)
+	assert.True(t, a)
+}
@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// названия прав в порядке кодирования в битовой маске
+var aclRights = [4]string{ACLRightRead, ACLRightWrite, ACLRightExecute, ACLRightAdmin}
+
+// ACLExplain разбор решения ParseTokenACL для каждого из прав
+type ACLExplain struct {
+	Uid      string   `json:"uid"`
+	Subjects []string `json:"subjects"`
+	// Unmatched субъекты запроса, которых нет в ACL токена
+	Unmatched []string          `json:"unmatched,omitempty"`
+	Rights    []ACLRightExplain `json:"rights"`
+}
+
+// ACLRightExplain как получено решение по одному праву (read/write/execute/admin)
+type ACLRightExplain struct {
+	Right string `json:"right"`
+	// Matched найденные в ACL субъекты и их права на это право
+	Matched []ACLSubjectExplain `json:"matched"`
+	// Levels состояние права после объединения субъектов в рамках приоритета (от Others к User)
+	Levels []ACLLevelExplain `json:"levels"`
+	// Decision итоговое состояние: allow, deny, conflict или null (никто не задал право)
+	Decision string `json:"decision"`
+	// DecidedBy приоритет и субъект, чье правило определило решение (пусто для null)
+	DecidedBy string `json:"decided_by,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	Allowed   bool   `json:"allowed"`
+	// Rule текстовое описание решающего правила
+	Rule string `json:"rule"`
+}
+
+// ACLSubjectExplain право субъекта из ACL
+type ACLSubjectExplain struct {
+	Subject    string `json:"subject"`
+	Priority   string `json:"priority"`
+	Permission string `json:"permission"`
+}
+
+// ACLLevelExplain состояние права в рамках приоритета, Subject - субъект, задавший состояние
+type ACLLevelExplain struct {
+	Priority string `json:"priority"`
+	State    string `json:"state"`
+	Subject  string `json:"subject,omitempty"`
+}
+
+// ExplainTokenACL объясняет решение ParseTokenACL с теми же параметрами:
+// какие субъекты найдены, их приоритеты и права, состояние на каждом приоритете и решающее правило
+// ошибки токена (просрочен, чужой uid) возвращаются как в ParseTokenACL
+func ExplainTokenACL(token, uid, subjects string, projectKey []byte) (explain ACLExplain, err error) {
+	return explainTokenACL(context.Background(), token, uid, subjects, projectKeyCipher(projectKey))
+}
+
+func explainTokenACL(ctx context.Context, token, uid, subjects string, c tokenCipher) (explain ACLExplain, err error) {
+	valid, acl, err := verifyTokenACL(ctx, token, uid, c)
+	if !valid || err != nil {
+		return explain, err
+	}
+
+	return explainACL(acl, uid, subjects), nil
+}
+
+// explainACL разбор расчета прав субъектов по ACL-листу
+func explainACL(acl map[string]uint16, uid, subjects string) (explain ACLExplain) {
+	e := evalACL(acl, subjects)
+	explain = ACLExplain{
+		Uid:      uid,
+		Subjects: strings.Split(subjects, ","),
+	}
+	for _, s := range explain.Subjects {
+		if _, ok := acl[s]; !ok {
+			explain.Unmatched = append(explain.Unmatched, s)
+		}
+	}
+
+	for i, right := range aclRights {
+		re := ACLRightExplain{
+			Right:    right,
+			Matched:  []ACLSubjectExplain{},
+			Levels:   []ACLLevelExplain{},
+			Decision: e.final[i],
+			Allowed:  e.final[i] == ACLPermissionAllow,
+		}
+		for _, m := range e.matched {
+			re.Matched = append(re.Matched, ACLSubjectExplain{Subject: m.subject, Priority: m.priority, Permission: m.permission[i]})
+		}
+		for _, pr := range []string{ACLPriorityOthers, ACLPriorityRole, ACLPriorityGroup, ACLPriorityUser} {
+			level, ok := e.levels[pr]
+			if !ok {
+				continue
+			}
+			state := level[i]
+			if state == "" {
+				state = ACLPermissionNull
+			}
+			re.Levels = append(re.Levels, ACLLevelExplain{Priority: pr, State: state, Subject: e.levelBy[pr][i]})
+		}
+
+		if re.Decision == "" {
+			re.Decision = ACLPermissionNull
+		} else {
+			re.DecidedBy, re.Subject = e.finalBy[i], e.levelBy[e.finalBy[i]][i]
+		}
+		re.Rule = re.rule(len(e.matched))
+		explain.Rights = append(explain.Rights, re)
+	}
+
+	return explain
+}
+
+// rule формирует описание решения
+func (re ACLRightExplain) rule(matched int) string {
+	switch {
+	case matched == 0:
+		return "no subject of the request is in the acl: denied"
+	case re.Decision == ACLPermissionNull:
+		return "no matched subject sets the right: denied"
+	}
+
+	rule := fmt.Sprintf("%s by %s %s", re.Decision, re.DecidedBy, re.Subject)
+	switch re.Decision {
+	case ACLPermissionAllow:
+		rule += ": allowed"
+	case ACLPermissionConflict:
+		rule += ": conflict of allow and deny is denied"
+	default:
+		rule += ": denied"
+	}
+
+	// более высокий приоритет переопределил решение нижних
+	for _, l := range re.Levels {
+		if l.Priority != re.DecidedBy && l.State != ACLPermissionNull && l.State != re.Decision {
+			rule += fmt.Sprintf(", overrides %s by %s %s", l.State, l.Priority, l.Subject)
+		}
+	}
+
+	return rule
+}
+
+// String разбор в JSON для логов и обращений в поддержку
+func (e ACLExplain) String() string {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("error Marshal ACLExplain, err: %s", err)
+	}
+
+	return string(data)
+}
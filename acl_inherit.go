@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"context"
+	"strings"
+)
+
+// Маркеры наследования - служебные ключи ACL-листа (субъекты с префиксом "@" зарезервированы)
+const (
+	// ACLBreakInheritance права родительских объектов не наследуются
+	ACLBreakInheritance = "@inherit:break"
+	// ACLOverride права объекта заменяют унаследованные (без приоритета Deny родителя),
+	// ACLOverride+субъект - только для этого субъекта
+	ACLOverride = "@inherit:override"
+)
+
+// BreakACLInheritance помечаем ACL объекта: права родителей не наследуются
+func BreakACLInheritance(acl map[string]uint16) {
+	acl[ACLBreakInheritance] = 0
+}
+
+// OverrideACL помечаем ACL объекта: права субъектов заменяют унаследованные, в т.ч. Deny родителя
+// без subjects - для всех субъектов объекта
+func OverrideACL(acl map[string]uint16, subjects ...string) {
+	if len(subjects) == 0 {
+		acl[ACLOverride] = 0
+		return
+	}
+	for _, s := range subjects {
+		acl[ACLOverride+":"+s] = 0
+	}
+}
+
+// isACLMarker служебный ключ ACL-листа
+func isACLMarker(subject string) bool {
+	return strings.HasPrefix(subject, "@inherit:")
+}
+
+// InheritACL рассчитывает итоговый ACL-лист объекта по цепочке ACL от корня к листу
+// права субъекта, заданные на нескольких уровнях, объединяются по каждому праву:
+// Deny родителя сохраняется, иначе непустое право потомка заменяет родительское,
+// приоритет субъекта (User/Group/Role/Others) берется с ближайшего к листу уровня
+// маркеры: ACLBreakInheritance - уровни выше не учитываются, ACLOverride - права потомка заменяют родительские
+func InheritACL(chain ...map[string]uint16) (acl map[string]uint16) {
+	start := 0
+	for i, level := range chain {
+		if _, ok := level[ACLBreakInheritance]; ok {
+			start = i
+		}
+	}
+
+	acl = map[string]uint16{}
+	for _, level := range chain[start:] {
+		_, overrideAll := level[ACLOverride]
+		for subject, rights := range level {
+			if isACLMarker(subject) {
+				continue
+			}
+			parent, ok := acl[subject]
+			if !ok {
+				acl[subject] = rights
+				continue
+			}
+			// страницы именованных прав (см. SetACLRights) наследуются так же, как права субъекта
+			base, _, _ := parseACLPageKey(subject)
+			_, override := level[ACLOverride+":"+base]
+			acl[subject] = inheritACLValue(parent, rights, override || overrideAll)
+		}
+	}
+
+	return acl
+}
+
+// inheritACLValue объединяет права субъекта родителя и потомка
+func inheritACLValue(parent, child uint16, override bool) uint16 {
+	parentPer, childPer := DecodeFromByte(byte(parent&0xFF)), DecodeFromByte(byte(child&0xFF))
+
+	var per [4]string
+	for i := range per {
+		switch {
+		case childPer[i] == ACLPermissionNull:
+			per[i] = parentPer[i]
+		case parentPer[i] == ACLPermissionDeny && !override:
+			per[i] = ACLPermissionDeny
+		default:
+			per[i] = childPer[i]
+		}
+	}
+
+	return child&0xFF00 | uint16(EncodeToByte(per[0], per[1], per[2], per[3]))
+}
+
+// ACLLink звено цепочки наследования: токен объекта и uid объекта, для которого он выпущен
+// пустой Token - у объекта нет своих прав, он наследует права родителя
+type ACLLink struct {
+	Token string
+	Uid   string
+}
+
+// verifyTokenACLChain проверяет токены цепочки (от корня к листу) и рассчитывает итоговый ACL-лист
+func verifyTokenACLChain(ctx context.Context, chain []ACLLink, c tokenCipher) (acl map[string]uint16, err error) {
+	levels := make([]map[string]uint16, 0, len(chain))
+	for _, link := range chain {
+		if link.Token == "" {
+			continue
+		}
+		valid, level, err := verifyTokenACL(ctx, link.Token, link.Uid, c)
+		if !valid || err != nil {
+			return nil, err
+		}
+		levels = append(levels, level)
+	}
+	if len(levels) == 0 {
+		return nil, ErrNoACLKey
+	}
+
+	return InheritACL(levels...), nil
+}
+
+// ParseTokenACLChain - возвращаем права вложенного объекта по цепочке токенов от корня к листу
+// (например папка, подпапка, файл), правила наследования см. InheritACL
+func ParseTokenACLChain(chain []ACLLink, subjects string, projectKey []byte) (r, w, x, a bool, err error) {
+	return parseTokenACLChain(context.Background(), chain, subjects, projectKeyCipher(projectKey))
+}
+
+func parseTokenACLChain(ctx context.Context, chain []ACLLink, subjects string, c tokenCipher) (r, w, x, a bool, err error) {
+	acl, err := verifyTokenACLChain(ctx, chain, c)
+	if err != nil {
+		return false, false, false, false, err
+	}
+
+	final := evalACL(acl, subjects).final
+	return final[0] == ACLPermissionAllow, final[1] == ACLPermissionAllow, final[2] == ACLPermissionAllow, final[3] == ACLPermissionAllow, nil
+}
+
+// ExplainTokenACLChain объясняет решение ParseTokenACLChain по итоговому ACL-листу (Uid - объект-лист цепочки)
+func ExplainTokenACLChain(chain []ACLLink, subjects string, projectKey []byte) (explain ACLExplain, err error) {
+	return explainTokenACLChain(context.Background(), chain, subjects, projectKeyCipher(projectKey))
+}
+
+func explainTokenACLChain(ctx context.Context, chain []ACLLink, subjects string, c tokenCipher) (explain ACLExplain, err error) {
+	acl, err := verifyTokenACLChain(ctx, chain, c)
+	if err != nil {
+		return explain, err
+	}
+
+	uid := ""
+	if len(chain) > 0 {
+		uid = chain[len(chain)-1].Uid
+	}
+
+	return explainACL(acl, uid, subjects), nil
+}
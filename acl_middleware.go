@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"git.lowcodeplatform.net/packages/models"
+)
+
+const (
+	// HeaderXACLKey заголовок (и cookie) с ACL-токеном объекта
+	HeaderXACLKey = "X-ACL-Key"
+
+	aclRightsCtx = "acl_rights"
+)
+
+var errACLForbidden = errors.New("access denied by acl")
+
+// TokenACLConfig настройки MiddlewareTokenACL
+type TokenACLConfig struct {
+	ProjectKey []byte
+	// Keyring связка ключей проекта, если задана - используется вместо ProjectKey
+	Keyring *Keyring
+	// Header, Cookie откуда берем ACL-токен (по-умолчанию HeaderXACLKey)
+	Header string
+	Cookie string
+	// ObjectUid uid объекта, для которого выпущен токен (по-умолчанию последний сегмент пути)
+	ObjectUid func(r *http.Request) string
+	// Routes требуемое право для маршрута, ключ - префикс пути, можно с методом ("DELETE /files/")
+	// выбирается самый длинный подходящий префикс, пустое право - проверка не требуется
+	Routes map[string]string
+	// Methods требуемое право по HTTP-методу, если маршрут не найден
+	// (по-умолчанию GET, HEAD - read, OPTIONS без проверки, остальные - write)
+	Methods map[string]string
+	// Subjects субъекты, добавляемые к каждому запросу (например общая группа всех пользователей)
+	Subjects []string
+}
+
+// MiddlewareTokenACL проверяет права на объект по ACL-токену запроса
+// субъекты - uid пользователя из контекста, Role, Groups и Profile из X-Service-Key
+// нет токена или он невалиден - 401, нет требуемого права или в токене неизвестные права - 403,
+// хранилище отзывов недоступно - 500
+// рассчитанные права доступны обработчику через TokenACLRightsFromContext
+func MiddlewareTokenACL(cfg TokenACLConfig) func(next http.Handler) http.Handler {
+	if cfg.Header == "" && cfg.Cookie == "" {
+		cfg.Header, cfg.Cookie = HeaderXACLKey, HeaderXACLKey
+	}
+	if cfg.ObjectUid == nil {
+		cfg.ObjectUid = func(r *http.Request) string {
+			return path.Base(r.URL.Path)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			right, ok := cfg.requiredRight(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token := cfg.token(r)
+			if token == "" {
+				_ = ResponseJSON(w, nil, "Unauthorized", ErrNoACLKey, nil)
+				return
+			}
+
+			rights, err := parseTokenACLRights(r.Context(), token, cfg.ObjectUid(r), strings.Join(cfg.subjects(r), ","), cfg.cipher())
+			if err != nil {
+				_ = ResponseJSON(w, nil, tokenACLErrorStatus(err), err, nil)
+				return
+			}
+			if !rights[right] {
+				_ = ResponseJSON(w, nil, "ErrorForbiddenElement", errACLForbidden, nil)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), aclRightsCtx, rights)))
+		})
+	}
+}
+
+// tokenACLErrorStatus статус ответа на ошибку проверки ACL-токена
+func tokenACLErrorStatus(err error) string {
+	switch {
+	case errors.Is(err, ErrNoACLKey), errors.Is(err, ErrInvalidACLKey), errors.Is(err, ErrExpiredACLKey),
+		errors.Is(err, ErrRevokedACLKey), errors.Is(err, ErrOutdatedACLKey):
+		return "Unauthorized"
+	case errors.Is(err, ErrUnknownACLRight), errors.Is(err, ErrUnsupportedACLVersion):
+		return "ErrorForbiddenElement"
+	}
+
+	return "ErrorGetData"
+}
+
+// TokenACLRightsFromContext права на объект, рассчитанные MiddlewareTokenACL
+func TokenACLRightsFromContext(ctx context.Context) (rights map[string]bool, ok bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	rights, ok = ctx.Value(aclRightsCtx).(map[string]bool)
+
+	return rights, ok
+}
+
+// token ACL-токен из заголовка или cookie
+func (cfg TokenACLConfig) token(r *http.Request) string {
+	if cfg.Header != "" {
+		if token := r.Header.Get(cfg.Header); token != "" {
+			return token
+		}
+	}
+	if cfg.Cookie != "" {
+		if cookie, err := r.Cookie(cfg.Cookie); err == nil {
+			return cookie.Value
+		}
+	}
+
+	return ""
+}
+
+// requiredRight право, необходимое для запроса (ok = false - проверка не требуется)
+func (cfg TokenACLConfig) requiredRight(r *http.Request) (right string, ok bool) {
+	// при равной длине префикса маршрут с методом приоритетнее
+	match := -1
+	for route, v := range cfg.Routes {
+		prefix, weight := route, 0
+		if method, p, found := strings.Cut(route, " "); found {
+			if method != r.Method {
+				continue
+			}
+			prefix, weight = p, 1
+		}
+		if strings.HasPrefix(r.URL.Path, prefix) && 2*len(prefix)+weight > match {
+			right, match = v, 2*len(prefix)+weight
+		}
+	}
+	if match >= 0 {
+		return right, right != ""
+	}
+
+	if right, ok = cfg.Methods[r.Method]; ok {
+		return right, right != ""
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		return "", false
+	case http.MethodGet, http.MethodHead:
+		return ACLRightRead, true
+	default:
+		return ACLRightWrite, true
+	}
+}
+
+// cipher ключи проверки токенов: связка Keyring, если задана, иначе ProjectKey
+func (cfg TokenACLConfig) cipher() tokenCipher {
+	if cfg.Keyring != nil {
+		return cfg.Keyring
+	}
+
+	return projectKeyCipher(cfg.ProjectKey)
+}
+
+// subjects субъекты доступа запроса
+func (cfg TokenACLConfig) subjects(r *http.Request) (subjects []string) {
+	ctx := r.Context()
+	user, _ := ctx.Value(userUid).(string)
+	if user == "" {
+		user = getFieldCtx(ctx, models.UserIDField)
+	}
+
+	add := func(values ...string) {
+		for _, v := range values {
+			if v = strings.TrimSpace(v); v != "" {
+				subjects = append(subjects, v)
+			}
+		}
+	}
+	add(user)
+	if xsKey, _, err := decodeServiceKey(cfg.cipher(), getServiceKey(r)); err == nil && xsKey.Expired > time.Now().Unix() {
+		add(xsKey.Role, xsKey.Profile)
+		add(strings.Split(xsKey.Groups, ",")...)
+	}
+	add(cfg.Subjects...)
+
+	return subjects
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/models"
+)
+
+func TestMiddlewareTokenACL(t *testing.T) {
+	key := []byte("POIlhb123Y09olUi")
+	acl := map[string]uint16{}
+	_ = SetACLRights(acl, "all", ACLPriorityOthers, ACLRights{ACLRightRead: ACLPermissionAllow})
+	_ = SetACLRights(acl, "editors", ACLPriorityGroup, ACLRights{ACLRightWrite: ACLPermissionAllow})
+	_ = SetACLRights(acl, "u1", ACLPriorityUser, ACLRights{ACLRightDelete: ACLPermissionAllow})
+	token, _ := GenTokenACL(acl, key, "doc1", 0)
+	serviceKey, _ := NewServiceKey().WithRole("manager").WithGroups("staff, editors").Build(key)
+
+	var rights map[string]bool
+	h := MiddlewareTokenACL(TokenACLConfig{
+		ProjectKey: key,
+		Routes:     map[string]string{"DELETE /docs/": ACLRightDelete, "/docs/public/": ""},
+		Subjects:   []string{"all"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rights, _ = TokenACLRightsFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(method, target, user string, headers map[string]string) int {
+		rights = nil
+		r := httptest.NewRequest(method, target, nil)
+		if user != "" {
+			r = r.WithContext(context.WithValue(r.Context(), userUid, user))
+		}
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/docs/doc1", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/docs/doc2", "", map[string]string{HeaderXACLKey: token}))
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/docs/public/doc1", "", nil))
+	assert.Equal(t, http.StatusOK, serve(http.MethodOptions, "/docs/doc1", "", nil))
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/docs/doc1", "", map[string]string{HeaderXACLKey: token}))
+	assert.True(t, rights[ACLRightRead])
+	assert.False(t, rights[ACLRightWrite])
+
+	// группы берутся из X-Service-Key, токен - из cookie
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodPut, "/docs/doc1", "", map[string]string{HeaderXACLKey: token}))
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, "/docs/doc1", "", map[string]string{
+		"Cookie": HeaderXACLKey + "=" + token, models.HeaderXServiceKey: serviceKey,
+	}))
+	assert.True(t, rights[ACLRightWrite])
+
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodDelete, "/docs/doc1", "u2", map[string]string{HeaderXACLKey: token}))
+	assert.Equal(t, http.StatusOK, serve(http.MethodDelete, "/docs/doc1", "u1", map[string]string{HeaderXACLKey: token}))
+	assert.True(t, rights[ACLRightDelete])
+}
+
+// failedRevocationStore недоступное хранилище отзывов
+type failedRevocationStore struct {
+	ACLRevocationStore
+}
+
+func (failedRevocationStore) Revocation(context.Context, string, string) (ACLRevocation, error) {
+	return ACLRevocation{}, errors.New("store is unavailable")
+}
+
+func TestMiddlewareTokenACLErrors(t *testing.T) {
+	key := []byte("POIlhb123Y09olUi")
+	acl := map[string]uint16{}
+	_ = SetACLRights(acl, "all", ACLPriorityOthers, ACLRights{ACLRightRead: ACLPermissionAllow})
+	token, _ := GenTokenACL(acl, key, "doc1", 0)
+
+	h := MiddlewareTokenACL(TokenACLConfig{ProjectKey: key, Subjects: []string{"all"}})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	SetACLRevocationStore(failedRevocationStore{NewMemoryACLRevocationStore()})
+	defer SetACLRevocationStore(nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/docs/doc1", nil)
+	r.Header.Set(HeaderXACLKey, token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	for err, status := range map[error]int{
+		ErrInvalidACLKey: http.StatusUnauthorized,
+		fmt.Errorf("error check acl revocation, err: %w", ErrRevokedACLKey): http.StatusUnauthorized,
+		fmt.Errorf("error decode acl page 1, err: %w", ErrUnknownACLRight):  http.StatusForbidden,
+		errors.New("store is unavailable"):                                  http.StatusInternalServerError,
+	} {
+		assert.Equal(t, status, models.StatusCode[tokenACLErrorStatus(err)].Status, err.Error())
+	}
+}
@@ -0,0 +1,325 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrRevokedACLKey = errors.New("acl token is revoked")
+var ErrOutdatedACLKey = errors.New("acl token version is outdated")
+
+// aclRevocationTimeout время ожидания ответа хранилища отзывов при проверке токена
+const aclRevocationTimeout = 5 * time.Second
+
+const (
+	// defaultACLRevocationCacheTTL время кеширования состояния отзыва по-умолчанию
+	defaultACLRevocationCacheTTL = 2 * time.Second
+	// aclRevocationCacheSize максимальное количество закешированных состояний отзыва
+	aclRevocationCacheSize = 4096
+)
+
+// ACLRevocation состояние отзыва токена и его объекта
+type ACLRevocation struct {
+	// TokenRevoked токен отозван по ID
+	TokenRevoked bool
+	// ObjectRevoked момент отзыва всех токенов объекта (unix nano, 0 - не отзывались)
+	ObjectRevoked int64
+	// Version текущая версия ACL объекта, токены меньшей версии не принимаются
+	Version int64
+}
+
+// ACLRevocationStore хранилище отзывов ACL-токенов, проверяется при разборе каждого токена
+// (см. SetACLRevocationStore)
+type ACLRevocationStore interface {
+	// RevokeToken отзывает токен по ID, expired - срок действия токена (unix), после него запись можно удалить
+	RevokeToken(ctx context.Context, id string, expired int64) (err error)
+	// RevokeObject отзывает все токены объекта, выпущенные до текущего момента
+	RevokeObject(ctx context.Context, uid string) (err error)
+	// SetACLVersion задает текущую версию ACL объекта
+	SetACLVersion(ctx context.Context, uid string, version int64) (err error)
+	// Revocation состояние отзыва токена id объекта uid
+	Revocation(ctx context.Context, id, uid string) (r ACLRevocation, err error)
+}
+
+var aclRevocationMx sync.RWMutex
+var aclRevocation ACLRevocationStore
+
+// aclRevocationCache состояния отзыва, полученные из хранилища (ключ - ID токена и uid объекта)
+var aclRevocationCache = &aclRevocationTTLCache{ttl: defaultACLRevocationCacheTTL, items: map[string]aclRevocationEntry{}}
+
+type aclRevocationEntry struct {
+	r      ACLRevocation
+	loaded time.Time
+}
+
+type aclRevocationTTLCache struct {
+	mx    sync.Mutex
+	ttl   time.Duration
+	items map[string]aclRevocationEntry
+}
+
+// SetACLRevocationStore задаем хранилище отзывов для ParseTokenACL и производных (nil - отзыв не проверяется)
+func SetACLRevocationStore(store ACLRevocationStore) {
+	aclRevocationMx.Lock()
+	defer aclRevocationMx.Unlock()
+
+	aclRevocation = store
+	aclRevocationCache.reset()
+}
+
+// SetACLRevocationCacheTTL задаем время кеширования состояния отзыва (0 - хранилище опрашивается при каждой проверке)
+// отзыв через RevokeTokenACL в этом же процессе действует сразу, остальные изменения хранилища
+// (RevokeObject, SetACLVersion, отзыв в другом экземпляре сервиса) - не позже чем через ttl
+func SetACLRevocationCacheTTL(ttl time.Duration) {
+	aclRevocationCache.mx.Lock()
+	defer aclRevocationCache.mx.Unlock()
+
+	aclRevocationCache.ttl = ttl
+	aclRevocationCache.items = map[string]aclRevocationEntry{}
+}
+
+func aclRevocationCacheKey(id, uid string) string {
+	return id + "\x00" + uid
+}
+
+func (c *aclRevocationTTLCache) get(key string) (r ACLRevocation, ok bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	e, ok := c.items[key]
+	if !ok || time.Since(e.loaded) >= c.ttl {
+		return r, false
+	}
+
+	return e.r, true
+}
+
+func (c *aclRevocationTTLCache) put(key string, r ACLRevocation) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.ttl <= 0 {
+		return
+	}
+	// при переполнении удаляем устаревшие записи, если их нет - сбрасываем кеш целиком
+	if len(c.items) >= aclRevocationCacheSize {
+		for k, e := range c.items {
+			if time.Since(e.loaded) >= c.ttl {
+				delete(c.items, k)
+			}
+		}
+		if len(c.items) >= aclRevocationCacheSize {
+			c.items = map[string]aclRevocationEntry{}
+		}
+	}
+	c.items[key] = aclRevocationEntry{r: r, loaded: time.Now()}
+}
+
+func (c *aclRevocationTTLCache) remove(key string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	delete(c.items, key)
+}
+
+func (c *aclRevocationTTLCache) reset() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.items = map[string]aclRevocationEntry{}
+}
+
+func getACLRevocationStore() ACLRevocationStore {
+	aclRevocationMx.RLock()
+	defer aclRevocationMx.RUnlock()
+
+	return aclRevocation
+}
+
+// RevokeTokenACL отзывает токен в хранилище отзывов (токены без ID отзываются только через RevokeObject)
+func RevokeTokenACL(ctx context.Context, store ACLRevocationStore, token string, projectKey []byte) (err error) {
+	return revokeTokenACL(ctx, store, token, projectKeyCipher(projectKey))
+}
+
+func revokeTokenACL(ctx context.Context, store ACLRevocationStore, token string, c tokenCipher) (err error) {
+	xsKey, err := decodeACLKey(c, token)
+	if err != nil {
+		return ErrInvalidACLKey
+	}
+	if xsKey.ID == "" {
+		return fmt.Errorf("error RevokeTokenACL, err: token of object %s has no id", xsKey.Uid)
+	}
+
+	if err = store.RevokeToken(ctx, xsKey.ID, xsKey.Expired); err != nil {
+		return err
+	}
+	aclRevocationCache.remove(aclRevocationCacheKey(xsKey.ID, xsKey.Uid))
+
+	return nil
+}
+
+// checkACLRevocation проверяем токен по хранилищу отзывов (состояние кешируется, см. SetACLRevocationCacheTTL)
+// при недоступности хранилища токен не принимается
+func checkACLRevocation(ctx context.Context, xsKey tokenACL) (err error) {
+	store := getACLRevocationStore()
+	if store == nil {
+		return nil
+	}
+
+	key := aclRevocationCacheKey(xsKey.ID, xsKey.Uid)
+	r, ok := aclRevocationCache.get(key)
+	if !ok {
+		ctx, cancel := context.WithTimeout(ctx, aclRevocationTimeout)
+		defer cancel()
+
+		r, err = store.Revocation(ctx, xsKey.ID, xsKey.Uid)
+		if err != nil {
+			return fmt.Errorf("error check acl revocation, err: %w", err)
+		}
+		aclRevocationCache.put(key, r)
+	}
+
+	switch {
+	case r.TokenRevoked:
+		return ErrRevokedACLKey
+	case r.ObjectRevoked != 0 && xsKey.Issued <= r.ObjectRevoked:
+		return ErrRevokedACLKey
+	case xsKey.Version < r.Version:
+		return ErrOutdatedACLKey
+	}
+
+	return nil
+}
+
+// memoryACLRevocation хранилище отзывов в памяти процесса
+type memoryACLRevocation struct {
+	mx      sync.RWMutex
+	tokens  map[string]int64
+	objects map[string]ACLRevocation
+}
+
+// NewMemoryACLRevocationStore хранилище отзывов в памяти процесса (для одного экземпляра сервиса и тестов)
+func NewMemoryACLRevocationStore() ACLRevocationStore {
+	return &memoryACLRevocation{
+		tokens:  map[string]int64{},
+		objects: map[string]ACLRevocation{},
+	}
+}
+
+func (m *memoryACLRevocation) RevokeToken(_ context.Context, id string, expired int64) (err error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	// удаляем записи истекших токенов
+	now := time.Now().Unix()
+	for k, v := range m.tokens {
+		if v < now {
+			delete(m.tokens, k)
+		}
+	}
+	m.tokens[id] = expired
+
+	return nil
+}
+
+func (m *memoryACLRevocation) RevokeObject(_ context.Context, uid string) (err error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	r := m.objects[uid]
+	r.ObjectRevoked = time.Now().UnixNano()
+	m.objects[uid] = r
+
+	return nil
+}
+
+func (m *memoryACLRevocation) SetACLVersion(_ context.Context, uid string, version int64) (err error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	r := m.objects[uid]
+	r.Version = version
+	m.objects[uid] = r
+
+	return nil
+}
+
+func (m *memoryACLRevocation) Revocation(_ context.Context, id, uid string) (r ACLRevocation, err error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	r = m.objects[uid]
+	if id != "" {
+		_, r.TokenRevoked = m.tokens[id]
+	}
+
+	return r, nil
+}
+
+// vfsACLRevocation хранилище отзывов в Vfs (общее для всех экземпляров сервиса)
+// prefix/tokens/<id> - срок действия отозванного токена
+// prefix/objects/<uid>/revoked, prefix/objects/<uid>/version - момент отзыва токенов объекта и версия ACL
+type vfsACLRevocation struct {
+	v      Vfs
+	prefix string
+}
+
+// NewVfsACLRevocationStore хранилище отзывов в Vfs в директории prefix
+func NewVfsACLRevocationStore(v Vfs, prefix string) ACLRevocationStore {
+	return &vfsACLRevocation{v: v, prefix: strings.Trim(prefix, "/")}
+}
+
+func (s *vfsACLRevocation) path(elem ...string) string {
+	return strings.TrimPrefix(s.prefix+"/"+strings.Join(elem, "/"), "/")
+}
+
+func (s *vfsACLRevocation) RevokeToken(ctx context.Context, id string, expired int64) (err error) {
+	return s.v.Write(ctx, s.path("tokens", id), []byte(strconv.FormatInt(expired, 10)))
+}
+
+func (s *vfsACLRevocation) RevokeObject(ctx context.Context, uid string) (err error) {
+	return s.v.Write(ctx, s.path("objects", uid, "revoked"), []byte(strconv.FormatInt(time.Now().UnixNano(), 10)))
+}
+
+func (s *vfsACLRevocation) SetACLVersion(ctx context.Context, uid string, version int64) (err error) {
+	return s.v.Write(ctx, s.path("objects", uid, "version"), []byte(strconv.FormatInt(version, 10)))
+}
+
+func (s *vfsACLRevocation) Revocation(ctx context.Context, id, uid string) (r ACLRevocation, err error) {
+	if id != "" {
+		if _, r.TokenRevoked, err = s.read(ctx, s.path("tokens", id)); err != nil {
+			return r, err
+		}
+	}
+	if r.ObjectRevoked, _, err = s.read(ctx, s.path("objects", uid, "revoked")); err != nil {
+		return r, err
+	}
+	if r.Version, _, err = s.read(ctx, s.path("objects", uid, "version")); err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// read читает число из файла, отсутствие файла - не ошибка (exist = false)
+func (s *vfsACLRevocation) read(ctx context.Context, file string) (value int64, exist bool, err error) {
+	data, _, err := s.v.Read(ctx, file, true)
+	if err != nil {
+		if IsVfsNotFound(err) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("error read acl revocation %s, err: %w", file, err)
+	}
+
+	value, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("error parse acl revocation %s, err: %w", file, err)
+	}
+
+	return value, true, nil
+}
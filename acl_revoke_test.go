@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3/s3test"
+	"git.lowcodeplatform.net/packages/models"
+)
+
+func TestACLRevocationStore(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+
+	stores := map[string]ACLRevocationStore{
+		"memory": NewMemoryACLRevocationStore(),
+		"vfs":    NewVfsACLRevocationStore(newS3TestVfs(t, srv), "/acl/revoked/"),
+	}
+	defer SetACLRevocationStore(nil)
+	// изменения хранилища должны быть видны сразу
+	SetACLRevocationCacheTTL(0)
+	defer SetACLRevocationCacheTTL(defaultACLRevocationCacheTTL)
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := []byte("POIlhb123Y09olUi")
+			acl := map[string]uint16{}
+			acl["u1"], _ = CreateACLValue(ACLPriorityUser, ACLPermissionAllow, ACLPermissionNull, ACLPermissionNull, ACLPermissionNull)
+			parse := func(token, uid string) error {
+				_, _, _, _, err := ParseTokenACL(token, uid, "u1", key)
+				return err
+			}
+
+			// токен без ID и версии (выпущен до появления отзыва)
+			legacy, _ := encodeACLKey(tokenACL{TokenACL: models.TokenACL{ACL: acl, Uid: "doc1", Expired: time.Now().Add(time.Hour).Unix()}}, projectKeyCipher(key))
+			t1, id1, err := GenTokenACLVersion(acl, key, "doc1", 0, 1)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, id1)
+			t2, _, _ := GenTokenACLVersion(acl, key, "doc1", 0, 1)
+			other, _, _ := GenTokenACLVersion(acl, key, "doc2", 0, 0)
+
+			SetACLRevocationStore(store)
+			assert.NoError(t, parse(legacy, "doc1"))
+			assert.NoError(t, parse(t1, "doc1"))
+
+			// отзыв по ID
+			assert.NoError(t, RevokeTokenACL(ctx, store, t1, key))
+			assert.ErrorIs(t, parse(t1, "doc1"), ErrRevokedACLKey)
+			assert.NoError(t, parse(t2, "doc1"))
+			assert.Error(t, RevokeTokenACL(ctx, store, legacy, key))
+
+			// версия ACL объекта
+			assert.NoError(t, store.SetACLVersion(ctx, "doc1", 1))
+			assert.ErrorIs(t, parse(legacy, "doc1"), ErrOutdatedACLKey)
+			assert.NoError(t, parse(t2, "doc1"))
+
+			// отзыв всех токенов объекта
+			assert.NoError(t, store.RevokeObject(ctx, "doc1"))
+			assert.ErrorIs(t, parse(t2, "doc1"), ErrRevokedACLKey)
+			t3, _, _ := GenTokenACLVersion(acl, key, "doc1", 0, 1)
+			assert.NoError(t, parse(t3, "doc1"))
+			assert.NoError(t, parse(other, "doc2"))
+
+			SetACLRevocationStore(nil)
+			assert.NoError(t, parse(t1, "doc1"))
+		})
+	}
+
+	assert.Contains(t, srv.Keys("files"), "acl/revoked/objects/doc1/version")
+}
+
+// countingRevocationStore считает обращения к хранилищу отзывов
+type countingRevocationStore struct {
+	ACLRevocationStore
+	calls atomic.Int32
+}
+
+func (s *countingRevocationStore) Revocation(ctx context.Context, id, uid string) (ACLRevocation, error) {
+	s.calls.Add(1)
+	if err := ctx.Err(); err != nil {
+		return ACLRevocation{}, err
+	}
+	return s.ACLRevocationStore.Revocation(ctx, id, uid)
+}
+
+func TestACLRevocationCache(t *testing.T) {
+	store := &countingRevocationStore{ACLRevocationStore: NewMemoryACLRevocationStore()}
+	SetACLRevocationStore(store)
+	defer SetACLRevocationStore(nil)
+	SetACLRevocationCacheTTL(100 * time.Millisecond)
+	defer SetACLRevocationCacheTTL(defaultACLRevocationCacheTTL)
+
+	ctx := context.Background()
+	key := []byte("POIlhb123Y09olUi")
+	acl := map[string]uint16{}
+	acl["u1"], _ = CreateACLValue(ACLPriorityUser, ACLPermissionAllow, ACLPermissionNull, ACLPermissionNull, ACLPermissionNull)
+	token, _, _ := GenTokenACLVersion(acl, key, "doc1", 0, 1)
+
+	// повторные проверки токена не обращаются к хранилищу
+	for i := 0; i < 10; i++ {
+		_, _, _, _, err := ParseTokenACL(token, "doc1", "u1", key)
+		assert.NoError(t, err)
+	}
+	access, err := ParseTokenACLManyContext(ctx, []string{token, token}, "u1", []string{"doc1", "doc1"}, key)
+	assert.NoError(t, err)
+	assert.True(t, access[1].Read)
+	assert.Equal(t, int32(1), store.calls.Load())
+
+	// изменение в хранилище видно после ttl
+	assert.NoError(t, store.SetACLVersion(ctx, "doc1", 2))
+	_, _, _, _, err = ParseTokenACL(token, "doc1", "u1", key)
+	assert.NoError(t, err)
+	time.Sleep(150 * time.Millisecond)
+	_, _, _, _, err = ParseTokenACL(token, "doc1", "u1", key)
+	assert.ErrorIs(t, err, ErrOutdatedACLKey)
+
+	// отзыв в этом процессе действует сразу
+	current, _, _ := GenTokenACLVersion(acl, key, "doc1", 0, 2)
+	_, _, _, _, err = ParseTokenACL(current, "doc1", "u1", key)
+	assert.NoError(t, err)
+	assert.NoError(t, RevokeTokenACL(ctx, store, current, key))
+	_, _, _, _, err = ParseTokenACL(current, "doc1", "u1", key)
+	assert.ErrorIs(t, err, ErrRevokedACLKey)
+
+	// контекст вызова передается в хранилище
+	other, _, _ := GenTokenACLVersion(acl, key, "doc2", 0, 0)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, _, _, err = ParseTokenACLContext(canceled, other, "doc2", "u1", key)
+	assert.ErrorIs(t, err, context.Canceled)
+}
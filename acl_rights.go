@@ -0,0 +1,300 @@
+// Именованные права ACL
+// первые 4 права (read/write/execute/admin) кодируются как и раньше - младшим байтом значения субъекта,
+// поэтому существующие токены и ParseTokenACL работают без изменений
+// остальные права хранятся страницами по 4 права в служебных ключах ACL-листа "@acl:<страница>:<субъект>",
+// старший байт значения страницы - приоритет субъекта (биты 0-1) и версия кодирования (биты 2-7)
+// у значений первой страницы версия = 0 (формат CreateACLValue)
+// позиция права в кодировании определяется порядком регистрации, поэтому новые права только добавляются в конец
+// токен хранит список прав, которым закодированы страницы, - токен с другим порядком прав, как и страницы
+// или права, не зарегистрированные в процессе, отклоняются с ErrUnknownACLRight, а не читаются молча
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ACLRightRead    = "read"
+	ACLRightWrite   = "write"
+	ACLRightExecute = "execute"
+	ACLRightAdmin   = "admin"
+	ACLRightDelete  = "delete"
+	ACLRightShare   = "share"
+	ACLRightExport  = "export"
+	ACLRightComment = "comment"
+
+	// aclPagePrefix префикс служебных ключей страниц прав
+	aclPagePrefix = "@acl:"
+	// aclPageVersion версия кодирования страниц прав
+	aclPageVersion = 1
+)
+
+var ErrUnknownACLRight = errors.New("unknown acl right")
+var ErrUnsupportedACLVersion = errors.New("unsupported acl encoding version")
+
+var aclRightsMx sync.RWMutex
+var aclRightNames = []string{
+	ACLRightRead, ACLRightWrite, ACLRightExecute, ACLRightAdmin,
+	ACLRightDelete, ACLRightShare, ACLRightExport, ACLRightComment,
+}
+
+// ACLRights права субъекта: название права - состояние (ACLPermissionAllow/Deny/Null/Conflict)
+type ACLRights map[string]string
+
+// RegisterACLRight добавляем право в конец списка именованных прав
+func RegisterACLRight(name string) (err error) {
+	aclRightsMx.Lock()
+	defer aclRightsMx.Unlock()
+
+	if name == "" || strings.ContainsAny(name, ",:") {
+		return fmt.Errorf("error RegisterACLRight, err: invalid name %q", name)
+	}
+	for _, v := range aclRightNames {
+		if v == name {
+			return fmt.Errorf("error RegisterACLRight, err: right %q already registered", name)
+		}
+	}
+	aclRightNames = append(aclRightNames, name)
+
+	return nil
+}
+
+// ACLRightNames список именованных прав в порядке кодирования
+func ACLRightNames() []string {
+	aclRightsMx.RLock()
+	defer aclRightsMx.RUnlock()
+
+	return append([]string{}, aclRightNames...)
+}
+
+// aclPageKey служебный ключ страницы прав субъекта
+func aclPageKey(subject string, page int) string {
+	return aclPagePrefix + strconv.Itoa(page) + ":" + subject
+}
+
+// parseACLPageKey разбирает служебный ключ страницы прав
+func parseACLPageKey(key string) (subject string, page int, ok bool) {
+	if !strings.HasPrefix(key, aclPagePrefix) {
+		return key, 0, false
+	}
+	p := strings.SplitN(strings.TrimPrefix(key, aclPagePrefix), ":", 2)
+	if len(p) != 2 {
+		return key, 0, false
+	}
+	page, err := strconv.Atoi(p[0])
+	if err != nil || page < 1 {
+		return key, 0, false
+	}
+
+	return p[1], page, true
+}
+
+// SetACLRights записываем в ACL-лист именованные права субъекта
+// незаданные права - ACLPermissionNull, неизвестное название права - ошибка ErrUnknownACLRight
+func SetACLRights(acl map[string]uint16, subject, priority string, rights ACLRights) (err error) {
+	names := ACLRightNames()
+	per := make([]string, len(names))
+	for name, state := range rights {
+		i := indexOf(names, name)
+		if i < 0 {
+			return fmt.Errorf("error SetACLRights, right %q, err: %w", name, ErrUnknownACLRight)
+		}
+		per[i] = state
+	}
+
+	bytePriority := uint16(EncodePriority(priority))
+	for page := 0; page*4 < len(per); page++ {
+		p := make([]string, 4)
+		copy(p, per[page*4:])
+		code := uint16(EncodeToByte(p[0], p[1], p[2], p[3]))
+
+		if page == 0 {
+			acl[subject] = bytePriority<<8 | code
+			continue
+		}
+		key := aclPageKey(subject, page)
+		if code == 0 {
+			delete(acl, key)
+			continue
+		}
+		acl[key] = (aclPageVersion<<2|bytePriority)<<8 | code
+	}
+
+	return nil
+}
+
+// CreateACLValueByName создаем значение субъекта для прав read/write/execute/admin, заданных по названию
+// (аналог CreateACLValue), для остальных прав используйте SetACLRights
+func CreateACLValueByName(priority string, rights ACLRights) (code uint16, err error) {
+	acl := map[string]uint16{}
+	if err = SetACLRights(acl, "", priority, rights); err != nil {
+		return 0, err
+	}
+	if len(acl) > 1 {
+		return 0, fmt.Errorf("error CreateACLValueByName, err: rights beyond %s require SetACLRights", ACLRightAdmin)
+	}
+
+	return acl[""], nil
+}
+
+// GetACLRights возвращаем приоритет и именованные права субъекта из ACL-листа
+func GetACLRights(acl map[string]uint16, subject string) (priority string, rights ACLRights, err error) {
+	value, ok := acl[subject]
+	if !ok {
+		return "", nil, nil
+	}
+
+	names := ACLRightNames()
+	pages := map[int]uint16{0: value}
+	for key, v := range acl {
+		if s, page, ok := parseACLPageKey(key); ok && s == subject {
+			if err = checkACLPageVersion(v); err != nil {
+				return "", nil, err
+			}
+			pages[page] = v
+		}
+	}
+
+	priority = DecodePriority(byte(value >> 8))
+	rights = ACLRights{}
+	for page, v := range pages {
+		states, err := decodeACLPage(v, page, names)
+		if err != nil {
+			return "", nil, err
+		}
+		for i, state := range states {
+			if state != ACLPermissionNull && state != "" {
+				rights[names[page*4+i]] = state
+			}
+		}
+	}
+
+	return priority, rights, nil
+}
+
+// decodeACLPage права страницы, установленные биты прав, которых нет в names, - ошибка ErrUnknownACLRight
+func decodeACLPage(value uint16, page int, names []string) (states [4]string, err error) {
+	states = DecodeFromByte(byte(value & 0xFF))
+	for i, state := range states {
+		if page*4+i >= len(names) && state != ACLPermissionNull && state != "" {
+			return states, fmt.Errorf("error decode acl page %d, right %d, err: %w", page, page*4+i, ErrUnknownACLRight)
+		}
+	}
+
+	return states, nil
+}
+
+// aclRightsLayout список прав, которым закодированы страницы ACL-листа (nil - страниц нет)
+func aclRightsLayout(acl map[string]uint16) []string {
+	last := 0
+	for key := range acl {
+		if _, page, ok := parseACLPageKey(key); ok && page > last {
+			last = page
+		}
+	}
+	if last == 0 {
+		return nil
+	}
+
+	names := ACLRightNames()
+	if n := (last + 1) * 4; n < len(names) {
+		names = names[:n]
+	}
+
+	return names
+}
+
+// checkACLRightsLayout список прав токена должен совпадать с началом списка прав процесса
+func checkACLRightsLayout(layout []string) error {
+	names := ACLRightNames()
+	for i, name := range layout {
+		if i >= len(names) || names[i] != name {
+			return fmt.Errorf("error check acl rights layout, right %q at %d, err: %w", name, i, ErrUnknownACLRight)
+		}
+	}
+
+	return nil
+}
+
+// checkACLPageVersion проверяем версию кодирования страницы прав
+func checkACLPageVersion(value uint16) error {
+	if version := value >> 10; version != aclPageVersion {
+		return fmt.Errorf("error decode acl page, version %d, err: %w", version, ErrUnsupportedACLVersion)
+	}
+
+	return nil
+}
+
+// ParseTokenACLRights - возвращаем все именованные права (см. ACLRightNames) для заданного объекта
+// правила расчета и параметры - как в ParseTokenACL
+func ParseTokenACLRights(token, uid, subjects string, projectKey []byte) (rights map[string]bool, err error) {
+	return parseTokenACLRights(context.Background(), token, uid, subjects, projectKeyCipher(projectKey))
+}
+
+func parseTokenACLRights(ctx context.Context, token, uid, subjects string, c tokenCipher) (rights map[string]bool, err error) {
+	xsKey, err := verifyTokenACLKey(ctx, token, uid, c)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkACLRightsLayout(xsKey.Rights); err != nil {
+		return nil, err
+	}
+
+	return evalACLRights(xsKey.ACL, subjects)
+}
+
+// evalACLRights рассчитывает именованные права: каждая страница прав считается как отдельный ACL-лист
+func evalACLRights(acl map[string]uint16, subjects string) (rights map[string]bool, err error) {
+	names := ACLRightNames()
+	// служебные ключи не участвуют в расчете первой страницы, как и в matchACLSubjects
+	pages := map[int]map[string]uint16{0: {}}
+	for key, value := range acl {
+		subject, page, ok := parseACLPageKey(key)
+		switch {
+		case !ok && (isACLMarker(key) || strings.HasPrefix(key, aclPagePrefix)):
+			continue
+		case !ok:
+			pages[0][key] = value
+			continue
+		}
+		if err = checkACLPageVersion(value); err != nil {
+			return nil, err
+		}
+		if _, err = decodeACLPage(value, page, names); err != nil {
+			return nil, err
+		}
+		if pages[page] == nil {
+			pages[page] = map[string]uint16{}
+		}
+		pages[page][subject] = value
+	}
+
+	rights = map[string]bool{}
+	for page := 0; page*4 < len(names); page++ {
+		var final [4]string
+		if pages[page] != nil {
+			final = evalACL(pages[page], subjects).final
+		}
+		for i := 0; i < 4 && page*4+i < len(names); i++ {
+			rights[names[page*4+i]] = final[i] == ACLPermissionAllow
+		}
+	}
+
+	return rights, nil
+}
+
+func indexOf(list []string, v string) int {
+	for i, s := range list {
+		if s == v {
+			return i
+		}
+	}
+
+	return -1
+}
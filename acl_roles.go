@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"git.lowcodeplatform.net/packages/models"
+)
+
+// RoleDecision решение CheckRoleAccess
+type RoleDecision string
+
+const (
+	// RoleAllowed роль указана в списке доступа (точно или по шаблону)
+	RoleAllowed RoleDecision = "allow"
+	// RoleDenied роль исключена отрицанием (!guest)
+	RoleDenied RoleDecision = "deny"
+	// RoleNotListed роли нет в списке доступа
+	RoleNotListed RoleDecision = "not_listed"
+	// RoleUnrestricted у объекта не заданы права - доступ открыт
+	RoleUnrestricted RoleDecision = "unrestricted"
+)
+
+// Allowed решение разрешает доступ
+func (d RoleDecision) Allowed() bool {
+	return d == RoleAllowed || d == RoleUnrestricted
+}
+
+// accessAttrs атрибуты прав объекта и соответствующие им права ACL (режимы CheckRoles)
+var accessAttrs = []struct {
+	mode, attr, right string
+}{
+	{"read", "access_read", ACLRightRead},
+	{"write", "access_write", ACLRightWrite},
+	{"delete", "access_delete", ACLRightDelete},
+	{"admin", "access_admin", ACLRightAdmin},
+}
+
+// ParseAccessList разбирает список ролей атрибута прав: через запятую, точку с запятой или пробел,
+// допускается JSON-массив; элементы - роль, шаблон (*, admin_*) или отрицание (!guest)
+func ParseAccessList(src string) (list []string) {
+	for _, v := range strings.FieldsFunc(src, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		if v = strings.Trim(v, `[]"'`); v != "" && v != "!" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// DataTokenACL преобразует атрибуты прав объекта (access_read/write/delete/admin) в TokenACL объекта
+// элементы списков становятся субъектами с приоритетом Role (шаблоны сохраняются как есть),
+// отрицание - правом Deny, которое приоритетнее разрешения той же роли
+func DataTokenACL(obj models.Data) (t models.TokenACL, err error) {
+	rights := map[string]ACLRights{}
+	for _, a := range accessAttrs {
+		src, _ := obj.Attr(a.attr, "src")
+		for _, role := range ParseAccessList(src) {
+			state := ACLPermissionAllow
+			if strings.HasPrefix(role, "!") {
+				role, state = strings.TrimPrefix(role, "!"), ACLPermissionDeny
+			}
+			if rights[role] == nil {
+				rights[role] = ACLRights{}
+			}
+			if rights[role][a.right] != ACLPermissionDeny {
+				rights[role][a.right] = state
+			}
+		}
+	}
+
+	t = models.TokenACL{ACL: map[string]uint16{}, Uid: obj.Uid}
+	for role, r := range rights {
+		if err = SetACLRights(t.ACL, role, ACLPriorityRole, r); err != nil {
+			return t, err
+		}
+	}
+
+	return t, nil
+}
+
+// matchACLSubjects субъекты ACL-листа, которые подходят под субъекты запроса (с учетом шаблонов)
+func matchACLSubjects(acl map[string]uint16, subjects []string) (matched []string) {
+	for key := range acl {
+		if isACLMarker(key) || strings.HasPrefix(key, aclPagePrefix) {
+			continue
+		}
+		for _, s := range subjects {
+			if ok, _ := path.Match(key, s); ok || key == s {
+				matched = append(matched, key)
+				break
+			}
+		}
+	}
+
+	return matched
+}
+
+// CheckRoleAccess проверяет доступ роли (или нескольких ролей через запятую) к объекту в режиме mode
+// ("read", "write", "delete", "admin") по атрибутам прав объекта
+// роли сравниваются точно, поддерживаются шаблоны и отрицание (см. ParseAccessList)
+func CheckRoleAccess(obj models.Data, role string, mode string) (decision RoleDecision, err error) {
+	attr, right, restricted := "", "", false
+	for _, a := range accessAttrs {
+		if a.mode == mode {
+			attr, right = a.attr, a.right
+		}
+		if src, _ := obj.Attr(a.attr, "src"); src != "" {
+			restricted = true
+		}
+	}
+	if !restricted {
+		return RoleUnrestricted, nil
+	}
+	if attr == "" {
+		return RoleNotListed, errors.New("error unknown mode")
+	}
+	if _, found := obj.Attr(attr, "src"); !found {
+		return RoleNotListed, errors.New("error not found " + attr + " attr")
+	}
+
+	t, err := DataTokenACL(obj)
+	if err != nil {
+		return RoleNotListed, err
+	}
+	matched := matchACLSubjects(t.ACL, ParseAccessList(role))
+	rights, err := evalACLRights(t.ACL, strings.Join(matched, ","))
+	if err != nil {
+		return RoleNotListed, err
+	}
+	if rights[right] {
+		return RoleAllowed, nil
+	}
+
+	// отличаем явный запрет от отсутствия роли в списке
+	for _, s := range matched {
+		if _, r, _ := GetACLRights(t.ACL, s); r[right] == ACLPermissionDeny {
+			return RoleDenied, nil
+		}
+	}
+
+	return RoleNotListed, nil
+}
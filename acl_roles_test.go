@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/models"
+)
+
+func TestCheckRoles(t *testing.T) {
+	obj := models.Data{Uid: "page1", Attributes: map[string]models.Attribute{
+		"access_read":   {Src: "*, !guest"},
+		"access_write":  {Src: `["superadmin", "editor_*"]`},
+		"access_delete": {Src: "superadmin;!editor_junior"},
+		"access_admin":  {Src: ""},
+	}}
+
+	cases := []struct {
+		role, mode string
+		decision   RoleDecision
+	}{
+		{"manager", "read", RoleAllowed},
+		{"guest", "read", RoleDenied},
+		{"admin", "write", RoleNotListed},
+		{"superadmin", "write", RoleAllowed},
+		{"editor_news", "write", RoleAllowed},
+		{"editor_junior", "delete", RoleDenied},
+		{"editor_junior,superadmin", "delete", RoleDenied},
+		{"superadmin", "admin", RoleNotListed},
+	}
+	for _, c := range cases {
+		decision, err := CheckRoleAccess(obj, c.role, c.mode)
+		assert.NoError(t, err)
+		assert.Equal(t, c.decision, decision, "%s %s", c.role, c.mode)
+
+		allowed, err := CheckRoles(obj, c.role, c.mode)
+		assert.NoError(t, err)
+		assert.Equal(t, c.decision.Allowed(), allowed)
+	}
+
+	_, err := CheckRoles(obj, "admin", "export")
+	assert.Error(t, err)
+	_, err = CheckRoles(models.Data{Attributes: map[string]models.Attribute{"access_read": {Src: "admin"}}}, "admin", "write")
+	assert.Error(t, err)
+
+	decision, err := CheckRoleAccess(models.Data{}, "guest", "admin")
+	assert.NoError(t, err)
+	assert.Equal(t, RoleUnrestricted, decision)
+
+	// ACL объекта совместим с ParseTokenACLRights
+	key := []byte("POIlhb123Y09olUi")
+	acl, err := DataTokenACL(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, "page1", acl.Uid)
+	token, _ := GenTokenACL(acl.ACL, key, acl.Uid, 0)
+	rights, err := ParseTokenACLRights(token, "page1", "superadmin", key)
+	assert.NoError(t, err)
+	assert.True(t, rights[ACLRightWrite])
+	assert.True(t, rights[ACLRightDelete])
+	assert.False(t, rights[ACLRightRead])
+}
@@ -1,6 +1,12 @@
 package lib
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func ExampleCreateACLValue() {
 	acl := map[string]uint16{}
@@ -21,3 +27,264 @@ func ExampleCreateACLValue() {
 	// Output:
 	// true true false true <nil>
 }
+
+func ExampleExplainTokenACL() {
+	key := []byte("POIlhb123Y09olUi")
+	acl := map[string]uint16{}
+
+	acl["all"], _ = CreateACLValue(ACLPriorityOthers, ACLPermissionAllow, ACLPermissionAllow, ACLPermissionNull, ACLPermissionNull)
+	acl["editors"], _ = CreateACLValue(ACLPriorityGroup, ACLPermissionNull, ACLPermissionDeny, ACLPermissionNull, ACLPermissionNull)
+	acl["auditors"], _ = CreateACLValue(ACLPriorityGroup, ACLPermissionNull, ACLPermissionAllow, ACLPermissionAllow, ACLPermissionNull)
+	acl["ivan"], _ = CreateACLValue(ACLPriorityUser, ACLPermissionNull, ACLPermissionNull, ACLPermissionConflict, ACLPermissionNull)
+
+	token, _ := GenTokenACL(acl, key, "1234", 0)
+	explain, err := ExplainTokenACL(token, "1234", "all,editors,auditors,ivan,guests", key)
+	fmt.Println(explain.Unmatched, err)
+	for _, r := range explain.Rights {
+		fmt.Println(r.Right, r.Allowed, r.Rule)
+	}
+
+	// Output:
+	// [guests] <nil>
+	// read true allow by others all: allowed
+	// write false deny by group editors: denied, overrides allow by others all
+	// execute false conflict by user ivan: conflict of allow and deny is denied, overrides allow by group auditors
+	// admin false no matched subject sets the right: denied
+}
+
+// решение ExplainTokenACL совпадает с ParseTokenACL для всех сочетаний прав двух субъектов
+func TestExplainTokenACLMatchesParse(t *testing.T) {
+	key := []byte("POIlhb123Y09olUi")
+	states := []string{ACLPermissionNull, ACLPermissionAllow, ACLPermissionDeny, ACLPermissionConflict}
+	priorities := []string{ACLPriorityOthers, ACLPriorityRole, ACLPriorityGroup, ACLPriorityUser}
+
+	for _, p1 := range priorities {
+		for _, p2 := range priorities {
+			for _, s1 := range states {
+				for _, s2 := range states {
+					acl := map[string]uint16{}
+					acl["a"], _ = CreateACLValue(p1, s1, s2, s1, s2)
+					acl["b"], _ = CreateACLValue(p2, s2, s1, ACLPermissionAllow, ACLPermissionDeny)
+					token, _ := GenTokenACL(acl, key, "1", 0)
+
+					r, w, x, a, err := ParseTokenACL(token, "1", "a,b", key)
+					assert.NoError(t, err)
+					explain, err := ExplainTokenACL(token, "1", "a,b", key)
+					assert.NoError(t, err)
+					for i, allowed := range []bool{r, w, x, a} {
+						assert.Equal(t, allowed, explain.Rights[i].Allowed, "%s %s %s %s: %s", p1, p2, s1, s2, explain.Rights[i].Rule)
+					}
+				}
+			}
+		}
+	}
+
+	token, _ := GenTokenACL(map[string]uint16{}, key, "1", 0)
+	explain, err := ExplainTokenACL(token, "1", "a", key)
+	assert.NoError(t, err)
+	var decoded ACLExplain
+	assert.NoError(t, json.Unmarshal([]byte(explain.String()), &decoded))
+	assert.Equal(t, explain, decoded)
+	assert.Equal(t, "no subject of the request is in the acl: denied", decoded.Rights[0].Rule)
+
+	_, err = ExplainTokenACL(token, "2", "a", key)
+	assert.ErrorIs(t, err, ErrInvalidACLKey)
+}
+
+func ExampleParseTokenACLChain() {
+	key := []byte("POIlhb123Y09olUi")
+
+	// папка: читают все, группа guests не может писать
+	folder := map[string]uint16{}
+	folder["all"], _ = CreateACLValue(ACLPriorityOthers, ACLPermissionAllow, ACLPermissionAllow, ACLPermissionNull, ACLPermissionNull)
+	folder["guests"], _ = CreateACLValue(ACLPriorityGroup, ACLPermissionNull, ACLPermissionDeny, ACLPermissionNull, ACLPermissionNull)
+	folderToken, _ := GenTokenACL(folder, key, "folder", 0)
+
+	// файл: guests разрешаем запись, но Deny папки сохраняется
+	file := map[string]uint16{}
+	file["guests"], _ = CreateACLValue(ACLPriorityGroup, ACLPermissionNull, ACLPermissionAllow, ACLPermissionAllow, ACLPermissionNull)
+	fileToken, _ := GenTokenACL(file, key, "file", 0)
+
+	chain := []ACLLink{{Token: folderToken, Uid: "folder"}, {Uid: "subfolder"}, {Token: fileToken, Uid: "file"}}
+	fmt.Println(ParseTokenACLChain(chain, "all,guests", key))
+
+	// с маркером override права файла заменяют права папки
+	OverrideACL(file, "guests")
+	chain[2].Token, _ = GenTokenACL(file, key, "file", 0)
+	fmt.Println(ParseTokenACLChain(chain, "all,guests", key))
+
+	// с маркером break права папки не учитываются
+	BreakACLInheritance(file)
+	chain[2].Token, _ = GenTokenACL(file, key, "file", 0)
+	fmt.Println(ParseTokenACLChain(chain, "all,guests", key))
+
+	// Output:
+	// true false true false <nil>
+	// true true true false <nil>
+	// false true true false <nil>
+}
+
+func TestInheritACL(t *testing.T) {
+	v := func(priority, r, w, x, a string) uint16 {
+		code, _ := CreateACLValue(priority, r, w, x, a)
+		return code
+	}
+	n, al, d := ACLPermissionNull, ACLPermissionAllow, ACLPermissionDeny
+
+	root := map[string]uint16{"u": v(ACLPriorityOthers, d, al, al, n), "g": v(ACLPriorityGroup, al, n, n, n)}
+	child := map[string]uint16{"u": v(ACLPriorityUser, al, d, n, al)}
+
+	acl := InheritACL(root, child)
+	assert.Equal(t, map[string]uint16{"u": v(ACLPriorityUser, d, d, al, al), "g": root["g"]}, acl)
+
+	OverrideACL(child)
+	acl = InheritACL(root, child)
+	assert.Equal(t, v(ACLPriorityUser, al, d, al, al), acl["u"])
+
+	BreakACLInheritance(child)
+	acl = InheritACL(root, child)
+	assert.Equal(t, map[string]uint16{"u": child["u"]}, acl)
+
+	// break на промежуточном уровне отсекает только уровни выше
+	mid := map[string]uint16{"m": v(ACLPriorityRole, al, n, n, n)}
+	BreakACLInheritance(mid)
+	acl = InheritACL(root, mid, map[string]uint16{"m": v(ACLPriorityRole, n, al, n, n)})
+	assert.Equal(t, map[string]uint16{"m": v(ACLPriorityRole, al, al, n, n)}, acl)
+
+	key := []byte("POIlhb123Y09olUi")
+	token, _ := GenTokenACL(root, key, "root", 0)
+	_, _, _, _, err := ParseTokenACLChain([]ACLLink{{Token: token, Uid: "other"}}, "u", key)
+	assert.ErrorIs(t, err, ErrInvalidACLKey)
+	_, _, _, _, err = ParseTokenACLChain([]ACLLink{{Uid: "root"}}, "u", key)
+	assert.ErrorIs(t, err, ErrNoACLKey)
+
+	explain, err := ExplainTokenACLChain([]ACLLink{{Token: token, Uid: "root"}, {Uid: "leaf"}}, "u,g", key)
+	assert.NoError(t, err)
+	assert.Equal(t, "leaf", explain.Uid)
+	assert.Equal(t, "allow by group g: allowed, overrides deny by others u", explain.Rights[0].Rule)
+}
+
+func ExampleParseTokenACLRights() {
+	key := []byte("POIlhb123Y09olUi")
+	acl := map[string]uint16{}
+
+	_ = SetACLRights(acl, "editors", ACLPriorityGroup, ACLRights{ACLRightRead: ACLPermissionAllow, ACLRightComment: ACLPermissionAllow, ACLRightShare: ACLPermissionAllow})
+	_ = SetACLRights(acl, "ivan", ACLPriorityUser, ACLRights{ACLRightShare: ACLPermissionDeny, ACLRightDelete: ACLPermissionAllow})
+
+	token, _ := GenTokenACL(acl, key, "1234", 0)
+	rights, err := ParseTokenACLRights(token, "1234", "editors,ivan", key)
+	for _, name := range ACLRightNames() {
+		fmt.Println(name, rights[name])
+	}
+	fmt.Println(err)
+
+	// Output:
+	// read true
+	// write false
+	// execute false
+	// admin false
+	// delete true
+	// share false
+	// export false
+	// comment true
+	// <nil>
+}
+
+func TestACLRightsCompatibility(t *testing.T) {
+	key := []byte("POIlhb123Y09olUi")
+
+	// значения по названию совпадают с позиционными
+	legacy, _ := CreateACLValue(ACLPriorityRole, ACLPermissionAllow, ACLPermissionNull, ACLPermissionDeny, ACLPermissionAllow)
+	code, err := CreateACLValueByName(ACLPriorityRole, ACLRights{ACLRightRead: ACLPermissionAllow, ACLRightExecute: ACLPermissionDeny, ACLRightAdmin: ACLPermissionAllow})
+	assert.NoError(t, err)
+	assert.Equal(t, legacy, code)
+
+	_, err = CreateACLValueByName(ACLPriorityRole, ACLRights{ACLRightExport: ACLPermissionAllow})
+	assert.Error(t, err)
+	_, err = CreateACLValueByName(ACLPriorityRole, ACLRights{"unknown": ACLPermissionAllow})
+	assert.ErrorIs(t, err, ErrUnknownACLRight)
+
+	// старый токен читается ParseTokenACLRights, новый - ParseTokenACL
+	token, _ := GenTokenACL(map[string]uint16{"2": legacy}, key, "1", 0)
+	rights, err := ParseTokenACLRights(token, "1", "2", key)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{ACLRightRead: true, ACLRightWrite: false, ACLRightExecute: false, ACLRightAdmin: true,
+		ACLRightDelete: false, ACLRightShare: false, ACLRightExport: false, ACLRightComment: false}, rights)
+
+	acl := map[string]uint16{}
+	assert.NoError(t, SetACLRights(acl, "2", ACLPriorityRole, ACLRights{ACLRightRead: ACLPermissionAllow, ACLRightExport: ACLPermissionAllow}))
+	token, _ = GenTokenACL(acl, key, "1", 0)
+	r, w, x, a, err := ParseTokenACL(token, "1", "2", key)
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, false, false, false}, []bool{r, w, x, a})
+
+	priority, got, err := GetACLRights(acl, "2")
+	assert.NoError(t, err)
+	assert.Equal(t, ACLPriorityRole, priority)
+	assert.Equal(t, ACLRights{ACLRightRead: ACLPermissionAllow, ACLRightExport: ACLPermissionAllow}, got)
+
+	// неизвестная версия страницы прав
+	acl[aclPageKey("2", 1)] |= 0b111100 << 8
+	_, err = evalACLRights(acl, "2")
+	assert.ErrorIs(t, err, ErrUnsupportedACLVersion)
+
+	// страницы прав наследуются по правилам InheritACL
+	parent, child := map[string]uint16{}, map[string]uint16{}
+	_ = SetACLRights(parent, "g", ACLPriorityGroup, ACLRights{ACLRightDelete: ACLPermissionDeny})
+	_ = SetACLRights(child, "g", ACLPriorityGroup, ACLRights{ACLRightDelete: ACLPermissionAllow, ACLRightShare: ACLPermissionAllow})
+	rights, err = evalACLRights(InheritACL(parent, child), "g")
+	assert.NoError(t, err)
+	assert.False(t, rights[ACLRightDelete])
+	assert.True(t, rights[ACLRightShare])
+	OverrideACL(child, "g")
+	rights, _ = evalACLRights(InheritACL(parent, child), "g")
+	assert.True(t, rights[ACLRightDelete])
+
+	assert.NoError(t, RegisterACLRight("publish"))
+	defer func() { aclRightNames = aclRightNames[:len(aclRightNames)-1] }()
+	assert.Error(t, RegisterACLRight("publish"))
+	rights, _ = evalACLRights(map[string]uint16{"2": legacy}, "2")
+	assert.Contains(t, rights, "publish")
+}
+
+func TestACLRightsLayout(t *testing.T) {
+	key := []byte("POIlhb123Y09olUi")
+	registered := ACLRightNames()
+	defer func() { aclRightNames = registered }()
+	assert.NoError(t, RegisterACLRight("publish"))
+	assert.NoError(t, RegisterACLRight("approve"))
+
+	acl := map[string]uint16{}
+	assert.NoError(t, SetACLRights(acl, "2", ACLPriorityRole, ACLRights{ACLRightDelete: ACLPermissionAllow, "approve": ACLPermissionAllow}))
+	token, _ := GenTokenACL(acl, key, "1", 0)
+	rights, err := ParseTokenACLRights(token, "1", "2", key)
+	assert.NoError(t, err)
+	assert.True(t, rights["approve"])
+	assert.False(t, rights["publish"])
+
+	// служебные ключи страниц не считаются субъектами первой страницы
+	rights, err = evalACLRights(acl, aclPageKey("2", 1))
+	assert.NoError(t, err)
+	assert.False(t, rights[ACLRightRead])
+
+	// права зарегистрированы в другом порядке
+	aclRightNames = append(append([]string{}, registered...), "approve", "publish")
+	_, err = ParseTokenACLRights(token, "1", "2", key)
+	assert.ErrorIs(t, err, ErrUnknownACLRight)
+	_, _, err = EditTokenACL(token, key, func(acl ACLList) error { return nil })
+	assert.ErrorIs(t, err, ErrUnknownACLRight)
+
+	// право не зарегистрировано - страница не читается молча
+	aclRightNames = append(append([]string{}, registered...), "publish")
+	_, err = ParseTokenACLRights(token, "1", "2", key)
+	assert.ErrorIs(t, err, ErrUnknownACLRight)
+	_, err = evalACLRights(acl, "2")
+	assert.ErrorIs(t, err, ErrUnknownACLRight)
+	_, _, err = GetACLRights(acl, "2")
+	assert.ErrorIs(t, err, ErrUnknownACLRight)
+
+	// первые права токена доступны и без регистрации
+	r, _, _, _, err := ParseTokenACL(token, "1", "2", key)
+	assert.NoError(t, err)
+	assert.False(t, r)
+}
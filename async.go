@@ -3,6 +3,7 @@ package lib
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"runtime"
 	"runtime/debug"
 	"time"
@@ -95,6 +96,43 @@ func Retrier[T any](
 	return
 }
 
+// RetrierCtx повторяет f, пока она возвращает ошибку, но не более retriesMaxCount раз
+// в отличие от Retrier прерывает ожидание между попытками при завершении ctx,
+// а retryable (если задана) определяет, имеет ли смысл повторять попытку после ошибки
+// задержка растет экспоненциально со случайным разбросом (см. backoffDelay)
+func RetrierCtx[T any](
+	ctx context.Context,
+	retriesMaxCount int,
+	retriesDelay time.Duration,
+	disableDelayProgression bool,
+	retryable func(err error) bool,
+	f func(ctx context.Context) (T, error),
+) (res T, err error) {
+	for i := 0; i < retriesMaxCount; i++ {
+		if i > 0 {
+			delay := backoffDelay(i, retriesDelay)
+			if disableDelayProgression {
+				delay = retriesDelay
+			}
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return res, err
+			case <-timer.C:
+			}
+		}
+
+		res, err = f(ctx)
+		if err == nil || (retryable != nil && !retryable(err)) || ctx.Err() != nil {
+			return res, err
+		}
+	}
+
+	return res, err
+}
+
 func sleepCalc(ind int, requestRetryMinInterval time.Duration) time.Duration {
 	sleep := ind ^ 2
 	if sleep > 60 {
@@ -103,3 +141,22 @@ func sleepCalc(ind int, requestRetryMinInterval time.Duration) time.Duration {
 
 	return time.Duration(sleep) * requestRetryMinInterval
 }
+
+// backoffMaxFactor задержка backoffDelay не растет больше base*backoffMaxFactor
+const backoffMaxFactor = 60
+
+// backoffDelay задержка перед повтором attempt (с 1): base*2^(attempt-1), но не больше base*backoffMaxFactor
+// случайная половина задержки (jitter) разводит повторы одновременных клиентов, задержка не меньше половины расчетной
+func backoffDelay(attempt int, base time.Duration) time.Duration {
+	if base <= 0 || attempt <= 0 {
+		return 0
+	}
+
+	delay := base * backoffMaxFactor
+	if attempt <= 16 && base<<(attempt-1) < delay {
+		delay = base << (attempt - 1)
+	}
+	half := delay / 2
+
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
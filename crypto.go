@@ -48,9 +48,12 @@ func removeBase64Padding(value string) string {
 
 func unpad(src []byte) ([]byte, error) {
 	length := len(src)
+	if length == 0 {
+		return nil, errors.New("unpad error. Message is empty")
+	}
 	unpadding := int(src[length-1])
 
-	if unpadding > length {
+	if unpadding == 0 || unpadding > length {
 		return nil, errors.New("unpad error. This could happen when incorrect encryption key is used")
 	}
 
@@ -63,7 +66,47 @@ func Pad(src []byte) []byte {
 	return append(src, padtext...)
 }
 
+// Encrypt шифрует text в конверте AES-GCM (см. sealEnvelope)
 func Encrypt(key []byte, text string) (string, error) {
+	return sealEnvelope(key, "", []byte(text))
+}
+
+// Decrypt расшифровывает конверт AES-GCM, а на время миграции - и старые токены AES-CFB
+// (прием старых токенов отключается SetLegacyDecrypt(false))
+func Decrypt(key []byte, text string) (string, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return "", err
+	}
+
+	decodedMsg, err := base64.URLEncoding.DecodeString(addBase64Padding(text))
+	if err != nil {
+		return "", err
+	}
+
+	// старый токен, IV которого совпал с заголовком конверта, не проходит проверку целостности конверта,
+	// поэтому, пока прием старых токенов разрешен, такой конверт расшифровывается и как AES-CFB
+	if env, ok := parseEnvelope(decodedMsg); ok {
+		msg, err := env.open(key)
+		if err == nil {
+			return string(msg), nil
+		}
+		if LegacyDecryptAllowed() && legacyCiphertextSize(decodedMsg) {
+			if text, errLegacy := decryptLegacy(key, decodedMsg); errLegacy == nil {
+				return text, nil
+			}
+		}
+		return "", err
+	}
+
+	if !LegacyDecryptAllowed() {
+		return "", ErrLegacyCiphertext
+	}
+
+	return decryptLegacy(key, decodedMsg)
+}
+
+// encryptLegacy шифрование AES-CFB без проверки целостности (формат до конверта AES-GCM)
+func encryptLegacy(key []byte, text string) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
@@ -82,23 +125,24 @@ func Encrypt(key []byte, text string) (string, error) {
 	return finalMsg, nil
 }
 
-func Decrypt(key []byte, text string) (string, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
-	}
+// legacyCiphertextSize размер подходит для токена AES-CFB: IV и хотя бы один блок
+func legacyCiphertextSize(decodedMsg []byte) bool {
+	return len(decodedMsg)%aes.BlockSize == 0 && len(decodedMsg) >= 2*aes.BlockSize
+}
 
-	decodedMsg, err := base64.URLEncoding.DecodeString(addBase64Padding(text))
+// decryptLegacy расшифровка AES-CFB
+func decryptLegacy(key []byte, decodedMsg []byte) (string, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
 	}
 
-	if (len(decodedMsg) % aes.BlockSize) != 0 {
+	if !legacyCiphertextSize(decodedMsg) {
 		return "", errors.New("blocksize must be multipe of decoded message length")
 	}
 
 	iv := decodedMsg[:aes.BlockSize]
-	msg := decodedMsg[aes.BlockSize:]
+	msg := append([]byte{}, decodedMsg[aes.BlockSize:]...)
 
 	cfb := cipher.NewCFBDecrypter(block, iv)
 	cfb.XORKeyStream(msg, msg)
@@ -121,15 +165,19 @@ func GenXServiceKey(domain string, projectKey []byte, tokenInterval time.Duratio
 		Client:  client,
 	}
 
-	return encodeServiceKey(t, projectKey)
+	return encodeServiceKey(t, projectKeyCipher(projectKey))
 }
 
 // CheckXServiceKey берем из заголовка X-Service-Key. если он есть, то он должен быть расшифровать
 // и валидируем содержимое
 // client - возвращает имя клиента, которому был выдан токен (опционально)
 func CheckXServiceKey(domain string, projectKey []byte, xServiceKey string) (valid bool, client string) {
+	return checkXServiceKey(domain, projectKeyCipher(projectKey), xServiceKey)
+}
+
+func checkXServiceKey(domain string, c tokenCipher, xServiceKey string) (valid bool, client string) {
 	var xsKeyValid bool
-	xsKey, err := decodeServiceKey(projectKey, xServiceKey)
+	xsKey, keyID, err := decodeServiceKey(c, xServiceKey)
 	if err != nil {
 		return false, ""
 	}
@@ -138,7 +186,7 @@ func CheckXServiceKey(domain string, projectKey []byte, xServiceKey string) (val
 		xsKeyValid = true
 	}
 	if !xsKeyValid {
-		if xsKey.Domain == string(projectKey) && xsKey.Expired > time.Now().Unix() {
+		if xsKey.Domain == string(c.secret(keyID)) && xsKey.Expired > time.Now().Unix() {
 			xsKeyValid = true
 		}
 	}
@@ -148,18 +196,26 @@ func CheckXServiceKey(domain string, projectKey []byte, xServiceKey string) (val
 
 // SetCheckCert устанавливает поле CheckCert в токене
 func SetCheckCert(projectKey []byte, xServiceKey string, checkCert bool) (token string, err error) {
-	xsKey, err := decodeServiceKey(projectKey, xServiceKey)
+	return setCheckCert(projectKeyCipher(projectKey), xServiceKey, checkCert)
+}
+
+func setCheckCert(c tokenCipher, xServiceKey string, checkCert bool) (token string, err error) {
+	xsKey, _, err := decodeServiceKey(c, xServiceKey)
 	if err != nil {
 		return token, err
 	}
 	xsKey.CheckCert = checkCert
 
-	return encodeServiceKey(xsKey, projectKey)
+	return encodeServiceKey(xsKey, c)
 }
 
 // GetCheckCert получает поле CheckCert из токена
 func GetCheckCert(projectKey []byte, xServiceKey string) (checkCert bool, err error) {
-	xsKey, err := decodeServiceKey(projectKey, xServiceKey)
+	return getCheckCert(projectKeyCipher(projectKey), xServiceKey)
+}
+
+func getCheckCert(c tokenCipher, xServiceKey string) (checkCert bool, err error) {
+	xsKey, _, err := decodeServiceKey(c, xServiceKey)
 	return xsKey.CheckCert, nil
 }
 
@@ -167,17 +223,25 @@ func GetCheckCert(projectKey []byte, xServiceKey string) (checkCert bool, err er
 // пустая строка означает, что достпуны все
 // несколько доменов разделяются запятой (без пробелов)
 func SetValidURI(uris string, projectKey []byte, xServiceKey string) (token string, err error) {
-	xsKey, err := decodeServiceKey(projectKey, xServiceKey)
+	return setValidURI(uris, projectKeyCipher(projectKey), xServiceKey)
+}
+
+func setValidURI(uris string, c tokenCipher, xServiceKey string) (token string, err error) {
+	xsKey, _, err := decodeServiceKey(c, xServiceKey)
 	if err != nil {
 		return token, err
 	}
 	xsKey.WhiteURI = uris
-	return encodeServiceKey(xsKey, projectKey)
+	return encodeServiceKey(xsKey, c)
 }
 
 // IsValidURI проверяет, есть ли дотуп у токена к запрашиваемому пути
 func IsValidURI(checkUri string, projectKey []byte, xServiceKey string) (isValidURI bool, err error) {
-	xsKey, err := decodeServiceKey(projectKey, xServiceKey)
+	return isValidURIToken(checkUri, projectKeyCipher(projectKey), xServiceKey)
+}
+
+func isValidURIToken(checkUri string, c tokenCipher, xServiceKey string) (isValidURI bool, err error) {
+	xsKey, _, err := decodeServiceKey(c, xServiceKey)
 	if err != nil {
 		return false, err
 	}
@@ -332,24 +396,25 @@ func decodeHash(encodedHash string) (p *paramsArgon2, salt, hash []byte, err err
 }
 
 // decodeServiceKey расшифровыет модель XServiceKey из токена
-func decodeServiceKey(projectKey []byte, xServiceKey string) (xsKey models.XServiceKey, err error) {
+// keyID - ID ключа связки, которым расшифрован токен (пусто для единственного ключа проекта)
+func decodeServiceKey(c tokenCipher, xServiceKey string) (xsKey models.XServiceKey, keyID string, err error) {
 	if xServiceKey == "" {
-		return xsKey, ErrNoServiceKey
+		return xsKey, "", ErrNoServiceKey
 	}
 
-	v, err := Decrypt(projectKey, xServiceKey)
+	v, keyID, err := c.decrypt(xServiceKey)
 	err = json.Unmarshal([]byte(v), &xsKey)
 	return
 }
 
 // encodeServiceKey шифрует модель XServiceKey в токен
-func encodeServiceKey(xsKey models.XServiceKey, projectKey []byte) (token string, err error) {
+func encodeServiceKey(xsKey models.XServiceKey, c tokenCipher) (token string, err error) {
 	strJson, err := json.Marshal(xsKey)
 	if err != nil {
 		return "", fmt.Errorf("error Marshal XServiceKey, err: %s", err)
 	}
 
-	token, err = Encrypt(projectKey, string(strJson))
+	token, err = c.encrypt(string(strJson))
 	if err != nil {
 		return "", fmt.Errorf("error Encrypt XServiceKey, err: %s", err)
 	}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Конверт шифрования (версия 2, версия 1 - AES-CFB без проверки целостности)
+// | версия (1 байт) | длина ID ключа (1 байт) | ID ключа | nonce (12 байт) | шифротекст AES-GCM с тегом |
+// заголовок (версия и ID ключа) защищен тегом как дополнительные данные, результат кодируется base64 URL без паддинга
+// ID ключа - печатные символы ASCII или пустой (Encrypt). Случайный IV старого токена может совпасть с заголовком
+// конверта (например начаться с 0x02 0x00), поэтому такие конверты при разрешенном приеме старых токенов
+// расшифровываются и как AES-CFB (см. Decrypt)
+const envelopeVersionGCM = 2
+
+var ErrLegacyCiphertext = errors.New("legacy ciphertext is rejected")
+var ErrInvalidCiphertext = errors.New("ciphertext is invalid or has been tampered with")
+
+// legacyDecryptDisabled запрет приема токенов AES-CFB
+var legacyDecryptDisabled atomic.Bool
+
+// CryptoConfig параметры шифрования токенов
+// совместим с ConfigLoad (toml + переменные окружения), применяется Apply при старте сервиса
+type CryptoConfig struct {
+	CryptoRejectLegacy bool `envconfig:"CRYPTO_REJECT_LEGACY" default:"false" toml:"CryptoRejectLegacy" description:"не принимать токены старого формата AES-CFB"`
+}
+
+// Apply применяем настройки шифрования
+func (c CryptoConfig) Apply() {
+	SetLegacyDecrypt(!c.CryptoRejectLegacy)
+}
+
+// SetLegacyDecrypt разрешаем или запрещаем Decrypt принимать токены старого формата AES-CFB
+// по-умолчанию разрешено на время миграции, после перевыпуска токенов прием нужно отключить
+// (CryptoConfig.CryptoRejectLegacy), запрет действует и на расшифрованные ранее токены из кеша
+func SetLegacyDecrypt(allow bool) {
+	legacyDecryptDisabled.Store(!allow)
+}
+
+// LegacyDecryptAllowed принимает ли Decrypt токены старого формата
+func LegacyDecryptAllowed() bool {
+	return !legacyDecryptDisabled.Load()
+}
+
+// envelope разобранный конверт шифрования
+type envelope struct {
+	keyID  string
+	header []byte
+	nonce  []byte
+	data   []byte
+}
+
+// sealEnvelope шифрует msg ключом key в конверт AES-GCM с идентификатором ключа keyID
+func sealEnvelope(key []byte, keyID string, msg []byte) (string, error) {
+	if !validEnvelopeKeyID(keyID) {
+		return "", fmt.Errorf("error seal envelope, err: invalid key id %q", keyID)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	header := append([]byte{envelopeVersionGCM, byte(len(keyID))}, keyID...)
+	out := make([]byte, len(header)+gcm.NonceSize(), len(header)+gcm.NonceSize()+len(msg)+gcm.Overhead())
+	copy(out, header)
+	nonce := out[len(header):]
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	out = gcm.Seal(out, nonce, msg, header)
+
+	return removeBase64Padding(base64.URLEncoding.EncodeToString(out)), nil
+}
+
+// parseEnvelope разбирает заголовок конверта (ok = false - не конверт, например токен AES-CFB)
+func parseEnvelope(decodedMsg []byte) (env envelope, ok bool) {
+	if len(decodedMsg) < 2 || decodedMsg[0] != envelopeVersionGCM {
+		return env, false
+	}
+
+	headerLen := 2 + int(decodedMsg[1])
+	// минимальный размер GCM: nonce 12 байт и тег 16 байт
+	if len(decodedMsg) < headerLen+12+16 || !validEnvelopeKeyID(string(decodedMsg[2:headerLen])) {
+		return env, false
+	}
+
+	return envelope{
+		keyID:  string(decodedMsg[2:headerLen]),
+		header: decodedMsg[:headerLen],
+		nonce:  decodedMsg[headerLen : headerLen+12],
+		data:   decodedMsg[headerLen+12:],
+	}, true
+}
+
+// validEnvelopeKeyID ID ключа: до 255 печатных символов ASCII
+func validEnvelopeKeyID(keyID string) bool {
+	if len(keyID) > 255 {
+		return false
+	}
+	for i := 0; i < len(keyID); i++ {
+		if keyID[i] < 0x21 || keyID[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isLegacyCiphertext токен может быть старого формата AES-CFB: не конверт
+// или конверт, размер которого подходит и для AES-CFB
+func isLegacyCiphertext(token string) bool {
+	decodedMsg, err := base64.URLEncoding.DecodeString(addBase64Padding(token))
+	if err != nil {
+		return false
+	}
+	_, ok := parseEnvelope(decodedMsg)
+
+	return !ok || legacyCiphertextSize(decodedMsg)
+}
+
+// open расшифровывает и проверяет целостность конверта
+func (env envelope) open(key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := gcm.Open(nil, env.nonce, env.data, env.header)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+
+	return msg, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -1,9 +1,17 @@
 package lib
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/models"
 )
 
 func TestXServiceKey(t *testing.T) {
@@ -119,7 +127,7 @@ func TestDecode(t *testing.T) {
 			//token, err := decodeServiceKey(c.projectKey, tk.AccessKey)
 			//fmt.Println(fmt.Sprintf("%+v", token), s, err)
 		case "token":
-			token, err := decodeServiceKey(c.projectKey, c.domain)
+			token, _, err := decodeServiceKey(projectKeyCipher(c.projectKey), c.domain)
 			fmt.Println(fmt.Sprintf("%+v", token), c.domain, err)
 		}
 	}
@@ -132,3 +140,132 @@ func TestStrongKeyHKDF(t *testing.T) {
 
 	fmt.Println(string(res), err)
 }
+
+func TestEncryptEnvelope(t *testing.T) {
+	key := []byte("LKHlhb899Y09olUi")
+
+	token, err := Encrypt(key, `{"uid":"doc1"}`)
+	assert.NoError(t, err)
+	msg, err := Decrypt(key, token)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"uid":"doc1"}`, msg)
+
+	// изменение любого байта конверта обнаруживается
+	raw, _ := base64.URLEncoding.DecodeString(addBase64Padding(token))
+	tamper := func(i int) string {
+		tampered := append([]byte{}, raw...)
+		tampered[i] ^= 0x01
+		return removeBase64Padding(base64.URLEncoding.EncodeToString(tampered))
+	}
+	for _, i := range []int{5, len(raw) - 1} {
+		// разобранный конверт с неверным тегом не расшифровывается как старый токен
+		_, err = Decrypt(key, tamper(i))
+		assert.ErrorIs(t, err, ErrInvalidCiphertext)
+	}
+	SetLegacyDecrypt(false)
+	_, err = Decrypt(key, tamper(1))
+	SetLegacyDecrypt(true)
+	assert.Error(t, err)
+	_, err = Decrypt([]byte("0123456789abcdef"), token)
+	assert.Error(t, err)
+
+	// старые токены принимаются, пока не отключен прием
+	legacy, err := encryptLegacy(key, "legacy")
+	assert.NoError(t, err)
+	msg, err = Decrypt(key, legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, "legacy", msg)
+
+	SetLegacyDecrypt(false)
+	defer SetLegacyDecrypt(true)
+	_, err = Decrypt(key, legacy)
+	assert.ErrorIs(t, err, ErrLegacyCiphertext)
+	msg, err = Decrypt(key, token)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"uid":"doc1"}`, msg)
+}
+
+// encryptLegacyIV шифрует text как encryptLegacy, но с заданным IV
+func encryptLegacyIV(t *testing.T, key, iv []byte, text string) string {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	assert.NoError(t, err)
+	msg := Pad([]byte(text))
+	ciphertext := append(append([]byte{}, iv...), make([]byte, len(msg))...)
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(ciphertext[aes.BlockSize:], msg)
+
+	return removeBase64Padding(base64.URLEncoding.EncodeToString(ciphertext))
+}
+
+func TestDecryptLegacyLikeEnvelope(t *testing.T) {
+	key := []byte("LKHlhb899Y09olUi")
+
+	// IV старого токена совпадает с заголовком конверта без ID ключа и с ID ключа
+	for _, iv := range [][]byte{
+		{envelopeVersionGCM, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14},
+		{envelopeVersionGCM, 2, 'k', '1', 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14},
+	} {
+		token := encryptLegacyIV(t, key, iv, `{"uid":"doc1"}`)
+		_, ok := parseEnvelope(mustDecodeToken(t, token))
+		assert.True(t, ok)
+		assert.True(t, isLegacyCiphertext(token))
+
+		msg, err := Decrypt(key, token)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"uid":"doc1"}`, msg)
+
+		kr, _ := NewKeyring(KeyringKey{ID: "k1", Secret: string(key)})
+		msg, err = kr.Decrypt(token)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"uid":"doc1"}`, msg)
+
+		SetLegacyDecrypt(false)
+		_, err = Decrypt(key, token)
+		assert.ErrorIs(t, err, ErrInvalidCiphertext)
+		_, err = kr.Decrypt(token)
+		assert.Error(t, err)
+		SetLegacyDecrypt(true)
+	}
+}
+
+func TestDecryptMalformed(t *testing.T) {
+	key := []byte("LKHlhb899Y09olUi")
+
+	_, err := unpad(nil)
+	assert.Error(t, err)
+	for _, text := range []string{"", "AA", removeBase64Padding(base64.URLEncoding.EncodeToString(make([]byte, aes.BlockSize)))} {
+		assert.NotPanics(t, func() {
+			_, err = Decrypt(key, text)
+		})
+		assert.Error(t, err)
+	}
+}
+
+func TestCryptoConfig(t *testing.T) {
+	defer SetLegacyDecrypt(true)
+
+	key := []byte("LKHlhb899Y09olUi")
+	acl := map[string]uint16{}
+	acl["u1"], _ = CreateACLValue(ACLPriorityUser, ACLPermissionAllow, ACLPermissionNull, ACLPermissionNull, ACLPermissionNull)
+	data, _ := json.Marshal(tokenACL{TokenACL: models.TokenACL{ACL: acl, Uid: "doc1", Expired: time.Now().Add(time.Hour).Unix()}})
+	legacy, _ := encryptLegacy(key, string(data))
+
+	// старый токен расшифрован и попал в кеш
+	r, _, _, _, err := ParseTokenACL(legacy, "doc1", "u1", key)
+	assert.NoError(t, err)
+	assert.True(t, r)
+
+	var cfg CryptoConfig
+	assert.NoError(t, DecodeConfig("CryptoRejectLegacy = true", &cfg))
+	cfg.Apply()
+	assert.False(t, LegacyDecryptAllowed())
+
+	// запрет действует и на токен из кеша
+	_, _, _, _, err = ParseTokenACL(legacy, "doc1", "u1", key)
+	assert.ErrorIs(t, err, ErrInvalidACLKey)
+
+	CryptoConfig{}.Apply()
+	_, _, _, _, err = ParseTokenACL(legacy, "doc1", "u1", key)
+	assert.NoError(t, err)
+}
@@ -525,6 +525,15 @@ func getServiceKey(r *http.Request) string {
 }
 
 func MiddlewareXServiceKey(project, service, projectKey string) func(next http.Handler) http.Handler {
+	return middlewareXServiceKey(project, service, projectKeyCipher(projectKey))
+}
+
+// MiddlewareXServiceKeyKeyring MiddlewareXServiceKey с проверкой токена связкой ключей проекта
+func MiddlewareXServiceKeyKeyring(project, service string, kr *Keyring) func(next http.Handler) http.Handler {
+	return middlewareXServiceKey(project, service, kr)
+}
+
+func middlewareXServiceKey(project, service string, c tokenCipher) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var err error
@@ -546,7 +555,7 @@ func MiddlewareXServiceKey(project, service, projectKey string) func(next http.H
 				return
 			}
 
-			valid, _ := CheckXServiceKey(project+"/"+service, []byte(projectKey), serviceKey)
+			valid, _ := checkXServiceKey(project+"/"+service, c, serviceKey)
 			if !valid {
 				err = errTokenInvalid
 			}
@@ -557,10 +566,19 @@ func MiddlewareXServiceKey(project, service, projectKey string) func(next http.H
 // MiddlewareValidateUri проверяет токен на доступ к пути
 // Инвертирует логику WhiteUri = "". IsValidURI по умолчанию пропускает. Эта не будет пропускать
 func MiddlewareValidateUri(projectKey string) func(next http.Handler) http.Handler {
+	return middlewareValidateUri(projectKeyCipher(projectKey))
+}
+
+// MiddlewareValidateUriKeyring MiddlewareValidateUri с проверкой токена связкой ключей проекта
+func MiddlewareValidateUriKeyring(kr *Keyring) func(next http.Handler) http.Handler {
+	return middlewareValidateUri(kr)
+}
+
+func middlewareValidateUri(c tokenCipher) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Получить ключ
-			xsKey, err := decodeServiceKey([]byte(projectKey), getServiceKey(r))
+			xsKey, _, err := decodeServiceKey(c, getServiceKey(r))
 			if err != nil {
 				_ = ResponseJSON(w, nil, "Unauthorized", errTokenInvalid, nil)
 				return
@@ -0,0 +1,424 @@
+package lib
+
+import (
+	"context"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"git.lowcodeplatform.net/packages/models"
+)
+
+var ErrNoActiveKey = errors.New("keyring has no active key")
+var ErrUnknownKeyID = errors.New("token key id is not accepted by keyring")
+
+// tokenCipher шифрование токенов: ключом проекта (projectKeyCipher) или связкой ключей (Keyring)
+type tokenCipher interface {
+	encrypt(text string) (token string, err error)
+	// decrypt возвращает также ID ключа, которым расшифрован токен
+	decrypt(token string) (text, keyID string, err error)
+	// secret ключ с ID keyID, nil - ключ не принимается
+	secret(keyID string) []byte
+	// cacheID идентификатор для кеша расшифрованных токенов
+	cacheID() []byte
+}
+
+// projectKeyCipher единственный ключ проекта
+type projectKeyCipher []byte
+
+func (k projectKeyCipher) encrypt(text string) (string, error) {
+	return Encrypt(k, text)
+}
+
+func (k projectKeyCipher) decrypt(token string) (string, string, error) {
+	text, err := Decrypt(k, token)
+	return text, "", err
+}
+
+func (k projectKeyCipher) secret(string) []byte {
+	return k
+}
+
+func (k projectKeyCipher) cacheID() []byte {
+	return k
+}
+
+// KeyringKey ключ проекта в связке
+type KeyringKey struct {
+	// ID идентификатор ключа, записывается в токен (до 255 печатных символов ASCII)
+	ID string `json:"id" toml:"ID"`
+	// Secret ключ AES (16, 24 или 32 байта)
+	Secret string `json:"secret" toml:"Secret"`
+	// ActivateAt с этого момента ключ подписывает новые токены (пусто - сразу)
+	// до активации ключ уже принимается, чтобы его успели получить все экземпляры сервисов
+	ActivateAt time.Time `json:"activate_at" toml:"ActivateAt"`
+	// RetireAt с этого момента токены этого ключа не принимаются (пусто - бессрочно)
+	RetireAt time.Time `json:"retire_at" toml:"RetireAt"`
+}
+
+// KeyringConfig настройки связки ключей проекта, в toml - массив таблиц [[ProjectKeys]]
+type KeyringConfig struct {
+	ProjectKeys []KeyringKey `json:"project_keys" toml:"ProjectKeys"`
+}
+
+// Keyring связка ключей проекта: активный ключ подписывает новые токены,
+// остальные непросроченные ключи принимаются при проверке (ключ выбирается по ID в токене)
+// токены без ID ключа (выпущенные по единственному ключу проекта) проверяются всеми принимаемыми ключами
+type Keyring struct {
+	mx   sync.RWMutex
+	id   string
+	keys []KeyringKey
+	now  func() time.Time
+}
+
+// NewKeyring создаем связку из ключей
+func NewKeyring(keys ...KeyringKey) (kr *Keyring, err error) {
+	kr = &Keyring{id: UUID(), now: time.Now}
+	for _, key := range keys {
+		if err = kr.Add(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return kr, nil
+}
+
+// NewKeyringFromConfig создаем связку из конфигурации (см. ConfigLoad)
+func NewKeyringFromConfig(cfg KeyringConfig) (kr *Keyring, err error) {
+	if len(cfg.ProjectKeys) == 0 {
+		return nil, fmt.Errorf("error NewKeyringFromConfig, err: %w", ErrNoActiveKey)
+	}
+
+	return NewKeyring(cfg.ProjectKeys...)
+}
+
+// Add добавляем ключ в связку
+func (kr *Keyring) Add(key KeyringKey) (err error) {
+	if err = checkKeyringKey(key); err != nil {
+		return err
+	}
+
+	kr.mx.Lock()
+	defer kr.mx.Unlock()
+
+	return kr.addLocked(key)
+}
+
+// checkKeyringKey проверяем ID и длину секрета ключа
+func checkKeyringKey(key KeyringKey) error {
+	if key.ID == "" || !validEnvelopeKeyID(key.ID) {
+		return fmt.Errorf("error add key to keyring, err: invalid key id %q", key.ID)
+	}
+	if _, err := aes.NewCipher([]byte(key.Secret)); err != nil {
+		return fmt.Errorf("error add key %s to keyring, err: %s", key.ID, err)
+	}
+
+	return nil
+}
+
+// addLocked добавляем проверенный ключ, вызывается под kr.mx
+func (kr *Keyring) addLocked(key KeyringKey) error {
+	for _, k := range kr.keys {
+		if k.ID == key.ID {
+			return fmt.Errorf("error add key to keyring, err: key %s already exists", key.ID)
+		}
+	}
+	kr.keys = append(kr.keys, key)
+	sort.SliceStable(kr.keys, func(i, j int) bool {
+		return kr.keys[i].ActivateAt.Before(kr.keys[j].ActivateAt)
+	})
+
+	return nil
+}
+
+// Rotate добавляем новый ключ и выводим из оборота текущий активный:
+// он перестает подписывать токены с активацией нового и принимается еще overlap после нее
+// чтение активного ключа, добавление нового и вывод старого выполняются под одной блокировкой
+func (kr *Keyring) Rotate(key KeyringKey, overlap time.Duration) (err error) {
+	if err = checkKeyringKey(key); err != nil {
+		return err
+	}
+
+	kr.mx.Lock()
+	defer kr.mx.Unlock()
+
+	if key.ActivateAt.IsZero() {
+		key.ActivateAt = kr.now()
+	}
+	active, _ := kr.activeLocked()
+	if err = kr.addLocked(key); err != nil {
+		return err
+	}
+	if active.ID == "" {
+		return nil
+	}
+
+	retire := key.ActivateAt.Add(overlap)
+	for i, k := range kr.keys {
+		if k.ID == active.ID && (k.RetireAt.IsZero() || k.RetireAt.After(retire)) {
+			kr.keys[i].RetireAt = retire
+		}
+	}
+
+	return nil
+}
+
+// Remove удаляем ключ из связки, токены этого ключа больше не принимаются
+func (kr *Keyring) Remove(id string) {
+	kr.mx.Lock()
+	defer kr.mx.Unlock()
+
+	for i, k := range kr.keys {
+		if k.ID == id {
+			kr.keys = append(kr.keys[:i], kr.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// ActiveID ID ключа, которым сейчас подписываются новые токены
+func (kr *Keyring) ActiveID() string {
+	key, _ := kr.active()
+	return key.ID
+}
+
+// active активный ключ - последний активированный из непросроченных
+func (kr *Keyring) active() (key KeyringKey, err error) {
+	kr.mx.RLock()
+	defer kr.mx.RUnlock()
+
+	return kr.activeLocked()
+}
+
+// activeLocked active, вызывается под kr.mx
+func (kr *Keyring) activeLocked() (key KeyringKey, err error) {
+	now := kr.now()
+	for _, k := range kr.keys {
+		if !k.ActivateAt.After(now) && (k.RetireAt.IsZero() || now.Before(k.RetireAt)) {
+			key = k
+		}
+	}
+	if key.ID == "" {
+		return key, ErrNoActiveKey
+	}
+
+	return key, nil
+}
+
+// accepted ключи, которые принимаются при проверке (активный - первым)
+func (kr *Keyring) accepted() (keys []KeyringKey) {
+	kr.mx.RLock()
+	defer kr.mx.RUnlock()
+
+	active, _ := kr.activeLocked()
+
+	now := kr.now()
+	if active.ID != "" {
+		keys = append(keys, active)
+	}
+	for _, k := range kr.keys {
+		if k.ID != active.ID && (k.RetireAt.IsZero() || now.Before(k.RetireAt)) {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// Encrypt шифруем text активным ключом, ID ключа записывается в конверт
+func (kr *Keyring) Encrypt(text string) (token string, err error) {
+	return kr.encrypt(text)
+}
+
+// Decrypt расшифровываем токен ключом, ID которого указан в токене
+func (kr *Keyring) Decrypt(token string) (text string, err error) {
+	text, _, err = kr.decrypt(token)
+	return text, err
+}
+
+func (kr *Keyring) encrypt(text string) (string, error) {
+	key, err := kr.active()
+	if err != nil {
+		return "", err
+	}
+
+	return sealEnvelope([]byte(key.Secret), key.ID, []byte(text))
+}
+
+func (kr *Keyring) decrypt(token string) (text, keyID string, err error) {
+	decodedMsg, err := base64.URLEncoding.DecodeString(addBase64Padding(token))
+	if err != nil {
+		return "", "", err
+	}
+
+	var errEnvelope error
+	if env, ok := parseEnvelope(decodedMsg); ok && env.keyID != "" {
+		secret := kr.secret(env.keyID)
+		if secret == nil {
+			errEnvelope = fmt.Errorf("error decrypt token, key %s, err: %w", env.keyID, ErrUnknownKeyID)
+		} else if msg, err := env.open(secret); err == nil {
+			return string(msg), env.keyID, nil
+		} else {
+			errEnvelope = err
+		}
+		// старый токен мог разобраться как конверт с ID ключа (см. Decrypt)
+		if !LegacyDecryptAllowed() || !legacyCiphertextSize(decodedMsg) {
+			return "", "", errEnvelope
+		}
+	}
+
+	// токен без ID ключа: старые токены AES-CFB с чужим ключом могут расшифроваться в мусор,
+	// поэтому принимаем только результат в формате JSON (все токены библиотеки - JSON)
+	err = ErrInvalidCiphertext
+	for _, k := range kr.accepted() {
+		text, e := Decrypt([]byte(k.Secret), token)
+		if e == nil && json.Valid([]byte(text)) {
+			return text, k.ID, nil
+		}
+		if errors.Is(e, ErrLegacyCiphertext) {
+			err = e
+		}
+	}
+	if errEnvelope != nil {
+		return "", "", errEnvelope
+	}
+
+	return "", "", err
+}
+
+func (kr *Keyring) secret(keyID string) []byte {
+	kr.mx.RLock()
+	defer kr.mx.RUnlock()
+
+	now := kr.now()
+	for _, k := range kr.keys {
+		if k.ID == keyID && (k.RetireAt.IsZero() || now.Before(k.RetireAt)) {
+			return []byte(k.Secret)
+		}
+	}
+
+	return nil
+}
+
+func (kr *Keyring) cacheID() []byte {
+	return []byte("keyring:" + kr.id)
+}
+
+// Reencrypt перешифровываем токен активным ключом (перевыпуск токенов выводимого ключа)
+func (kr *Keyring) Reencrypt(token string) (newToken string, err error) {
+	text, _, err := kr.decrypt(token)
+	if err != nil {
+		return "", err
+	}
+
+	return kr.encrypt(text)
+}
+
+// GenTokenACL GenTokenACL с подписью активным ключом связки
+func (kr *Keyring) GenTokenACL(acl map[string]uint16, uid string, tokenInterval time.Duration) (token string, err error) {
+	token, _, err = genTokenACL(acl, kr, uid, tokenInterval, 0)
+	return token, err
+}
+
+// GenTokenACLVersion GenTokenACLVersion с подписью активным ключом связки
+func (kr *Keyring) GenTokenACLVersion(acl map[string]uint16, uid string, tokenInterval time.Duration, version int64) (token, id string, err error) {
+	return genTokenACL(acl, kr, uid, tokenInterval, version)
+}
+
+// ParseTokenACL ParseTokenACL с проверкой токена ключами связки
+func (kr *Keyring) ParseTokenACL(token, uid, subjects string) (r, w, x, a bool, err error) {
+	return parseTokenACL(context.Background(), token, uid, subjects, kr)
+}
+
+// ParseTokenACLRights ParseTokenACLRights с проверкой токена ключами связки
+func (kr *Keyring) ParseTokenACLRights(token, uid, subjects string) (rights map[string]bool, err error) {
+	return parseTokenACLRights(context.Background(), token, uid, subjects, kr)
+}
+
+// ParseTokenACLMany ParseTokenACLMany с проверкой токенов ключами связки
+func (kr *Keyring) ParseTokenACLMany(tokens []string, subjects string, uids []string) (access []ACLAccess, err error) {
+	return parseTokenACLMany(context.Background(), tokens, subjects, uids, kr)
+}
+
+// ParseTokenACLChain ParseTokenACLChain с проверкой токенов ключами связки
+func (kr *Keyring) ParseTokenACLChain(chain []ACLLink, subjects string) (r, w, x, a bool, err error) {
+	return parseTokenACLChain(context.Background(), chain, subjects, kr)
+}
+
+// ExplainTokenACL ExplainTokenACL с проверкой токена ключами связки
+func (kr *Keyring) ExplainTokenACL(token, uid, subjects string) (explain ACLExplain, err error) {
+	return explainTokenACL(context.Background(), token, uid, subjects, kr)
+}
+
+// ExplainTokenACLChain ExplainTokenACLChain с проверкой токенов ключами связки
+func (kr *Keyring) ExplainTokenACLChain(chain []ACLLink, subjects string) (explain ACLExplain, err error) {
+	return explainTokenACLChain(context.Background(), chain, subjects, kr)
+}
+
+// RevokeTokenACL RevokeTokenACL с проверкой токена ключами связки
+func (kr *Keyring) RevokeTokenACL(ctx context.Context, store ACLRevocationStore, token string) (err error) {
+	return revokeTokenACL(ctx, store, token, kr)
+}
+
+// DecodeTokenACL DecodeTokenACL с проверкой токена ключами связки
+func (kr *Keyring) DecodeTokenACL(token string) (t models.TokenACL, err error) {
+	return decodeTokenACL(token, kr)
+}
+
+// EditTokenACL EditTokenACL, новый токен подписывается активным ключом связки
+func (kr *Keyring) EditTokenACL(token string, edit func(acl ACLList) error) (newToken string, changes []ACLChange, err error) {
+	return editTokenACL(context.Background(), token, kr, edit)
+}
+
+// InspectTokenACL InspectTokenACL с проверкой токена ключами связки
+func (kr *Keyring) InspectTokenACL(token string) (listing string, err error) {
+	return inspectTokenACL(token, kr)
+}
+
+// GenXServiceKey GenXServiceKey с подписью активным ключом связки
+func (kr *Keyring) GenXServiceKey(domain string, tokenInterval time.Duration, client string) (token string, err error) {
+	t := models.XServiceKey{
+		Domain:  domain,
+		Expired: time.Now().Add(tokenInterval).Unix(),
+		Client:  client,
+	}
+
+	return encodeServiceKey(t, kr)
+}
+
+// CheckXServiceKey CheckXServiceKey с проверкой токена ключами связки
+// токен, выпущенный на домен-ключ проекта, принимается для ключа, которым он подписан
+func (kr *Keyring) CheckXServiceKey(domain string, xServiceKey string) (valid bool, client string) {
+	return checkXServiceKey(domain, kr, xServiceKey)
+}
+
+// DecodeServiceKey DecodeServiceKey с проверкой токена ключами связки
+func (kr *Keyring) DecodeServiceKey(xServiceKey string) (out models.XServiceKey, err error) {
+	out, _, err = decodeServiceKey(kr, xServiceKey)
+	return out, err
+}
+
+// SetCheckCert SetCheckCert, новый токен подписывается активным ключом связки
+func (kr *Keyring) SetCheckCert(xServiceKey string, checkCert bool) (token string, err error) {
+	return setCheckCert(kr, xServiceKey, checkCert)
+}
+
+// GetCheckCert GetCheckCert с проверкой токена ключами связки
+func (kr *Keyring) GetCheckCert(xServiceKey string) (checkCert bool, err error) {
+	return getCheckCert(kr, xServiceKey)
+}
+
+// SetValidURI SetValidURI, новый токен подписывается активным ключом связки
+func (kr *Keyring) SetValidURI(uris string, xServiceKey string) (token string, err error) {
+	return setValidURI(uris, kr, xServiceKey)
+}
+
+// IsValidURI IsValidURI с проверкой токена ключами связки
+func (kr *Keyring) IsValidURI(checkUri string, xServiceKey string) (isValidURI bool, err error) {
+	return isValidURIToken(checkUri, kr, xServiceKey)
+}
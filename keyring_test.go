@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	now := time.Now()
+	kr, err := NewKeyring(KeyringKey{ID: "k1", Secret: "POIlhb123Y09olUi"})
+	assert.NoError(t, err)
+	kr.now = func() time.Time { return now }
+
+	acl := map[string]uint16{}
+	acl["u1"], _ = CreateACLValue(ACLPriorityUser, ACLPermissionAllow, ACLPermissionAllow, ACLPermissionNull, ACLPermissionNull)
+
+	t1, err := kr.GenTokenACL(acl, "doc", time.Hour)
+	assert.NoError(t, err)
+
+	// новый ключ активируется через минуту, старый принимается еще час после активации
+	err = kr.Rotate(KeyringKey{ID: "k2", Secret: "0123456789abcdef", ActivateAt: now.Add(time.Minute)}, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", kr.ActiveID())
+
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, "k2", kr.ActiveID())
+	t2, err := kr.GenTokenACL(acl, "doc", time.Hour)
+	assert.NoError(t, err)
+
+	for _, token := range []string{t1, t2} {
+		r, w, _, _, err := kr.ParseTokenACL(token, "doc", "u1")
+		assert.NoError(t, err)
+		assert.True(t, r && w)
+	}
+	// токен нового ключа не расшифровывается старым ключом проекта
+	_, _, _, _, err = ParseTokenACL(t2, "doc", "u1", []byte("POIlhb123Y09olUi"))
+	assert.ErrorIs(t, err, ErrInvalidACLKey)
+
+	// перевыпуск токена выводимого ключа
+	t3, err := kr.Reencrypt(t1)
+	assert.NoError(t, err)
+
+	// после окончания перекрытия токены старого ключа не принимаются, в том числе из кеша
+	now = now.Add(2 * time.Hour)
+	_, _, _, _, err = kr.ParseTokenACL(t1, "doc", "u1")
+	assert.ErrorIs(t, err, ErrInvalidACLKey)
+	_, _, _, _, err = kr.ParseTokenACL(t3, "doc", "u1")
+	assert.NoError(t, err)
+
+	kr.Remove("k2")
+	assert.Equal(t, "", kr.ActiveID())
+	_, err = kr.GenTokenACL(acl, "doc", time.Hour)
+	assert.Error(t, err)
+}
+
+func TestKeyringRotateConcurrent(t *testing.T) {
+	now := time.Now()
+	kr, _ := NewKeyring(KeyringKey{ID: "k0", Secret: "POIlhb123Y09olUi"})
+	// пауза расширяет окно между чтением активного ключа и добавлением нового
+	kr.now = func() time.Time {
+		time.Sleep(time.Millisecond)
+		return now
+	}
+
+	// каждая ротация выводит ключ, активный на момент ее вызова, - без вывода остается только последний
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, kr.Rotate(KeyringKey{ID: "k" + strconv.Itoa(i), Secret: "0123456789abcdef"}, time.Hour))
+		}(i)
+	}
+	wg.Wait()
+
+	unretired := 0
+	for _, k := range kr.keys {
+		if k.RetireAt.IsZero() {
+			unretired++
+			assert.Equal(t, k.ID, kr.ActiveID())
+		}
+	}
+	assert.Equal(t, 1, unretired)
+}
+
+func TestKeyringKeyID(t *testing.T) {
+	kr, err := NewKeyring(
+		KeyringKey{ID: "k1", Secret: "POIlhb123Y09olUi"},
+		KeyringKey{ID: "k2", Secret: "0123456789abcdef0123456789abcdef", ActivateAt: time.Now().Add(-time.Minute)},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "k2", kr.ActiveID())
+
+	token, err := kr.Encrypt(`{"a":1}`)
+	assert.NoError(t, err)
+	env, ok := parseEnvelope(mustDecodeToken(t, token))
+	assert.True(t, ok)
+	assert.Equal(t, "k2", env.keyID)
+
+	text, err := kr.Decrypt(token)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, text)
+
+	// ключ, которого нет в связке
+	other, _ := NewKeyring(KeyringKey{ID: "k3", Secret: "0123456789abcdef"})
+	token, _ = other.Encrypt(`{"a":1}`)
+	_, err = kr.Decrypt(token)
+	assert.ErrorIs(t, err, ErrUnknownKeyID)
+
+	// токены единственного ключа проекта (без ID ключа) принимаются ключами связки
+	legacy, _ := GenXServiceKey("project/service", []byte("POIlhb123Y09olUi"), time.Hour, "client")
+	valid, client := kr.CheckXServiceKey("project/service", legacy)
+	assert.True(t, valid)
+	assert.Equal(t, "client", client)
+
+	_, err = NewKeyring(KeyringKey{ID: "bad", Secret: "short"})
+	assert.Error(t, err)
+	_, err = NewKeyring(KeyringKey{ID: "k1", Secret: "POIlhb123Y09olUi"}, KeyringKey{ID: "k1", Secret: "0123456789abcdef"})
+	assert.Error(t, err)
+}
+
+func TestKeyringMiddleware(t *testing.T) {
+	kr, _ := NewKeyring(KeyringKey{ID: "k1", Secret: "POIlhb123Y09olUi"})
+	token, err := NewServiceKey().WithDomain("project/service").BuildKeyring(kr)
+	assert.NoError(t, err)
+
+	handler := MiddlewareXServiceKeyKeyring("project", "service", kr)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Service-Key", token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	kr.Remove("k1")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.NotEqual(t, http.StatusOK, rec.Code)
+}
+
+func TestNewKeyringFromConfig(t *testing.T) {
+	var cfg KeyringConfig
+	err := DecodeConfig(`
+[[ProjectKeys]]
+ID = "2026-01"
+Secret = "POIlhb123Y09olUi"
+RetireAt = 2099-01-01T00:00:00Z
+
+[[ProjectKeys]]
+ID = "2026-02"
+Secret = "0123456789abcdef"
+ActivateAt = 2099-01-01T00:00:00Z
+`, &cfg)
+	assert.NoError(t, err)
+
+	kr, err := NewKeyringFromConfig(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "2026-01", kr.ActiveID())
+	assert.Len(t, kr.accepted(), 2)
+
+	_, err = NewKeyringFromConfig(KeyringConfig{})
+	assert.ErrorIs(t, err, ErrNoActiveKey)
+}
+
+func mustDecodeToken(t *testing.T, token string) []byte {
+	t.Helper()
+
+	data, err := base64.URLEncoding.DecodeString(addBase64Padding(token))
+	assert.NoError(t, err)
+
+	return data
+}
+
+// ctxRevocationStore хранилище отзывов, которое учитывает отмену контекста вызова
+type ctxRevocationStore struct {
+	ACLRevocationStore
+}
+
+func (s ctxRevocationStore) RevokeToken(ctx context.Context, id string, expired int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.ACLRevocationStore.RevokeToken(ctx, id, expired)
+}
+
+func TestKeyringRevokeTokenACL(t *testing.T) {
+	kr, _ := NewKeyring(KeyringKey{ID: "k1", Secret: "POIlhb123Y09olUi"})
+	store := ctxRevocationStore{NewMemoryACLRevocationStore()}
+	acl := map[string]uint16{}
+	acl["u1"], _ = CreateACLValue(ACLPriorityUser, ACLPermissionAllow, ACLPermissionNull, ACLPermissionNull, ACLPermissionNull)
+	token, _ := kr.GenTokenACL(acl, "doc", time.Hour)
+
+	// контекст вызова передается в хранилище отзывов
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, kr.RevokeTokenACL(canceled, store, token), context.Canceled)
+	assert.NoError(t, kr.RevokeTokenACL(context.Background(), store, token))
+}
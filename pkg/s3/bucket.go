@@ -0,0 +1,449 @@
+package s3
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/graymeta/stow"
+	"github.com/pkg/errors"
+)
+
+// Versioning states of a bucket. VersioningOff means versioning was never enabled,
+// once enabled it can only be suspended.
+const (
+	VersioningOff       = ""
+	VersioningEnabled   = s3.BucketVersioningStatusEnabled
+	VersioningSuspended = s3.BucketVersioningStatusSuspended
+)
+
+// PolicyVersion is the current version of the policy language.
+const PolicyVersion = "2012-10-17"
+
+// BucketManager is implemented by locations which can configure buckets.
+// Setting empty rules (or a nil policy) removes the configuration.
+type BucketManager interface {
+	BucketCORS(bucket string) ([]CORSRule, error)
+	SetBucketCORS(bucket string, rules []CORSRule) error
+	BucketPolicy(bucket string) (*BucketPolicy, error)
+	SetBucketPolicy(bucket string, policy *BucketPolicy) error
+	BucketVersioning(bucket string) (string, error)
+	SetBucketVersioning(bucket string, enabled bool) error
+	BucketLifecycle(bucket string) ([]LifecycleRule, error)
+	SetBucketLifecycle(bucket string, rules []LifecycleRule) error
+}
+
+// CORSRule is a cross-origin access rule of a bucket.
+type CORSRule struct {
+	ID             string   `json:"id,omitempty"`
+	AllowedOrigins []string `json:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods"`
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	ExposeHeaders  []string `json:"expose_headers,omitempty"`
+	MaxAgeSeconds  int64    `json:"max_age_seconds,omitempty"`
+}
+
+// BucketPolicy is an access policy document of a bucket.
+type BucketPolicy struct {
+	Version   string            `json:"Version"`
+	ID        string            `json:"Id,omitempty"`
+	Statement []PolicyStatement `json:"Statement"`
+}
+
+// PolicyStatement is a single statement of a bucket policy.
+// Condition maps an operator (e.g. "IpAddress") to the condition keys and their values.
+type PolicyStatement struct {
+	Sid       string                             `json:"Sid,omitempty"`
+	Effect    string                             `json:"Effect"`
+	Principal *PolicyPrincipal                   `json:"Principal,omitempty"`
+	Action    PolicyValues                       `json:"Action"`
+	Resource  PolicyValues                       `json:"Resource"`
+	Condition map[string]map[string]PolicyValues `json:"Condition,omitempty"`
+}
+
+// PolicyPrincipal is the principal of a statement: anyone ("*") or the listed AWS accounts/users and services.
+type PolicyPrincipal struct {
+	Anyone  bool
+	AWS     PolicyValues
+	Service PolicyValues
+}
+
+// PolicyValues is a list of policy values which is also parsed from a single string.
+type PolicyValues []string
+
+// UnmarshalJSON accepts both "value" and ["value", ...].
+func (v *PolicyValues) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*v = PolicyValues{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.Wrap(err, "policy value must be a string or a list of strings")
+	}
+	*v = list
+
+	return nil
+}
+
+// MarshalJSON writes "*" for anyone, otherwise {"AWS": [...], "Service": [...]}.
+func (p PolicyPrincipal) MarshalJSON() ([]byte, error) {
+	if p.Anyone {
+		return json.Marshal("*")
+	}
+
+	m := map[string]PolicyValues{}
+	if len(p.AWS) > 0 {
+		m["AWS"] = p.AWS
+	}
+	if len(p.Service) > 0 {
+		m["Service"] = p.Service
+	}
+
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON accepts "*", {"AWS": "*"} and {"AWS": [...], "Service": [...]}.
+func (p *PolicyPrincipal) UnmarshalJSON(data []byte) error {
+	var anyone string
+	if err := json.Unmarshal(data, &anyone); err == nil {
+		if anyone != "*" {
+			return errors.Errorf("unsupported policy principal %q", anyone)
+		}
+		*p = PolicyPrincipal{Anyone: true}
+		return nil
+	}
+
+	var m map[string]PolicyValues
+	if err := json.Unmarshal(data, &m); err != nil {
+		return errors.Wrap(err, "parsing policy principal")
+	}
+	*p = PolicyPrincipal{AWS: m["AWS"], Service: m["Service"]}
+	if len(p.AWS) == 1 && p.AWS[0] == "*" && len(p.Service) == 0 {
+		*p = PolicyPrincipal{Anyone: true}
+	}
+
+	return nil
+}
+
+// LifecycleRule is a lifecycle rule of the objects with the Prefix (and all the Tags).
+// Zero days disable the corresponding action.
+type LifecycleRule struct {
+	ID                        string                `json:"id,omitempty"`
+	Enabled                   bool                  `json:"enabled"`
+	Prefix                    string                `json:"prefix,omitempty"`
+	Tags                      map[string]string     `json:"tags,omitempty"`
+	ExpirationDays            int64                 `json:"expiration_days,omitempty"`
+	NoncurrentExpirationDays  int64                 `json:"noncurrent_expiration_days,omitempty"`
+	AbortIncompleteUploadDays int64                 `json:"abort_incomplete_upload_days,omitempty"`
+	Transitions               []LifecycleTransition `json:"transitions,omitempty"`
+}
+
+// LifecycleTransition moves objects to the storage class after Days.
+type LifecycleTransition struct {
+	Days         int64  `json:"days"`
+	StorageClass string `json:"storage_class"`
+}
+
+// bucketError maps a missing bucket to stow.ErrNotFound. The error codes meaning
+// the configuration is not set (notSet) are not errors.
+func bucketError(err error, op string, notSet ...string) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		if aerr.Code() == s3.ErrCodeNoSuchBucket {
+			return stow.ErrNotFound
+		}
+		for _, code := range notSet {
+			if aerr.Code() == code {
+				return nil
+			}
+		}
+	}
+
+	return errors.Wrap(err, op)
+}
+
+// BucketCORS returns the CORS rules of the bucket, nil if not set.
+func (l *location) BucketCORS(bucket string) ([]CORSRule, error) {
+	res, err := l.client.GetBucketCors(&s3.GetBucketCorsInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		err = bucketError(err, "BucketCORS, getting the bucket cors", "NoSuchCORSConfiguration")
+		return nil, err
+	}
+
+	var rules []CORSRule
+	for _, r := range res.CORSRules {
+		rules = append(rules, CORSRule{
+			ID:             aws.StringValue(r.ID),
+			AllowedOrigins: aws.StringValueSlice(r.AllowedOrigins),
+			AllowedMethods: aws.StringValueSlice(r.AllowedMethods),
+			AllowedHeaders: aws.StringValueSlice(r.AllowedHeaders),
+			ExposeHeaders:  aws.StringValueSlice(r.ExposeHeaders),
+			MaxAgeSeconds:  aws.Int64Value(r.MaxAgeSeconds),
+		})
+	}
+
+	return rules, nil
+}
+
+// SetBucketCORS replaces the CORS rules of the bucket, empty rules remove them.
+func (l *location) SetBucketCORS(bucket string, rules []CORSRule) error {
+	if len(rules) == 0 {
+		_, err := l.client.DeleteBucketCors(&s3.DeleteBucketCorsInput{Bucket: aws.String(bucket)})
+		if err != nil {
+			err = bucketError(err, "SetBucketCORS, deleting the bucket cors")
+		}
+		return err
+	}
+
+	config := &s3.CORSConfiguration{}
+	for _, r := range rules {
+		if len(r.AllowedOrigins) == 0 || len(r.AllowedMethods) == 0 {
+			return errors.New("SetBucketCORS, allowed origins and methods are required")
+		}
+		rule := &s3.CORSRule{
+			AllowedOrigins: aws.StringSlice(r.AllowedOrigins),
+			AllowedMethods: aws.StringSlice(r.AllowedMethods),
+		}
+		if r.ID != "" {
+			rule.ID = aws.String(r.ID)
+		}
+		if len(r.AllowedHeaders) > 0 {
+			rule.AllowedHeaders = aws.StringSlice(r.AllowedHeaders)
+		}
+		if len(r.ExposeHeaders) > 0 {
+			rule.ExposeHeaders = aws.StringSlice(r.ExposeHeaders)
+		}
+		if r.MaxAgeSeconds > 0 {
+			rule.MaxAgeSeconds = aws.Int64(r.MaxAgeSeconds)
+		}
+		config.CORSRules = append(config.CORSRules, rule)
+	}
+
+	_, err := l.client.PutBucketCors(&s3.PutBucketCorsInput{
+		Bucket:            aws.String(bucket),
+		CORSConfiguration: config,
+	})
+	if err != nil {
+		err = bucketError(err, "SetBucketCORS, putting the bucket cors")
+	}
+
+	return err
+}
+
+// BucketPolicy returns the access policy of the bucket, nil if not set.
+func (l *location) BucketPolicy(bucket string) (*BucketPolicy, error) {
+	res, err := l.client.GetBucketPolicy(&s3.GetBucketPolicyInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		err = bucketError(err, "BucketPolicy, getting the bucket policy", "NoSuchBucketPolicy")
+		return nil, err
+	}
+
+	policy := &BucketPolicy{}
+	if err = json.Unmarshal([]byte(aws.StringValue(res.Policy)), policy); err != nil {
+		return nil, errors.Wrap(err, "BucketPolicy, parsing the bucket policy")
+	}
+
+	return policy, nil
+}
+
+// SetBucketPolicy replaces the access policy of the bucket, nil removes it.
+// Version defaults to PolicyVersion.
+func (l *location) SetBucketPolicy(bucket string, policy *BucketPolicy) error {
+	if policy == nil || len(policy.Statement) == 0 {
+		_, err := l.client.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{Bucket: aws.String(bucket)})
+		if err != nil {
+			err = bucketError(err, "SetBucketPolicy, deleting the bucket policy")
+		}
+		return err
+	}
+
+	p := *policy
+	if p.Version == "" {
+		p.Version = PolicyVersion
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "SetBucketPolicy, encoding the bucket policy")
+	}
+
+	_, err = l.client.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(bucket),
+		Policy: aws.String(string(data)),
+	})
+	if err != nil {
+		err = bucketError(err, "SetBucketPolicy, putting the bucket policy")
+	}
+
+	return err
+}
+
+// BucketVersioning returns the versioning state of the bucket (VersioningOff, VersioningEnabled, VersioningSuspended).
+func (l *location) BucketVersioning(bucket string) (string, error) {
+	res, err := l.client.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		err = bucketError(err, "BucketVersioning, getting the bucket versioning")
+		return VersioningOff, err
+	}
+
+	return aws.StringValue(res.Status), nil
+}
+
+// SetBucketVersioning enables or suspends versioning of the bucket.
+func (l *location) SetBucketVersioning(bucket string, enabled bool) error {
+	status := VersioningSuspended
+	if enabled {
+		status = VersioningEnabled
+	}
+
+	_, err := l.client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket:                  aws.String(bucket),
+		VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(status)},
+	})
+	if err != nil {
+		err = bucketError(err, "SetBucketVersioning, putting the bucket versioning")
+	}
+
+	return err
+}
+
+// BucketLifecycle returns the lifecycle rules of the bucket, nil if not set.
+func (l *location) BucketLifecycle(bucket string) ([]LifecycleRule, error) {
+	res, err := l.client.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		err = bucketError(err, "BucketLifecycle, getting the bucket lifecycle", "NoSuchLifecycleConfiguration")
+		return nil, err
+	}
+
+	var rules []LifecycleRule
+	for _, r := range res.Rules {
+		rule := LifecycleRule{
+			ID:      aws.StringValue(r.ID),
+			Enabled: aws.StringValue(r.Status) == s3.ExpirationStatusEnabled,
+			Prefix:  aws.StringValue(r.Prefix), // deprecated rule prefix, replaced by the filter
+		}
+
+		var tags []*s3.Tag
+		if f := r.Filter; f != nil {
+			if f.Prefix != nil {
+				rule.Prefix = *f.Prefix
+			}
+			if f.Tag != nil {
+				tags = append(tags, f.Tag)
+			}
+			if f.And != nil {
+				if f.And.Prefix != nil {
+					rule.Prefix = *f.And.Prefix
+				}
+				tags = append(tags, f.And.Tags...)
+			}
+		}
+		for _, tag := range tags {
+			if rule.Tags == nil {
+				rule.Tags = map[string]string{}
+			}
+			rule.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+
+		if r.Expiration != nil {
+			rule.ExpirationDays = aws.Int64Value(r.Expiration.Days)
+		}
+		if r.NoncurrentVersionExpiration != nil {
+			rule.NoncurrentExpirationDays = aws.Int64Value(r.NoncurrentVersionExpiration.NoncurrentDays)
+		}
+		if r.AbortIncompleteMultipartUpload != nil {
+			rule.AbortIncompleteUploadDays = aws.Int64Value(r.AbortIncompleteMultipartUpload.DaysAfterInitiation)
+		}
+		for _, t := range r.Transitions {
+			rule.Transitions = append(rule.Transitions, LifecycleTransition{
+				Days:         aws.Int64Value(t.Days),
+				StorageClass: aws.StringValue(t.StorageClass),
+			})
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// SetBucketLifecycle replaces the lifecycle rules of the bucket, empty rules remove them.
+func (l *location) SetBucketLifecycle(bucket string, rules []LifecycleRule) error {
+	if len(rules) == 0 {
+		_, err := l.client.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{Bucket: aws.String(bucket)})
+		if err != nil {
+			err = bucketError(err, "SetBucketLifecycle, deleting the bucket lifecycle")
+		}
+		return err
+	}
+
+	config := &s3.BucketLifecycleConfiguration{}
+	for _, r := range rules {
+		rule := &s3.LifecycleRule{
+			Status: aws.String(s3.ExpirationStatusDisabled),
+			Filter: lifecycleFilter(r.Prefix, r.Tags),
+		}
+		if r.Enabled {
+			rule.Status = aws.String(s3.ExpirationStatusEnabled)
+		}
+		if r.ID != "" {
+			rule.ID = aws.String(r.ID)
+		}
+		if r.ExpirationDays > 0 {
+			rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(r.ExpirationDays)}
+		}
+		if r.NoncurrentExpirationDays > 0 {
+			rule.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{NoncurrentDays: aws.Int64(r.NoncurrentExpirationDays)}
+		}
+		if r.AbortIncompleteUploadDays > 0 {
+			rule.AbortIncompleteMultipartUpload = &s3.AbortIncompleteMultipartUpload{DaysAfterInitiation: aws.Int64(r.AbortIncompleteUploadDays)}
+		}
+		for _, t := range r.Transitions {
+			rule.Transitions = append(rule.Transitions, &s3.Transition{
+				Days:         aws.Int64(t.Days),
+				StorageClass: aws.String(t.StorageClass),
+			})
+		}
+		config.Rules = append(config.Rules, rule)
+	}
+
+	_, err := l.client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(bucket),
+		LifecycleConfiguration: config,
+	})
+	if err != nil {
+		err = bucketError(err, "SetBucketLifecycle, putting the bucket lifecycle")
+	}
+
+	return err
+}
+
+// lifecycleFilter builds the rule filter: a prefix, a single tag or both combined with And.
+func lifecycleFilter(prefix string, tags map[string]string) *s3.LifecycleRuleFilter {
+	if len(tags) == 0 {
+		return &s3.LifecycleRuleFilter{Prefix: aws.String(prefix)}
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var s3tags []*s3.Tag
+	for _, key := range keys {
+		s3tags = append(s3tags, &s3.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	if prefix == "" && len(s3tags) == 1 {
+		return &s3.LifecycleRuleFilter{Tag: s3tags[0]}
+	}
+
+	and := &s3.LifecycleRuleAndOperator{Tags: s3tags}
+	if prefix != "" {
+		and.Prefix = aws.String(prefix)
+	}
+
+	return &s3.LifecycleRuleFilter{And: and}
+}
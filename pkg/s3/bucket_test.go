@@ -0,0 +1,156 @@
+package s3
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/graymeta/stow"
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3/s3test"
+)
+
+// bucketConfigServer connects to a fake server with the bucket "files".
+func bucketConfigServer(t *testing.T) *location {
+	t.Helper()
+
+	srv := s3test.NewServer(s3test.WithBuckets("files"))
+	t.Cleanup(srv.Close)
+
+	config := srv.Config()
+	client, endpoint, err := newS3Client(config, "")
+	assert.NoError(t, err)
+
+	return &location{config: config, client: client, customEndpoint: endpoint}
+}
+
+func TestBucketCORS(t *testing.T) {
+	l := bucketConfigServer(t)
+
+	rules, err := l.BucketCORS("files")
+	assert.NoError(t, err)
+	assert.Nil(t, rules)
+
+	want := []CORSRule{{
+		ID:             "web",
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"*"},
+		ExposeHeaders:  []string{"ETag"},
+		MaxAgeSeconds:  3600,
+	}}
+	assert.NoError(t, l.SetBucketCORS("files", want))
+	rules, err = l.BucketCORS("files")
+	assert.NoError(t, err)
+	assert.Equal(t, want, rules)
+
+	assert.NoError(t, l.SetBucketCORS("files", nil))
+	rules, err = l.BucketCORS("files")
+	assert.NoError(t, err)
+	assert.Nil(t, rules)
+
+	assert.Error(t, l.SetBucketCORS("files", []CORSRule{{AllowedMethods: []string{"GET"}}}))
+	_, err = l.BucketCORS("missing")
+	assert.ErrorIs(t, err, stow.ErrNotFound)
+}
+
+func TestBucketPolicy(t *testing.T) {
+	l := bucketConfigServer(t)
+
+	policy, err := l.BucketPolicy("files")
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+
+	want := &BucketPolicy{Statement: []PolicyStatement{{
+		Sid:       "PublicRead",
+		Effect:    "Allow",
+		Principal: &PolicyPrincipal{Anyone: true},
+		Action:    PolicyValues{"s3:GetObject"},
+		Resource:  PolicyValues{"arn:aws:s3:::files/public/*"},
+		Condition: map[string]map[string]PolicyValues{"IpAddress": {"aws:SourceIp": {"10.0.0.0/8"}}},
+	}}}
+	assert.NoError(t, l.SetBucketPolicy("files", want))
+	policy, err = l.BucketPolicy("files")
+	assert.NoError(t, err)
+	want.Version = PolicyVersion
+	assert.Equal(t, want, policy)
+
+	assert.NoError(t, l.SetBucketPolicy("files", nil))
+	policy, err = l.BucketPolicy("files")
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+}
+
+func TestPolicyJSON(t *testing.T) {
+	var policy BucketPolicy
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"Version": "2012-10-17",
+		"Statement": [
+			{"Effect": "Allow", "Principal": {"AWS": "arn:aws:iam::1:root"}, "Action": "s3:*", "Resource": ["arn:aws:s3:::files", "arn:aws:s3:::files/*"]},
+			{"Effect": "Deny", "Principal": {"AWS": ["*"]}, "Action": ["s3:DeleteObject"], "Resource": "arn:aws:s3:::files/*"}
+		]
+	}`), &policy))
+
+	assert.Equal(t, PolicyValues{"arn:aws:iam::1:root"}, policy.Statement[0].Principal.AWS)
+	assert.Equal(t, PolicyValues{"s3:*"}, policy.Statement[0].Action)
+	assert.Len(t, policy.Statement[0].Resource, 2)
+	assert.True(t, policy.Statement[1].Principal.Anyone)
+
+	data, err := json.Marshal(policy.Statement[1].Principal)
+	assert.NoError(t, err)
+	assert.Equal(t, `"*"`, string(data))
+}
+
+func TestBucketVersioning(t *testing.T) {
+	l := bucketConfigServer(t)
+
+	status, err := l.BucketVersioning("files")
+	assert.NoError(t, err)
+	assert.Equal(t, VersioningOff, status)
+
+	assert.NoError(t, l.SetBucketVersioning("files", true))
+	status, err = l.BucketVersioning("files")
+	assert.NoError(t, err)
+	assert.Equal(t, VersioningEnabled, status)
+
+	assert.NoError(t, l.SetBucketVersioning("files", false))
+	status, err = l.BucketVersioning("files")
+	assert.NoError(t, err)
+	assert.Equal(t, VersioningSuspended, status)
+}
+
+func TestBucketLifecycle(t *testing.T) {
+	l := bucketConfigServer(t)
+
+	want := []LifecycleRule{
+		{
+			ID:                        "tmp",
+			Enabled:                   true,
+			Prefix:                    "tmp/",
+			ExpirationDays:            7,
+			AbortIncompleteUploadDays: 1,
+		},
+		{
+			ID:                       "archive",
+			Enabled:                  true,
+			Prefix:                   "reports/",
+			Tags:                     map[string]string{"class": "cold", "team": "bi"},
+			NoncurrentExpirationDays: 30,
+			Transitions:              []LifecycleTransition{{Days: 30, StorageClass: "STANDARD_IA"}, {Days: 365, StorageClass: "GLACIER"}},
+		},
+		{
+			ID:             "drafts",
+			Tags:           map[string]string{"draft": "true"},
+			ExpirationDays: 1,
+		},
+	}
+	assert.NoError(t, l.SetBucketLifecycle("files", want))
+	rules, err := l.BucketLifecycle("files")
+	assert.NoError(t, err)
+	assert.Equal(t, want, rules)
+
+	assert.NoError(t, l.SetBucketLifecycle("files", nil))
+	rules, err = l.BucketLifecycle("files")
+	assert.NoError(t, err)
+	assert.Nil(t, rules)
+}
@@ -8,7 +8,6 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/graymeta/stow"
@@ -24,7 +23,13 @@ var (
 )
 
 const (
-	// ConfigAuthType is an optional argument that defines whether to use an IAM role or access key based auth
+	// ConfigAuthType is an optional argument that defines the source of credentials:
+	// "accesskey" (default) - ConfigAccessKeyID, ConfigSecretKey and optional ConfigToken,
+	// "iam" - the SDK default chain (environment, shared file, EC2/ECS role),
+	// "env" - AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN,
+	// "file" - shared credentials file (ConfigCredentialsFile, ConfigProfile),
+	// "provider" - a callback registered with RegisterCredentialsProvider (ConfigCredentialsProvider),
+	// "assume_role" - a role assumed via STS (ConfigRoleARN, ConfigSTSEndpoint...).
 	ConfigAuthType = "auth_type"
 
 	// ConfigAccessKeyID is one key of a pair of AWS credentials.
@@ -35,7 +40,7 @@ const (
 
 	// ConfigToken is an optional argument which is required when providing
 	// credentials with temporary access.
-	// ConfigToken = "token"
+	ConfigToken = "token"
 
 	// ConfigRegion represents the region/availability zone of the session.
 	ConfigRegion = "region"
@@ -58,49 +63,12 @@ const (
 
 func init() {
 	validatefn := func(config stow.Config) error {
-		authType, ok := config.Config(ConfigAuthType)
-		if !ok || authType == "" {
-			authType = authTypeAccessKey
-		}
-
-		if !(authType == authTypeAccessKey || authType == authTypeIAM) {
-			return errors.New("invalid auth_type")
-		}
-
-		if authType == authTypeAccessKey {
-			_, ok := config.Config(ConfigAccessKeyID)
-			if !ok {
-				return errors.New("missing Access Key ID")
-			}
-
-			_, ok = config.Config(ConfigSecretKey)
-			if !ok {
-				return errors.New("missing Secret Key")
-			}
-		}
-		return nil
+		return validateAuth(config)
 	}
 	makefn := func(config stow.Config) (stow.Location, error) {
 
-		authType, ok := config.Config(ConfigAuthType)
-		if !ok || authType == "" {
-			authType = authTypeAccessKey
-		}
-
-		if !(authType == authTypeAccessKey || authType == authTypeIAM) {
-			return nil, errors.New("invalid auth_type")
-		}
-
-		if authType == authTypeAccessKey {
-			_, ok := config.Config(ConfigAccessKeyID)
-			if !ok {
-				return nil, errors.New("missing Access Key ID")
-			}
-
-			_, ok = config.Config(ConfigSecretKey)
-			if !ok {
-				return nil, errors.New("missing Secret Key")
-			}
+		if err := validateAuth(config); err != nil {
+			return nil, err
 		}
 
 		// Create a new client (s3 session)
@@ -128,16 +96,8 @@ func init() {
 
 // Attempts to create a session based on the information given.
 func newS3Client(config stow.Config, region string) (client *s3.S3, endpoint string, err error) {
-	authType, _ := config.Config(ConfigAuthType)
-	accessKeyID, _ := config.Config(ConfigAccessKeyID)
-	secretKey, _ := config.Config(ConfigSecretKey)
-	//	token, _ := config.Config(ConfigToken)
 	caCert, _ := config.Config(ConfigCaCert)
 
-	if authType == "" {
-		authType = authTypeAccessKey
-	}
-
 	httpClient := http.DefaultClient
 
 	if caCert != "" {
@@ -150,7 +110,8 @@ func newS3Client(config stow.Config, region string) (client *s3.S3, endpoint str
 			},
 		}
 
-		httpClient.Transport = transport
+		// a separate client, http.DefaultClient is shared by the whole process
+		httpClient = &http.Client{Transport: transport}
 	}
 
 	awsConfig := aws.NewConfig().
@@ -169,8 +130,12 @@ func newS3Client(config stow.Config, region string) (client *s3.S3, endpoint str
 		awsConfig.WithRegion("us-east-1")
 	}
 
-	if authType == authTypeAccessKey {
-		awsConfig.WithCredentials(credentials.NewStaticCredentials(accessKeyID, secretKey, ""))
+	creds, err := newCredentials(config, httpClient, aws.StringValue(awsConfig.Region))
+	if err != nil {
+		return nil, "", err
+	}
+	if creds != nil {
+		awsConfig.WithCredentials(creds)
 	}
 
 	endpoint, ok := config.Config(ConfigEndpoint)
@@ -0,0 +1,28 @@
+package s3
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3/s3test"
+)
+
+func TestCACertClient(t *testing.T) {
+	// the SDK replaces the root CAs of the client (ca_cert) with the bundle
+	t.Setenv("AWS_CA_BUNDLE", "")
+	srv := s3test.NewServer(s3test.WithTLS())
+	defer srv.Close()
+
+	transport := http.DefaultClient.Transport
+	c := dialContainer(t, srv, nil)
+	_, err := c.Put("a.txt", strings.NewReader("a"), 1, nil)
+	assert.NoError(t, err)
+
+	// ca_cert applies to the location client only, http.DefaultClient is shared by the whole process
+	assert.Equal(t, transport, http.DefaultClient.Transport)
+	_, err = http.DefaultClient.Get(srv.URL)
+	assert.Error(t, err)
+}
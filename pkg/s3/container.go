@@ -6,6 +6,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/graymeta/stow"
@@ -21,6 +22,10 @@ type container struct {
 	// region describes the AWS Availability Zone of the S3 Bucket.
 	region         string
 	customEndpoint string
+	// options are the default encryption and storage class of written objects.
+	options PutOptions
+	// listArchived makes Items return archived objects.
+	listArchived bool
 }
 
 // ID returns a string value which represents the name of the container.
@@ -42,7 +47,15 @@ func (c *container) Item(id string) (stow.Item, error) {
 
 // Items sends a request to retrieve a list of items that are prepended with
 // the prefix argument. The 'cursor' variable facilitates pagination.
+// Archived objects are skipped unless ConfigListArchived is set, see ArchivedItems.
 func (c *container) Items(prefix, cursor string, count int) ([]stow.Item, string, error) {
+	return c.items(prefix, cursor, count, func(class string) bool {
+		return c.listArchived || !IsArchivedClass(class)
+	})
+}
+
+// items lists the objects whose storage class passes the filter.
+func (c *container) items(prefix, cursor string, count int, filter func(class string) bool) ([]stow.Item, string, error) {
 	itemLimit := int64(count)
 
 	params := &s3.ListObjectsV2Input{
@@ -60,37 +73,92 @@ func (c *container) Items(prefix, cursor string, count int) ([]stow.Item, string
 	var containerItems []stow.Item
 
 	for _, object := range response.Contents {
-		if *object.StorageClass == "GLACIER" {
+		// some s3-compatible storages do not return the storage class
+		if !filter(aws.StringValue(object.StorageClass)) {
 			continue
 		}
-		etag := cleanEtag(*object.ETag) // Copy etag value and remove the strings.
-		object.ETag = &etag             // Assign the value to the object field representing the item.
-
-		newItem := &item{
-			container: c,
-			client:    c.client,
-			properties: properties{
-				ETag:         object.ETag,
-				Key:          object.Key,
-				LastModified: object.LastModified,
-				Owner:        object.Owner,
-				Size:         object.Size,
-				StorageClass: object.StorageClass,
-			},
-		}
-		containerItems = append(containerItems, newItem)
+		containerItems = append(containerItems, c.listedItem(object))
 	}
 
 	// Create a marker and determine if the list of items to retrieve is complete.
-	// If not, the last file is the input to the value of after which item to start
+	// If not, the last listed key is the input to the value of after which item to start
+	// (the last object of the page may be filtered out).
 	startAfter := ""
-	if *response.IsTruncated {
-		startAfter = containerItems[len(containerItems)-1].Name()
+	if aws.BoolValue(response.IsTruncated) && len(response.Contents) > 0 {
+		startAfter = aws.StringValue(response.Contents[len(response.Contents)-1].Key)
 	}
 
 	return containerItems, startAfter, nil
 }
 
+// DirContainer is implemented by containers which can list a single level of the key hierarchy.
+type DirContainer interface {
+	ItemsDir(prefix, cursor string, count int) ([]stow.Item, []string, string, error)
+}
+
+// ItemsDir lists the objects directly under the prefix and the common prefixes ("subdirectories",
+// ending with "/") of the deeper objects, without descending into them. The prefix should be empty
+// or end with "/". The cursor is a continuation token: start with stow.CursorStart and pass the
+// returned value until it is empty. Archived objects are filtered as in Items.
+func (c *container) ItemsDir(prefix, cursor string, count int) ([]stow.Item, []string, string, error) {
+	itemLimit := int64(count)
+
+	params := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(c.Name()),
+		Delimiter: aws.String("/"),
+		MaxKeys:   &itemLimit,
+		Prefix:    &prefix,
+	}
+	if cursor != "" {
+		params.ContinuationToken = aws.String(cursor)
+	}
+
+	response, err := c.client.ListObjectsV2(params)
+	if err != nil {
+		return nil, nil, "", errors.Wrap(err, "ItemsDir, listing objects")
+	}
+
+	var containerItems []stow.Item
+	for _, object := range response.Contents {
+		if !c.listArchived && IsArchivedClass(aws.StringValue(object.StorageClass)) {
+			continue
+		}
+		containerItems = append(containerItems, c.listedItem(object))
+	}
+
+	var dirs []string
+	for _, commonPrefix := range response.CommonPrefixes {
+		dirs = append(dirs, aws.StringValue(commonPrefix.Prefix))
+	}
+
+	next := ""
+	if aws.BoolValue(response.IsTruncated) {
+		next = aws.StringValue(response.NextContinuationToken)
+	}
+
+	return containerItems, dirs, next, nil
+}
+
+// listedItem creates an item from an object of a listing.
+func (c *container) listedItem(object *s3.Object) *item {
+	etag := cleanEtag(aws.StringValue(object.ETag)) // Copy etag value and remove the strings.
+	object.ETag = &etag                             // Assign the value to the object field representing the item.
+
+	return &item{
+		container:      c,
+		client:         c.client,
+		sseCustomerKey: c.options.SSECustomerKey,
+		properties: properties{
+			ETag:         object.ETag,
+			Key:          object.Key,
+			LastModified: object.LastModified,
+			Owner:        object.Owner,
+			Size:         object.Size,
+			StorageClass: object.StorageClass,
+		},
+	}
+}
+
 func (c *container) RemoveItem(id string) error {
 	params := &s3.DeleteObjectInput{
 		Bucket: aws.String(c.Name()),
@@ -107,31 +175,42 @@ func (c *container) RemoveItem(id string) error {
 // Put sends a request to upload content to the container. The arguments
 // received are the name of the item (S3 Object), a reader representing the
 // content, and the size of the file. Many more attributes can be given to the
-// file, including metadata. Keeping it simple for now.
+// file, including metadata. The object is encrypted and stored with the bucket
+// settings (ConfigSSE, ConfigStorageClass...), see PutWithOptions to override them.
 func (c *container) Put(name string, r io.Reader, size int64, metadata map[string]interface{}) (stow.Item, error) {
+	return c.put(name, r, size, metadata, c.options)
+}
+
+func (c *container) put(name string, r io.Reader, size int64, metadata map[string]interface{}, opts PutOptions) (stow.Item, error) {
 	// Convert map[string]interface{} to map[string]*string
 	mdPrepped, err := prepMetadata(metadata)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to create or update item, preparing metadata")
 	}
 
-	uploader := s3manager.NewUploaderWithClient(c.client)
-	_, err = uploader.Upload(&s3manager.UploadInput{
+	input := &s3manager.UploadInput{
 		Bucket:   aws.String(c.name), // Required
 		Key:      aws.String(name),   // Required
 		Body:     r,
 		Metadata: mdPrepped, // map[string]*string
-	})
+	}
+	opts.applyUpload(input)
 
+	uploader := s3manager.NewUploaderWithClient(c.client)
+	_, err = uploader.Upload(input)
 	if err != nil {
 		return nil, errors.Wrap(err, "PutObject, putting object")
 	}
+
+	algorithm, key := sseCustomerKey(opts.SSECustomerKey)
 	i, err := c.client.HeadObject(&s3.HeadObjectInput{
-		Key:    aws.String(name),
-		Bucket: aws.String(c.name),
+		Key:                  aws.String(name),
+		Bucket:               aws.String(c.name),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       key,
 	})
 	var etag string
-	if i.ETag != nil && err == nil {
+	if err == nil && i.ETag != nil {
 		etag = cleanEtag(*i.ETag)
 	}
 
@@ -140,22 +219,103 @@ func (c *container) Put(name string, r io.Reader, size int64, metadata map[strin
 	// Keeping it simple for now.
 	// s3.Object info: https://github.com/aws/aws-sdk-go/blob/master/service/s3/api.go#L7092-L7107
 	// Response: https://github.com/aws/aws-sdk-go/blob/master/service/s3/api.go#L8193-L8227
+	var storageClass *string
+	if opts.StorageClass != "" {
+		storageClass = aws.String(opts.StorageClass)
+	}
 	newItem := &item{
-		container: c,
-		client:    c.client,
+		container:      c,
+		client:         c.client,
+		sseCustomerKey: opts.SSECustomerKey,
 		properties: properties{
-			ETag: &etag,
-			Key:  &name,
-			Size: &size,
+			ETag:         &etag,
+			Key:          &name,
+			Size:         &size,
+			StorageClass: storageClass,
 			//LastModified *time.Time
 			//Owner        *s3.Owner
-			//StorageClass *string
 		},
 	}
 
 	return newItem, nil
 }
 
+// ErrPreconditionFailed is returned by PutIf when the conditional headers of the
+// request are not satisfied (412 Precondition Failed or 409 ConditionalRequestConflict).
+var ErrPreconditionFailed = errors.New("s3: precondition failed")
+
+// PutCondition holds the conditional headers sent with PutIf.
+// IfMatch replaces the object only if its current ETag matches, IfNoneMatch("*")
+// creates the object only if it does not exist yet. Empty values are not sent.
+type PutCondition struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+// ConditionalPutter is implemented by containers which support conditional writes.
+type ConditionalPutter interface {
+	PutIf(name string, r io.ReadSeeker, size int64, metadata map[string]interface{}, cond PutCondition) (stow.Item, error)
+}
+
+// PutIf uploads the content in a single PutObject request with If-Match/If-None-Match headers.
+// Multipart uploads are not used since the conditions must be checked atomically.
+func (c *container) PutIf(name string, r io.ReadSeeker, size int64, metadata map[string]interface{}, cond PutCondition) (stow.Item, error) {
+	mdPrepped, err := prepMetadata(metadata)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create or update item, preparing metadata")
+	}
+
+	headers := map[string]string{}
+	if cond.IfMatch != "" {
+		headers["If-Match"] = quoteEtag(cond.IfMatch)
+	}
+	if cond.IfNoneMatch != "" {
+		headers["If-None-Match"] = quoteEtag(cond.IfNoneMatch)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(c.name),
+		Key:           aws.String(name),
+		Body:          r,
+		ContentLength: aws.Int64(size),
+		Metadata:      mdPrepped,
+	}
+	c.options.applyPut(input)
+
+	res, err := c.client.PutObjectWithContext(aws.BackgroundContext(), input, request.WithSetRequestHeaders(headers))
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && (aerr.StatusCode() == 412 || aerr.StatusCode() == 409) {
+			return nil, errors.Wrapf(ErrPreconditionFailed, "PutIf, putting object %s", name)
+		}
+		return nil, errors.Wrap(err, "PutIf, putting object")
+	}
+
+	var etag string
+	if res.ETag != nil {
+		etag = cleanEtag(*res.ETag)
+	}
+
+	return &item{
+		container:      c,
+		client:         c.client,
+		sseCustomerKey: c.options.SSECustomerKey,
+		properties: properties{
+			ETag: &etag,
+			Key:  &name,
+			Size: &size,
+		},
+	}, nil
+}
+
+// quoteEtag wraps an etag in quotation marks as required by conditional headers.
+func quoteEtag(etag string) string {
+	if etag == "*" {
+		return etag
+	}
+
+	return `"` + cleanEtag(etag) + `"`
+}
+
 // Region returns a string representing the region/availability zone of the container.
 func (c *container) Region() string {
 	return c.region
@@ -169,9 +329,17 @@ func (c *container) Region() string {
 // May be simpler to just stick it in PUT and and do a request every time, please vouch
 // for this if so.
 func (c *container) getItem(id string) (*item, error) {
+	return c.getItemWithKey(id, c.options.SSECustomerKey)
+}
+
+// getItemWithKey requests the item of an object encrypted with the SSE-C key (nil if not encrypted with SSE-C).
+func (c *container) getItemWithKey(id string, key []byte) (*item, error) {
+	algorithm, keyValue := sseCustomerKey(key)
 	params := &s3.HeadObjectInput{
-		Bucket: aws.String(c.name),
-		Key:    aws.String(id),
+		Bucket:               aws.String(c.name),
+		Key:                  aws.String(id),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       keyValue,
 	}
 
 	res, err := c.client.HeadObject(params)
@@ -190,8 +358,9 @@ func (c *container) getItem(id string) (*item, error) {
 	}
 
 	i := &item{
-		container: c,
-		client:    c.client,
+		container:      c,
+		client:         c.client,
+		sseCustomerKey: key,
 		properties: properties{
 			ETag:         &etag,
 			Key:          &id,
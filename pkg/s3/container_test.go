@@ -0,0 +1,225 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/graymeta/stow"
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3/s3test"
+)
+
+// dialContainer connects to the fake server bucket "files".
+func dialContainer(t *testing.T, srv *s3test.Server, config stow.ConfigMap) stow.Container {
+	t.Helper()
+
+	srv.CreateBucket("files")
+	if config == nil {
+		config = stow.ConfigMap{}
+	}
+	for key, value := range srv.Config() {
+		config[key] = value
+	}
+
+	loc, err := stow.Dial(Kind, config)
+	assert.NoError(t, err)
+	t.Cleanup(func() { loc.Close() })
+
+	c, err := loc.Container("files")
+	assert.NoError(t, err)
+
+	return c
+}
+
+func readItem(t *testing.T, i stow.Item) string {
+	t.Helper()
+
+	r, err := i.Open()
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+
+	return string(data)
+}
+
+func TestContainerItems(t *testing.T) {
+	for _, signing := range []string{"v4", "v2"} {
+		t.Run(signing, func(t *testing.T) {
+			srv := s3test.NewServer()
+			defer srv.Close()
+			c := dialContainer(t, srv, stow.ConfigMap{ConfigV2Signing: map[string]string{"v4": "false", "v2": "true"}[signing]})
+
+			for _, name := range []string{"docs/a.txt", "docs/b.txt", "docs/c d.txt", "img/logo.png"} {
+				_, err := c.Put(name, strings.NewReader("content of "+name), int64(len("content of "+name)), map[string]interface{}{"author": "ops"})
+				assert.NoError(t, err)
+			}
+
+			i, err := c.Item("docs/c d.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, "content of docs/c d.txt", readItem(t, i))
+			md, err := i.Metadata()
+			assert.NoError(t, err)
+			assert.Equal(t, "ops", md["author"])
+
+			r, err := i.(*item).OpenRange(11, 14)
+			assert.NoError(t, err)
+			data, _ := io.ReadAll(r)
+			r.Close()
+			assert.Equal(t, "docs", string(data))
+
+			var names []string
+			cursor := stow.CursorStart
+			for {
+				var items []stow.Item
+				items, cursor, err = c.Items("docs/", cursor, 2)
+				assert.NoError(t, err)
+				for _, i := range items {
+					names = append(names, i.Name())
+				}
+				if stow.IsCursorEnd(cursor) {
+					break
+				}
+			}
+			assert.Equal(t, []string{"docs/a.txt", "docs/b.txt", "docs/c d.txt"}, names)
+
+			assert.NoError(t, c.RemoveItem("docs/a.txt"))
+			_, err = c.Item("docs/a.txt")
+			assert.ErrorIs(t, err, stow.ErrNotFound)
+		})
+	}
+}
+
+func TestContainerItemsDir(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	c := dialContainer(t, srv, nil)
+
+	for _, name := range []string{"docs/a.txt", "docs/b.txt", "docs/img/logo.png", "docs/img/deep/x.png", "docs/sub/c.txt", "other.txt"} {
+		_, err := c.Put(name, strings.NewReader(name), int64(len(name)), nil)
+		assert.NoError(t, err)
+	}
+
+	var names, dirs []string
+	cursor := stow.CursorStart
+	for {
+		items, prefixes, next, err := c.(DirContainer).ItemsDir("docs/", cursor, 2)
+		assert.NoError(t, err)
+		for _, i := range items {
+			names = append(names, i.Name())
+		}
+		dirs = append(dirs, prefixes...)
+		if stow.IsCursorEnd(next) {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, []string{"docs/a.txt", "docs/b.txt"}, names)
+	assert.Equal(t, []string{"docs/img/", "docs/sub/"}, dirs)
+}
+
+func TestContainerTagsAndMultipart(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	c := dialContainer(t, srv, nil)
+
+	data := bytes.Repeat([]byte("x"), 11<<20)
+	i, err := c.Put("big.bin", bytes.NewReader(data), int64(len(data)), nil)
+	assert.NoError(t, err)
+	etag, _ := i.ETag()
+	assert.True(t, strings.HasSuffix(etag, "-3"), etag)
+	stored, _ := srv.Object("files", "big.bin")
+	assert.Equal(t, len(data), len(stored))
+
+	tags, err := i.(*item).Tags()
+	assert.NoError(t, err)
+	assert.Empty(t, tags)
+}
+
+func TestContainerPutIf(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	c := dialContainer(t, srv, nil).(ConditionalPutter)
+
+	i, err := c.PutIf("lock", strings.NewReader("1"), 1, nil, PutCondition{IfNoneMatch: "*"})
+	assert.NoError(t, err)
+	_, err = c.PutIf("lock", strings.NewReader("2"), 1, nil, PutCondition{IfNoneMatch: "*"})
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+
+	etag, _ := i.ETag()
+	_, err = c.PutIf("lock", strings.NewReader("3"), 1, nil, PutCondition{IfMatch: etag})
+	assert.NoError(t, err)
+	_, err = c.PutIf("lock", strings.NewReader("4"), 1, nil, PutCondition{IfMatch: etag})
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+
+	data, _ := srv.Object("files", "lock")
+	assert.Equal(t, "3", string(data))
+}
+
+func TestContainerSSECustomerKey(t *testing.T) {
+	// the SDK replaces the root CAs of the client (ca_cert) with the bundle
+	t.Setenv("AWS_CA_BUNDLE", "")
+	srv := s3test.NewServer(s3test.WithTLS())
+	defer srv.Close()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	c := dialContainer(t, srv, stow.ConfigMap{ConfigSSECustomerKey: base64.StdEncoding.EncodeToString(key)})
+
+	_, err := c.Put("secret.txt", strings.NewReader("secret"), 6, nil)
+	assert.NoError(t, err)
+	i, err := c.Item("secret.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", readItem(t, i))
+
+	other := make([]byte, 32)
+	rand.Read(other)
+	_, err = c.(KeyedContainer).ItemWithKey("secret.txt", other)
+	assert.Error(t, err)
+
+	_, err = c.(OptionsPutter).PutWithOptions("other.txt", strings.NewReader("other"), 5, nil, PutOptions{SSECustomerKey: other})
+	assert.NoError(t, err)
+	i, err = c.(KeyedContainer).ItemWithKey("other.txt", other)
+	assert.NoError(t, err)
+	assert.Equal(t, "other", readItem(t, i))
+}
+
+func TestContainerArchived(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	c := dialContainer(t, srv, nil)
+
+	_, err := c.(OptionsPutter).PutWithOptions("cold.txt", strings.NewReader("cold"), 4, nil, PutOptions{StorageClass: "GLACIER"})
+	assert.NoError(t, err)
+	_, err = c.Put("hot.txt", strings.NewReader("hot"), 3, nil)
+	assert.NoError(t, err)
+
+	items, _, err := c.Items("", stow.CursorStart, 10)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	items, _, err = c.(ArchiveContainer).ArchivedItems("", stow.CursorStart, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, items, 1) {
+		assert.True(t, items[0].(ArchivedItem).Archived())
+	}
+
+	i, err := c.Item("cold.txt")
+	assert.NoError(t, err)
+	_, err = i.Open()
+	assert.ErrorIs(t, err, ErrArchived)
+
+	assert.NoError(t, c.(ArchiveContainer).RestoreItem("cold.txt", 1, ""))
+	assert.NoError(t, c.(ArchiveContainer).RestoreItem("cold.txt", 2, ""))
+	ongoing, expiry, err := i.(ArchivedItem).RestoreStatus()
+	assert.NoError(t, err)
+	assert.False(t, ongoing)
+	assert.False(t, expiry.IsZero())
+	assert.Equal(t, "cold", readItem(t, i))
+}
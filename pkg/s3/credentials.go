@@ -0,0 +1,292 @@
+package s3
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/graymeta/stow"
+	"github.com/pkg/errors"
+)
+
+var (
+	authTypeEnv        = "env"
+	authTypeFile       = "file"
+	authTypeProvider   = "provider"
+	authTypeAssumeRole = "assume_role"
+)
+
+const (
+	// ConfigCredentialsFile is an optional path of the shared credentials file used with
+	// the "file" auth_type. The SDK default (~/.aws/credentials or AWS_SHARED_CREDENTIALS_FILE) is used if empty.
+	ConfigCredentialsFile = "credentials_file"
+
+	// ConfigProfile is an optional profile of the shared credentials file ("default" if empty).
+	ConfigProfile = "profile"
+
+	// ConfigCredentialsProvider is the name of a provider registered with RegisterCredentialsProvider,
+	// required by the "provider" auth_type.
+	ConfigCredentialsProvider = "credentials_provider"
+
+	// ConfigRoleARN is the ARN of the role assumed with the "assume_role" auth_type. The role is
+	// assumed with the access key (if set) or with the credentials of the environment.
+	ConfigRoleARN = "role_arn"
+
+	// ConfigRoleSessionName is an optional session name of the assumed role.
+	ConfigRoleSessionName = "role_session_name"
+
+	// ConfigRoleExternalID is an optional external ID required by the trust policy of the role.
+	ConfigRoleExternalID = "role_external_id"
+
+	// ConfigRoleDuration is an optional duration of the role session, e.g. "1h" (15m by default).
+	ConfigRoleDuration = "role_duration"
+
+	// ConfigSTSEndpoint is an optional STS endpoint used to assume the role,
+	// the regional AWS endpoint is used if empty.
+	ConfigSTSEndpoint = "sts_endpoint"
+)
+
+// credentialsExpiryWindow is how long before the expiration credentials are refreshed.
+const credentialsExpiryWindow = time.Minute
+
+// Credentials are returned by a CredentialsFunc. Token is the session token of temporary
+// credentials, Expires is the time they expire (zero if they never do).
+type Credentials struct {
+	AccessKeyID string
+	SecretKey   string
+	Token       string
+	Expires     time.Time
+}
+
+// CredentialsFunc returns the current credentials. It's called again when the returned
+// credentials are about to expire.
+type CredentialsFunc func() (Credentials, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]CredentialsFunc{}
+
+	// credentialsCache keeps the credentials of assumed roles and providers between connects,
+	// so they are retrieved again only before expiration.
+	credentialsMu    sync.Mutex
+	credentialsCache = map[string]*credentials.Credentials{}
+)
+
+// RegisterCredentialsProvider registers the credentials callback used by locations with
+// the "provider" auth_type and ConfigCredentialsProvider set to the name.
+// Registering a nil fn removes the provider.
+func RegisterCredentialsProvider(name string, fn CredentialsFunc) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	// the credentials of the replaced provider must not be used any more
+	credentialsMu.Lock()
+	for key := range credentialsCache {
+		if strings.HasPrefix(key, credentialsKey(authTypeProvider, name)) {
+			delete(credentialsCache, key)
+		}
+	}
+	credentialsMu.Unlock()
+
+	if fn == nil {
+		delete(providers, name)
+		return
+	}
+	providers[name] = fn
+}
+
+func credentialsProvider(name string) (CredentialsFunc, bool) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	fn, ok := providers[name]
+
+	return fn, ok
+}
+
+// funcProvider adapts a CredentialsFunc to the SDK credentials provider.
+type funcProvider struct {
+	credentials.Expiry
+	fn        CredentialsFunc
+	retrieved bool
+	expires   bool
+}
+
+func (p *funcProvider) Retrieve() (credentials.Value, error) {
+	c, err := p.fn()
+	if err != nil {
+		return credentials.Value{}, errors.Wrap(err, "retrieving credentials from provider")
+	}
+	if c.AccessKeyID == "" || c.SecretKey == "" {
+		return credentials.Value{}, errors.New("credentials provider returned empty credentials")
+	}
+
+	p.retrieved = true
+	p.expires = !c.Expires.IsZero()
+	if p.expires {
+		p.SetExpiration(c.Expires, credentialsExpiryWindow)
+	}
+
+	return credentials.Value{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretKey,
+		SessionToken:    c.Token,
+		ProviderName:    "CredentialsFunc",
+	}, nil
+}
+
+// IsExpired reports credentials without expiration as valid once they are retrieved.
+func (p *funcProvider) IsExpired() bool {
+	if !p.retrieved {
+		return true
+	}
+
+	return p.expires && p.Expiry.IsExpired()
+}
+
+// validateAuth checks the auth_type and the config values it requires.
+func validateAuth(config stow.Config) error {
+	authType, ok := config.Config(ConfigAuthType)
+	if !ok || authType == "" {
+		authType = authTypeAccessKey
+	}
+
+	switch authType {
+	case authTypeAccessKey:
+		if _, ok := config.Config(ConfigAccessKeyID); !ok {
+			return errors.New("missing Access Key ID")
+		}
+		if _, ok := config.Config(ConfigSecretKey); !ok {
+			return errors.New("missing Secret Key")
+		}
+	case authTypeIAM, authTypeEnv, authTypeFile:
+	case authTypeProvider:
+		name, _ := config.Config(ConfigCredentialsProvider)
+		if _, ok := credentialsProvider(name); !ok {
+			return errors.Errorf("credentials provider %q is not registered", name)
+		}
+	case authTypeAssumeRole:
+		if arn, _ := config.Config(ConfigRoleARN); arn == "" {
+			return errors.New("missing Role ARN")
+		}
+		if duration, ok := config.Config(ConfigRoleDuration); ok && duration != "" {
+			if _, err := time.ParseDuration(duration); err != nil {
+				return errors.Wrap(err, "invalid role_duration")
+			}
+		}
+	default:
+		return errors.New("invalid auth_type")
+	}
+
+	return nil
+}
+
+// credentialsKey joins the config values the credentials are built from.
+func credentialsKey(values ...string) string {
+	return strings.Join(values, "\x00") + "\x00"
+}
+
+// cachedCredentials returns the credentials cached for the key or builds them with fn.
+func cachedCredentials(key string, fn func() (*credentials.Credentials, error)) (*credentials.Credentials, error) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+
+	if creds, ok := credentialsCache[key]; ok {
+		return creds, nil
+	}
+	creds, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	credentialsCache[key] = creds
+
+	return creds, nil
+}
+
+// newCredentials returns the credentials of the auth_type, nil for "iam" (the SDK default chain:
+// environment, shared file, EC2/ECS role). Credentials of assumed roles and providers are built
+// once per config and shared by its connects.
+func newCredentials(config stow.Config, httpClient *http.Client, region string) (*credentials.Credentials, error) {
+	authType, _ := config.Config(ConfigAuthType)
+	accessKeyID, _ := config.Config(ConfigAccessKeyID)
+	secretKey, _ := config.Config(ConfigSecretKey)
+	token, _ := config.Config(ConfigToken)
+
+	switch authType {
+	case "", authTypeAccessKey:
+		return credentials.NewStaticCredentials(accessKeyID, secretKey, token), nil
+	case authTypeEnv:
+		return credentials.NewEnvCredentials(), nil
+	case authTypeFile:
+		filename, _ := config.Config(ConfigCredentialsFile)
+		profile, _ := config.Config(ConfigProfile)
+		return credentials.NewSharedCredentials(filename, profile), nil
+	case authTypeProvider:
+		name, _ := config.Config(ConfigCredentialsProvider)
+		fn, ok := credentialsProvider(name)
+		if !ok {
+			return nil, errors.Errorf("credentials provider %q is not registered", name)
+		}
+		return cachedCredentials(credentialsKey(authTypeProvider, name), func() (*credentials.Credentials, error) {
+			return credentials.NewCredentials(&funcProvider{fn: fn}), nil
+		})
+	case authTypeAssumeRole:
+		key := credentialsKey(authTypeAssumeRole, region, accessKeyID, secretKey, token)
+		for _, name := range []string{ConfigRoleARN, ConfigRoleSessionName, ConfigRoleExternalID, ConfigRoleDuration, ConfigSTSEndpoint, ConfigCaCert} {
+			value, _ := config.Config(name)
+			key += credentialsKey(value)
+		}
+		return cachedCredentials(key, func() (*credentials.Credentials, error) {
+			return assumeRoleCredentials(config, httpClient, region)
+		})
+	}
+
+	return nil, nil
+}
+
+// assumeRoleCredentials returns credentials of the role assumed via STS, they are refreshed
+// before the role session expires.
+func assumeRoleCredentials(config stow.Config, httpClient *http.Client, region string) (*credentials.Credentials, error) {
+	roleARN, _ := config.Config(ConfigRoleARN)
+	sessionName, _ := config.Config(ConfigRoleSessionName)
+	externalID, _ := config.Config(ConfigRoleExternalID)
+	duration, _ := config.Config(ConfigRoleDuration)
+	endpoint, _ := config.Config(ConfigSTSEndpoint)
+	accessKeyID, _ := config.Config(ConfigAccessKeyID)
+	secretKey, _ := config.Config(ConfigSecretKey)
+	token, _ := config.Config(ConfigToken)
+
+	stsConfig := aws.NewConfig().
+		WithHTTPClient(httpClient).
+		WithRegion(region)
+	if endpoint != "" {
+		stsConfig.WithEndpoint(endpoint)
+	}
+	if accessKeyID != "" {
+		stsConfig.WithCredentials(credentials.NewStaticCredentials(accessKeyID, secretKey, token))
+	}
+
+	sess, err := session.NewSession(stsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating the STS session")
+	}
+
+	return stscreds.NewCredentialsWithClient(sts.New(sess), roleARN, func(p *stscreds.AssumeRoleProvider) {
+		if sessionName != "" {
+			p.RoleSessionName = sessionName
+		}
+		if externalID != "" {
+			p.ExternalID = aws.String(externalID)
+		}
+		if d, err := time.ParseDuration(duration); err == nil && d > 0 {
+			p.Duration = d
+		}
+		p.ExpiryWindow = credentialsExpiryWindow
+	}), nil
+}
@@ -0,0 +1,218 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/graymeta/stow"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSTS answers AssumeRole with session credentials numbered by request.
+func fakeSTS(t *testing.T) (*httptest.Server, *[]http.Request) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		mu.Lock()
+		requests = append(requests, *r)
+		n := len(requests)
+		mu.Unlock()
+
+		if r.Form.Get("Action") != "AssumeRole" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIAROLE%d</AccessKeyId>
+      <SecretAccessKey>role-secret</SecretAccessKey>
+      <SessionToken>role-token-%d</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>%s/session</Arn>
+      <AssumedRoleId>AROA:session</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+  <ResponseMetadata><RequestId>%d</RequestId></ResponseMetadata>
+</AssumeRoleResponse>`, n, n, time.Now().Add(time.Hour).UTC().Format(time.RFC3339), r.Form.Get("RoleArn"), n)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
+
+// fakeS3 records the access key and session token each request is signed with.
+func fakeS3(t *testing.T) (*httptest.Server, func() (key, token string)) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var key, token string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		auth := r.Header.Get("Authorization")
+		if i := strings.Index(auth, "Credential="); i >= 0 {
+			key = strings.SplitN(auth[i+len("Credential="):], "/", 2)[0]
+		}
+		token = r.Header.Get("X-Amz-Security-Token")
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<ListAllMyBucketsResult><Buckets></Buckets></ListAllMyBucketsResult>`)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() (string, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return key, token
+	}
+}
+
+func listBuckets(t *testing.T, config stow.ConfigMap) error {
+	t.Helper()
+
+	client, _, err := newS3Client(config, "")
+	if err != nil {
+		return err
+	}
+	_, err = client.ListBuckets(nil)
+
+	return err
+}
+
+func TestSessionToken(t *testing.T) {
+	s3srv, signed := fakeS3(t)
+
+	assert.NoError(t, listBuckets(t, stow.ConfigMap{
+		ConfigEndpoint:    s3srv.URL,
+		ConfigAccessKeyID: "ASIATEMP",
+		ConfigSecretKey:   "secret",
+		ConfigToken:       "session-token",
+	}))
+	key, token := signed()
+	assert.Equal(t, "ASIATEMP", key)
+	assert.Equal(t, "session-token", token)
+}
+
+func TestAssumeRole(t *testing.T) {
+	s3srv, signed := fakeS3(t)
+	stssrv, requests := fakeSTS(t)
+
+	config := stow.ConfigMap{
+		ConfigEndpoint:        s3srv.URL,
+		ConfigAuthType:        authTypeAssumeRole,
+		ConfigAccessKeyID:     "AKIABASE",
+		ConfigSecretKey:       "base-secret",
+		ConfigRoleARN:         "arn:aws:iam::123456789012:role/storage",
+		ConfigRoleSessionName: "lib-test",
+		ConfigRoleExternalID:  "ext-1",
+		ConfigRoleDuration:    "30m",
+		ConfigSTSEndpoint:     stssrv.URL,
+	}
+	assert.NoError(t, validateAuth(config))
+	assert.NoError(t, listBuckets(t, config))
+
+	assert.Len(t, *requests, 1)
+	req := (*requests)[0]
+	assert.Equal(t, "arn:aws:iam::123456789012:role/storage", req.Form.Get("RoleArn"))
+	assert.Equal(t, "lib-test", req.Form.Get("RoleSessionName"))
+	assert.Equal(t, "ext-1", req.Form.Get("ExternalId"))
+	assert.Equal(t, "1800", req.Form.Get("DurationSeconds"))
+	assert.Contains(t, req.Header.Get("Authorization"), "Credential=AKIABASE/")
+
+	key, token := signed()
+	assert.Equal(t, "ASIAROLE1", key)
+	assert.Equal(t, "role-token-1", token)
+
+	// the next connect reuses the assumed role until it expires
+	assert.NoError(t, listBuckets(t, config))
+	assert.Len(t, *requests, 1)
+
+	delete(config, ConfigRoleARN)
+	assert.Error(t, validateAuth(config))
+}
+
+func TestCredentialsProvider(t *testing.T) {
+	s3srv, signed := fakeS3(t)
+
+	calls := 0
+	RegisterCredentialsProvider("vault", func() (Credentials, error) {
+		calls++
+		return Credentials{
+			AccessKeyID: fmt.Sprintf("ASIAVAULT%d", calls),
+			SecretKey:   "secret",
+			Token:       "vault-token",
+			// expires within the refresh window, so it is retrieved again for every request
+			Expires: time.Now().Add(credentialsExpiryWindow / 2),
+		}, nil
+	})
+	defer RegisterCredentialsProvider("vault", nil)
+
+	config := stow.ConfigMap{
+		ConfigEndpoint:            s3srv.URL,
+		ConfigAuthType:            authTypeProvider,
+		ConfigCredentialsProvider: "vault",
+	}
+	client, _, err := newS3Client(config, "")
+	assert.NoError(t, err)
+
+	_, err = client.ListBuckets(nil)
+	assert.NoError(t, err)
+	_, err = client.ListBuckets(nil)
+	assert.NoError(t, err)
+
+	key, token := signed()
+	assert.Equal(t, "ASIAVAULT2", key)
+	assert.Equal(t, "vault-token", token)
+
+	// the replaced provider is used by the next connect
+	RegisterCredentialsProvider("vault", func() (Credentials, error) {
+		return Credentials{AccessKeyID: "ASIAOTHER", SecretKey: "secret"}, nil
+	})
+	assert.NoError(t, listBuckets(t, config))
+	key, _ = signed()
+	assert.Equal(t, "ASIAOTHER", key)
+
+	assert.Error(t, validateAuth(stow.ConfigMap{ConfigAuthType: authTypeProvider, ConfigCredentialsProvider: "unknown"}))
+}
+
+func TestFileAndEnvCredentials(t *testing.T) {
+	s3srv, signed := fakeS3(t)
+
+	file := filepath.Join(t.TempDir(), "credentials")
+	assert.NoError(t, os.WriteFile(file, []byte("[storage]\naws_access_key_id = AKIAFILE\naws_secret_access_key = secret\naws_session_token = file-token\n"), 0600))
+
+	assert.NoError(t, listBuckets(t, stow.ConfigMap{
+		ConfigEndpoint:        s3srv.URL,
+		ConfigAuthType:        authTypeFile,
+		ConfigCredentialsFile: file,
+		ConfigProfile:         "storage",
+	}))
+	key, token := signed()
+	assert.Equal(t, "AKIAFILE", key)
+	assert.Equal(t, "file-token", token)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "env-token")
+	assert.NoError(t, listBuckets(t, stow.ConfigMap{
+		ConfigEndpoint: s3srv.URL,
+		ConfigAuthType: authTypeEnv,
+	}))
+	key, token = signed()
+	assert.Equal(t, "AKIAENV", key)
+	assert.Equal(t, "env-token", token)
+}
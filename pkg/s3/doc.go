@@ -28,7 +28,12 @@ There are s3.container methods which can retrieve an S3 Bucket's:
 Additional s3.container methods give Stow the ability to:
 
 - remove an S3 Bucket (RemoveItem)
-- update or create an S3 Object (Put)
+- update or create an S3 Object (Put, PutWithOptions with encryption and storage class)
+- list and restore archived Objects (ArchivedItems, RestoreItem)
+
+Encryption
+
+Server-side encryption and the storage class of written Objects are set with s3.ConfigSSE, s3.ConfigSSEKMSKeyID, s3.ConfigSSECustomerKey and s3.ConfigStorageClass for all Buckets of the Location, or for a single Bucket with the ".<bucket>" key suffix. The SSE-C key is sent with reads as well.
 
 Item
 
@@ -28,11 +28,13 @@ type item struct {
 	client *s3.S3
 	// properties represent the characteristics of the file. Name, Etag, etc.
 	properties properties
-	infoOnce   sync.Once
-	infoErr    error
-	tags       map[string]interface{}
-	tagsOnce   sync.Once
-	tagsErr    error
+	// sseCustomerKey is the SSE-C key sent with reads of the object, nil if not encrypted with SSE-C.
+	sseCustomerKey []byte
+	infoOnce       sync.Once
+	infoErr        error
+	tags           map[string]interface{}
+	tagsOnce       sync.Once
+	tagsErr        error
 }
 
 type properties struct {
@@ -87,10 +89,11 @@ func (i *item) Open() (io.ReadCloser, error) {
 		Bucket: aws.String(i.container.Name()),
 		Key:    aws.String(i.ID()),
 	}
+	params.SSECustomerAlgorithm, params.SSECustomerKey = sseCustomerKey(i.sseCustomerKey)
 
 	response, err := i.client.GetObject(params)
 	if err != nil {
-		return nil, errors.Wrap(err, "Open, getting the object")
+		return nil, archivedError(err, "Open")
 	}
 	return response.Body, nil
 }
@@ -151,7 +154,7 @@ func (i *item) ensureInfo() error {
 }
 
 func (i *item) getInfo() (stow.Item, error) {
-	itemInfo, err := i.container.getItem(i.ID())
+	itemInfo, err := i.container.getItemWithKey(i.ID(), i.sseCustomerKey)
 	if err != nil {
 		return nil, err
 	}
@@ -193,10 +196,11 @@ func (i *item) OpenRange(start, end uint64) (io.ReadCloser, error) {
 		Key:    aws.String(i.ID()),
 		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
 	}
+	params.SSECustomerAlgorithm, params.SSECustomerKey = sseCustomerKey(i.sseCustomerKey)
 
 	response, err := i.client.GetObject(params)
 	if err != nil {
-		return nil, errors.Wrap(err, "Open, getting the object")
+		return nil, archivedError(err, "OpenRange")
 	}
 	return response.Body, nil
 }
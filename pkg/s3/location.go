@@ -36,14 +36,7 @@ func (l *location) CreateContainer(containerName string) (stow.Container, error)
 
 	region, _ := l.config.Config("region")
 
-	newContainer := &container{
-		name:           containerName,
-		client:         l.client,
-		region:         region,
-		customEndpoint: l.customEndpoint,
-	}
-
-	return newContainer, nil
+	return l.newContainer(containerName, l.client, region)
 }
 
 // Containers returns a slice of the Container interface, a cursor, and an error.
@@ -124,11 +117,9 @@ func (l *location) Containers(prefix, cursor string, count int) ([]stow.Containe
 			}
 		}
 
-		newContainer := &container{
-			name:           *(bucket.Name),
-			client:         client,
-			region:         bucketRegion,
-			customEndpoint: l.customEndpoint,
+		newContainer, err := l.newContainer(*(bucket.Name), client, bucketRegion)
+		if err != nil {
+			return nil, "", err
 		}
 
 		containers = append(containers, newContainer)
@@ -163,11 +154,9 @@ func (l *location) Container(id string) (stow.Container, error) {
 		}
 	}
 
-	c := &container{
-		name:           id,
-		client:         client,
-		region:         bucketRegion,
-		customEndpoint: l.customEndpoint,
+	c, err := l.newContainer(id, client, bucketRegion)
+	if err != nil {
+		return nil, err
 	}
 
 	if bucketRegionSet || bucketRegion != "" {
@@ -178,7 +167,7 @@ func (l *location) Container(id string) (stow.Container, error) {
 		Bucket: aws.String(id),
 	}
 
-	_, err := client.GetBucketLocation(params)
+	_, err = client.GetBucketLocation(params)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchBucket" {
 			return nil, stow.ErrNotFound
@@ -0,0 +1,278 @@
+package s3test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	v4Algorithm      = "AWS4-HMAC-SHA256"
+	v4TimeFormat     = "20060102T150405Z"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	v2AuthPrefix     = "AWS "
+	v4AuthPrefix     = v4Algorithm + " "
+	securityTokenKey = "X-Amz-Security-Token"
+)
+
+// v2SignedParams are the sub-resources included in the V2 string to sign
+// (the same list the pkg/s3 V2 signer uses).
+var v2SignedParams = map[string]bool{
+	"acl": true, "location": true, "logging": true, "notification": true, "partNumber": true,
+	"policy": true, "requestPayment": true, "torrent": true, "uploadId": true, "uploads": true,
+	"versionId": true, "versioning": true, "versions": true, "response-content-type": true,
+	"response-content-language": true, "response-expires": true, "response-cache-control": true,
+	"response-content-disposition": true, "response-content-encoding": true, "website": true, "delete": true,
+}
+
+func errAccessDenied(format string, args ...interface{}) *s3Error {
+	return newError(http.StatusForbidden, "AccessDenied", format, args...)
+}
+
+func errSignature() *s3Error {
+	return newError(http.StatusForbidden, "SignatureDoesNotMatch",
+		"The request signature we calculated does not match the signature you provided")
+}
+
+// authenticate verifies the V4 (header or presigned) or V2 signature of the request.
+func (s *Server) authenticate(r *http.Request, body []byte) *s3Error {
+	if s.noAuth {
+		return nil
+	}
+
+	auth := r.Header.Get("Authorization")
+	query := r.URL.Query()
+	switch {
+	case strings.HasPrefix(auth, v4AuthPrefix):
+		return s.verifyV4(r, body, parseV4Header(strings.TrimPrefix(auth, v4AuthPrefix)), false)
+	case query.Get("X-Amz-Algorithm") == v4Algorithm:
+		return s.verifyV4(r, body, map[string]string{
+			"Credential":    query.Get("X-Amz-Credential"),
+			"SignedHeaders": query.Get("X-Amz-SignedHeaders"),
+			"Signature":     query.Get("X-Amz-Signature"),
+		}, true)
+	case strings.HasPrefix(auth, v2AuthPrefix):
+		return s.verifyV2(r, strings.TrimPrefix(auth, v2AuthPrefix))
+	case auth == "" && s.anonymousRead && (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		strings.Count(strings.Trim(r.URL.Path, "/"), "/") > 0:
+		return nil
+	case auth == "":
+		return errAccessDenied("Anonymous access is denied")
+	}
+
+	return newError(http.StatusBadRequest, "InvalidArgument", "Unsupported Authorization Type")
+}
+
+func (s *Server) checkToken(token string) *s3Error {
+	if s.sessionToken != "" && token != s.sessionToken {
+		return newError(http.StatusForbidden, "InvalidToken", "The provided token is malformed or otherwise invalid")
+	}
+
+	return nil
+}
+
+// parseV4Header parses "Credential=..., SignedHeaders=..., Signature=...".
+func parseV4Header(auth string) map[string]string {
+	fields := map[string]string{}
+	for _, part := range strings.Split(auth, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			fields[name] = value
+		}
+	}
+
+	return fields
+}
+
+func (s *Server) verifyV4(r *http.Request, body []byte, fields map[string]string, presigned bool) *s3Error {
+	// Credential=AKID/20060102/region/s3/aws4_request
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[4] != "aws4_request" {
+		return newError(http.StatusBadRequest, "AuthorizationHeaderMalformed", "Invalid credential %q", fields["Credential"])
+	}
+	if credential[0] != s.AccessKeyID {
+		return newError(http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records")
+	}
+
+	query := r.URL.Query()
+	amzDate, token, payloadHash := r.Header.Get("X-Amz-Date"), r.Header.Get(securityTokenKey), r.Header.Get("X-Amz-Content-Sha256")
+	if presigned {
+		amzDate, token = query.Get("X-Amz-Date"), query.Get(securityTokenKey)
+		if hash := query.Get("X-Amz-Content-Sha256"); hash != "" {
+			payloadHash = hash
+		}
+		if payloadHash == "" {
+			payloadHash = unsignedPayload
+		}
+
+		signed, err := time.Parse(v4TimeFormat, amzDate)
+		expires, _ := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || time.Now().After(signed.Add(time.Duration(expires)*time.Second)) {
+			return errAccessDenied("Request has expired")
+		}
+		query.Del("X-Amz-Signature")
+	}
+	if aerr := s.checkToken(token); aerr != nil {
+		return aerr
+	}
+
+	switch payloadHash {
+	case "":
+		return newError(http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256")
+	case unsignedPayload:
+	default:
+		sum := sha256.Sum256(body)
+		if payloadHash != hex.EncodeToString(sum[:]) {
+			return newError(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed")
+		}
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	headers := make([]string, len(signedHeaders))
+	for i, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			values := r.Header.Values(name)
+			for j := range values {
+				values[j] = strings.TrimSpace(values[j])
+			}
+			value = strings.Join(values, ",")
+		}
+		headers[i] = name + ":" + collapseSpaces(value)
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		requestPath(r),
+		strings.ReplaceAll(query.Encode(), "+", "%20"),
+		strings.Join(headers, "\n") + "\n",
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{
+		v4Algorithm,
+		amzDate,
+		strings.Join(credential[1:], "/"),
+		hex.EncodeToString(canonicalSum[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), credential[1])
+	for _, part := range credential[2:] {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(fields["Signature"])) != 1 {
+		return errSignature()
+	}
+
+	return nil
+}
+
+func (s *Server) verifyV2(r *http.Request, auth string) *s3Error {
+	accessKey, signature, ok := strings.Cut(auth, ":")
+	if !ok {
+		return newError(http.StatusBadRequest, "InvalidArgument", "Invalid Authorization header")
+	}
+	if accessKey != s.AccessKeyID {
+		return newError(http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records")
+	}
+	if aerr := s.checkToken(r.Header.Get(securityTokenKey)); aerr != nil {
+		return aerr
+	}
+
+	var amzHeaders []string
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			amzHeaders = append(amzHeaders, name+":"+strings.Join(values, ","))
+		}
+	}
+	sort.Strings(amzHeaders)
+	amz := ""
+	if len(amzHeaders) > 0 {
+		amz = strings.Join(amzHeaders, "\n") + "\n"
+	}
+
+	date := r.Header.Get("Date")
+	if r.Header.Get("X-Amz-Date") != "" {
+		date = ""
+	}
+
+	var params []string
+	for name, values := range r.URL.Query() {
+		if !v2SignedParams[name] {
+			continue
+		}
+		for _, value := range values {
+			if value == "" {
+				params = append(params, name)
+			} else {
+				params = append(params, name+"="+value)
+			}
+		}
+	}
+	resource := requestPath(r)
+	if len(params) > 0 {
+		sort.Strings(params)
+		resource += "?" + strings.Join(params, "&")
+	}
+
+	stringToSign := strings.Join([]string{
+		r.Method,
+		r.Header.Get("Content-Md5"),
+		r.Header.Get("Content-Type"),
+		date,
+		amz + resource,
+	}, "\n")
+	mac := hmac.New(sha1.New, []byte(s.SecretKey))
+	mac.Write([]byte(stringToSign))
+	if subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(mac.Sum(nil))), []byte(signature)) != 1 {
+		return errSignature()
+	}
+
+	return nil
+}
+
+// requestPath returns the escaped path as it was sent by the client.
+func requestPath(r *http.Request) string {
+	uri := r.RequestURI
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	if u, err := url.Parse(uri); err == nil && u.IsAbs() {
+		return u.EscapedPath()
+	}
+
+	return uri
+}
+
+func collapseSpaces(s string) string {
+	s = strings.TrimSpace(s)
+	for strings.Contains(s, "  ") {
+		s = strings.ReplaceAll(s, "  ", " ")
+	}
+
+	return s
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,372 @@
+package s3test
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type bucket struct {
+	name    string
+	created time.Time
+	objects map[string]*object
+	// configs are the stored sub-resource documents (cors, policy, lifecycle, versioning, tagging).
+	configs map[string][]byte
+}
+
+func newBucket(name string) *bucket {
+	return &bucket{
+		name:    name,
+		created: time.Now().UTC().Truncate(time.Second),
+		objects: map[string]*object{},
+		configs: map[string][]byte{},
+	}
+}
+
+func (b *bucket) keys() []string {
+	keys := make([]string, 0, len(b.objects))
+	for key := range b.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// bucketConfigs are the bucket sub-resources stored as is, with the error code returned when not set.
+var bucketConfigs = map[string]string{
+	"cors":      "NoSuchCORSConfiguration",
+	"policy":    "NoSuchBucketPolicy",
+	"lifecycle": "NoSuchLifecycleConfiguration",
+	"tagging":   "NoSuchTagSet",
+}
+
+func (s *Server) serveBucket(w http.ResponseWriter, r *http.Request, name string, body []byte) error {
+	query := r.URL.Query()
+	b, exists := s.buckets[name]
+
+	if r.Method == http.MethodPut && len(query) == 0 {
+		if exists {
+			return newError(http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it")
+		}
+		s.buckets[name] = newBucket(name)
+		w.Header().Set("Location", "/"+name)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if !exists {
+		return errNoSuchBucket(name)
+	}
+
+	for sub, notSet := range bucketConfigs {
+		if _, ok := query[sub]; ok {
+			return s.serveBucketConfig(w, r, b, sub, notSet, body)
+		}
+	}
+
+	switch {
+	case query.Has("location") && r.Method == http.MethodGet:
+		region := s.Region
+		if region == DefaultRegion {
+			region = ""
+		}
+		return writeXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Region  string   `xml:",chardata"`
+		}{Region: region})
+	case query.Has("versioning"):
+		return s.serveVersioning(w, r, b, body)
+	case query.Has("delete") && r.Method == http.MethodPost:
+		return s.deleteObjects(w, b, body)
+	case query.Has("uploads"), query.Has("versions"):
+		return errNotImplemented
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("X-Amz-Bucket-Region", s.Region)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodDelete:
+		if len(b.objects) > 0 {
+			return newError(http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty")
+		}
+		delete(s.buckets, name)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodGet:
+		if query.Get("list-type") == "2" {
+			return s.listObjectsV2(w, b, query)
+		}
+		return s.listObjects(w, b, query)
+	}
+
+	return errNotImplemented
+}
+
+func (s *Server) serveBucketConfig(w http.ResponseWriter, r *http.Request, b *bucket, sub, notSet string, body []byte) error {
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := b.configs[sub]
+		if !ok {
+			return newError(http.StatusNotFound, notSet, "The %s configuration does not exist", sub)
+		}
+		if sub == "policy" {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "application/xml")
+		}
+		w.Write(data)
+	case http.MethodPut:
+		b.configs[sub] = body
+		if sub == "policy" {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case http.MethodDelete:
+		delete(b.configs, sub)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return errNotImplemented
+	}
+
+	return nil
+}
+
+func (s *Server) serveVersioning(w http.ResponseWriter, r *http.Request, b *bucket, body []byte) error {
+	switch r.Method {
+	case http.MethodGet:
+		if data, ok := b.configs["versioning"]; ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write(data)
+			return nil
+		}
+		return writeXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"VersioningConfiguration"`
+		}{})
+	case http.MethodPut:
+		var config struct {
+			Status string `xml:"Status"`
+		}
+		if aerr := readXML(body, &config); aerr != nil {
+			return aerr
+		}
+		if config.Status != "Enabled" && config.Status != "Suspended" {
+			return newError(http.StatusBadRequest, "IllegalVersioningConfigurationException", "Invalid versioning status %q", config.Status)
+		}
+		b.configs["versioning"] = body
+		return nil
+	}
+
+	return errNotImplemented
+}
+
+func (s *Server) deleteObjects(w http.ResponseWriter, b *bucket, body []byte) error {
+	var req struct {
+		Quiet   bool `xml:"Quiet"`
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if aerr := readXML(body, &req); aerr != nil {
+		return aerr
+	}
+
+	type deleted struct {
+		Key string `xml:"Key"`
+	}
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Deleted []deleted `xml:"Deleted"`
+	}{}
+	for _, o := range req.Objects {
+		delete(b.objects, o.Key)
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, deleted{Key: o.Key})
+		}
+	}
+
+	return writeXML(w, http.StatusOK, result)
+}
+
+type xmlContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+	Owner        *xmlOwner
+}
+
+type xmlPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listing is a page of keys and common prefixes after the marker.
+type listing struct {
+	contents   []xmlContent
+	prefixes   []xmlPrefix
+	truncated  bool
+	nextMarker string
+}
+
+// list walks the sorted keys after marker, grouping keys by the delimiter.
+// The marker is either a key or a common prefix, in the latter case all the keys
+// of the prefix are skipped.
+func (b *bucket) list(prefix, delimiter, marker string, maxKeys int, encode func(string) string) listing {
+	var l listing
+	lastPrefix := ""
+	for _, key := range b.keys() {
+		if !strings.HasPrefix(key, prefix) || key <= marker {
+			continue
+		}
+		if marker != "" && delimiter != "" && strings.HasSuffix(marker, delimiter) && strings.HasPrefix(key, marker) {
+			continue
+		}
+
+		entry := key
+		isPrefix := false
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+				isPrefix = true
+				if entry == lastPrefix {
+					continue
+				}
+			}
+		}
+
+		if len(l.contents)+len(l.prefixes) >= maxKeys {
+			l.truncated = true
+			break
+		}
+		l.nextMarker = entry
+		if isPrefix {
+			lastPrefix = entry
+			l.prefixes = append(l.prefixes, xmlPrefix{Prefix: encode(entry)})
+			continue
+		}
+
+		o := b.objects[key]
+		l.contents = append(l.contents, xmlContent{
+			Key:          encode(key),
+			LastModified: o.modified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         `"` + o.etag + `"`,
+			Size:         int64(len(o.data)),
+			StorageClass: o.storageClass(),
+			Owner:        &owner,
+		})
+	}
+
+	return l
+}
+
+func listParams(query url.Values) (maxKeys int, encode func(string) string, aerr *s3Error) {
+	maxKeys = 1000
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, nil, newError(http.StatusBadRequest, "InvalidArgument", "Invalid max-keys %q", v)
+		}
+		maxKeys = n
+	}
+
+	encode = func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+
+	return maxKeys, encode, nil
+}
+
+func (s *Server) listObjectsV2(w http.ResponseWriter, b *bucket, query url.Values) error {
+	maxKeys, encode, aerr := listParams(query)
+	if aerr != nil {
+		return aerr
+	}
+
+	marker := query.Get("start-after")
+	token := query.Get("continuation-token")
+	if token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return newError(http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+		}
+		marker = string(decoded)
+	}
+
+	l := b.list(query.Get("prefix"), query.Get("delimiter"), marker, maxKeys, encode)
+	result := struct {
+		XMLName               xml.Name     `xml:"ListBucketResult"`
+		Name                  string       `xml:"Name"`
+		Prefix                string       `xml:"Prefix"`
+		Delimiter             string       `xml:"Delimiter,omitempty"`
+		StartAfter            string       `xml:"StartAfter,omitempty"`
+		ContinuationToken     string       `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string       `xml:"NextContinuationToken,omitempty"`
+		MaxKeys               int          `xml:"MaxKeys"`
+		KeyCount              int          `xml:"KeyCount"`
+		IsTruncated           bool         `xml:"IsTruncated"`
+		EncodingType          string       `xml:"EncodingType,omitempty"`
+		Contents              []xmlContent `xml:"Contents"`
+		CommonPrefixes        []xmlPrefix  `xml:"CommonPrefixes"`
+	}{
+		Name:              b.name,
+		Prefix:            encode(query.Get("prefix")),
+		Delimiter:         encode(query.Get("delimiter")),
+		StartAfter:        encode(query.Get("start-after")),
+		ContinuationToken: token,
+		MaxKeys:           maxKeys,
+		KeyCount:          len(l.contents) + len(l.prefixes),
+		IsTruncated:       l.truncated,
+		EncodingType:      query.Get("encoding-type"),
+		Contents:          l.contents,
+		CommonPrefixes:    l.prefixes,
+	}
+	if l.truncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(l.nextMarker))
+	}
+
+	return writeXML(w, http.StatusOK, result)
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, b *bucket, query url.Values) error {
+	maxKeys, encode, aerr := listParams(query)
+	if aerr != nil {
+		return aerr
+	}
+
+	l := b.list(query.Get("prefix"), query.Get("delimiter"), query.Get("marker"), maxKeys, encode)
+	result := struct {
+		XMLName        xml.Name     `xml:"ListBucketResult"`
+		Name           string       `xml:"Name"`
+		Prefix         string       `xml:"Prefix"`
+		Delimiter      string       `xml:"Delimiter,omitempty"`
+		Marker         string       `xml:"Marker"`
+		NextMarker     string       `xml:"NextMarker,omitempty"`
+		MaxKeys        int          `xml:"MaxKeys"`
+		IsTruncated    bool         `xml:"IsTruncated"`
+		EncodingType   string       `xml:"EncodingType,omitempty"`
+		Contents       []xmlContent `xml:"Contents"`
+		CommonPrefixes []xmlPrefix  `xml:"CommonPrefixes"`
+	}{
+		Name:           b.name,
+		Prefix:         encode(query.Get("prefix")),
+		Delimiter:      encode(query.Get("delimiter")),
+		Marker:         encode(query.Get("marker")),
+		MaxKeys:        maxKeys,
+		IsTruncated:    l.truncated,
+		EncodingType:   query.Get("encoding-type"),
+		Contents:       l.contents,
+		CommonPrefixes: l.prefixes,
+	}
+	if l.truncated {
+		result.NextMarker = encode(l.nextMarker)
+	}
+
+	return writeXML(w, http.StatusOK, result)
+}
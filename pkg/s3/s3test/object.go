@@ -0,0 +1,573 @@
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// minPartSize is the minimal size of a multipart upload part except the last one.
+	minPartSize = 5 << 20
+
+	sseHeader       = "X-Amz-Server-Side-Encryption"
+	sseKMSKeyHeader = "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"
+	sseCAlgorithm   = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+	sseCKey         = "X-Amz-Server-Side-Encryption-Customer-Key"
+	sseCKeyMD5      = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+	metaPrefix      = "X-Amz-Meta-"
+)
+
+type object struct {
+	data        []byte
+	etag        string
+	contentType string
+	metadata    http.Header
+	modified    time.Time
+	tags        map[string]string
+	class       string
+	sse         string
+	kmsKeyID    string
+	// customerKeyMD5 is the base64 MD5 of the SSE-C key the object was written with.
+	customerKeyMD5 string
+	// restored is the expiry of the restored copy of an archived object.
+	restored time.Time
+}
+
+// newObject creates an object from the content and the PutObject (CreateMultipartUpload) headers.
+func newObject(data []byte, h http.Header) *object {
+	sum := md5.Sum(data)
+	o := &object{
+		data:        data,
+		etag:        hex.EncodeToString(sum[:]),
+		contentType: h.Get("Content-Type"),
+		metadata:    http.Header{},
+		modified:    time.Now().UTC().Truncate(time.Second),
+		tags:        map[string]string{},
+		class:       h.Get("X-Amz-Storage-Class"),
+		sse:         h.Get(sseHeader),
+		kmsKeyID:    h.Get(sseKMSKeyHeader),
+	}
+	if o.contentType == "" {
+		o.contentType = "binary/octet-stream"
+	}
+	if o.sse == "aws:kms" && o.kmsKeyID == "" {
+		o.kmsKeyID = "aws/s3"
+	}
+	for name, values := range h {
+		if strings.HasPrefix(name, metaPrefix) {
+			o.metadata[name] = values
+		}
+	}
+	if tags, err := url.ParseQuery(h.Get("X-Amz-Tagging")); err == nil {
+		for name := range tags {
+			o.tags[name] = tags.Get(name)
+		}
+	}
+
+	return o
+}
+
+func (o *object) storageClass() string {
+	if o.class == "" {
+		return "STANDARD"
+	}
+
+	return o.class
+}
+
+func (o *object) archived() bool {
+	return o.class == "GLACIER" || o.class == "DEEP_ARCHIVE"
+}
+
+// upload is an in-progress multipart upload.
+type upload struct {
+	bucket string
+	key    string
+	header http.Header
+	parts  map[int]*object
+}
+
+// customerKey verifies the SSE-C headers and returns the key MD5 ("" if SSE-C is not used).
+func customerKey(h http.Header) (string, *s3Error) {
+	algorithm, key, keyMD5 := h.Get(sseCAlgorithm), h.Get(sseCKey), h.Get(sseCKeyMD5)
+	if algorithm == "" && key == "" {
+		return "", nil
+	}
+	if algorithm != "AES256" {
+		return "", newError(http.StatusBadRequest, "InvalidEncryptionAlgorithmError", "The encryption request you specified is not valid. The valid value is AES256")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return "", newError(http.StatusBadRequest, "InvalidArgument", "The secret key was invalid for the specified algorithm")
+	}
+	sum := md5.Sum(raw)
+	if base64.StdEncoding.EncodeToString(sum[:]) != keyMD5 {
+		return "", newError(http.StatusBadRequest, "InvalidArgument", "The calculated MD5 hash of the key did not match the hash that was provided")
+	}
+
+	return keyMD5, nil
+}
+
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, bucketName, key string, body []byte) error {
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		return errNoSuchBucket(bucketName)
+	}
+	query := r.URL.Query()
+
+	switch {
+	case query.Has("tagging"):
+		return s.serveTagging(w, r, b, key, body)
+	case query.Has("uploads") && r.Method == http.MethodPost:
+		return s.createUpload(w, r, b, key)
+	case query.Has("uploadId"):
+		return s.serveUpload(w, r, b, key, query, body)
+	case query.Has("restore") && r.Method == http.MethodPost:
+		return s.restoreObject(w, b, key, body)
+	case query.Has("acl"), query.Has("versionId"), query.Has("retention"), query.Has("legal-hold"):
+		return errNotImplemented
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return s.copyObject(w, r, b, key)
+		}
+		return s.putObject(w, r, b, key, body)
+	case http.MethodGet, http.MethodHead:
+		return s.getObject(w, r, b, key)
+	case http.MethodDelete:
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return errNotImplemented
+}
+
+// checkPreconditions checks the If-Match and If-None-Match headers of a write.
+func checkPreconditions(r *http.Request, current *object, key string) *s3Error {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch != "" {
+		if current == nil {
+			return errNoSuchKey(key)
+		}
+		if !etagMatches(ifMatch, current.etag) {
+			return newError(http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		}
+	}
+	if ifNoneMatch != "" && current != nil && etagMatches(ifNoneMatch, current.etag) {
+		return newError(http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+	}
+
+	return nil
+}
+
+// etagMatches compares the conditional header (a list of quoted etags or "*") with the etag.
+func etagMatches(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.Trim(strings.TrimSpace(v), `"`)
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (o *object) writeHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("ETag", `"`+o.etag+`"`)
+	if o.class != "" && o.class != "STANDARD" {
+		h.Set("X-Amz-Storage-Class", o.class)
+	}
+	if o.sse != "" {
+		h.Set(sseHeader, o.sse)
+	}
+	if o.kmsKeyID != "" {
+		h.Set(sseKMSKeyHeader, o.kmsKeyID)
+	}
+	if o.customerKeyMD5 != "" {
+		h.Set(sseCAlgorithm, "AES256")
+		h.Set(sseCKeyMD5, o.customerKeyMD5)
+	}
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, b *bucket, key string, body []byte) error {
+	if aerr := checkPreconditions(r, b.objects[key], key); aerr != nil {
+		return aerr
+	}
+	if contentMD5 := r.Header.Get("Content-Md5"); contentMD5 != "" {
+		sum := md5.Sum(body)
+		if base64.StdEncoding.EncodeToString(sum[:]) != contentMD5 {
+			return newError(http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received")
+		}
+	}
+	keyMD5, aerr := customerKey(r.Header)
+	if aerr != nil {
+		return aerr
+	}
+
+	o := newObject(body, r.Header)
+	o.customerKeyMD5 = keyMD5
+	b.objects[key] = o
+
+	o.writeHeaders(w)
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, b *bucket, key string) error {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return newError(http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+	}
+	sourceBucket, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	sb, ok := s.buckets[sourceBucket]
+	if !ok {
+		return errNoSuchBucket(sourceBucket)
+	}
+	src, ok := sb.objects[sourceKey]
+	if !ok {
+		return errNoSuchKey(sourceKey)
+	}
+	if aerr := checkPreconditions(r, b.objects[key], key); aerr != nil {
+		return aerr
+	}
+
+	var o *object
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		o = newObject(src.data, r.Header)
+	} else {
+		if sb == b && sourceKey == key {
+			return newError(http.StatusBadRequest, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata")
+		}
+		copied := *src
+		o = &copied
+		o.modified = time.Now().UTC().Truncate(time.Second)
+		o.restored = time.Time{}
+		if class := r.Header.Get("X-Amz-Storage-Class"); class != "" {
+			o.class = class
+		}
+	}
+	if r.Header.Get("X-Amz-Tagging-Directive") != "REPLACE" {
+		o.tags = make(map[string]string, len(src.tags))
+		for name, value := range src.tags {
+			o.tags[name] = value
+		}
+	}
+	b.objects[key] = o
+
+	return writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string   `xml:"ETag"`
+		LastModified string   `xml:"LastModified"`
+	}{ETag: `"` + o.etag + `"`, LastModified: o.modified.Format("2006-01-02T15:04:05.000Z")})
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, b *bucket, key string) error {
+	o, ok := b.objects[key]
+	if !ok {
+		return errNoSuchKey(key)
+	}
+
+	if o.customerKeyMD5 != "" || r.Header.Get(sseCKey) != "" {
+		keyMD5, aerr := customerKey(r.Header)
+		switch {
+		case aerr != nil:
+			return aerr
+		case o.customerKeyMD5 == "":
+			return newError(http.StatusBadRequest, "InvalidRequest", "The encryption parameters are not applicable to this object")
+		case keyMD5 == "":
+			return newError(http.StatusBadRequest, "InvalidRequest", "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object")
+		case keyMD5 != o.customerKeyMD5:
+			return errAccessDenied("Access Denied")
+		}
+	}
+
+	if o.archived() && r.Method == http.MethodGet && time.Now().After(o.restored) {
+		return newError(http.StatusForbidden, "InvalidObjectState", "The operation is not valid for the object's storage class")
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" && !etagMatches(match, o.etag) {
+		return newError(http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+	}
+
+	o.writeHeaders(w)
+	h := w.Header()
+	h.Set("Last-Modified", o.modified.Format(http.TimeFormat))
+	h.Set("Content-Type", o.contentType)
+	h.Set("Accept-Ranges", "bytes")
+	for name, values := range o.metadata {
+		h[name] = values
+	}
+	if len(o.tags) > 0 {
+		h.Set("X-Amz-Tagging-Count", strconv.Itoa(len(o.tags)))
+	}
+	if o.archived() && !o.restored.IsZero() {
+		h.Set("X-Amz-Restore", fmt.Sprintf(`ongoing-request="false", expiry-date="%s"`, o.restored.Format(http.TimeFormat)))
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, o.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	data, status := o.data, http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		start, end, ok := parseRange(rangeHeader, int64(len(o.data)))
+		if !ok {
+			h.Del("ETag")
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", len(o.data)))
+			return newError(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+		}
+		data, status = o.data[start:end+1], http.StatusPartialContent
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.data)))
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+
+	return nil
+}
+
+// parseRange parses a single "bytes=start-end", "bytes=start-" or "bytes=-suffix" range.
+func parseRange(header string, size int64) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end, true
+}
+
+type xmlTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type xmlTagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  []xmlTag `xml:"TagSet>Tag"`
+}
+
+func (s *Server) serveTagging(w http.ResponseWriter, r *http.Request, b *bucket, key string, body []byte) error {
+	o, ok := b.objects[key]
+	if !ok {
+		return errNoSuchKey(key)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		names := make([]string, 0, len(o.tags))
+		for name := range o.tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var tagging xmlTagging
+		for _, name := range names {
+			tagging.TagSet = append(tagging.TagSet, xmlTag{Key: name, Value: o.tags[name]})
+		}
+		return writeXML(w, http.StatusOK, tagging)
+	case http.MethodPut:
+		var tagging xmlTagging
+		if aerr := readXML(body, &tagging); aerr != nil {
+			return aerr
+		}
+		if len(tagging.TagSet) > 10 {
+			return newError(http.StatusBadRequest, "BadRequest", "Object tags cannot be greater than 10")
+		}
+		o.tags = make(map[string]string, len(tagging.TagSet))
+		for _, tag := range tagging.TagSet {
+			o.tags[tag.Key] = tag.Value
+		}
+		return nil
+	case http.MethodDelete:
+		o.tags = map[string]string{}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return errNotImplemented
+}
+
+func (s *Server) restoreObject(w http.ResponseWriter, b *bucket, key string, body []byte) error {
+	o, ok := b.objects[key]
+	if !ok {
+		return errNoSuchKey(key)
+	}
+	if !o.archived() {
+		return newError(http.StatusForbidden, "InvalidObjectState", "Restore is not allowed for the object's current storage class")
+	}
+
+	var req struct {
+		Days int `xml:"Days"`
+	}
+	if aerr := readXML(body, &req); aerr != nil {
+		return aerr
+	}
+	if req.Days < 1 {
+		return newError(http.StatusBadRequest, "InvalidArgument", "Days must be a positive number")
+	}
+
+	// the restore completes at once, a repeated request only extends the expiry
+	status := http.StatusAccepted
+	if !o.restored.IsZero() {
+		status = http.StatusOK
+	}
+	o.restored = time.Now().UTC().Truncate(time.Second).AddDate(0, 0, req.Days)
+	w.WriteHeader(status)
+
+	return nil
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, b *bucket, key string) error {
+	if _, aerr := customerKey(r.Header); aerr != nil {
+		return aerr
+	}
+
+	id := s.nextID()
+	s.uploads[id] = &upload{
+		bucket: b.name,
+		key:    key,
+		header: r.Header.Clone(),
+		parts:  map[int]*object{},
+	}
+
+	return writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Bucket: b.name, Key: key, UploadID: id})
+}
+
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, b *bucket, key string, query url.Values, body []byte) error {
+	id := query.Get("uploadId")
+	u, ok := s.uploads[id]
+	if !ok || u.bucket != b.name || u.key != key {
+		return newError(http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || number < 1 || number > 10000 {
+			return newError(http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000")
+		}
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return errNotImplemented
+		}
+		part := newObject(body, http.Header{})
+		u.parts[number] = part
+		w.Header().Set("ETag", `"`+part.etag+`"`)
+		return nil
+	case http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodPost:
+		return s.completeUpload(w, r, b, id, u, body)
+	}
+
+	return errNotImplemented
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, b *bucket, id string, u *upload, body []byte) error {
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if aerr := readXML(body, &req); aerr != nil {
+		return aerr
+	}
+	if len(req.Parts) == 0 {
+		return newError(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema")
+	}
+	if aerr := checkPreconditions(r, b.objects[u.key], u.key); aerr != nil {
+		return aerr
+	}
+
+	var data, sums []byte
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			return newError(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order")
+		}
+		part, ok := u.parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != part.etag {
+			return newError(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found")
+		}
+		if i < len(req.Parts)-1 && len(part.data) < minPartSize {
+			return newError(http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size")
+		}
+		data = append(data, part.data...)
+		sum, _ := hex.DecodeString(part.etag)
+		sums = append(sums, sum...)
+	}
+
+	keyMD5, _ := customerKey(u.header)
+	o := newObject(data, u.header)
+	sum := md5.Sum(sums)
+	o.etag = fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(req.Parts))
+	o.customerKeyMD5 = keyMD5
+	b.objects[u.key] = o
+	delete(s.uploads, id)
+
+	o.writeHeaders(w)
+	w.Header().Del("ETag")
+
+	return writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{Location: s.URL + "/" + b.name + "/" + u.key, Bucket: b.name, Key: u.key, ETag: `"` + o.etag + `"`})
+}
@@ -0,0 +1,347 @@
+/*
+Package s3test provides an in-process S3-compatible server for tests.
+
+The server keeps buckets and objects in memory and speaks the path-style S3 REST API:
+bucket create/list/delete, object put/get/head/delete/copy, ListObjects(V2) with
+delimiter and continuation, multipart uploads, tagging, range GET, restore of archived
+objects and bucket CORS, policy, versioning and lifecycle documents. Requests must be
+signed with the server credentials using signature V4 (header or presigned URL) or V2.
+
+	srv := s3test.NewServer(s3test.WithBuckets("files"))
+	defer srv.Close()
+
+	loc, err := stow.Dial("s3", srv.Config())
+*/
+package s3test
+
+import (
+	"bytes"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graymeta/stow"
+)
+
+// Default credentials and region of the server.
+const (
+	DefaultAccessKeyID = "s3test"
+	DefaultSecretKey   = "s3test-secret"
+	DefaultRegion      = "us-east-1"
+)
+
+// Server is a fake S3 server. The embedded httptest.Server provides URL and Close.
+type Server struct {
+	*httptest.Server
+
+	AccessKeyID string
+	SecretKey   string
+	Region      string
+
+	anonymousRead bool
+	noAuth        bool
+	tls           bool
+	sessionToken  string
+
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	uploads  map[string]*upload
+	sequence int
+}
+
+// Option configures the server.
+type Option func(s *Server)
+
+// WithCredentials sets the access key pair requests must be signed with.
+func WithCredentials(accessKeyID, secretKey string) Option {
+	return func(s *Server) {
+		s.AccessKeyID, s.SecretKey = accessKeyID, secretKey
+	}
+}
+
+// WithSessionToken requires the session token (X-Amz-Security-Token) of temporary credentials.
+func WithSessionToken(token string) Option {
+	return func(s *Server) {
+		s.sessionToken = token
+	}
+}
+
+// WithRegion sets the region returned by GetBucketLocation.
+func WithRegion(region string) Option {
+	return func(s *Server) {
+		s.Region = region
+	}
+}
+
+// WithAnonymousRead allows unsigned GET and HEAD requests of objects, as for a public-read bucket.
+func WithAnonymousRead() Option {
+	return func(s *Server) {
+		s.anonymousRead = true
+	}
+}
+
+// WithoutAuth disables the signature verification.
+func WithoutAuth() Option {
+	return func(s *Server) {
+		s.noAuth = true
+	}
+}
+
+// WithTLS starts the server with a self-signed certificate, the SDK refuses to send
+// SSE-C keys over plain HTTP. Config passes the certificate in "ca_cert".
+func WithTLS() Option {
+	return func(s *Server) {
+		s.tls = true
+	}
+}
+
+// WithBuckets creates the buckets on start.
+func WithBuckets(names ...string) Option {
+	return func(s *Server) {
+		for _, name := range names {
+			s.buckets[name] = newBucket(name)
+		}
+	}
+}
+
+// NewServer starts a fake S3 server, the caller must Close it.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		AccessKeyID: DefaultAccessKeyID,
+		SecretKey:   DefaultSecretKey,
+		Region:      DefaultRegion,
+		buckets:     map[string]*bucket{},
+		uploads:     map[string]*upload{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.tls {
+		s.Server = httptest.NewTLSServer(s)
+	} else {
+		s.Server = httptest.NewServer(s)
+	}
+
+	return s
+}
+
+// Config returns the stow config of the pkg/s3 location connected to the server
+// (keys match s3.ConfigEndpoint, s3.ConfigAccessKeyID, s3.ConfigSecretKey, s3.ConfigRegion, s3.ConfigCaCert).
+func (s *Server) Config() stow.ConfigMap {
+	config := stow.ConfigMap{
+		"endpoint":      s.URL,
+		"access_key_id": s.AccessKeyID,
+		"secret_key":    s.SecretKey,
+		"region":        s.Region,
+	}
+	if s.tls {
+		config["ca_cert"] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}))
+	}
+
+	return config
+}
+
+// CreateBucket creates an empty bucket if it does not exist.
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[name]; !ok {
+		s.buckets[name] = newBucket(name)
+	}
+}
+
+// Put stores an object, creating the bucket if needed.
+func (s *Server) Put(bucketName, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		b = newBucket(bucketName)
+		s.buckets[bucketName] = b
+	}
+	b.objects[key] = newObject(data, http.Header{})
+}
+
+// Object returns the content of a stored object.
+func (s *Server) Object(bucketName, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		return nil, false
+	}
+	o, ok := b.objects[key]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte(nil), o.data...), true
+}
+
+// Keys returns the sorted keys of the bucket objects.
+func (s *Server) Keys(bucketName string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		return nil
+	}
+
+	return b.keys()
+}
+
+// s3Error is an S3 error response.
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newError(status int, code, format string, args ...interface{}) *s3Error {
+	return &s3Error{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errNoSuchBucket = func(name string) *s3Error {
+		return newError(http.StatusNotFound, "NoSuchBucket", "The specified bucket %s does not exist", name)
+	}
+	errNoSuchKey = func(key string) *s3Error {
+		return newError(http.StatusNotFound, "NoSuchKey", "The specified key %s does not exist", key)
+	}
+	errNotImplemented = newError(http.StatusNotImplemented, "NotImplemented", "The request is not supported by s3test")
+)
+
+// ServeHTTP routes path-style requests: /, /bucket and /bucket/key.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.writeError(w, r, newError(http.StatusBadRequest, "IncompleteBody", "%s", err))
+		return
+	}
+
+	if aerr := s.authenticate(r, body); aerr != nil {
+		s.writeError(w, r, aerr)
+		return
+	}
+
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case bucketName == "":
+		if r.Method != http.MethodGet {
+			err = errNotImplemented
+			break
+		}
+		err = s.listBuckets(w)
+	case key == "":
+		err = s.serveBucket(w, r, bucketName, body)
+	default:
+		err = s.serveObject(w, r, bucketName, key, body)
+	}
+
+	if err != nil {
+		s.writeError(w, r, err)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	aerr, ok := err.(*s3Error)
+	if !ok {
+		aerr = newError(http.StatusInternalServerError, "InternalError", "%s", err)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(aerr.Status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	writeXMLBody(w, struct {
+		XMLName xml.Name `xml:"Error"`
+		*s3Error
+		Resource string `xml:"Resource"`
+	}{s3Error: aerr, Resource: r.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	writeXMLBody(w, v)
+
+	return nil
+}
+
+func writeXMLBody(w io.Writer, v interface{}) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(v); err != nil {
+		panic(err)
+	}
+	w.Write(buf.Bytes())
+}
+
+func readXML(body []byte, v interface{}) *s3Error {
+	if err := xml.Unmarshal(body, v); err != nil {
+		return newError(http.StatusBadRequest, "MalformedXML", "%s", err)
+	}
+
+	return nil
+}
+
+// nextID returns a unique id for upload ids and request ids.
+func (s *Server) nextID() string {
+	s.sequence++
+
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.Itoa(s.sequence)
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter) error {
+	type xmlBucket struct {
+		Name         string
+		CreationDate string
+	}
+	result := struct {
+		XMLName xml.Name    `xml:"ListAllMyBucketsResult"`
+		Owner   xmlOwner    `xml:"Owner"`
+		Buckets []xmlBucket `xml:"Buckets>Bucket"`
+	}{Owner: owner}
+
+	names := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result.Buckets = append(result.Buckets, xmlBucket{
+			Name:         name,
+			CreationDate: s.buckets[name].created.Format(time.RFC3339),
+		})
+	}
+
+	return writeXML(w, http.StatusOK, result)
+}
+
+type xmlOwner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+var owner = xmlOwner{ID: "s3test", DisplayName: "s3test"}
@@ -0,0 +1,274 @@
+package s3test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+)
+
+func newClient(t *testing.T, srv *Server, secret string) *s3.S3 {
+	t.Helper()
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(srv.URL),
+		Region:           aws.String(srv.Region),
+		Credentials:      credentials.NewStaticCredentials(srv.AccessKeyID, secret, ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	assert.NoError(t, err)
+
+	return s3.New(sess)
+}
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+
+	return ""
+}
+
+func TestServerAuth(t *testing.T) {
+	srv := NewServer(WithBuckets("files"))
+	defer srv.Close()
+
+	_, err := newClient(t, srv, "wrong").ListBuckets(nil)
+	assert.Equal(t, "SignatureDoesNotMatch", errorCode(err))
+
+	res, err := http.Get(srv.URL + "/files/a.txt")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	client := newClient(t, srv, srv.SecretKey)
+	list, err := client.ListBuckets(nil)
+	assert.NoError(t, err)
+	assert.Len(t, list.Buckets, 1)
+	assert.Equal(t, "files", aws.StringValue(list.Buckets[0].Name))
+
+	srv.Put("files", "a b/ф.txt", []byte("hello"))
+	req, _ := client.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String("files"), Key: aws.String("a b/ф.txt")})
+	url, err := req.Presign(time.Minute)
+	assert.NoError(t, err)
+	res, err = http.Get(url)
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "hello", string(data))
+
+	res, err = http.Get(strings.Replace(url, "X-Amz-Expires=60", "X-Amz-Expires=600", 1))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestServerAnonymousRead(t *testing.T) {
+	srv := NewServer(WithAnonymousRead())
+	defer srv.Close()
+	srv.Put("public", "logo.png", []byte("png"))
+
+	res, err := http.Get(srv.URL + "/public/logo.png")
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "png", string(data))
+
+	res, err = http.Get(srv.URL + "/public")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/public/logo.png", strings.NewReader("x"))
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestServerBuckets(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	client := newClient(t, srv, srv.SecretKey)
+
+	_, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("files")})
+	assert.NoError(t, err)
+	_, err = client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("files")})
+	assert.Equal(t, "BucketAlreadyOwnedByYou", errorCode(err))
+
+	_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String("files")})
+	assert.NoError(t, err)
+	_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String("missing")})
+	assert.Error(t, err)
+
+	srv.Put("files", "a.txt", []byte("a"))
+	_, err = client.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String("files")})
+	assert.Equal(t, "BucketNotEmpty", errorCode(err))
+
+	_, err = client.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String("files"),
+		Delete: &s3.Delete{Objects: []*s3.ObjectIdentifier{{Key: aws.String("a.txt")}}},
+	})
+	assert.NoError(t, err)
+	_, err = client.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String("files")})
+	assert.NoError(t, err)
+	assert.Nil(t, srv.Keys("files"))
+}
+
+func TestServerListObjectsV2(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	for _, key := range []string{"a.txt", "dir/1.txt", "dir/2.txt", "dir/sub/3.txt", "other/4.txt", "z.txt"} {
+		srv.Put("files", key, []byte(key))
+	}
+	client := newClient(t, srv, srv.SecretKey)
+
+	var keys, prefixes []string
+	pages := 0
+	err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String("files"),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int64(2),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		pages++
+		for _, o := range page.Contents {
+			keys = append(keys, aws.StringValue(o.Key))
+		}
+		for _, p := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(p.Prefix))
+		}
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pages)
+	assert.Equal(t, []string{"a.txt", "z.txt"}, keys)
+	assert.Equal(t, []string{"dir/", "other/"}, prefixes)
+
+	res, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:    aws.String("files"),
+		Prefix:    aws.String("dir/"),
+		Delimiter: aws.String("/"),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, res.Contents, 2)
+	assert.Equal(t, "dir/sub/", aws.StringValue(res.CommonPrefixes[0].Prefix))
+	assert.Equal(t, int64(len("dir/1.txt")), aws.Int64Value(res.Contents[0].Size))
+
+	v1, err := client.ListObjects(&s3.ListObjectsInput{Bucket: aws.String("files"), Marker: aws.String("dir/sub/3.txt")})
+	assert.NoError(t, err)
+	assert.Len(t, v1.Contents, 2)
+}
+
+func TestServerObjects(t *testing.T) {
+	srv := NewServer(WithBuckets("files"))
+	defer srv.Close()
+	client := newClient(t, srv, srv.SecretKey)
+
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String("files"),
+		Key:         aws.String("doc.txt"),
+		Body:        bytes.NewReader([]byte("0123456789")),
+		ContentType: aws.String("text/plain"),
+		Metadata:    map[string]*string{"Author": aws.String("ops")},
+		Tagging:     aws.String("team=bi"),
+	})
+	assert.NoError(t, err)
+
+	head, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("files"), Key: aws.String("doc.txt")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), aws.Int64Value(head.ContentLength))
+	assert.Equal(t, "text/plain", aws.StringValue(head.ContentType))
+	assert.Equal(t, "ops", aws.StringValue(head.Metadata["Author"]))
+
+	get, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("files"), Key: aws.String("doc.txt"), Range: aws.String("bytes=2-4")})
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(get.Body)
+	get.Body.Close()
+	assert.Equal(t, "234", string(data))
+	assert.Equal(t, "bytes 2-4/10", aws.StringValue(get.ContentRange))
+
+	_, err = client.GetObject(&s3.GetObjectInput{Bucket: aws.String("files"), Key: aws.String("doc.txt"), Range: aws.String("bytes=20-")})
+	assert.Equal(t, "InvalidRange", errorCode(err))
+
+	_, err = client.CopyObject(&s3.CopyObjectInput{Bucket: aws.String("files"), Key: aws.String("copy.txt"), CopySource: aws.String("files/doc.txt")})
+	assert.NoError(t, err)
+	copied, _ := srv.Object("files", "copy.txt")
+	assert.Equal(t, "0123456789", string(copied))
+
+	tags, err := client.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: aws.String("files"), Key: aws.String("copy.txt")})
+	assert.NoError(t, err)
+	assert.Equal(t, "bi", aws.StringValue(tags.TagSet[0].Value))
+	_, err = client.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  aws.String("files"),
+		Key:     aws.String("copy.txt"),
+		Tagging: &s3.Tagging{TagSet: []*s3.Tag{{Key: aws.String("a"), Value: aws.String("1")}, {Key: aws.String("b"), Value: aws.String("2")}}},
+	})
+	assert.NoError(t, err)
+	tags, err = client.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: aws.String("files"), Key: aws.String("copy.txt")})
+	assert.NoError(t, err)
+	assert.Len(t, tags.TagSet, 2)
+
+	_, err = client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("files"), Key: aws.String("doc.txt")})
+	assert.NoError(t, err)
+	_, err = client.GetObject(&s3.GetObjectInput{Bucket: aws.String("files"), Key: aws.String("doc.txt")})
+	assert.Equal(t, s3.ErrCodeNoSuchKey, errorCode(err))
+	assert.Equal(t, []string{"copy.txt"}, srv.Keys("files"))
+}
+
+func TestServerMultipart(t *testing.T) {
+	srv := NewServer(WithBuckets("files"))
+	defer srv.Close()
+	client := newClient(t, srv, srv.SecretKey)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (minPartSize*2+1024)/16)
+	res, err := s3manager.NewUploaderWithClient(client).Upload(&s3manager.UploadInput{
+		Bucket: aws.String("files"),
+		Key:    aws.String("big.bin"),
+		Body:   bytes.NewReader(data),
+	})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(aws.StringValue(res.ETag), `-3"`))
+
+	stored, _ := srv.Object("files", "big.bin")
+	assert.Equal(t, data, stored)
+
+	upload, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String("files"), Key: aws.String("small.bin")})
+	assert.NoError(t, err)
+	var parts []*s3.CompletedPart
+	for i := int64(1); i <= 2; i++ {
+		part, err := client.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String("files"),
+			Key:        aws.String("small.bin"),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int64(i),
+			Body:       bytes.NewReader([]byte("part")),
+		})
+		assert.NoError(t, err)
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(i), ETag: part.ETag})
+	}
+	_, err = client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String("files"),
+		Key:             aws.String("small.bin"),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	assert.Equal(t, "EntityTooSmall", errorCode(err))
+
+	_, err = client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String("files"), Key: aws.String("small.bin"), UploadId: upload.UploadId})
+	assert.NoError(t, err)
+	_, err = client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String("files"), Key: aws.String("small.bin"), UploadId: upload.UploadId})
+	assert.Equal(t, s3.ErrCodeNoSuchUpload, errorCode(err))
+}
@@ -0,0 +1,352 @@
+package s3
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/graymeta/stow"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ConfigSSE is an optional config value which enables server-side encryption
+	// of every object written to the bucket: "AES256" (SSE-S3) or "aws:kms" (SSE-KMS).
+	// Any config value below can be set for a single bucket by appending "." and the
+	// bucket name to the key, e.g. "sse.reports".
+	ConfigSSE = "sse"
+
+	// ConfigSSEKMSKeyID is an optional KMS key ID used with "aws:kms" encryption.
+	// The account default KMS key is used if empty.
+	ConfigSSEKMSKeyID = "sse_kms_key_id"
+
+	// ConfigSSECustomerKey is an optional base64 encoded 256-bit key for SSE-C.
+	// The key is sent with every write and read of the bucket's objects.
+	ConfigSSECustomerKey = "sse_customer_key"
+
+	// ConfigStorageClass is an optional storage class of written objects, e.g. "STANDARD_IA".
+	ConfigStorageClass = "storage_class"
+
+	// ConfigListArchived is an optional config value which makes Items return archived
+	// (GLACIER, DEEP_ARCHIVE) objects. Its default value is "false": archived objects
+	// can't be read without a restore, so they are listed only by ArchivedItems.
+	ConfigListArchived = "list_archived"
+)
+
+// Server-side encryption algorithms.
+const (
+	SSEAES256 = s3.ServerSideEncryptionAes256
+	SSEKMS    = s3.ServerSideEncryptionAwsKms
+)
+
+// Restore retrieval tiers of archived objects.
+const (
+	RestoreTierExpedited = s3.TierExpedited
+	RestoreTierStandard  = s3.TierStandard
+	RestoreTierBulk      = s3.TierBulk
+)
+
+// sseCustomerAlgorithm is the only algorithm supported by SSE-C.
+const sseCustomerAlgorithm = "AES256"
+
+// ErrArchived is returned when an archived object is opened before it is restored.
+var ErrArchived = errors.New("s3: object is archived, restore it first")
+
+// PutOptions holds the encryption and storage class of an uploaded object.
+// Empty fields fall back to the bucket configuration (ConfigSSE, ConfigStorageClass...).
+// SSECustomerKey takes precedence over ServerSideEncryption since S3 accepts only one of them.
+type PutOptions struct {
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+	SSECustomerKey       []byte
+	StorageClass         string
+}
+
+// OptionsPutter is implemented by containers which accept per-write options.
+type OptionsPutter interface {
+	PutWithOptions(name string, r io.Reader, size int64, metadata map[string]interface{}, opts PutOptions) (stow.Item, error)
+}
+
+// KeyedContainer is implemented by containers which can read SSE-C objects
+// encrypted with a key other than the bucket one.
+type KeyedContainer interface {
+	ItemWithKey(id string, key []byte) (stow.Item, error)
+}
+
+// ArchiveContainer is implemented by containers which can list and restore archived objects.
+type ArchiveContainer interface {
+	ArchivedItems(prefix, cursor string, count int) ([]stow.Item, string, error)
+	RestoreItem(id string, days int64, tier string) error
+}
+
+// ArchivedItem is implemented by items which know their storage class and restore status.
+type ArchivedItem interface {
+	StorageClass() string
+	Archived() bool
+	RestoreStatus() (ongoing bool, expiry time.Time, err error)
+}
+
+// IsArchivedClass reports whether objects of the storage class must be restored before reading.
+func IsArchivedClass(class string) bool {
+	return class == s3.ObjectStorageClassGlacier || class == s3.ObjectStorageClassDeepArchive
+}
+
+// merge fills empty options with the defaults.
+func (o PutOptions) merge(def PutOptions) PutOptions {
+	// encryption is taken from the bucket only when the write sets none
+	if o.SSECustomerKey == nil && o.ServerSideEncryption == "" {
+		o.SSECustomerKey = def.SSECustomerKey
+		o.ServerSideEncryption = def.ServerSideEncryption
+		o.SSEKMSKeyID = def.SSEKMSKeyID
+	}
+	if o.StorageClass == "" {
+		o.StorageClass = def.StorageClass
+	}
+
+	return o
+}
+
+func (o PutOptions) validate() error {
+	switch o.ServerSideEncryption {
+	case "", SSEAES256, SSEKMS:
+	default:
+		return errors.Errorf("unsupported server-side encryption %q", o.ServerSideEncryption)
+	}
+	if o.SSEKMSKeyID != "" && o.ServerSideEncryption != SSEKMS && o.SSECustomerKey == nil {
+		return errors.Errorf("%s requires %s encryption", ConfigSSEKMSKeyID, SSEKMS)
+	}
+	if o.SSECustomerKey != nil && len(o.SSECustomerKey) != 32 {
+		return errors.Errorf("SSE-C key must be 32 bytes, got %d", len(o.SSECustomerKey))
+	}
+
+	return nil
+}
+
+// bucketConfig returns the config value for the bucket, falling back to the location wide value.
+func bucketConfig(config stow.Config, key, bucket string) string {
+	if value, ok := config.Config(key + "." + bucket); ok {
+		return value
+	}
+	value, _ := config.Config(key)
+
+	return value
+}
+
+// containerOptions reads the default put options and the archived listing flag of the bucket.
+func containerOptions(config stow.Config, bucket string) (opts PutOptions, listArchived bool, err error) {
+	if config == nil {
+		return opts, false, nil
+	}
+
+	opts = PutOptions{
+		ServerSideEncryption: bucketConfig(config, ConfigSSE, bucket),
+		SSEKMSKeyID:          bucketConfig(config, ConfigSSEKMSKeyID, bucket),
+		StorageClass:         bucketConfig(config, ConfigStorageClass, bucket),
+	}
+	if key := bucketConfig(config, ConfigSSECustomerKey, bucket); key != "" {
+		opts.SSECustomerKey, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return opts, false, errors.Wrap(err, "decoding "+ConfigSSECustomerKey)
+		}
+	}
+	if err = opts.validate(); err != nil {
+		return opts, false, errors.Wrapf(err, "bucket %s", bucket)
+	}
+
+	return opts, bucketConfig(config, ConfigListArchived, bucket) == "true", nil
+}
+
+// newContainer creates a container with the encryption and storage class settings of the bucket.
+func (l *location) newContainer(name string, client *s3.S3, region string) (*container, error) {
+	opts, listArchived, err := containerOptions(l.config, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &container{
+		name:           name,
+		client:         client,
+		region:         region,
+		customEndpoint: l.customEndpoint,
+		options:        opts,
+		listArchived:   listArchived,
+	}, nil
+}
+
+// sseCustomerKey returns the SSE-C headers values of the key (the SDK computes the key MD5).
+func sseCustomerKey(key []byte) (algorithm, value *string) {
+	if key == nil {
+		return nil, nil
+	}
+
+	return aws.String(sseCustomerAlgorithm), aws.String(string(key))
+}
+
+func (o PutOptions) applyUpload(in *s3manager.UploadInput) {
+	in.SSECustomerAlgorithm, in.SSECustomerKey = sseCustomerKey(o.SSECustomerKey)
+	if o.SSECustomerKey == nil && o.ServerSideEncryption != "" {
+		in.ServerSideEncryption = aws.String(o.ServerSideEncryption)
+		if o.SSEKMSKeyID != "" {
+			in.SSEKMSKeyId = aws.String(o.SSEKMSKeyID)
+		}
+	}
+	if o.StorageClass != "" {
+		in.StorageClass = aws.String(o.StorageClass)
+	}
+}
+
+func (o PutOptions) applyPut(in *s3.PutObjectInput) {
+	in.SSECustomerAlgorithm, in.SSECustomerKey = sseCustomerKey(o.SSECustomerKey)
+	if o.SSECustomerKey == nil && o.ServerSideEncryption != "" {
+		in.ServerSideEncryption = aws.String(o.ServerSideEncryption)
+		if o.SSEKMSKeyID != "" {
+			in.SSEKMSKeyId = aws.String(o.SSEKMSKeyID)
+		}
+	}
+	if o.StorageClass != "" {
+		in.StorageClass = aws.String(o.StorageClass)
+	}
+}
+
+// PutWithOptions uploads the content like Put with the given encryption and storage class.
+// The returned item keeps the SSE-C key, so it can be opened right away.
+func (c *container) PutWithOptions(name string, r io.Reader, size int64, metadata map[string]interface{}, opts PutOptions) (stow.Item, error) {
+	opts = opts.merge(c.options)
+	if err := opts.validate(); err != nil {
+		return nil, errors.Wrap(err, "PutWithOptions")
+	}
+
+	return c.put(name, r, size, metadata, opts)
+}
+
+// ItemWithKey returns the item of an object encrypted with the SSE-C key.
+func (c *container) ItemWithKey(id string, key []byte) (stow.Item, error) {
+	return c.getItemWithKey(id, key)
+}
+
+// ArchivedItems lists only the archived (GLACIER, DEEP_ARCHIVE) objects with the prefix.
+// The cursor works the same way as in Items.
+func (c *container) ArchivedItems(prefix, cursor string, count int) ([]stow.Item, string, error) {
+	return c.items(prefix, cursor, count, func(class string) bool {
+		return IsArchivedClass(class)
+	})
+}
+
+// RestoreItem requests a temporary copy of the archived object for days using the retrieval tier
+// (RestoreTierStandard if empty). The object is readable once RestoreStatus reports it is not ongoing.
+// A repeated request for an object which is being restored is not an error.
+func (c *container) RestoreItem(id string, days int64, tier string) error {
+	if days <= 0 {
+		days = 1
+	}
+	if tier == "" {
+		tier = RestoreTierStandard
+	}
+
+	_, err := c.client.RestoreObject(&s3.RestoreObjectInput{
+		Bucket: aws.String(c.name),
+		Key:    aws.String(id),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(days),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case "RestoreAlreadyInProgress":
+				return nil
+			case s3.ErrCodeNoSuchKey, "NotFound":
+				return stow.ErrNotFound
+			}
+		}
+		return errors.Wrapf(err, "RestoreItem, restoring object %s", id)
+	}
+
+	return nil
+}
+
+// StorageClass returns the storage class of the item, "STANDARD" if S3 did not return it.
+func (i *item) StorageClass() string {
+	if class := aws.StringValue(i.properties.StorageClass); class != "" {
+		return class
+	}
+
+	return s3.ObjectStorageClassStandard
+}
+
+// Archived reports whether the item is stored in an archive storage class.
+func (i *item) Archived() bool {
+	return IsArchivedClass(i.StorageClass())
+}
+
+// RestoreStatus requests the restore state of the archived item: ongoing is true while
+// the restore is in progress, expiry is the time the restored copy is removed (zero if not restored).
+func (i *item) RestoreStatus() (ongoing bool, expiry time.Time, err error) {
+	algorithm, key := sseCustomerKey(i.sseCustomerKey)
+	res, err := i.client.HeadObject(&s3.HeadObjectInput{
+		Bucket:               aws.String(i.container.name),
+		Key:                  aws.String(i.ID()),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       key,
+	})
+	if err != nil {
+		return false, time.Time{}, errors.Wrap(err, "RestoreStatus, getting the object")
+	}
+
+	ongoing, expiry = parseRestore(aws.StringValue(res.Restore))
+
+	return ongoing, expiry, nil
+}
+
+// parseRestore parses the x-amz-restore header:
+// ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+func parseRestore(header string) (ongoing bool, expiry time.Time) {
+	for header != "" {
+		var part string
+		part, header = cutRestorePart(header)
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch strings.TrimSpace(name) {
+		case "ongoing-request":
+			ongoing = value == "true"
+		case "expiry-date":
+			expiry, _ = time.Parse(time.RFC1123, value)
+		}
+	}
+
+	return ongoing, expiry
+}
+
+// cutRestorePart cuts the next name="value" pair, commas inside quotes are kept.
+func cutRestorePart(s string) (part, rest string) {
+	quoted := false
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			return strings.TrimSpace(s[:i]), s[i+1:]
+		}
+	}
+
+	return strings.TrimSpace(s), ""
+}
+
+// archivedError returns ErrArchived if S3 refused to read the object because it is not restored.
+func archivedError(err error, op string) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeInvalidObjectState {
+		return errors.Wrap(ErrArchived, fmt.Sprintf("%s, getting the object", op))
+	}
+
+	return errors.Wrap(err, fmt.Sprintf("%s, getting the object", op))
+}
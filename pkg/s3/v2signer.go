@@ -90,7 +90,8 @@ func setv2Handlers(svc *s3.S3) {
 		if err != nil {
 			log.Fatal("Failed to parse URL", err)
 		}
-		r.HTTPRequest.URL.Opaque = parsedURL.Path
+		// the path is sent as is, keep it escaped (keys may contain spaces and non-ASCII characters)
+		r.HTTPRequest.URL.Opaque = parsedURL.EscapedPath()
 	})
 
 	svc.Handlers.Sign.Clear()
@@ -143,7 +144,7 @@ func (v2 *signer) Sign() error {
 	if err != nil {
 		return err
 	}
-	host, canonicalPath := parsedURL.Host, parsedURL.Path
+	host, canonicalPath := parsedURL.Host, parsedURL.EscapedPath()
 	v2.Request.Header["Host"] = []string{host}
 	v2.Request.Header["x-amz-date"] = []string{v2.Time.In(time.UTC).Format(time.RFC1123)}
 
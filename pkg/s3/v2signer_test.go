@@ -0,0 +1,32 @@
+package s3
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/graymeta/stow"
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3/s3test"
+)
+
+func TestV2SignerEscapedPath(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	c := dialContainer(t, srv, stow.ConfigMap{ConfigV2Signing: "true"})
+
+	// the request line and the string to sign use the escaped path
+	for _, name := range []string{"with space.txt", "отчет 2024.pdf", "a+b/c%d.txt"} {
+		_, err := c.Put(name, strings.NewReader(name), int64(len(name)), nil)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		i, err := c.Item(name)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, name, readItem(t, i))
+		}
+		data, ok := srv.Object("files", name)
+		assert.True(t, ok, name)
+		assert.Equal(t, name, string(data))
+	}
+}
@@ -73,9 +73,16 @@ func (b *XServiceKeyBuilder) WithInterval(interval time.Duration) *XServiceKeyBu
 
 func (b *XServiceKeyBuilder) Build(projectKey []byte) (token string, err error) {
 	b.key.Expired = time.Now().Add(b.tokenInterval).Unix()
-	return encodeServiceKey(b.key, projectKey)
+	return encodeServiceKey(b.key, projectKeyCipher(projectKey))
+}
+
+// BuildKeyring подписываем токен активным ключом связки
+func (b *XServiceKeyBuilder) BuildKeyring(kr *Keyring) (token string, err error) {
+	b.key.Expired = time.Now().Add(b.tokenInterval).Unix()
+	return encodeServiceKey(b.key, kr)
 }
 
 func DecodeServiceKey(xServiceKey string, projectKey []byte) (out models.XServiceKey, err error) {
-	return decodeServiceKey(projectKey, xServiceKey)
+	out, _, err = decodeServiceKey(projectKeyCipher(projectKey), xServiceKey)
+	return out, err
 }
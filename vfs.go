@@ -8,10 +8,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/graymeta/stow"
 	"github.com/graymeta/stow/azure"
 	"github.com/graymeta/stow/local"
@@ -44,6 +47,14 @@ type vfs struct {
 	container                                      stow.Container
 	comma                                          string
 	cacert                                         string
+	disableSSL, v2Signing                          bool
+	authType                                       string
+	creds                                          vfsCredentials
+	sse                                            vfsSSE
+
+	// mx защищает location и container: каждая операция подключается заново,
+	// и операции могут выполняться одновременно
+	mx sync.RWMutex
 }
 
 type Vfs interface {
@@ -66,11 +77,32 @@ type Item interface {
 
 // Connect инициируем подключение к хранилищу, в зависимости от типа соединения
 func (v *vfs) Connect() (err error) {
+	location, container, err := v.dial()
+
+	v.mx.Lock()
+	v.location, v.container = location, container
+	v.mx.Unlock()
+
+	return err
+}
+
+// conn текущее соединение с хранилищем
+func (v *vfs) conn() (location stow.Location, container stow.Container) {
+	v.mx.RLock()
+	defer v.mx.RUnlock()
+
+	return v.location, v.container
+}
+
+// dial подключение к хранилищу без изменения полей vfs
+// (для операций, которым нужно собственное соединение, например WriteIf)
+func (v *vfs) dial() (location stow.Location, container stow.Container, err error) {
 	var config = stow.ConfigMap{}
 	var flagBucketExist bool
 
-	if v.region == "" {
-		v.region = "ru-central-1"
+	region := v.region
+	if region == "" {
+		region = "ru-central-1"
 	}
 
 	switch strings.ToLower(v.kind) {
@@ -79,9 +111,20 @@ func (v *vfs) Connect() (err error) {
 			s3.ConfigEndpoint:    v.endpoint,
 			s3.ConfigAccessKeyID: v.accessKeyID,
 			s3.ConfigSecretKey:   v.secretKey,
-			s3.ConfigRegion:      v.region,
+			s3.ConfigRegion:      region,
 			s3.ConfigCaCert:      v.cacert,
 		}
+		if v.disableSSL {
+			config[s3.ConfigDisableSSL] = "true"
+		}
+		if v.v2Signing {
+			config[s3.ConfigV2Signing] = "true"
+		}
+		if v.authType != "" {
+			config[s3.ConfigAuthType] = v.authType
+		}
+		v.creds.apply(config)
+		v.sse.apply(config)
 	case "azure":
 		config = stow.ConfigMap{
 			azure.ConfigAccount: v.accessKeyID,
@@ -91,7 +134,7 @@ func (v *vfs) Connect() (err error) {
 		if !IsExist(v.endpoint) {
 			err = CreateDir(v.endpoint, 0)
 			if err != nil {
-				return fmt.Errorf("directory not exist. error create local directory. err: %w", err)
+				return nil, nil, fmt.Errorf("directory not exist. error create local directory. err: %w", err)
 			}
 		}
 		config = stow.ConfigMap{
@@ -101,13 +144,13 @@ func (v *vfs) Connect() (err error) {
 	}
 
 	// подсключаемся к хранилищу
-	v.location, err = stow.Dial(strings.ToLower(v.kind), config)
+	location, err = stow.Dial(strings.ToLower(v.kind), config)
 	if err != nil {
-		return fmt.Errorf("error create container from config. err: %s", err)
+		return nil, nil, fmt.Errorf("error create container from config. err: %s", err)
 	}
 
 	// ищем переданных бакет, если нет, то создаем его
-	err = stow.WalkContainers(v.location, stow.NoPrefix, 10000, func(c stow.Container, err error) error {
+	err = stow.WalkContainers(location, stow.NoPrefix, 10000, func(c stow.Container, err error) error {
 		if err != nil {
 			return err
 		}
@@ -121,29 +164,30 @@ func (v *vfs) Connect() (err error) {
 		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("error list to containers from config. err: %s", err)
+		return location, nil, fmt.Errorf("error list to containers from config. err: %s", err)
 	}
 
 	// создаем если нет
 	if !flagBucketExist {
-		v.container, err = v.location.CreateContainer(v.bucket)
+		container, err = location.CreateContainer(v.bucket)
 		if err != nil {
-			return fmt.Errorf("error create container from config. err: %s", err)
+			return location, nil, fmt.Errorf("error create container from config. err: %s", err)
 		}
 	}
 
 	// инициируем переданный контейнер
-	v.container, err = v.location.Container(v.bucket)
+	container, err = location.Container(v.bucket)
 	if err != nil {
-		return fmt.Errorf("error create container from config. err: %s", err)
+		return location, nil, fmt.Errorf("error create container from config. err: %s", err)
 	}
 
-	return err
+	return location, container, err
 }
 
 // Close закрываем соединение
 func (v *vfs) Close() (err error) {
-	err = v.location.Close()
+	location, _ := v.conn()
+	err = location.Close()
 
 	return err
 }
@@ -253,7 +297,8 @@ func (v *vfs) ReadFromBucket(ctx context.Context, file, bucket string, private_a
 
 		data, err = io.ReadAll(d.Reader)
 		if err != nil {
-			err = fmt.Errorf("error ReadAll. err: %s. file: %s, bucket: %s, v.container: %+v", err, file, bucket, v.container)
+			_, container := v.conn()
+			err = fmt.Errorf("error ReadAll. err: %s. file: %s, bucket: %s, v.container: %+v", err, file, bucket, container)
 
 			return nil, "", err
 		}
@@ -293,10 +338,10 @@ func (v *vfs) Write(ctx context.Context, file string, data []byte) (err error) {
 		return fmt.Errorf("path file not valid")
 	}
 
+	_, container := v.conn()
 	chResult := make(chan result)
 	exec := func(ctx context.Context, name string, rr io.Reader, size int64, metadata map[string]interface{}) (r result) {
-		_, err = v.container.Put(file, rr, size, nil)
-		r.Err = err
+		_, r.Err = container.Put(file, rr, size, nil)
 		return r
 	}
 
@@ -325,7 +370,8 @@ func (v *vfs) Delete(ctx context.Context, file string) (err error) {
 		return fmt.Errorf("error get Item for path: %s, err: %s", file, err)
 	}
 
-	err = v.container.RemoveItem(item.ID())
+	_, container := v.conn()
+	err = container.RemoveItem(item.ID())
 	if err != nil {
 		return err
 	}
@@ -341,7 +387,8 @@ func (v *vfs) List(ctx context.Context, prefix string, pageSize int) (files []It
 	}
 	defer v.Close()
 
-	err = stow.Walk(v.container, prefix, pageSize, func(item stow.Item, err error) error {
+	_, container := v.conn()
+	err = stow.Walk(container, prefix, pageSize, func(item stow.Item, err error) error {
 		if err != nil {
 			fmt.Printf("error Walk from list vfs. connect:%+v, prefix: %s, err: %s\n", v, prefix, err)
 
@@ -356,6 +403,83 @@ func (v *vfs) List(ctx context.Context, prefix string, pageSize int) (files []It
 	return files, err
 }
 
+// ListLimit первая страница списка файлов с префиксом (не больше limit файлов)
+func (v *vfs) ListLimit(ctx context.Context, prefix string, limit int) (files []Item, err error) {
+	err = v.Connect()
+	if err != nil {
+		return files, fmt.Errorf("error connect to filestorage. err: %s cfg: VfsKind: %s, VfsEndpoint: %s, VfsBucket: %s", err, v.kind, v.endpoint, v.bucket)
+	}
+	defer v.Close()
+
+	// local драйвер делит файлы на страницы до фильтра по префиксу, поэтому читаем страницы до limit файлов
+	pageSize := limit
+	if strings.ToLower(v.kind) == "local" && pageSize < vfsFSPageSize {
+		pageSize = vfsFSPageSize
+	}
+	_, container := v.conn()
+	cursor := stow.CursorStart
+	for len(files) < limit {
+		items, next, err := container.Items(prefix, cursor, pageSize)
+		if err != nil {
+			return files, fmt.Errorf("error list prefix %s. err: %s", prefix, err)
+		}
+		for _, item := range items {
+			files = append(files, item)
+		}
+		if stow.IsCursorEnd(next) {
+			break
+		}
+		cursor = next
+	}
+	if len(files) > limit {
+		files = files[:limit]
+	}
+
+	return files, nil
+}
+
+// ListDir файлы и директории первого уровня префикса (см. ListDir)
+// s3 возвращает один уровень запросом с разделителем "/", остальные хранилища читают весь список
+func (v *vfs) ListDir(ctx context.Context, prefix string) (files []Item, dirs []string, err error) {
+	if strings.ToLower(v.kind) != "s3" {
+		return listDirAll(ctx, v, prefix)
+	}
+
+	err = v.Connect()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connect to filestorage. err: %s cfg: VfsKind: %s, VfsEndpoint: %s, VfsBucket: %s", err, v.kind, v.endpoint, v.bucket)
+	}
+	defer v.Close()
+
+	_, container := v.conn()
+	lister, ok := container.(s3.DirContainer)
+	if !ok {
+		return nil, nil, fmt.Errorf("error list dir %s. err: storage does not support listing by directories", prefix)
+	}
+
+	cursor := stow.CursorStart
+	for {
+		items, prefixes, next, err := lister.ItemsDir(prefix, cursor, vfsFSPageSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error list dir %s. err: %w", prefix, err)
+		}
+		for _, item := range items {
+			files = append(files, item)
+		}
+		for _, dir := range prefixes {
+			if dir = strings.TrimSuffix(strings.TrimPrefix(dir, prefix), "/"); dir != "" {
+				dirs = append(dirs, dir)
+			}
+		}
+		if stow.IsCursorEnd(next) {
+			break
+		}
+		cursor = next
+	}
+
+	return files, dirs, nil
+}
+
 // ReadCloser
 // private_access - параметр, который позволяет читать из приватной директории другого пользователя (по умолчанию ставьте false)
 func (v *vfs) ReadCloser(ctx context.Context, file string, private_access bool) (reader io.ReadCloser, err error) {
@@ -365,10 +489,9 @@ func (v *vfs) ReadCloser(ctx context.Context, file string, private_access bool)
 // ReadCloserFromBucket
 // private_access - параметр, который позволяет читать из приватной директории другого пользователя (по умолчанию ставьте false)
 func (v *vfs) ReadCloserFromBucket(ctx context.Context, file, bucket string, private_access bool) (reader io.ReadCloser, err error) {
-	user, _ := ctx.Value(userUid).(string)
-
-	if strings.Contains(file, "users") && (user == "" || !strings.Contains(file, user)) && !private_access {
-		return nil, errors.New(privateDirectory)
+	err = checkPrivateAccess(ctx, file, private_access)
+	if err != nil {
+		return nil, err
 	}
 
 	item, err := v.getItem(file, bucket)
@@ -384,9 +507,83 @@ func (v *vfs) ReadCloserFromBucket(ctx context.Context, file, bucket string, pri
 	return reader, err
 }
 
+// checkPrivateAccess запрещает чтение из приватной директории другого пользователя
+func checkPrivateAccess(ctx context.Context, file string, private_access bool) error {
+	user, _ := ctx.Value(userUid).(string)
+
+	if strings.Contains(file, "users") && (user == "" || !strings.Contains(file, user)) && !private_access {
+		return errors.New(privateDirectory)
+	}
+
+	return nil
+}
+
+// vfsNotFoundMarkers текст ошибок s3 и файловой системы об отсутствии файла
+var vfsNotFoundMarkers = []string{"NoSuchKey: ", "NotFound: ", "status code: 404", "no such file or directory"}
+
+// IsVfsNotFound проверяет, что ошибка операции Vfs означает отсутствие файла
+// сначала проверяются типизированные ошибки (stow, io/fs, коды s3), а ошибки, обернутые драйверами
+// хранилищ в строку, - по тексту, характерному только для отсутствия файла
+func IsVfsNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, stow.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code() == "NoSuchKey" || aerr.Code() == "NotFound"
+	}
+
+	msg := err.Error()
+	if strings.HasSuffix(msg, ": "+stow.ErrNotFound.Error()) {
+		return true
+	}
+	for _, marker := range vfsNotFoundMarkers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (v *vfs) getItem(file, bucket string) (item Item, err error) {
+	location, _ := v.conn()
+
+	return v.getItemFrom(location, file, bucket)
+}
+
+// getItemFrom получает объект через соединение location
+func (v *vfs) getItemFrom(location stow.Location, file, bucket string) (item Item, err error) {
 	var urlPath url.URL
 
+	file = v.itemPath(file, bucket)
+
+	//fmt.Printf("file: %s, bucket: %s, container: %-v\n", file, bucket, v.container)
+
+	urlPath.Host = bucket
+	urlPath.Path = file
+
+	if location == nil {
+		return nil, fmt.Errorf("error. location is empty. bucket: %s, file: %s, endpoint: %s", urlPath.Host, urlPath.Path, v.endpoint)
+	}
+
+	item, err = location.ItemByURL(&urlPath)
+	if err != nil {
+		return nil, fmt.Errorf("error. location.ItemByURL is failled. urlPath: %v, err: %w", urlPath, err)
+	}
+
+	if item == nil {
+		return nil, fmt.Errorf("error. Item is null. urlPath: %v", urlPath)
+	}
+
+	return item, err
+}
+
+// itemPath путь объекта в хранилище
+func (v *vfs) itemPath(file, bucket string) string {
 	// если передан разделитель, то заменяем / на него (возможно понадобится для совместимости плоских хранилищ)
 	if v.comma != "" {
 		file = strings.Replace(file, v.comma, sep, -1)
@@ -406,27 +603,11 @@ func (v *vfs) getItem(file, bucket string) (item Item, err error) {
 		file = strings.Replace(file, sep+sep, sep, -1)
 	}
 
-	//fmt.Printf("file: %s, bucket: %s, container: %-v\n", file, bucket, v.container)
-
-	urlPath.Host = bucket
-	urlPath.Path = file
-
-	if v.location == nil {
-		return nil, fmt.Errorf("error. location is empty. bucket: %s, file: %s, endpoint: %s", urlPath.Host, urlPath.Path, v.endpoint)
-	}
-
-	item, err = v.location.ItemByURL(&urlPath)
-	if err != nil {
-		return nil, fmt.Errorf("error. location.ItemByURL is failled. urlPath: %v, err: %s", urlPath, err)
-	}
-
-	if item == nil {
-		return nil, fmt.Errorf("error. Item is null. urlPath: %v", urlPath)
-	}
-
-	return item, err
+	return file
 }
 
+// NewVfs создает хранилище по параметрам подключения
+// дополнительные параметры (disable_ssl, v2_signing, auth_type) задаются через NewVfsFromConfig
 func NewVfs(kind, endpoint, accessKeyID, secretKey, region, bucket, comma, cacert string) Vfs {
 	return &vfs{
 		kind:        kind,
@@ -0,0 +1,383 @@
+package lib
+
+import (
+	tarlib "archive/tar"
+	"archive/zip"
+	gziplib "compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Форматы архивов для ArchivePrefix/ExtractArchive
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+const (
+	defaultArchiveMaxSize      = 1 << 30   // 1Gb
+	defaultArchiveMaxEntrySize = 256 << 20 // 256Mb
+	defaultArchiveMaxEntries   = 10000
+)
+
+var (
+	ErrArchiveFormat   = errors.New("unsupported archive format")
+	ErrArchiveTooLarge = errors.New("archive size limit exceeded")
+	ErrArchivePath     = errors.New("archive entry path is not valid")
+)
+
+// ArchiveEntry файл, распакованный из архива в хранилище
+type ArchiveEntry struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mime_type"`
+}
+
+type archiveOptions struct {
+	maxSize       int64
+	maxEntrySize  int64
+	maxEntries    int
+	privateAccess bool
+}
+
+// ArchiveOption параметр упаковки/распаковки архива
+type ArchiveOption func(o *archiveOptions)
+
+// WithArchiveMaxSize ограничивает суммарный размер (распакованных) данных архива
+func WithArchiveMaxSize(size int64) ArchiveOption {
+	return func(o *archiveOptions) {
+		o.maxSize = size
+	}
+}
+
+// WithArchiveMaxEntrySize ограничивает размер одного файла архива
+func WithArchiveMaxEntrySize(size int64) ArchiveOption {
+	return func(o *archiveOptions) {
+		o.maxEntrySize = size
+	}
+}
+
+// WithArchiveMaxEntries ограничивает количество файлов в архиве
+func WithArchiveMaxEntries(count int) ArchiveOption {
+	return func(o *archiveOptions) {
+		o.maxEntries = count
+	}
+}
+
+// WithArchivePrivateAccess разрешает упаковку файлов из приватных директорий других пользователей
+func WithArchivePrivateAccess() ArchiveOption {
+	return func(o *archiveOptions) {
+		o.privateAccess = true
+	}
+}
+
+func newArchiveOptions(opts []ArchiveOption) archiveOptions {
+	o := archiveOptions{
+		maxSize:      defaultArchiveMaxSize,
+		maxEntrySize: defaultArchiveMaxEntrySize,
+		maxEntries:   defaultArchiveMaxEntries,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// archiveFormat приводит формат к одной из констант
+func archiveFormat(format string) (string, error) {
+	switch strings.TrimPrefix(strings.ToLower(format), ".") {
+	case ArchiveZip:
+		return ArchiveZip, nil
+	case ArchiveTarGz, "tgz":
+		return ArchiveTarGz, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrArchiveFormat, format)
+}
+
+// ArchivePrefix упаковывает все файлы хранилища с префиксом prefix в архив и пишет его потоком в w
+// (например, в http.ResponseWriter) без временных файлов
+// пути в архиве указываются относительно prefix, prefix считается директорией ("project" не включает "project-old/")
+func ArchivePrefix(ctx context.Context, v Vfs, prefix string, w io.Writer, format string, opts ...ArchiveOption) (err error) {
+	o := newArchiveOptions(opts)
+	format, err = archiveFormat(format)
+	if err != nil {
+		return err
+	}
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+
+	// список читается только до превышения лимита (маркер директории prefix не считается)
+	items, err := ListLimit(ctx, v, prefix, o.maxEntries+2)
+	if err != nil {
+		return fmt.Errorf("error list prefix %s. err: %w", prefix, err)
+	}
+	names := make([]string, 0, len(items))
+	files := items[:0]
+	for _, item := range items {
+		entryName := strings.TrimPrefix(item.Name(), "/")
+		if !strings.HasPrefix(entryName, prefix) {
+			continue
+		}
+		// маркер директории prefix не попадает в архив
+		if entryName = strings.TrimPrefix(entryName, prefix); entryName == "" {
+			continue
+		}
+		names = append(names, entryName)
+		files = append(files, item)
+	}
+	if len(files) > o.maxEntries {
+		return fmt.Errorf("%w: more than %d files", ErrArchiveTooLarge, o.maxEntries)
+	}
+
+	var zw *zip.Writer
+	var tw *tarlib.Writer
+	switch format {
+	case ArchiveZip:
+		zw = zip.NewWriter(w)
+	case ArchiveTarGz:
+		gw := gziplib.NewWriter(w)
+		defer func() {
+			if errClose := gw.Close(); err == nil {
+				err = errClose
+			}
+		}()
+		tw = tarlib.NewWriter(gw)
+	}
+
+	var total int64
+	for i, item := range files {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		name, entryName := item.Name(), names[i]
+		size, err := item.Size()
+		if err != nil {
+			return fmt.Errorf("error get size of %s. err: %w", name, err)
+		}
+		total += size
+		if total > o.maxSize {
+			return fmt.Errorf("%w: limit %d bytes", ErrArchiveTooLarge, o.maxSize)
+		}
+		modified, _ := item.LastMod()
+		if modified.IsZero() {
+			modified = time.Now()
+		}
+
+		var entry io.Writer
+		if zw != nil {
+			entry, err = zw.CreateHeader(&zip.FileHeader{
+				Name:     entryName,
+				Method:   zip.Deflate,
+				Modified: modified,
+			})
+		} else {
+			entry = tw
+			err = tw.WriteHeader(&tarlib.Header{
+				Typeflag: tarlib.TypeReg,
+				Name:     entryName,
+				Size:     size,
+				Mode:     0644,
+				ModTime:  modified,
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("error create archive entry %s. err: %w", entryName, err)
+		}
+
+		reader, err := v.ReadCloser(ctx, name, o.privateAccess)
+		if err != nil {
+			return fmt.Errorf("error read %s. err: %w", name, err)
+		}
+		_, err = io.Copy(entry, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("error write archive entry %s. err: %w", entryName, err)
+		}
+	}
+
+	if zw != nil {
+		return zw.Close()
+	}
+
+	return tw.Close()
+}
+
+// ExtractArchive распаковывает архив из r в хранилище под префикс prefix
+// пути, выходящие за пределы prefix (zip-slip), отклоняются с ErrArchivePath,
+// превышение ограничений размера - ErrArchiveTooLarge
+// возвращает список записанных файлов с определенным MimeType
+func ExtractArchive(ctx context.Context, v Vfs, r io.Reader, prefix string, format string, opts ...ArchiveOption) (entries []ArchiveEntry, err error) {
+	o := newArchiveOptions(opts)
+	format, err = archiveFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	store := func(name string, body io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(entries) >= o.maxEntries {
+			return fmt.Errorf("%w: more than %d files", ErrArchiveTooLarge, o.maxEntries)
+		}
+
+		entryPath, err := archiveEntryPath(prefix, name)
+		if err != nil {
+			return err
+		}
+
+		data, err := io.ReadAll(io.LimitReader(body, o.maxEntrySize+1))
+		if err != nil {
+			return fmt.Errorf("error read archive entry %s. err: %w", name, err)
+		}
+		if int64(len(data)) > o.maxEntrySize {
+			return fmt.Errorf("%w: entry %s is larger than %d bytes", ErrArchiveTooLarge, name, o.maxEntrySize)
+		}
+		total += int64(len(data))
+		if total > o.maxSize {
+			return fmt.Errorf("%w: limit %d bytes", ErrArchiveTooLarge, o.maxSize)
+		}
+
+		err = v.Write(ctx, entryPath, data)
+		if err != nil {
+			return fmt.Errorf("error write %s. err: %w", entryPath, err)
+		}
+
+		entries = append(entries, ArchiveEntry{
+			Path:     entryPath,
+			Size:     int64(len(data)),
+			MimeType: detectMIME(data, entryPath),
+		})
+
+		return nil
+	}
+
+	switch format {
+	case ArchiveZip:
+		// zip читается с конца, поэтому архив (в пределах лимита) сохраняем во временный файл
+		tmp, err := os.CreateTemp("", "vfs-archive-*")
+		if err != nil {
+			return nil, fmt.Errorf("error create temp file. err: %w", err)
+		}
+		defer func() {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}()
+
+		size, err := io.Copy(tmp, &archiveLimitReader{r: r, limit: o.maxSize})
+		if err != nil {
+			return nil, fmt.Errorf("error read archive. err: %w", err)
+		}
+
+		zr, err := zip.NewReader(tmp, size)
+		if err != nil {
+			return nil, fmt.Errorf("error open zip archive. err: %w", err)
+		}
+
+		for _, file := range zr.File {
+			if file.FileInfo().IsDir() || !file.Mode().IsRegular() {
+				continue
+			}
+
+			fr, err := file.Open()
+			if err != nil {
+				return entries, fmt.Errorf("error open archive entry %s. err: %w", file.Name, err)
+			}
+			err = store(file.Name, fr)
+			fr.Close()
+			if err != nil {
+				return entries, err
+			}
+		}
+
+	case ArchiveTarGz:
+		gr, err := gziplib.NewReader(&archiveLimitReader{r: r, limit: o.maxSize})
+		if err != nil {
+			return nil, fmt.Errorf("error open gzip archive. err: %w", err)
+		}
+		defer gr.Close()
+
+		tr := tarlib.NewReader(gr)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return entries, fmt.Errorf("error read tar archive. err: %w", err)
+			}
+			// ссылки и директории не переносим
+			if header.Typeflag != tarlib.TypeReg {
+				continue
+			}
+
+			err = store(header.Name, tr)
+			if err != nil {
+				return entries, err
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// archiveLimitReader прерывает чтение архива с ErrArchiveTooLarge при превышении лимита размера
+// данные сверх лимита не отдаются, поэтому обрезанный поток не читается как целый архив
+type archiveLimitReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *archiveLimitReader) Read(p []byte) (n int, err error) {
+	if l.read > l.limit {
+		return 0, l.tooLarge()
+	}
+	// читаем не больше одного байта сверх лимита - он означает превышение
+	if rest := l.limit - l.read + 1; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	n, err = l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n - 1, l.tooLarge()
+	}
+
+	return n, err
+}
+
+func (l *archiveLimitReader) tooLarge() error {
+	return fmt.Errorf("%w: limit %d bytes", ErrArchiveTooLarge, l.limit)
+}
+
+// archiveEntryPath формирует путь файла в хранилище и отсекает выход за пределы prefix
+func archiveEntryPath(prefix, name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	// абсолютные пути и пути с буквой диска не допускаются
+	if name == "" || strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", fmt.Errorf("%w: %s", ErrArchivePath, name)
+	}
+
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%w: %s", ErrArchivePath, name)
+	}
+
+	if prefix == "" {
+		return clean, nil
+	}
+
+	return strings.TrimSuffix(prefix, "/") + "/" + clean, nil
+}
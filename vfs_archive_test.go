@@ -0,0 +1,136 @@
+package lib
+
+import (
+	tarlib "archive/tar"
+	"archive/zip"
+	"bytes"
+	gziplib "compress/gzip"
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchivePrefixRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := newTestVfs(t)
+
+	files := map[string]string{
+		"project/index.html":    "<html></html>",
+		"project/css/main.css":  "body{}",
+		"project/data/one.json": `{"a":1}`,
+		"other/skip.txt":        "skip",
+		"project-old/skip.txt":  "skip",
+	}
+	for name, body := range files {
+		assert.NoError(t, src.Write(ctx, name, []byte(body)))
+	}
+
+	for _, format := range []string{ArchiveZip, ArchiveTarGz} {
+		var buf bytes.Buffer
+		err := ArchivePrefix(ctx, src, "project", &buf, format)
+		if !assert.NoError(t, err, format) {
+			continue
+		}
+
+		dst := newTestVfs(t)
+		entries, err := ExtractArchive(ctx, dst, &buf, "import", format)
+		assert.NoError(t, err, format)
+		assert.Len(t, entries, 3, format)
+
+		mimes := map[string]string{}
+		for _, e := range entries {
+			mimes[e.Path] = e.MimeType
+		}
+		assert.Equal(t, "text/html", mimes["import/index.html"])
+		assert.Equal(t, "text/css", mimes["import/css/main.css"])
+
+		data, _, err := dst.Read(ctx, "import/data/one.json", false)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"a":1}`, string(data))
+
+		// соседний префикс с тем же началом не попадает в архив
+		for _, e := range entries {
+			assert.NotContains(t, e.Path, "skip", format)
+		}
+	}
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	ctx := context.Background()
+
+	build := func(files map[string]string) *bytes.Buffer {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, body := range files {
+			w, _ := zw.Create(name)
+			w.Write([]byte(body))
+		}
+		zw.Close()
+		return &buf
+	}
+
+	_, err := ExtractArchive(ctx, newTestVfs(t), build(map[string]string{"../evil.txt": "x"}), "import", ArchiveZip)
+	assert.ErrorIs(t, err, ErrArchivePath)
+
+	_, err = ExtractArchive(ctx, newTestVfs(t), build(map[string]string{"a/../../evil.txt": "x"}), "import", ArchiveZip)
+	assert.ErrorIs(t, err, ErrArchivePath)
+
+	_, err = ExtractArchive(ctx, newTestVfs(t), build(map[string]string{"big.txt": "0123456789"}), "import", ArchiveZip, WithArchiveMaxEntrySize(5))
+	assert.ErrorIs(t, err, ErrArchiveTooLarge)
+
+	_, err = ExtractArchive(ctx, newTestVfs(t), build(map[string]string{"a": "1", "b": "2"}), "import", ArchiveZip, WithArchiveMaxEntries(1))
+	assert.ErrorIs(t, err, ErrArchiveTooLarge)
+
+	_, err = ExtractArchive(ctx, newTestVfs(t), build(map[string]string{"a": "1"}), "import", "rar")
+	assert.ErrorIs(t, err, ErrArchiveFormat)
+}
+
+// listLimitOnlyVfs хранилище, в котором полный список файлов не запрашивается
+type listLimitOnlyVfs struct {
+	VfsWrapper
+}
+
+func (l *listLimitOnlyVfs) List(ctx context.Context, prefix string, pageSize int) ([]Item, error) {
+	return nil, errors.New("full list is not expected")
+}
+
+func TestArchivePrefixMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	src := newTestVfs(t)
+	for _, name := range []string{"project/a.txt", "project/b.txt", "project/c.txt"} {
+		assert.NoError(t, src.Write(ctx, name, []byte(name)))
+	}
+	v := &listLimitOnlyVfs{VfsWrapper{Next: src}}
+
+	var buf bytes.Buffer
+	assert.ErrorIs(t, ArchivePrefix(ctx, v, "project", &buf, ArchiveZip, WithArchiveMaxEntries(2)), ErrArchiveTooLarge)
+	assert.NoError(t, ArchivePrefix(ctx, v, "project", &buf, ArchiveZip, WithArchiveMaxEntries(3)))
+}
+
+func TestExtractArchiveMaxSize(t *testing.T) {
+	ctx := context.Background()
+	body := make([]byte, 1000)
+	rand.Read(body)
+
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	w, _ := zw.Create("random.bin")
+	w.Write(body)
+	zw.Close()
+	_, err := ExtractArchive(ctx, newTestVfs(t), &zbuf, "import", ArchiveZip, WithArchiveMaxSize(500))
+	assert.ErrorIs(t, err, ErrArchiveTooLarge)
+
+	// сжатый поток больше лимита, хотя распакованные данные в него укладываются
+	var tbuf bytes.Buffer
+	gw := gziplib.NewWriter(&tbuf)
+	tw := tarlib.NewWriter(gw)
+	tw.WriteHeader(&tarlib.Header{Typeflag: tarlib.TypeReg, Name: "random.bin", Size: int64(len(body)), Mode: 0644})
+	tw.Write(body)
+	tw.Close()
+	gw.Close()
+	_, err = ExtractArchive(ctx, newTestVfs(t), &tbuf, "import", ArchiveTarGz, WithArchiveMaxSize(1010))
+	assert.ErrorIs(t, err, ErrArchiveTooLarge)
+}
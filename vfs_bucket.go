@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3"
+)
+
+// BucketConfigurer хранилище, которое умеет настраивать свой бакет (CORS, политика доступа, версионирование, lifecycle)
+// пустые правила (nil политика) удаляют настройку
+type BucketConfigurer interface {
+	BucketCORS(ctx context.Context) (rules []s3.CORSRule, err error)
+	SetBucketCORS(ctx context.Context, rules []s3.CORSRule) (err error)
+	BucketPolicy(ctx context.Context) (policy *s3.BucketPolicy, err error)
+	SetBucketPolicy(ctx context.Context, policy *s3.BucketPolicy) (err error)
+	BucketVersioning(ctx context.Context) (status string, err error)
+	SetBucketVersioning(ctx context.Context, enabled bool) (err error)
+	BucketLifecycle(ctx context.Context) (rules []s3.LifecycleRule, err error)
+	SetBucketLifecycle(ctx context.Context, rules []s3.LifecycleRule) (err error)
+}
+
+// VfsBucketConfig возвращает управление бакетом хранилища
+// мидлвари на основе VfsWrapper пропускаются, кроме WithVfsHooks - операции с бакетом проходят через ее хуки
+// false - хранилище не поддерживает настройку бакета
+func VfsBucketConfig(v Vfs) (BucketConfigurer, bool) {
+	for v != nil {
+		if c, ok := v.(BucketConfigurer); ok {
+			return c, true
+		}
+		if h, ok := v.(interface {
+			bucketConfig() (BucketConfigurer, bool)
+		}); ok {
+			return h.bucketConfig()
+		}
+		u, ok := v.(interface{ Unwrap() Vfs })
+		if !ok {
+			break
+		}
+		v = u.Unwrap()
+	}
+
+	return nil, false
+}
+
+// bucketExec выполняет операцию с настройками бакета s3 в рамках подключения
+func bucketExec[T any](ctx context.Context, v *vfs, op string, fn func(m s3.BucketManager, bucket string) (T, error)) (res T, err error) {
+	if strings.ToLower(v.kind) != "s3" {
+		return res, fmt.Errorf("%w: %s", ErrVfsOptionsUnsupported, v.kind)
+	}
+
+	err = v.Connect()
+	if err != nil {
+		return res, fmt.Errorf("error connect to filestorage. err: %s cfg: VfsKind: %s, VfsEndpoint: %s, VfsBucket: %s", err, v.kind, v.endpoint, v.bucket)
+	}
+	defer v.Close()
+
+	location, _ := v.conn()
+	m, ok := location.(s3.BucketManager)
+	if !ok {
+		return res, fmt.Errorf("%w: %s", ErrVfsOptionsUnsupported, v.kind)
+	}
+
+	type result struct {
+		res T
+		err error
+	}
+	chResult := make(chan result, 1)
+	go func() {
+		res, err := fn(m, v.bucket)
+		chResult <- result{res, err}
+	}()
+
+	select {
+	case r := <-chResult:
+		return r.res, r.err
+	case <-ctx.Done():
+		return res, fmt.Errorf("exec %s dead for context", op)
+	}
+}
+
+// BucketCORS правила CORS бакета (nil - не заданы)
+func (v *vfs) BucketCORS(ctx context.Context) (rules []s3.CORSRule, err error) {
+	return bucketExec(ctx, v, "BucketCORS", func(m s3.BucketManager, bucket string) ([]s3.CORSRule, error) {
+		return m.BucketCORS(bucket)
+	})
+}
+
+// SetBucketCORS заменяет правила CORS бакета
+func (v *vfs) SetBucketCORS(ctx context.Context, rules []s3.CORSRule) (err error) {
+	_, err = bucketExec(ctx, v, "SetBucketCORS", func(m s3.BucketManager, bucket string) (struct{}, error) {
+		return struct{}{}, m.SetBucketCORS(bucket, rules)
+	})
+
+	return err
+}
+
+// BucketPolicy политика доступа бакета (nil - не задана)
+func (v *vfs) BucketPolicy(ctx context.Context) (policy *s3.BucketPolicy, err error) {
+	return bucketExec(ctx, v, "BucketPolicy", func(m s3.BucketManager, bucket string) (*s3.BucketPolicy, error) {
+		return m.BucketPolicy(bucket)
+	})
+}
+
+// SetBucketPolicy заменяет политику доступа бакета
+func (v *vfs) SetBucketPolicy(ctx context.Context, policy *s3.BucketPolicy) (err error) {
+	_, err = bucketExec(ctx, v, "SetBucketPolicy", func(m s3.BucketManager, bucket string) (struct{}, error) {
+		return struct{}{}, m.SetBucketPolicy(bucket, policy)
+	})
+
+	return err
+}
+
+// BucketVersioning состояние версионирования бакета (s3.VersioningOff, s3.VersioningEnabled, s3.VersioningSuspended)
+func (v *vfs) BucketVersioning(ctx context.Context) (status string, err error) {
+	return bucketExec(ctx, v, "BucketVersioning", func(m s3.BucketManager, bucket string) (string, error) {
+		return m.BucketVersioning(bucket)
+	})
+}
+
+// SetBucketVersioning включает или приостанавливает версионирование бакета
+func (v *vfs) SetBucketVersioning(ctx context.Context, enabled bool) (err error) {
+	_, err = bucketExec(ctx, v, "SetBucketVersioning", func(m s3.BucketManager, bucket string) (struct{}, error) {
+		return struct{}{}, m.SetBucketVersioning(bucket, enabled)
+	})
+
+	return err
+}
+
+// BucketLifecycle правила lifecycle бакета (nil - не заданы)
+func (v *vfs) BucketLifecycle(ctx context.Context) (rules []s3.LifecycleRule, err error) {
+	return bucketExec(ctx, v, "BucketLifecycle", func(m s3.BucketManager, bucket string) ([]s3.LifecycleRule, error) {
+		return m.BucketLifecycle(bucket)
+	})
+}
+
+// SetBucketLifecycle заменяет правила lifecycle бакета
+func (v *vfs) SetBucketLifecycle(ctx context.Context, rules []s3.LifecycleRule) (err error) {
+	_, err = bucketExec(ctx, v, "SetBucketLifecycle", func(m s3.BucketManager, bucket string) (struct{}, error) {
+		return struct{}{}, m.SetBucketLifecycle(bucket, rules)
+	})
+
+	return err
+}
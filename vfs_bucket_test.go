@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3"
+	"git.lowcodeplatform.net/packages/lib/pkg/s3/s3test"
+)
+
+func TestVfsBucketConfig(t *testing.T) {
+	v := newTestVfs(t)
+
+	// мидлвари пропускаются до исходного хранилища
+	buckets, ok := VfsBucketConfig(ChainVfs(v, WithVfsRetry(VfsRetryConfig{Delay: time.Millisecond})))
+	assert.True(t, ok)
+
+	// настройка бакета поддерживается только s3
+	_, err := buckets.BucketCORS(context.Background())
+	assert.ErrorIs(t, err, ErrVfsOptionsUnsupported)
+
+	_, ok = VfsBucketConfig(NewOverlayVfs(v))
+	assert.False(t, ok)
+}
+
+func TestVfsBucketConfigHooked(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("files")
+
+	errDenied := errors.New("denied")
+	var ops []string
+	v := ChainVfs(newS3TestVfs(t, srv), WithVfsRetry(VfsRetryConfig{Delay: time.Millisecond}), WithVfsHooks(VfsHooks{
+		Before: func(ctx context.Context, call *VfsCall) error {
+			ops = append(ops, call.Op+":"+call.Path)
+			if call.Op == VfsOpSetBucketConfig {
+				return errDenied
+			}
+			return nil
+		},
+	}))
+	ctx := context.Background()
+
+	// настройка бакета не обходит хуки
+	buckets, ok := VfsBucketConfig(v)
+	assert.True(t, ok)
+	_, err := buckets.BucketCORS(ctx)
+	assert.NoError(t, err)
+	err = buckets.SetBucketCORS(ctx, []s3.CORSRule{{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}}})
+	assert.ErrorIs(t, err, errDenied)
+	assert.Equal(t, []string{"bucket_config:cors", "set_bucket_config:cors"}, ops)
+
+	// хранилище без настройки бакета за хуками
+	_, ok = VfsBucketConfig(ChainVfs(NewOverlayVfs(newTestVfs(t)), WithVfsHooks(VfsHooks{})))
+	assert.False(t, ok)
+}
@@ -0,0 +1,218 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3"
+)
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// vfsWriteLocks блокировки условной записи для хранилищ без поддержки условных запросов
+// (блокировка по хешу пути, чтобы не хранить мьютекс на каждый файл)
+var vfsWriteLocks [256]sync.Mutex
+
+type writeConditions struct {
+	ifMatch           string
+	ifNoneMatch       string
+	ifUnmodifiedSince time.Time
+}
+
+// WriteCondition условие записи файла (compare-and-swap)
+type WriteCondition func(c *writeConditions)
+
+// IfMatch запись пройдет, только если текущий ETag файла совпадает с etag ("*" - файл существует)
+func IfMatch(etag string) WriteCondition {
+	return func(c *writeConditions) {
+		c.ifMatch = etag
+	}
+}
+
+// IfNoneMatch запись пройдет, только если ETag файла не совпадает с etag
+// IfNoneMatch("*") - только создание нового файла
+func IfNoneMatch(etag string) WriteCondition {
+	return func(c *writeConditions) {
+		c.ifNoneMatch = etag
+	}
+}
+
+// IfUnmodifiedSince запись пройдет, только если файл существует и не изменялся после t
+func IfUnmodifiedSince(t time.Time) WriteCondition {
+	return func(c *writeConditions) {
+		c.ifUnmodifiedSince = t
+	}
+}
+
+func newWriteConditions(conditions []WriteCondition) (c writeConditions) {
+	for _, condition := range conditions {
+		if condition != nil {
+			condition(&c)
+		}
+	}
+
+	return c
+}
+
+// ConditionalWriter хранилище с поддержкой условной записи
+// при невыполнении условия возвращается ошибка, оборачивающая ErrPreconditionFailed
+type ConditionalWriter interface {
+	WriteIf(ctx context.Context, file string, data []byte, conditions ...WriteCondition) (err error)
+}
+
+// WriteIf условная запись в хранилище
+// если хранилище не реализует ConditionalWriter, условие проверяется под блокировкой внутри процесса
+func WriteIf(ctx context.Context, v Vfs, file string, data []byte, conditions ...WriteCondition) (err error) {
+	if w, ok := v.(ConditionalWriter); ok {
+		return w.WriteIf(ctx, file, data, conditions...)
+	}
+
+	return writeIfLocked(ctx, v, fmt.Sprintf("%p", v), file, data, newWriteConditions(conditions))
+}
+
+// WriteIf условная запись: для s3 условие передается заголовками запроса и проверяется хранилищем,
+// для остальных хранилищ - сравнением ETag под блокировкой (атомарно только в пределах процесса)
+// проверка и запись выполняются через одно собственное соединение, поля vfs не изменяются
+func (v *vfs) WriteIf(ctx context.Context, file string, data []byte, conditions ...WriteCondition) (err error) {
+	c := newWriteConditions(conditions)
+
+	location, container, err := v.dial()
+	if location != nil {
+		defer location.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("error connect to filestorage. err: %s cfg: VfsKind: %s, VfsEndpoint: %s, VfsBucket: %s", err, v.kind, v.endpoint, v.bucket)
+	}
+
+	getItem := func() (Item, error) {
+		return v.getItemFrom(location, file, v.bucket)
+	}
+
+	name := file
+	if v.comma != "" {
+		name = strings.Replace(name, sep, v.comma, -1)
+	}
+	if strings.Contains(name, "../") {
+		return fmt.Errorf("path file not valid")
+	}
+
+	putter, ok := container.(s3.ConditionalPutter)
+	if !ok || strings.ToLower(v.kind) != "s3" {
+		return withWriteLock(v.kind+v.endpoint+v.bucket, file, func() error {
+			return compareAndWrite(file, c, getItem, func() error {
+				_, err := container.Put(name, bytes.NewReader(data), int64(len(data)), nil)
+				return err
+			})
+		})
+	}
+
+	// s3 не поддерживает If-Unmodified-Since при записи - проверяем дату и фиксируем текущий ETag через If-Match
+	if !c.ifUnmodifiedSince.IsZero() && c.ifMatch == "" {
+		item, err := getItem()
+		if err != nil {
+			if IsVfsNotFound(err) {
+				return fmt.Errorf("%w: file %s not exist", ErrPreconditionFailed, file)
+			}
+			return err
+		}
+		if err = checkWriteConditions(file, item, c); err != nil {
+			return err
+		}
+		if c.ifMatch, err = item.ETag(); err != nil {
+			return err
+		}
+	}
+
+	_, err = putter.PutIf(name, bytes.NewReader(data), int64(len(data)), nil, s3.PutCondition{
+		IfMatch:     c.ifMatch,
+		IfNoneMatch: c.ifNoneMatch,
+	})
+	if errors.Is(err, s3.ErrPreconditionFailed) {
+		return fmt.Errorf("%w: file %s", ErrPreconditionFailed, file)
+	}
+
+	return err
+}
+
+// writeIfLocked проверяет условие и пишет файл под блокировкой ключа хранилища и пути
+func writeIfLocked(ctx context.Context, v Vfs, key, file string, data []byte, c writeConditions) (err error) {
+	return withWriteLock(key, file, func() error {
+		return compareAndWrite(file, c, func() (Item, error) {
+			return v.Item(ctx, file)
+		}, func() error {
+			return v.Write(ctx, file, data)
+		})
+	})
+}
+
+// withWriteLock выполняет fn под блокировкой ключа хранилища и пути
+func withWriteLock(key, file string, fn func() error) error {
+	h := fnv.New32a()
+	h.Write([]byte(key + "|" + file))
+	lock := &vfsWriteLocks[h.Sum32()%uint32(len(vfsWriteLocks))]
+	lock.Lock()
+	defer lock.Unlock()
+
+	return fn()
+}
+
+// compareAndWrite проверяет условие для текущего состояния файла и выполняет запись
+func compareAndWrite(file string, c writeConditions, getItem func() (Item, error), write func() error) (err error) {
+	item, err := getItem()
+	if err == nil {
+		// часть хранилищ (local) возвращает Item без проверки существования - проверяем через Size
+		if _, err = item.Size(); err != nil {
+			item = nil
+		}
+	}
+	if err != nil && !IsVfsNotFound(err) {
+		return err
+	}
+
+	if err = checkWriteConditions(file, item, c); err != nil {
+		return err
+	}
+
+	return write()
+}
+
+// checkWriteConditions проверяет условия записи для текущего состояния файла (item == nil - файла нет)
+func checkWriteConditions(file string, item Item, c writeConditions) error {
+	var etag string
+	var modified time.Time
+	if item != nil {
+		var err error
+		if etag, err = item.ETag(); err != nil {
+			return err
+		}
+		if modified, err = item.LastMod(); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case c.ifMatch != "" && (item == nil || (c.ifMatch != "*" && !sameETag(c.ifMatch, etag))):
+		return fmt.Errorf("%w: file %s does not match etag %s", ErrPreconditionFailed, file, c.ifMatch)
+	case c.ifNoneMatch != "" && item != nil && (c.ifNoneMatch == "*" || sameETag(c.ifNoneMatch, etag)):
+		return fmt.Errorf("%w: file %s already exists", ErrPreconditionFailed, file)
+	case !c.ifUnmodifiedSince.IsZero() && (item == nil || modified.After(c.ifUnmodifiedSince)):
+		return fmt.Errorf("%w: file %s modified since %s", ErrPreconditionFailed, file, c.ifUnmodifiedSince.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// sameETag сравнивает ETag без учета кавычек и признака слабого ETag
+func sameETag(a, b string) bool {
+	clean := func(etag string) string {
+		return strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+	}
+
+	return clean(a) == clean(b)
+}
@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteIf(t *testing.T) {
+	ctx := context.Background()
+	v := newTestVfs(t)
+
+	assert.NoError(t, WriteIf(ctx, v, "page.json", []byte(`{"v":1}`), IfNoneMatch("*")))
+	assert.ErrorIs(t, WriteIf(ctx, v, "page.json", []byte(`{"v":1}`), IfNoneMatch("*")), ErrPreconditionFailed)
+
+	item, err := v.Item(ctx, "page.json")
+	assert.NoError(t, err)
+	etag, err := item.ETag()
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, WriteIf(ctx, v, "page.json", []byte(`{"v":2}`), IfMatch("other")), ErrPreconditionFailed)
+	assert.ErrorIs(t, WriteIf(ctx, v, "none.json", []byte(`{}`), IfMatch("*")), ErrPreconditionFailed)
+	assert.NoError(t, WriteIf(ctx, v, "page.json", []byte(`{"v":2}`), IfMatch(etag)))
+
+	assert.ErrorIs(t, WriteIf(ctx, v, "page.json", []byte(`{"v":3}`), IfUnmodifiedSince(time.Now().Add(-time.Hour))), ErrPreconditionFailed)
+	assert.NoError(t, WriteIf(ctx, v, "page.json", []byte(`{"v":3}`), IfUnmodifiedSince(time.Now().Add(time.Hour))))
+
+	data, _, err := v.Read(ctx, "page.json", false)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"v":3}`, string(data))
+}
+
+func TestWriteIfConcurrent(t *testing.T) {
+	ctx := context.Background()
+	// условная запись проходит через мидлвари
+	v := ChainVfs(newTestVfs(t), WithVfsHooks(VfsHooks{}))
+
+	var created int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if WriteIf(ctx, v, "lock.json", []byte("owner"), IfNoneMatch("*")) == nil {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), created)
+}
@@ -0,0 +1,326 @@
+package lib
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3"
+	"git.lowcodeplatform.net/packages/models"
+)
+
+// Способы авторизации в s3 (см. pkg/s3 ConfigAuthType)
+const (
+	VfsAuthAccessKey  = "accesskey"
+	VfsAuthIAM        = "iam"
+	VfsAuthEnv        = "env"
+	VfsAuthFile       = "file"
+	VfsAuthProvider   = "provider"
+	VfsAuthAssumeRole = "assume_role"
+)
+
+var ErrVfsConfig = errors.New("vfs config is not valid")
+
+// VfsConfig параметры подключения к хранилищу
+// совместим с ConfigLoad (toml + переменные окружения), поля совпадают с models.VFSConfig
+// VfsDSN, если задан, заполняет незаданные поля (s3://key:secret@host:9000/bucket?region=ru-central-1&v2_signing=true)
+type VfsConfig struct {
+	VfsDSN         string `envconfig:"VFS_DSN" default:"" toml:"VfsDSN"`
+	VfsKind        string `envconfig:"VFS_KIND" default:"" toml:"VfsKind"`
+	VfsEndpoint    string `envconfig:"VFS_ENDPOINT" default:"" toml:"VfsEndpoint"`
+	VfsAccessKeyID string `envconfig:"VFS_ACCESS_KEY_ID" default:"" toml:"VfsAccessKeyID"`
+	VfsSecretKey   string `envconfig:"VFS_SECRET_KEY" default:"" toml:"VfsSecretKey"`
+	VfsRegion      string `envconfig:"VFS_REGION" default:"" toml:"VfsRegion"`
+	VfsBucket      string `envconfig:"VFS_BUCKET" default:"" toml:"VfsBucket"`
+	VfsComma       string `envconfig:"VFS_COMMA" default:"" toml:"VfsComma"`
+	VfsCertCA      string `envconfig:"VFS_CERT_CA" default:"" toml:"VfsCertCA" description:"CA-сертификат"`
+	VfsCAFile      string `envconfig:"VFS_CA_FILE" default:"" toml:"VfsCAFile" description:"Файл CA-сертификата"`
+	VfsDisableSSL  bool   `envconfig:"VFS_DISABLE_SSL" default:"false" toml:"VfsDisableSSL"`
+	VfsV2Signing   bool   `envconfig:"VFS_V2_SIGNING" default:"false" toml:"VfsV2Signing"`
+	VfsAuthType    string `envconfig:"VFS_AUTH_TYPE" default:"" toml:"VfsAuthType" description:"accesskey, iam, env, file, provider или assume_role"`
+
+	VfsToken               string `envconfig:"VFS_TOKEN" default:"" toml:"VfsToken" description:"сессионный токен временных ключей"`
+	VfsCredentialsFile     string `envconfig:"VFS_CREDENTIALS_FILE" default:"" toml:"VfsCredentialsFile"`
+	VfsProfile             string `envconfig:"VFS_PROFILE" default:"" toml:"VfsProfile"`
+	VfsCredentialsProvider string `envconfig:"VFS_CREDENTIALS_PROVIDER" default:"" toml:"VfsCredentialsProvider" description:"имя провайдера, см. s3.RegisterCredentialsProvider"`
+	VfsRoleARN             string `envconfig:"VFS_ROLE_ARN" default:"" toml:"VfsRoleARN"`
+	VfsRoleSessionName     string `envconfig:"VFS_ROLE_SESSION_NAME" default:"" toml:"VfsRoleSessionName"`
+	VfsRoleExternalID      string `envconfig:"VFS_ROLE_EXTERNAL_ID" default:"" toml:"VfsRoleExternalID"`
+	VfsRoleDuration        string `envconfig:"VFS_ROLE_DURATION" default:"" toml:"VfsRoleDuration" description:"длительность сессии роли, например 1h"`
+	VfsSTSEndpoint         string `envconfig:"VFS_STS_ENDPOINT" default:"" toml:"VfsSTSEndpoint"`
+
+	VfsSSE            string `envconfig:"VFS_SSE" default:"" toml:"VfsSSE" description:"AES256 или aws:kms"`
+	VfsSSEKMSKeyID    string `envconfig:"VFS_SSE_KMS_KEY_ID" default:"" toml:"VfsSSEKMSKeyID"`
+	VfsSSECustomerKey string `envconfig:"VFS_SSE_CUSTOMER_KEY" default:"" toml:"VfsSSECustomerKey" description:"ключ SSE-C (base64, 32 байта)"`
+	VfsStorageClass   string `envconfig:"VFS_STORAGE_CLASS" default:"" toml:"VfsStorageClass"`
+	VfsListArchived   bool   `envconfig:"VFS_LIST_ARCHIVED" default:"false" toml:"VfsListArchived" description:"показывать в List архивные файлы (GLACIER)"`
+}
+
+// VfsConfigFromModels переносит системный конфиг models.VFSConfig
+func VfsConfigFromModels(cfg models.VFSConfig) VfsConfig {
+	return VfsConfig{
+		VfsKind:        cfg.VfsKind,
+		VfsEndpoint:    cfg.VfsEndpoint,
+		VfsAccessKeyID: cfg.VfsAccessKeyID,
+		VfsSecretKey:   cfg.VfsSecretKey,
+		VfsRegion:      cfg.VfsRegion,
+		VfsBucket:      cfg.VfsBucket,
+		VfsComma:       cfg.VfsComma,
+		VfsCertCA:      cfg.VfsCertCA,
+		VfsCAFile:      cfg.VfsCAFile,
+	}
+}
+
+// ParseVfsDSN разбирает строку подключения вида
+//
+//	s3://key:secret@host:9000/bucket?region=ru-central-1&disable_ssl=true&v2_signing=true&auth_type=iam&comma=|&ca_file=/etc/ca.pem
+//	s3://key:secret@host/bucket?sse=aws:kms&sse_kms_key_id=key&storage_class=STANDARD_IA&list_archived=true
+//	s3://key:secret@host/bucket?auth_type=assume_role&role_arn=arn:aws:iam::1:role/x&sts_endpoint=https://sts.host
+//	local:///var/data?bucket=x
+//
+// для local путь задает директорию хранилища, бакет передается параметром bucket
+func ParseVfsDSN(dsn string) (cfg VfsConfig, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return cfg, fmt.Errorf("%w: error parse dsn. err: %s", ErrVfsConfig, err)
+	}
+	if u.Scheme == "" {
+		return cfg, fmt.Errorf("%w: storage kind is not set in dsn", ErrVfsConfig)
+	}
+
+	query := u.Query()
+	cfg.VfsKind = strings.ToLower(u.Scheme)
+	cfg.VfsRegion = query.Get("region")
+	cfg.VfsComma = query.Get("comma")
+	cfg.VfsCAFile = query.Get("ca_file")
+	cfg.VfsAuthType = query.Get("auth_type")
+	cfg.VfsToken = query.Get("token")
+	cfg.VfsCredentialsFile = query.Get("credentials_file")
+	cfg.VfsProfile = query.Get("profile")
+	cfg.VfsCredentialsProvider = query.Get("credentials_provider")
+	cfg.VfsRoleARN = query.Get("role_arn")
+	cfg.VfsRoleSessionName = query.Get("role_session_name")
+	cfg.VfsRoleExternalID = query.Get("role_external_id")
+	cfg.VfsRoleDuration = query.Get("role_duration")
+	cfg.VfsSTSEndpoint = query.Get("sts_endpoint")
+	cfg.VfsSSE = query.Get("sse")
+	cfg.VfsSSEKMSKeyID = query.Get("sse_kms_key_id")
+	cfg.VfsSSECustomerKey = query.Get("sse_customer_key")
+	cfg.VfsStorageClass = query.Get("storage_class")
+	if u.User != nil {
+		cfg.VfsAccessKeyID = u.User.Username()
+		cfg.VfsSecretKey, _ = u.User.Password()
+	}
+
+	for param, value := range map[string]*bool{
+		"disable_ssl":   &cfg.VfsDisableSSL,
+		"v2_signing":    &cfg.VfsV2Signing,
+		"list_archived": &cfg.VfsListArchived,
+	} {
+		if query.Get(param) == "" {
+			continue
+		}
+		*value, err = strconv.ParseBool(query.Get(param))
+		if err != nil {
+			return cfg, fmt.Errorf("%w: error parse %s. err: %s", ErrVfsConfig, param, err)
+		}
+	}
+
+	if cfg.VfsKind == "local" {
+		cfg.VfsEndpoint = u.Host + u.Path
+		cfg.VfsBucket = query.Get("bucket")
+
+		return cfg, nil
+	}
+
+	cfg.VfsBucket = strings.Trim(u.Path, "/")
+	if bucket := query.Get("bucket"); bucket != "" {
+		cfg.VfsBucket = bucket
+	}
+	if u.Host != "" {
+		scheme := "https://"
+		if cfg.VfsDisableSSL {
+			scheme = "http://"
+		}
+		cfg.VfsEndpoint = scheme + u.Host
+	}
+
+	return cfg, nil
+}
+
+// merge заполняет незаданные поля значениями из src
+func (c *VfsConfig) merge(src VfsConfig) {
+	for _, field := range []struct {
+		dst *string
+		src string
+	}{
+		{&c.VfsKind, src.VfsKind},
+		{&c.VfsEndpoint, src.VfsEndpoint},
+		{&c.VfsAccessKeyID, src.VfsAccessKeyID},
+		{&c.VfsSecretKey, src.VfsSecretKey},
+		{&c.VfsRegion, src.VfsRegion},
+		{&c.VfsBucket, src.VfsBucket},
+		{&c.VfsComma, src.VfsComma},
+		{&c.VfsCertCA, src.VfsCertCA},
+		{&c.VfsCAFile, src.VfsCAFile},
+		{&c.VfsAuthType, src.VfsAuthType},
+		{&c.VfsToken, src.VfsToken},
+		{&c.VfsCredentialsFile, src.VfsCredentialsFile},
+		{&c.VfsProfile, src.VfsProfile},
+		{&c.VfsCredentialsProvider, src.VfsCredentialsProvider},
+		{&c.VfsRoleARN, src.VfsRoleARN},
+		{&c.VfsRoleSessionName, src.VfsRoleSessionName},
+		{&c.VfsRoleExternalID, src.VfsRoleExternalID},
+		{&c.VfsRoleDuration, src.VfsRoleDuration},
+		{&c.VfsSTSEndpoint, src.VfsSTSEndpoint},
+		{&c.VfsSSE, src.VfsSSE},
+		{&c.VfsSSEKMSKeyID, src.VfsSSEKMSKeyID},
+		{&c.VfsSSECustomerKey, src.VfsSSECustomerKey},
+		{&c.VfsStorageClass, src.VfsStorageClass},
+	} {
+		if *field.dst == "" {
+			*field.dst = field.src
+		}
+	}
+
+	c.VfsDisableSSL = c.VfsDisableSSL || src.VfsDisableSSL
+	c.VfsV2Signing = c.VfsV2Signing || src.VfsV2Signing
+	c.VfsListArchived = c.VfsListArchived || src.VfsListArchived
+}
+
+// Validate проверяет заполненность параметров подключения (с учетом VfsDSN)
+func (c VfsConfig) Validate() error {
+	_, err := c.resolve()
+
+	return err
+}
+
+// resolve применяет VfsDSN и проверяет параметры
+func (c VfsConfig) resolve() (VfsConfig, error) {
+	if c.VfsDSN != "" {
+		dsn, err := ParseVfsDSN(c.VfsDSN)
+		if err != nil {
+			return c, err
+		}
+		c.merge(dsn)
+	}
+
+	c.VfsKind = strings.ToLower(c.VfsKind)
+	switch c.VfsKind {
+	case "":
+		return c, fmt.Errorf("%w: VfsKind is empty", ErrVfsConfig)
+	case "s3", "local", "azure", "google", "swift", "oracle":
+	default:
+		return c, fmt.Errorf("%w: unsupported VfsKind %s", ErrVfsConfig, c.VfsKind)
+	}
+
+	if c.VfsBucket == "" {
+		return c, fmt.Errorf("%w: VfsBucket is empty", ErrVfsConfig)
+	}
+
+	switch c.VfsKind {
+	case "local":
+		if c.VfsEndpoint == "" {
+			return c, fmt.Errorf("%w: VfsEndpoint (directory) is empty", ErrVfsConfig)
+		}
+	case "s3":
+		switch strings.ToLower(c.VfsAuthType) {
+		case "", VfsAuthAccessKey:
+			if c.VfsAccessKeyID == "" || c.VfsSecretKey == "" {
+				return c, fmt.Errorf("%w: VfsAccessKeyID and VfsSecretKey are required for %s auth", ErrVfsConfig, VfsAuthAccessKey)
+			}
+		case VfsAuthIAM, VfsAuthEnv, VfsAuthFile:
+		case VfsAuthProvider:
+			if c.VfsCredentialsProvider == "" {
+				return c, fmt.Errorf("%w: VfsCredentialsProvider is required for %s auth", ErrVfsConfig, VfsAuthProvider)
+			}
+		case VfsAuthAssumeRole:
+			if c.VfsRoleARN == "" {
+				return c, fmt.Errorf("%w: VfsRoleARN is required for %s auth", ErrVfsConfig, VfsAuthAssumeRole)
+			}
+			if c.VfsRoleDuration != "" {
+				if _, err := time.ParseDuration(c.VfsRoleDuration); err != nil {
+					return c, fmt.Errorf("%w: error parse VfsRoleDuration. err: %s", ErrVfsConfig, err)
+				}
+			}
+		default:
+			return c, fmt.Errorf("%w: unsupported VfsAuthType %s", ErrVfsConfig, c.VfsAuthType)
+		}
+		switch c.VfsSSE {
+		case "", s3.SSEAES256, s3.SSEKMS:
+		default:
+			return c, fmt.Errorf("%w: unsupported VfsSSE %s (%s or %s)", ErrVfsConfig, c.VfsSSE, s3.SSEAES256, s3.SSEKMS)
+		}
+		if c.VfsSSEKMSKeyID != "" && c.VfsSSE != s3.SSEKMS {
+			return c, fmt.Errorf("%w: VfsSSEKMSKeyID requires VfsSSE %s", ErrVfsConfig, s3.SSEKMS)
+		}
+		if c.VfsSSECustomerKey != "" {
+			key, err := base64.StdEncoding.DecodeString(c.VfsSSECustomerKey)
+			if err != nil || len(key) != 32 {
+				return c, fmt.Errorf("%w: VfsSSECustomerKey must be base64 encoded 32 bytes key", ErrVfsConfig)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// NewVfsFromConfig создает хранилище по конфигу
+// CA-сертификат берется из VfsCertCA, а если он пуст - читается из VfsCAFile
+func NewVfsFromConfig(cfg VfsConfig) (Vfs, error) {
+	cfg, err := cfg.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	cacert := cfg.VfsCertCA
+	if cacert == "" && cfg.VfsCAFile != "" {
+		data, err := os.ReadFile(cfg.VfsCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error read VfsCAFile %s. err: %w", cfg.VfsCAFile, err)
+		}
+		cacert = string(data)
+	}
+
+	return &vfs{
+		kind:        cfg.VfsKind,
+		endpoint:    cfg.VfsEndpoint,
+		accessKeyID: cfg.VfsAccessKeyID,
+		secretKey:   cfg.VfsSecretKey,
+		region:      cfg.VfsRegion,
+		bucket:      cfg.VfsBucket,
+		comma:       cfg.VfsComma,
+		cacert:      cacert,
+		disableSSL:  cfg.VfsDisableSSL,
+		v2Signing:   cfg.VfsV2Signing,
+		authType:    strings.ToLower(cfg.VfsAuthType),
+		creds: vfsCredentials{
+			token:        cfg.VfsToken,
+			file:         cfg.VfsCredentialsFile,
+			profile:      cfg.VfsProfile,
+			provider:     cfg.VfsCredentialsProvider,
+			roleARN:      cfg.VfsRoleARN,
+			sessionName:  cfg.VfsRoleSessionName,
+			externalID:   cfg.VfsRoleExternalID,
+			roleDuration: cfg.VfsRoleDuration,
+			stsEndpoint:  cfg.VfsSTSEndpoint,
+		},
+		sse: vfsSSE{
+			sse:          cfg.VfsSSE,
+			kmsKeyID:     cfg.VfsSSEKMSKeyID,
+			customerKey:  cfg.VfsSSECustomerKey,
+			storageClass: cfg.VfsStorageClass,
+			listArchived: cfg.VfsListArchived,
+		},
+	}, nil
+}
+
+// NewVfsFromDSN создает хранилище по строке подключения (см. ParseVfsDSN)
+func NewVfsFromDSN(dsn string) (Vfs, error) {
+	return NewVfsFromConfig(VfsConfig{VfsDSN: dsn})
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVfsDSN(t *testing.T) {
+	cases := []struct {
+		dsn  string
+		want VfsConfig
+	}{
+		{
+			dsn: "s3://key:secret@127.0.0.1:9000/bucket?region=ru-central-1&v2_signing=true&disable_ssl=true",
+			want: VfsConfig{
+				VfsKind:        "s3",
+				VfsEndpoint:    "http://127.0.0.1:9000",
+				VfsAccessKeyID: "key",
+				VfsSecretKey:   "secret",
+				VfsRegion:      "ru-central-1",
+				VfsBucket:      "bucket",
+				VfsDisableSSL:  true,
+				VfsV2Signing:   true,
+			},
+		},
+		{
+			dsn: "s3://storage.yandexcloud.net/files?auth_type=iam",
+			want: VfsConfig{
+				VfsKind:     "s3",
+				VfsEndpoint: "https://storage.yandexcloud.net",
+				VfsBucket:   "files",
+				VfsAuthType: VfsAuthIAM,
+			},
+		},
+		{
+			dsn: "s3://key:secret@host/files?sse=aws:kms&sse_kms_key_id=k1&storage_class=STANDARD_IA&list_archived=true",
+			want: VfsConfig{
+				VfsKind:         "s3",
+				VfsEndpoint:     "https://host",
+				VfsAccessKeyID:  "key",
+				VfsSecretKey:    "secret",
+				VfsBucket:       "files",
+				VfsSSE:          "aws:kms",
+				VfsSSEKMSKeyID:  "k1",
+				VfsStorageClass: "STANDARD_IA",
+				VfsListArchived: true,
+			},
+		},
+		{
+			dsn: "local:///var/data?bucket=x",
+			want: VfsConfig{
+				VfsKind:     "local",
+				VfsEndpoint: "/var/data",
+				VfsBucket:   "x",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cfg, err := ParseVfsDSN(c.dsn)
+		assert.NoError(t, err, c.dsn)
+		assert.Equal(t, c.want, cfg, c.dsn)
+	}
+
+	_, err := ParseVfsDSN("s3://host/bucket?v2_signing=maybe")
+	assert.ErrorIs(t, err, ErrVfsConfig)
+}
+
+func TestVfsConfigValidate(t *testing.T) {
+	cases := []struct {
+		cfg   VfsConfig
+		valid bool
+	}{
+		{VfsConfig{VfsDSN: "s3://key:secret@host/bucket"}, true},
+		{VfsConfig{VfsDSN: "s3://host/bucket"}, false},
+		{VfsConfig{VfsDSN: "s3://host/bucket", VfsAccessKeyID: "key", VfsSecretKey: "secret"}, true},
+		{VfsConfig{VfsKind: "s3", VfsBucket: "b", VfsAuthType: "iam"}, true},
+		{VfsConfig{VfsKind: "s3", VfsBucket: "b", VfsAuthType: "token"}, false},
+		{VfsConfig{VfsKind: "s3", VfsBucket: "b", VfsAuthType: "env"}, true},
+		{VfsConfig{VfsDSN: "s3://host/b?auth_type=assume_role&role_arn=arn:aws:iam::1:role/x&role_duration=1h"}, true},
+		{VfsConfig{VfsDSN: "s3://host/b?auth_type=assume_role"}, false},
+		{VfsConfig{VfsDSN: "s3://host/b?auth_type=assume_role&role_arn=arn&role_duration=day"}, false},
+		{VfsConfig{VfsKind: "s3", VfsBucket: "b", VfsAuthType: "provider"}, false},
+		{VfsConfig{VfsKind: "ftp", VfsBucket: "b"}, false},
+		{VfsConfig{VfsDSN: "s3://key:secret@host/bucket?sse=AES256"}, true},
+		{VfsConfig{VfsDSN: "s3://key:secret@host/bucket?sse=DES"}, false},
+		{VfsConfig{VfsDSN: "s3://key:secret@host/bucket?sse=AES256&sse_kms_key_id=k1"}, false},
+		{VfsConfig{VfsDSN: "s3://key:secret@host/bucket", VfsSSECustomerKey: "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}, true},
+		{VfsConfig{VfsDSN: "s3://key:secret@host/bucket", VfsSSECustomerKey: "c2hvcnQ="}, false},
+		{VfsConfig{VfsKind: "local", VfsBucket: "b"}, false},
+		{VfsConfig{VfsKind: "local", VfsEndpoint: "/tmp"}, false},
+	}
+
+	for _, c := range cases {
+		err := c.cfg.Validate()
+		if c.valid {
+			assert.NoError(t, err, "%+v", c.cfg)
+		} else {
+			assert.ErrorIs(t, err, ErrVfsConfig, "%+v", c.cfg)
+		}
+	}
+}
+
+func TestNewVfsFromDSN(t *testing.T) {
+	ctx := context.Background()
+
+	v, err := NewVfsFromDSN("local://" + t.TempDir() + "?bucket=files")
+	assert.NoError(t, err)
+	assert.NoError(t, v.Write(ctx, "a.txt", []byte("dsn")))
+
+	data, _, err := v.Read(ctx, "a.txt", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "dsn", string(data))
+
+	// шифрование поддерживается только s3 - файл не пишется без него
+	err = WriteWithOptions(ctx, v, "b.txt", []byte("secret"), WriteOptions{SSE: "AES256"})
+	assert.ErrorIs(t, err, ErrVfsOptionsUnsupported)
+	exists, err := vfsExists(ctx, v, "b.txt")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
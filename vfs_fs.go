@@ -0,0 +1,619 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const vfsFSPageSize = 1000
+
+var ErrVfsReadOnly = errors.New("vfs is read only")
+
+// VfsFS адаптер Vfs к интерфейсам io/fs (fs.FS, fs.ReadDirFS, fs.StatFS, fs.ReadFileFS)
+// позволяет использовать хранилище в html/template.ParseFS, http.FS, fs.WalkDir
+// директории в хранилище не хранятся и синтезируются из префиксов файлов
+type VfsFS struct {
+	ctx           context.Context
+	vfs           Vfs
+	privateAccess bool
+}
+
+// NewVfsFS создаем адаптер с привязанным контекстом, который передается во все операции Vfs
+// privateAccess - параметр, который позволяет читать из приватной директории другого пользователя (по умолчанию ставьте false)
+func NewVfsFS(ctx context.Context, v Vfs, privateAccess bool) *VfsFS {
+	return &VfsFS{
+		ctx:           ctx,
+		vfs:           v,
+		privateAccess: privateAccess,
+	}
+}
+
+// Open открывает файл или синтезированную директорию
+func (f *VfsFS) Open(name string) (fs.File, error) {
+	info, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return &vfsDir{fsys: f, name: name, info: info}, nil
+	}
+
+	reader, err := f.vfs.ReadCloser(f.ctx, name, f.privateAccess)
+	if err != nil {
+		return nil, f.pathError("open", name, err)
+	}
+
+	return &vfsFile{fsys: f, name: name, info: info, reader: reader}, nil
+}
+
+// Stat возвращает информацию о файле или директории
+func (f *VfsFS) Stat(name string) (fs.FileInfo, error) {
+	return f.stat("stat", name)
+}
+
+// ReadFile читает файл целиком
+func (f *VfsFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+
+	reader, err := f.vfs.ReadCloser(f.ctx, name, f.privateAccess)
+	if err != nil {
+		return nil, f.pathError("readfile", name, err)
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// ReadDir возвращает отсортированный по имени список файлов и директорий первого уровня
+func (f *VfsFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entries, err := f.readDir(name)
+	if err != nil {
+		return nil, f.pathError("readdir", name, err)
+	}
+	if len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return entries, nil
+}
+
+func (f *VfsFS) readDir(name string) (entries []fs.DirEntry, err error) {
+	prefix := ""
+	if name != "." {
+		prefix = name + "/"
+	}
+
+	files, dirs, err := ListDir(f.ctx, f.vfs, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range files {
+		rel := strings.TrimPrefix(item.Name(), prefix)
+		if rel == "" {
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(newItemInfo(rel, item)))
+	}
+	for _, dir := range dirs {
+		entries = append(entries, fs.FileInfoToDirEntry(newDirInfo(dir)))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+func (f *VfsFS) stat(op, name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return newDirInfo("."), nil
+	}
+
+	// файл проверяем одним запросом Item, часть хранилищ (local) возвращает Item без проверки существования -
+	// проверяем через Size, а директорию на диске отличаем по метаданным
+	item, errItem := f.vfs.Item(f.ctx, name)
+	if errItem == nil {
+		if _, errItem = item.Size(); errItem == nil && !isDirItem(item) {
+			return newItemInfo(path.Base(name), item), nil
+		}
+	}
+
+	// директории синтезируются из префиксов - достаточно одного файла с префиксом
+	items, err := ListLimit(f.ctx, f.vfs, name+"/", 1)
+	if err != nil {
+		return nil, f.pathError(op, name, err)
+	}
+	if len(items) > 0 {
+		return newDirInfo(path.Base(name)), nil
+	}
+	// пустая директория на диске в хранилище не существует
+	if errItem == nil {
+		errItem = fs.ErrNotExist
+	}
+
+	return nil, f.pathError(op, name, errItem)
+}
+
+// isDirItem Item директории на диске (local хранилище отдает признак в метаданных is_dir)
+func isDirItem(item Item) bool {
+	metadata, err := item.Metadata()
+	if err != nil {
+		return false
+	}
+	dir, _ := metadata["is_dir"].(bool)
+
+	return dir
+}
+
+// LimitedLister хранилище, которое умеет возвращать не больше limit файлов с префиксом за один запрос
+type LimitedLister interface {
+	ListLimit(ctx context.Context, prefix string, limit int) (files []Item, err error)
+}
+
+// ListLimit возвращает не больше limit файлов с префиксом prefix
+// если хранилище не реализует LimitedLister - читает весь список через List и обрезает его
+func ListLimit(ctx context.Context, v Vfs, prefix string, limit int) (files []Item, err error) {
+	if l, ok := v.(LimitedLister); ok {
+		return l.ListLimit(ctx, prefix, limit)
+	}
+
+	files, err = v.List(ctx, prefix, limit)
+	if len(files) > limit {
+		files = files[:limit]
+	}
+
+	return files, err
+}
+
+// DirLister хранилище, которое умеет возвращать один уровень дерева файлов без обхода вложенных директорий
+type DirLister interface {
+	ListDir(ctx context.Context, prefix string) (files []Item, dirs []string, err error)
+}
+
+// ListDir возвращает файлы с префиксом prefix без вложенных директорий и имена директорий первого уровня
+// prefix - пустой или заканчивается на "/"
+// если хранилище не реализует DirLister - читает весь список через List и синтезирует директории из префиксов
+func ListDir(ctx context.Context, v Vfs, prefix string) (files []Item, dirs []string, err error) {
+	if l, ok := v.(DirLister); ok {
+		return l.ListDir(ctx, prefix)
+	}
+
+	return listDirAll(ctx, v, prefix)
+}
+
+// listDirAll один уровень дерева из полного списка файлов с префиксом
+func listDirAll(ctx context.Context, v Vfs, prefix string) (files []Item, dirs []string, err error) {
+	items, err := v.List(ctx, prefix, vfsFSPageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, item := range items {
+		rel := strings.TrimPrefix(item.Name(), prefix)
+		if prefix != "" && rel == item.Name() {
+			continue
+		}
+
+		// вложенный файл - синтезируем директорию первого уровня
+		if i := strings.Index(rel, "/"); i >= 0 {
+			dir := rel[:i]
+			if dir != "" && !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+			continue
+		}
+
+		files = append(files, item)
+	}
+
+	return files, dirs, nil
+}
+
+// pathError приводит ошибку Vfs к ошибке io/fs
+func (f *VfsFS) pathError(op, name string, err error) error {
+	if IsVfsNotFound(err) {
+		err = fs.ErrNotExist
+	}
+
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// vfsFileInfo реализация fs.FileInfo для файлов и синтезированных директорий
+type vfsFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	item    Item
+}
+
+func newItemInfo(name string, item Item) *vfsFileInfo {
+	size, _ := item.Size()
+	modTime, _ := item.LastMod()
+
+	return &vfsFileInfo{
+		name:    name,
+		size:    size,
+		modTime: modTime,
+		item:    item,
+	}
+}
+
+func newDirInfo(name string) *vfsFileInfo {
+	return &vfsFileInfo{
+		name: name,
+		dir:  true,
+	}
+}
+
+func (i *vfsFileInfo) Name() string       { return i.name }
+func (i *vfsFileInfo) Size() int64        { return i.size }
+func (i *vfsFileInfo) ModTime() time.Time { return i.modTime }
+func (i *vfsFileInfo) IsDir() bool        { return i.dir }
+func (i *vfsFileInfo) Sys() interface{}   { return i.item }
+
+func (i *vfsFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+
+	return 0444
+}
+
+// vfsFile открытый на чтение файл
+// Seek (нужен http.FileServer) вычитывает файл в память при первом вызове
+type vfsFile struct {
+	fsys   *VfsFS
+	name   string
+	info   fs.FileInfo
+	reader io.ReadCloser
+	offset int64
+	buffer *bytes.Reader
+}
+
+func (f *vfsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *vfsFile) Read(p []byte) (n int, err error) {
+	if f.buffer != nil {
+		return f.buffer.Read(p)
+	}
+
+	n, err = f.reader.Read(p)
+	f.offset += int64(n)
+
+	return n, err
+}
+
+func (f *vfsFile) Seek(offset int64, whence int) (int64, error) {
+	if f.buffer == nil {
+		data, err := f.fsys.ReadFile(f.name)
+		if err != nil {
+			return 0, err
+		}
+		f.buffer = bytes.NewReader(data)
+		if _, err = f.buffer.Seek(f.offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+
+	return f.buffer.Seek(offset, whence)
+}
+
+func (f *vfsFile) Close() error {
+	return f.reader.Close()
+}
+
+// vfsDir синтезированная директория
+type vfsDir struct {
+	fsys    *VfsFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	loaded  bool
+	offset  int
+}
+
+func (d *vfsDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *vfsDir) Read(_ []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *vfsDir) Close() error {
+	return nil
+}
+
+func (d *vfsDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if !d.loaded {
+		entries, err := d.fsys.readDir(d.name)
+		if err != nil {
+			return nil, d.fsys.pathError("readdir", d.name, err)
+		}
+		d.entries, d.loaded = entries, true
+	}
+
+	rest := d.entries[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.offset += count
+
+	return rest[:count], nil
+}
+
+// fsVfs хранилище только для чтения поверх любой fs.FS (в том числе embed.FS)
+type fsVfs struct {
+	fsys fs.FS
+}
+
+// NewFSVfs создаем Vfs только для чтения поверх fs.FS
+// операции записи и удаления возвращают ErrVfsReadOnly, бакеты игнорируются
+func NewFSVfs(fsys fs.FS) Vfs {
+	return &fsVfs{fsys: fsys}
+}
+
+// fsPath приводит путь Vfs к пути fs.FS
+func fsPath(file string) string {
+	file = path.Clean("/" + strings.ReplaceAll(file, "\\", "/"))
+	file = strings.TrimPrefix(file, "/")
+	if file == "" {
+		return "."
+	}
+
+	return file
+}
+
+func (v *fsVfs) Item(ctx context.Context, file string) (Item, error) {
+	name := fsPath(file)
+	info, err := fs.Stat(v.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("error. %s is a directory", file)
+	}
+
+	return &fsItem{fsys: v.fsys, name: name, info: info}, nil
+}
+
+// List возвращает файлы, имена которых начинаются с prefix (как в s3)
+func (v *fsVfs) List(ctx context.Context, prefix string, pageSize int) (files []Item, err error) {
+	root := "."
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		root = fsPath(prefix[:i])
+	}
+
+	err = fs.WalkDir(v.fsys, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, &fsItem{fsys: v.fsys, name: name, info: info})
+
+		return nil
+	})
+
+	return files, err
+}
+
+func (v *fsVfs) Read(ctx context.Context, file string, private_access bool) (data []byte, mimeType string, err error) {
+	return v.ReadFromBucket(ctx, file, "", private_access)
+}
+
+func (v *fsVfs) ReadFromBucket(ctx context.Context, file, bucket string, private_access bool) (data []byte, mimeType string, err error) {
+	err = checkPrivateAccess(ctx, file, private_access)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err = fs.ReadFile(v.fsys, fsPath(file))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, detectMIME(data, file), nil
+}
+
+func (v *fsVfs) ReadCloser(ctx context.Context, file string, private_access bool) (reader io.ReadCloser, err error) {
+	return v.ReadCloserFromBucket(ctx, file, "", private_access)
+}
+
+func (v *fsVfs) ReadCloserFromBucket(ctx context.Context, file, bucket string, private_access bool) (reader io.ReadCloser, err error) {
+	err = checkPrivateAccess(ctx, file, private_access)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.fsys.Open(fsPath(file))
+}
+
+func (v *fsVfs) Write(ctx context.Context, file string, data []byte) (err error) {
+	return ErrVfsReadOnly
+}
+
+func (v *fsVfs) Delete(ctx context.Context, file string) (err error) {
+	return ErrVfsReadOnly
+}
+
+func (v *fsVfs) Connect() (err error) {
+	return nil
+}
+
+func (v *fsVfs) Close() (err error) {
+	return nil
+}
+
+func (v *fsVfs) Proxy(trimPrefix, newPrefix string) (http.Handler, error) {
+	return vfsHandler(v, trimPrefix, newPrefix), nil
+}
+
+// fsItem файл fs.FS, реализующий Item
+type fsItem struct {
+	fsys fs.FS
+	name string
+	info fs.FileInfo
+
+	etagOnce sync.Once
+	etag     string
+	etagErr  error
+}
+
+func (i *fsItem) ID() string {
+	return i.name
+}
+
+func (i *fsItem) Name() string {
+	return i.name
+}
+
+func (i *fsItem) URL() *url.URL {
+	return &url.URL{
+		Scheme: "fs",
+		Path:   i.name,
+	}
+}
+
+func (i *fsItem) Size() (int64, error) {
+	return i.info.Size(), nil
+}
+
+func (i *fsItem) Open() (io.ReadCloser, error) {
+	return i.fsys.Open(i.name)
+}
+
+// ETag у embed.FS нет даты изменения, поэтому для него считаем хеш содержимого
+func (i *fsItem) ETag() (string, error) {
+	i.etagOnce.Do(func() {
+		if !i.info.ModTime().IsZero() {
+			i.etag = strconv.FormatInt(i.info.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(i.info.Size(), 36)
+			return
+		}
+
+		data, err := fs.ReadFile(i.fsys, i.name)
+		if err != nil {
+			i.etagErr = err
+			return
+		}
+		i.etag = Hash(string(data))
+	})
+
+	return i.etag, i.etagErr
+}
+
+func (i *fsItem) LastMod() (time.Time, error) {
+	return i.info.ModTime(), nil
+}
+
+func (i *fsItem) Metadata() (map[string]interface{}, error) {
+	return map[string]interface{}{}, nil
+}
+
+// vfsHandler отдает файлы Vfs по http (для хранилищ, к которым нельзя проксировать запрос напрямую)
+// путь запроса: newPrefix + путь без trimPrefix, отсутствующие файлы - 404 с пустым телом
+func vfsHandler(v Vfs, trimPrefix, newPrefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "../") {
+			http.Error(w, ErrPath.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		file := strings.TrimPrefix(newPrefix+strings.TrimPrefix(r.URL.Path, trimPrefix), "/")
+
+		reader, err := v.ReadCloser(r.Context(), file, false)
+		if err != nil {
+			switch {
+			case err.Error() == privateDirectory:
+				w.WriteHeader(http.StatusForbidden)
+			case IsVfsNotFound(err):
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				w.WriteHeader(http.StatusBadGateway)
+			}
+			return
+		}
+		defer reader.Close()
+
+		w.Header().Set("Content-Type", detectMIME(nil, file))
+		if item, err := v.Item(r.Context(), file); err == nil {
+			if size, err := item.Size(); err == nil {
+				w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			}
+			if etag, err := item.ETag(); err == nil && etag != "" {
+				w.Header().Set("ETag", `"`+strings.Trim(etag, `"`)+`"`)
+				if matchETagList(r.Header.Get("If-None-Match"), etag) {
+					w.Header().Del("Content-Length")
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+
+		if r.Method == http.MethodGet {
+			_, _ = io.Copy(w, reader)
+		}
+	})
+}
+
+// matchETagList проверяет, есть ли etag в списке If-None-Match ("*" - любой)
+func matchETagList(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (candidate != "" && sameETag(candidate, etag)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3/s3test"
+)
+
+func TestVfsFS(t *testing.T) {
+	ctx := context.Background()
+	v := newTestVfs(t)
+
+	for name, body := range map[string]string{
+		"index.html":          "<h1>{{.}}</h1>",
+		"tpl/header.tmpl":     "header {{.}}",
+		"tpl/footer.tmpl":     "footer",
+		"static/css/app.css":  "body{}",
+		"static/js/app.js":    "alert(1)",
+		"static/img/logo.svg": "<svg/>",
+	} {
+		assert.NoError(t, v.Write(ctx, name, []byte(body)))
+	}
+
+	fsys := NewVfsFS(ctx, v, false)
+	assert.NoError(t, fstest.TestFS(fsys, "index.html", "tpl/header.tmpl", "static/css/app.css", "static/img/logo.svg"))
+
+	info, err := fs.Stat(fsys, "static/js/app.js")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), info.Size())
+	assert.False(t, info.IsDir())
+
+	_, err = fs.Stat(fsys, "static/none.js")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	entries, err := fs.ReadDir(fsys, "static")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, "css", entries[0].Name())
+		assert.True(t, entries[0].IsDir())
+	}
+
+	tpl, err := template.ParseFS(fsys, "tpl/*.tmpl")
+	assert.NoError(t, err)
+	assert.NotNil(t, tpl.Lookup("header.tmpl"))
+
+	srv := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/static/css/app.css")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/css; charset=utf-8", resp.Header.Get("Content-Type"))
+		resp.Body.Close()
+	}
+}
+
+func TestFSVfs(t *testing.T) {
+	ctx := context.Background()
+	v := NewFSVfs(fstest.MapFS{
+		"tpl/page.html":  {Data: []byte("<html></html>")},
+		"tpl/block.html": {Data: []byte("<div></div>")},
+		"data.json":      {Data: []byte("{}")},
+	})
+
+	data, mimeType, err := v.Read(ctx, "/tpl/page.html", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "<html></html>", string(data))
+	assert.Equal(t, "text/html", mimeType)
+
+	files, err := v.List(ctx, "tpl/", 100)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	files, err = v.List(ctx, "missing/", 100)
+	assert.NoError(t, err)
+	assert.Len(t, files, 0)
+
+	item, err := v.Item(ctx, "data.json")
+	if assert.NoError(t, err) {
+		etag, err := item.ETag()
+		assert.NoError(t, err)
+		assert.Equal(t, Hash("{}"), etag)
+	}
+
+	assert.ErrorIs(t, v.Write(ctx, "data.json", nil), ErrVfsReadOnly)
+	assert.ErrorIs(t, v.Delete(ctx, "data.json"), ErrVfsReadOnly)
+
+	handler, err := v.Proxy("/static", "tpl")
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/static/page.html", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "<html></html>", w.Body.String())
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// условный запрос с совпадающим ETag
+	r := httptest.NewRequest(http.MethodGet, "/static/page.html", nil)
+	r.Header.Set("If-None-Match", `"other", `+etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	r.Header.Set("If-None-Match", `"other"`)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/static/none.html", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// listCountVfs считает полные, ограниченные и одноуровневые списки файлов
+type listCountVfs struct {
+	VfsWrapper
+	lists, limited, dirs, dirFiles int
+}
+
+func (v *listCountVfs) List(ctx context.Context, prefix string, pageSize int) (files []Item, err error) {
+	v.lists++
+	return v.Next.List(ctx, prefix, pageSize)
+}
+
+func (v *listCountVfs) ListLimit(ctx context.Context, prefix string, limit int) (files []Item, err error) {
+	v.limited++
+	return ListLimit(ctx, v.Next, prefix, limit)
+}
+
+func (v *listCountVfs) ListDir(ctx context.Context, prefix string) (files []Item, dirs []string, err error) {
+	v.dirs++
+	files, dirs, err = ListDir(ctx, v.Next, prefix)
+	v.dirFiles += len(files)
+
+	return files, dirs, err
+}
+
+func TestVfsFSStat(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("files")
+	for _, name := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "dir-old/d.txt"} {
+		srv.Put("files", name, []byte(name))
+	}
+
+	v := newS3TestVfs(t, srv)
+	assert.NoError(t, v.Connect())
+	counter := &listCountVfs{VfsWrapper: VfsWrapper{Next: v}}
+	fsys := NewVfsFS(context.Background(), ChainVfs(counter, WithVfsHooks(VfsHooks{})), false)
+
+	// файлы проверяются через Item, без списков
+	for _, name := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt"} {
+		info, err := fs.Stat(fsys, name)
+		assert.NoError(t, err)
+		assert.False(t, info.IsDir(), name)
+	}
+	assert.Equal(t, 0, counter.lists+counter.limited)
+
+	// директории - одним ограниченным списком
+	info, err := fs.Stat(fsys, "dir")
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	_, err = fs.Stat(fsys, "di")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Equal(t, 0, counter.lists)
+	assert.Equal(t, 2, counter.limited)
+
+	// обход читает по одному уровню на директорию - каждый файл приходит один раз
+	var walked []string
+	assert.NoError(t, fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		walked = append(walked, name)
+		return err
+	}))
+	assert.Equal(t, []string{".", "a.txt", "dir", "dir/b.txt", "dir/sub", "dir/sub/c.txt", "dir-old", "dir-old/d.txt"}, walked)
+	assert.Equal(t, 0, counter.lists)
+	assert.Equal(t, 4, counter.dirs)
+	assert.Equal(t, 4, counter.dirFiles)
+}
@@ -0,0 +1,402 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	giflib "image/gif"
+	"image/jpeg"
+	pnglib "image/png"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Режимы вписывания изображения в заданные размеры
+const (
+	ImageFitContain = "contain" // вписать целиком с сохранением пропорций
+	ImageFitCover   = "cover"   // заполнить размер с сохранением пропорций, лишнее обрезать по центру
+	ImageFitFill    = "fill"    // растянуть до размера без сохранения пропорций
+)
+
+const (
+	defaultImageMaxSide      = 2048
+	defaultImageMaxPixels    = 40_000_000
+	defaultImageMaxSource    = 50 << 20 // 50Mb
+	defaultImageCachePrefix  = ".images"
+	defaultImageJPEGQuality  = 85
+	defaultImageCacheControl = "public, max-age=31536000, immutable"
+)
+
+var (
+	ErrImageParams = errors.New("image transform parameters are not valid")
+	ErrImageLimit  = errors.New("image size limit exceeded")
+	ErrImageFormat = errors.New("unsupported image format")
+)
+
+// ImageConfig параметры обработчика преобразования изображений
+type ImageConfig struct {
+	// CacheVfs хранилище для готовых вариантов (по умолчанию - исходное хранилище)
+	CacheVfs Vfs
+	// CachePrefix директория для готовых вариантов (по умолчанию .images)
+	CachePrefix string
+	// AllowedWidths, AllowedHeights разрешенные размеры (пустой список - любой размер в пределах MaxWidth/MaxHeight)
+	AllowedWidths  []int
+	AllowedHeights []int
+	// MaxWidth, MaxHeight максимальный размер результата (по умолчанию 2048)
+	MaxWidth  int
+	MaxHeight int
+	// MaxSourcePixels максимальное количество пикселей исходного изображения (по умолчанию 40Мп)
+	MaxSourcePixels int
+	// MaxSourceSize максимальный размер исходного файла (по умолчанию 50Mb)
+	MaxSourceSize int64
+	// Quality качество jpeg (по умолчанию 85)
+	Quality int
+}
+
+// ImageParams параметры преобразования
+type ImageParams struct {
+	Width  int
+	Height int
+	Fit    string
+	Format string // jpeg, png, gif, пусто - формат исходного файла
+}
+
+// key строка параметров для ключа кеша
+func (p ImageParams) key() string {
+	return fmt.Sprintf("w%d-h%d-%s", p.Width, p.Height, p.Fit)
+}
+
+// ParseImageParams разбирает параметры запроса w, h, fit, format и проверяет их на соответствие ограничениям
+func ParseImageParams(query map[string][]string, cfg ImageConfig) (p ImageParams, err error) {
+	cfg = cfg.withDefaults()
+
+	get := func(name string) string {
+		if values := query[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	for _, param := range []struct {
+		name    string
+		value   *int
+		max     int
+		allowed []int
+	}{
+		{"w", &p.Width, cfg.MaxWidth, cfg.AllowedWidths},
+		{"h", &p.Height, cfg.MaxHeight, cfg.AllowedHeights},
+	} {
+		raw := get(param.name)
+		if raw == "" {
+			continue
+		}
+		*param.value, err = strconv.Atoi(raw)
+		if err != nil || *param.value <= 0 {
+			return p, fmt.Errorf("%w: %s=%s", ErrImageParams, param.name, raw)
+		}
+		if *param.value > param.max || (len(param.allowed) > 0 && !containsInt(param.allowed, *param.value)) {
+			return p, fmt.Errorf("%w: %s=%d is not allowed", ErrImageLimit, param.name, *param.value)
+		}
+	}
+
+	p.Fit = strings.ToLower(get("fit"))
+	switch p.Fit {
+	case "":
+		p.Fit = ImageFitContain
+	case ImageFitContain, ImageFitCover, ImageFitFill:
+	default:
+		return p, fmt.Errorf("%w: fit=%s", ErrImageParams, p.Fit)
+	}
+
+	p.Format = strings.ToLower(get("format"))
+	switch p.Format {
+	case "", "jpeg", "png", "gif":
+	case "jpg":
+		p.Format = "jpeg"
+	default:
+		return p, fmt.Errorf("%w: %s", ErrImageFormat, p.Format)
+	}
+
+	return p, nil
+}
+
+func (cfg ImageConfig) withDefaults() ImageConfig {
+	if cfg.CachePrefix == "" {
+		cfg.CachePrefix = defaultImageCachePrefix
+	}
+	if cfg.MaxWidth <= 0 {
+		cfg.MaxWidth = defaultImageMaxSide
+	}
+	if cfg.MaxHeight <= 0 {
+		cfg.MaxHeight = defaultImageMaxSide
+	}
+	if cfg.MaxSourcePixels <= 0 {
+		cfg.MaxSourcePixels = defaultImageMaxPixels
+	}
+	if cfg.MaxSourceSize <= 0 {
+		cfg.MaxSourceSize = defaultImageMaxSource
+	}
+	if cfg.Quality <= 0 || cfg.Quality > 100 {
+		cfg.Quality = defaultImageJPEGQuality
+	}
+
+	return cfg
+}
+
+// ImageHandler отдает изображения из хранилища с преобразованием размера и формата (jpeg, png, gif)
+// параметры запроса: w, h - размеры, fit - contain/cover/fill, format - jpeg/png/gif
+// без параметров файл отдается как есть. Готовые варианты сохраняются в CacheVfs
+// под CachePrefix с ключом из ETag исходного файла и параметров, поэтому изменение исходника дает новый вариант
+func ImageHandler(v Vfs, trimPrefix, newPrefix string, cfg ImageConfig) http.Handler {
+	cfg = cfg.withDefaults()
+	if cfg.CacheVfs == nil {
+		cfg.CacheVfs = v
+	}
+	original := vfsHandler(v, trimPrefix, newPrefix)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "../") {
+			http.Error(w, ErrPath.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		params, err := ParseImageParams(r.URL.Query(), cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if params.Width == 0 && params.Height == 0 && params.Format == "" {
+			original.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		file := strings.TrimPrefix(newPrefix+strings.TrimPrefix(r.URL.Path, trimPrefix), "/")
+		if err = checkPrivateAccess(ctx, file, false); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		item, err := v.Item(ctx, file)
+		if err == nil {
+			_, err = item.Size()
+		}
+		if err != nil {
+			imageError(w, err)
+			return
+		}
+		etag, err := item.ETag()
+		if err != nil {
+			imageError(w, err)
+			return
+		}
+
+		format := params.Format
+		if format == "" {
+			format = imageFormatByName(file)
+		}
+		variant := Hash(etag + "|" + params.key() + "|" + format)
+		cacheFile := path.Join(cfg.CachePrefix, file, variant+"."+format)
+
+		w.Header().Set("ETag", `"`+variant+`"`)
+		if sameETag(r.Header.Get("If-None-Match"), variant) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		data, _, err := cfg.CacheVfs.Read(ctx, cacheFile, true)
+		if err != nil {
+			data, err = transformImage(ctx, v, file, params, format, cfg)
+			if err != nil {
+				imageError(w, err)
+				return
+			}
+			// ошибка записи кеша не мешает отдать результат
+			_ = cfg.CacheVfs.Write(ctx, cacheFile, data)
+		}
+
+		w.Header().Set("Content-Type", "image/"+format)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Cache-Control", defaultImageCacheControl)
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	})
+}
+
+func imageError(w http.ResponseWriter, err error) {
+	switch {
+	case err.Error() == privateDirectory:
+		w.WriteHeader(http.StatusForbidden)
+	case IsVfsNotFound(err):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, ErrImageLimit), errors.Is(err, ErrImageFormat):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// transformImage читает исходное изображение, проверяет ограничения, меняет размер и кодирует в format
+func transformImage(ctx context.Context, v Vfs, file string, params ImageParams, format string, cfg ImageConfig) ([]byte, error) {
+	reader, err := v.ReadCloser(ctx, file, false)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, cfg.MaxSourceSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > cfg.MaxSourceSize {
+		return nil, fmt.Errorf("%w: source is larger than %d bytes", ErrImageLimit, cfg.MaxSourceSize)
+	}
+
+	// размер проверяем по заголовку до декодирования, чтобы не распаковывать "бомбы"
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrImageFormat, err)
+	}
+	if config.Width*config.Height > cfg.MaxSourcePixels {
+		return nil, fmt.Errorf("%w: source has %dx%d pixels", ErrImageLimit, config.Width, config.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrImageFormat, err)
+	}
+
+	dst := ResizeImage(src, params.Width, params.Height, params.Fit)
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: cfg.Quality})
+	case "png":
+		err = pnglib.Encode(&buf, dst)
+	case "gif":
+		err = giflib.Encode(&buf, dst, nil)
+	default:
+		err = fmt.Errorf("%w: %s", ErrImageFormat, format)
+	}
+
+	return buf.Bytes(), err
+}
+
+func imageFormatByName(file string) string {
+	switch strings.ToLower(path.Ext(file)) {
+	case ".png":
+		return "png"
+	case ".gif":
+		return "gif"
+	}
+
+	return "jpeg"
+}
+
+// ResizeImage меняет размер изображения с усреднением пикселей (box filter)
+// если задан только один размер, второй вычисляется по пропорциям исходного изображения
+// contain не увеличивает изображение больше исходного размера
+func ResizeImage(src image.Image, width, height int, fit string) image.Image {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	if sw == 0 || sh == 0 {
+		return src
+	}
+
+	switch {
+	case width == 0 && height == 0:
+		width, height = sw, sh
+	case width == 0:
+		width = max(1, sw*height/sh)
+	case height == 0:
+		height = max(1, sh*width/sw)
+	}
+
+	// область исходного изображения, которая попадет в результат
+	crop := bounds
+	switch fit {
+	case ImageFitCover:
+		if sw*height > sh*width {
+			cw := sh * width / height
+			crop.Min.X += (sw - cw) / 2
+			crop.Max.X = crop.Min.X + cw
+		} else {
+			ch := sw * height / width
+			crop.Min.Y += (sh - ch) / 2
+			crop.Max.Y = crop.Min.Y + ch
+		}
+	case ImageFitFill:
+	default:
+		scale := min(float64(width)/float64(sw), float64(height)/float64(sh), 1)
+		width = max(1, int(float64(sw)*scale+0.5))
+		height = max(1, int(float64(sh)*scale+0.5))
+	}
+
+	rgba := image.NewNRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, crop.Min, draw.Src)
+
+	return boxResize(rgba, width, height)
+}
+
+// boxResize каждый пиксель результата - среднее пикселей исходника, попадающих в него
+func boxResize(src *image.NRGBA, width, height int) *image.NRGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * sh / height
+		y1 := max(y0+1, (y+1)*sh/height)
+		for x := 0; x < width; x++ {
+			x0 := x * sw / width
+			x1 := max(x0+1, (x+1)*sw/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				offset := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					pix := src.Pix[offset : offset+4]
+					alpha := uint64(pix[3])
+					// усредняем с учетом прозрачности, чтобы прозрачные пиксели не давали темную кайму
+					r += uint64(pix[0]) * alpha
+					g += uint64(pix[1]) * alpha
+					b += uint64(pix[2]) * alpha
+					a += alpha
+					n++
+					offset += 4
+				}
+			}
+
+			c := color.NRGBA{}
+			if a > 0 {
+				c = color.NRGBA{R: uint8(r / a), G: uint8(g / a), B: uint8(b / a), A: uint8(a / n)}
+			}
+			dst.SetNRGBA(x, y, c)
+		}
+	}
+
+	return dst
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	pnglib "image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageHandler(t *testing.T) {
+	ctx := context.Background()
+	v := newTestVfs(t)
+
+	src := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	for y := 0; y < 50; y++ {
+		for x := 0; x < 100; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, pnglib.Encode(&buf, src))
+	assert.NoError(t, v.Write(ctx, "gallery/photo.png", buf.Bytes()))
+
+	handler := ImageHandler(v, "/img", "gallery", ImageConfig{
+		CachePrefix:   "thumbs",
+		MaxWidth:      400,
+		AllowedWidths: []int{20, 40},
+	})
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/img/photo.png"+query, nil))
+		return w
+	}
+	size := func(w *httptest.ResponseRecorder) (int, int) {
+		config, _, err := image.DecodeConfig(w.Body)
+		if !assert.NoError(t, err) {
+			return 0, 0
+		}
+		return config.Width, config.Height
+	}
+
+	w := get("?w=20")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	width, height := size(w)
+	assert.Equal(t, 20, width)
+	assert.Equal(t, 10, height)
+
+	w = get("?w=40&h=40&fit=cover&format=jpeg")
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	etag := w.Header().Get("ETag")
+	width, height = size(w)
+	assert.Equal(t, 40, width)
+	assert.Equal(t, 40, height)
+
+	// варианты сохранены в кеш
+	cached, err := v.List(ctx, "thumbs/", 100)
+	assert.NoError(t, err)
+	assert.Len(t, cached, 2)
+
+	r := httptest.NewRequest(http.MethodGet, "/img/photo.png?w=40&h=40&fit=cover&format=jpeg", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// без параметров отдается оригинал
+	w = get("")
+	assert.Equal(t, buf.Len(), w.Body.Len())
+
+	assert.Equal(t, http.StatusBadRequest, get("?w=30").Code)
+	assert.Equal(t, http.StatusBadRequest, get("?w=20&fit=zoom").Code)
+	assert.Equal(t, http.StatusBadRequest, get("?w=20&format=webp").Code)
+	assert.Equal(t, http.StatusNotFound, httpGet(handler, "/img/none.png?w=20").Code)
+
+	small := ImageHandler(v, "/img", "gallery", ImageConfig{MaxSourcePixels: 1000})
+	assert.Equal(t, http.StatusUnprocessableEntity, httpGet(small, "/img/photo.png?w=20").Code)
+}
+
+func httpGet(handler http.Handler, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestResizeImage(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+
+	cases := []struct {
+		w, h         int
+		fit          string
+		wantW, wantH int
+	}{
+		{50, 50, ImageFitContain, 50, 25},
+		{50, 50, ImageFitCover, 50, 50},
+		{50, 50, ImageFitFill, 50, 50},
+		{0, 20, ImageFitContain, 40, 20},
+		{400, 400, ImageFitContain, 200, 100},
+	}
+	for _, c := range cases {
+		b := ResizeImage(src, c.w, c.h, c.fit).Bounds()
+		assert.Equal(t, c.wantW, b.Dx(), "%+v", c)
+		assert.Equal(t, c.wantH, b.Dy(), "%+v", c)
+	}
+}
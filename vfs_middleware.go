@@ -0,0 +1,482 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3"
+	"git.lowcodeplatform.net/packages/models"
+)
+
+// Операции Vfs, которые передаются в хуки мидлвари
+const (
+	VfsOpItem                 = "item"
+	VfsOpList                 = "list"
+	VfsOpRead                 = "read"
+	VfsOpReadFromBucket       = "read_from_bucket"
+	VfsOpReadCloser           = "read_closer"
+	VfsOpReadCloserFromBucket = "read_closer_from_bucket"
+	VfsOpWrite                = "write"
+	VfsOpDelete               = "delete"
+	VfsOpConnect              = "connect"
+	VfsOpClose                = "close"
+	VfsOpProxy                = "proxy"
+	VfsOpRestore              = "restore"
+	VfsOpBucketConfig         = "bucket_config"
+	VfsOpSetBucketConfig      = "set_bucket_config"
+)
+
+// VfsMiddleware оборачивает Vfs дополнительной логикой (логирование, ретраи, метрики, кеш, политики доступа)
+type VfsMiddleware func(Vfs) Vfs
+
+// ChainVfs оборачивает v переданными мидлварями
+// первая мидлварь в списке становится внешней (первой получает вызов)
+func ChainVfs(v Vfs, middlewares ...VfsMiddleware) Vfs {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if middlewares[i] == nil {
+			continue
+		}
+		v = middlewares[i](v)
+	}
+
+	return v
+}
+
+// VfsWrapper базовая обертка, которая проксирует все вызовы в Next
+// встраивается в мидлвари, чтобы переопределять только нужные методы
+// дополнительные возможности (ConditionalWriter, StreamWriter, OptionsWriter, OptionsReader, Restorer, LimitedLister, DirLister) передаются в Next,
+// мидлварь, которая проверяет операции, должна переопределить и их (см. hookedVfs)
+type VfsWrapper struct {
+	Next Vfs
+}
+
+func (w *VfsWrapper) Item(ctx context.Context, path string) (file Item, err error) {
+	return w.Next.Item(ctx, path)
+}
+
+func (w *VfsWrapper) List(ctx context.Context, prefix string, pageSize int) (files []Item, err error) {
+	return w.Next.List(ctx, prefix, pageSize)
+}
+
+// ListLimit передает ограниченный список в Next (см. ListLimit)
+func (w *VfsWrapper) ListLimit(ctx context.Context, prefix string, limit int) (files []Item, err error) {
+	return ListLimit(ctx, w.Next, prefix, limit)
+}
+
+// ListDir передает один уровень дерева файлов в Next (см. ListDir)
+func (w *VfsWrapper) ListDir(ctx context.Context, prefix string) (files []Item, dirs []string, err error) {
+	return ListDir(ctx, w.Next, prefix)
+}
+
+func (w *VfsWrapper) Read(ctx context.Context, file string, private_access bool) (data []byte, mimeType string, err error) {
+	return w.Next.Read(ctx, file, private_access)
+}
+
+func (w *VfsWrapper) ReadFromBucket(ctx context.Context, file, bucket string, private_access bool) (data []byte, mimeType string, err error) {
+	return w.Next.ReadFromBucket(ctx, file, bucket, private_access)
+}
+
+func (w *VfsWrapper) ReadCloser(ctx context.Context, file string, private_access bool) (reader io.ReadCloser, err error) {
+	return w.Next.ReadCloser(ctx, file, private_access)
+}
+
+func (w *VfsWrapper) ReadCloserFromBucket(ctx context.Context, file, bucket string, private_access bool) (reader io.ReadCloser, err error) {
+	return w.Next.ReadCloserFromBucket(ctx, file, bucket, private_access)
+}
+
+func (w *VfsWrapper) Write(ctx context.Context, file string, data []byte) (err error) {
+	return w.Next.Write(ctx, file, data)
+}
+
+// WriteIf передает условную запись в Next (см. WriteIf)
+func (w *VfsWrapper) WriteIf(ctx context.Context, file string, data []byte, conditions ...WriteCondition) (err error) {
+	return WriteIf(ctx, w.Next, file, data, conditions...)
+}
+
+// WriteStream передает потоковую запись в Next (см. WriteStream)
+func (w *VfsWrapper) WriteStream(ctx context.Context, file string, r io.Reader, size int64) (err error) {
+	return WriteStream(ctx, w.Next, file, r, size)
+}
+
+// WriteWithOptions передает запись с параметрами в Next (см. WriteWithOptions)
+func (w *VfsWrapper) WriteWithOptions(ctx context.Context, file string, data []byte, opts WriteOptions) (err error) {
+	return WriteWithOptions(ctx, w.Next, file, data, opts)
+}
+
+// ReadWithOptions передает чтение с параметрами в Next (см. ReadWithOptions)
+func (w *VfsWrapper) ReadWithOptions(ctx context.Context, file string, private_access bool, opts ReadOptions) (data []byte, mimeType string, err error) {
+	return ReadWithOptions(ctx, w.Next, file, private_access, opts)
+}
+
+// Restore передает восстановление архивного файла в Next (см. Restore)
+func (w *VfsWrapper) Restore(ctx context.Context, file string, days int64, tier string) (err error) {
+	return Restore(ctx, w.Next, file, days, tier)
+}
+
+func (w *VfsWrapper) Delete(ctx context.Context, file string) (err error) {
+	return w.Next.Delete(ctx, file)
+}
+
+func (w *VfsWrapper) Connect() (err error) {
+	return w.Next.Connect()
+}
+
+func (w *VfsWrapper) Close() (err error) {
+	return w.Next.Close()
+}
+
+// Unwrap возвращает обернутое хранилище
+func (w *VfsWrapper) Unwrap() Vfs {
+	return w.Next
+}
+
+func (w *VfsWrapper) Proxy(trimPrefix, newPrefix string) (http.Handler, error) {
+	return w.Next.Proxy(trimPrefix, newPrefix)
+}
+
+// VfsRequest контекст запроса, в рамках которого вызвана операция Vfs
+type VfsRequest struct {
+	UserUid   string
+	RequestID string
+	// Fields значения полей models.ProxiedHeaders из контекста (ключ - поле контекста)
+	Fields map[string]string
+}
+
+// VfsRequestFromContext извлекает из контекста uid пользователя и поля models.ProxiedHeaders
+func VfsRequestFromContext(ctx context.Context) (r VfsRequest) {
+	if ctx == nil {
+		return r
+	}
+
+	r.UserUid, _ = ctx.Value(userUid).(string)
+	r.Fields = map[string]string{}
+	for ctxField := range models.ProxiedHeaders {
+		if value := getFieldCtx(ctx, ctxField); value != "" {
+			r.Fields[ctxField] = value
+		}
+	}
+	r.RequestID = r.Fields[models.RequestIDField]
+
+	return r
+}
+
+// VfsCall описание вызова операции Vfs, передается в хуки
+type VfsCall struct {
+	Op      string
+	Path    string // путь к файлу, префикс (для List) или настройка бакета (cors, policy, versioning, lifecycle)
+	Bucket  string // только для *FromBucket
+	Size    int    // размер данных для Write, размер страницы для List
+	Request VfsRequest
+	Started time.Time
+}
+
+// VfsHooks хуки, вызываемые до и после каждой операции
+// Before может прервать операцию, вернув ошибку (она же вернется вызывающему)
+// After получает результат операции и время ее выполнения через call.Started
+type VfsHooks struct {
+	Before func(ctx context.Context, call *VfsCall) error
+	After  func(ctx context.Context, call *VfsCall, err error)
+}
+
+// WithVfsHooks мидлварь, вызывающая хуки вокруг каждой операции Vfs
+func WithVfsHooks(hooks VfsHooks) VfsMiddleware {
+	return func(next Vfs) Vfs {
+		return &hookedVfs{
+			VfsWrapper: VfsWrapper{Next: next},
+			hooks:      hooks,
+		}
+	}
+}
+
+type hookedVfs struct {
+	VfsWrapper
+	hooks VfsHooks
+}
+
+// before формирует описание вызова и выполняет хук Before
+func (h *hookedVfs) before(ctx context.Context, op, path, bucket string, size int) (call *VfsCall, err error) {
+	call = &VfsCall{
+		Op:      op,
+		Path:    path,
+		Bucket:  bucket,
+		Size:    size,
+		Request: VfsRequestFromContext(ctx),
+		Started: time.Now(),
+	}
+
+	if h.hooks.Before != nil {
+		err = h.hooks.Before(ctx, call)
+	}
+
+	return call, err
+}
+
+func (h *hookedVfs) after(ctx context.Context, call *VfsCall, err error) {
+	if h.hooks.After != nil {
+		h.hooks.After(ctx, call, err)
+	}
+}
+
+func (h *hookedVfs) Item(ctx context.Context, path string) (file Item, err error) {
+	call, err := h.before(ctx, VfsOpItem, path, "", 0)
+	if err == nil {
+		file, err = h.Next.Item(ctx, path)
+	}
+	h.after(ctx, call, err)
+
+	return file, err
+}
+
+func (h *hookedVfs) List(ctx context.Context, prefix string, pageSize int) (files []Item, err error) {
+	call, err := h.before(ctx, VfsOpList, prefix, "", pageSize)
+	if err == nil {
+		files, err = h.Next.List(ctx, prefix, pageSize)
+	}
+	h.after(ctx, call, err)
+
+	return files, err
+}
+
+func (h *hookedVfs) ListLimit(ctx context.Context, prefix string, limit int) (files []Item, err error) {
+	call, err := h.before(ctx, VfsOpList, prefix, "", limit)
+	if err == nil {
+		files, err = ListLimit(ctx, h.Next, prefix, limit)
+	}
+	h.after(ctx, call, err)
+
+	return files, err
+}
+
+func (h *hookedVfs) ListDir(ctx context.Context, prefix string) (files []Item, dirs []string, err error) {
+	call, err := h.before(ctx, VfsOpList, prefix, "", 0)
+	if err == nil {
+		files, dirs, err = ListDir(ctx, h.Next, prefix)
+	}
+	h.after(ctx, call, err)
+
+	return files, dirs, err
+}
+
+func (h *hookedVfs) Read(ctx context.Context, file string, private_access bool) (data []byte, mimeType string, err error) {
+	call, err := h.before(ctx, VfsOpRead, file, "", 0)
+	if err == nil {
+		data, mimeType, err = h.Next.Read(ctx, file, private_access)
+	}
+	h.after(ctx, call, err)
+
+	return data, mimeType, err
+}
+
+func (h *hookedVfs) ReadWithOptions(ctx context.Context, file string, private_access bool, opts ReadOptions) (data []byte, mimeType string, err error) {
+	call, err := h.before(ctx, VfsOpRead, file, "", 0)
+	if err == nil {
+		data, mimeType, err = ReadWithOptions(ctx, h.Next, file, private_access, opts)
+	}
+	h.after(ctx, call, err)
+
+	return data, mimeType, err
+}
+
+func (h *hookedVfs) ReadFromBucket(ctx context.Context, file, bucket string, private_access bool) (data []byte, mimeType string, err error) {
+	call, err := h.before(ctx, VfsOpReadFromBucket, file, bucket, 0)
+	if err == nil {
+		data, mimeType, err = h.Next.ReadFromBucket(ctx, file, bucket, private_access)
+	}
+	h.after(ctx, call, err)
+
+	return data, mimeType, err
+}
+
+func (h *hookedVfs) ReadCloser(ctx context.Context, file string, private_access bool) (reader io.ReadCloser, err error) {
+	call, err := h.before(ctx, VfsOpReadCloser, file, "", 0)
+	if err == nil {
+		reader, err = h.Next.ReadCloser(ctx, file, private_access)
+	}
+	h.after(ctx, call, err)
+
+	return reader, err
+}
+
+func (h *hookedVfs) ReadCloserFromBucket(ctx context.Context, file, bucket string, private_access bool) (reader io.ReadCloser, err error) {
+	call, err := h.before(ctx, VfsOpReadCloserFromBucket, file, bucket, 0)
+	if err == nil {
+		reader, err = h.Next.ReadCloserFromBucket(ctx, file, bucket, private_access)
+	}
+	h.after(ctx, call, err)
+
+	return reader, err
+}
+
+func (h *hookedVfs) Write(ctx context.Context, file string, data []byte) (err error) {
+	call, err := h.before(ctx, VfsOpWrite, file, "", len(data))
+	if err == nil {
+		err = h.Next.Write(ctx, file, data)
+	}
+	h.after(ctx, call, err)
+
+	return err
+}
+
+func (h *hookedVfs) WriteIf(ctx context.Context, file string, data []byte, conditions ...WriteCondition) (err error) {
+	call, err := h.before(ctx, VfsOpWrite, file, "", len(data))
+	if err == nil {
+		err = WriteIf(ctx, h.Next, file, data, conditions...)
+	}
+	h.after(ctx, call, err)
+
+	return err
+}
+
+func (h *hookedVfs) WriteStream(ctx context.Context, file string, r io.Reader, size int64) (err error) {
+	call, err := h.before(ctx, VfsOpWrite, file, "", int(size))
+	if err == nil {
+		err = WriteStream(ctx, h.Next, file, r, size)
+	}
+	h.after(ctx, call, err)
+
+	return err
+}
+
+func (h *hookedVfs) WriteWithOptions(ctx context.Context, file string, data []byte, opts WriteOptions) (err error) {
+	call, err := h.before(ctx, VfsOpWrite, file, "", len(data))
+	if err == nil {
+		err = WriteWithOptions(ctx, h.Next, file, data, opts)
+	}
+	h.after(ctx, call, err)
+
+	return err
+}
+
+func (h *hookedVfs) Restore(ctx context.Context, file string, days int64, tier string) (err error) {
+	call, err := h.before(ctx, VfsOpRestore, file, "", 0)
+	if err == nil {
+		err = Restore(ctx, h.Next, file, days, tier)
+	}
+	h.after(ctx, call, err)
+
+	return err
+}
+
+func (h *hookedVfs) Delete(ctx context.Context, file string) (err error) {
+	call, err := h.before(ctx, VfsOpDelete, file, "", 0)
+	if err == nil {
+		err = h.Next.Delete(ctx, file)
+	}
+	h.after(ctx, call, err)
+
+	return err
+}
+
+func (h *hookedVfs) Connect() (err error) {
+	ctx := context.Background()
+	call, err := h.before(ctx, VfsOpConnect, "", "", 0)
+	if err == nil {
+		err = h.Next.Connect()
+	}
+	h.after(ctx, call, err)
+
+	return err
+}
+
+func (h *hookedVfs) Close() (err error) {
+	ctx := context.Background()
+	call, err := h.before(ctx, VfsOpClose, "", "", 0)
+	if err == nil {
+		err = h.Next.Close()
+	}
+	h.after(ctx, call, err)
+
+	return err
+}
+
+func (h *hookedVfs) Proxy(trimPrefix, newPrefix string) (handler http.Handler, err error) {
+	ctx := context.Background()
+	call, err := h.before(ctx, VfsOpProxy, newPrefix, "", 0)
+	if err == nil {
+		handler, err = h.Next.Proxy(trimPrefix, newPrefix)
+	}
+	h.after(ctx, call, err)
+
+	return handler, err
+}
+
+// bucketConfig настройка бакета через хуки (см. VfsBucketConfig), без хуков бакет мимо мидлвари не настраивается
+func (h *hookedVfs) bucketConfig() (BucketConfigurer, bool) {
+	next, ok := VfsBucketConfig(h.Next)
+	if !ok {
+		return nil, false
+	}
+
+	return &hookedBucketConfig{hooked: h, next: next}, true
+}
+
+// hookedBucketConfig вызывает хуки вокруг операций с настройками бакета
+type hookedBucketConfig struct {
+	hooked *hookedVfs
+	next   BucketConfigurer
+}
+
+// hookBucketConfig выполняет операцию с настройкой бакета setting между хуками Before и After
+func hookBucketConfig[T any](ctx context.Context, h *hookedVfs, op, setting string, fn func() (T, error)) (res T, err error) {
+	call, err := h.before(ctx, op, setting, "", 0)
+	if err == nil {
+		res, err = fn()
+	}
+	h.after(ctx, call, err)
+
+	return res, err
+}
+
+func (c *hookedBucketConfig) BucketCORS(ctx context.Context) (rules []s3.CORSRule, err error) {
+	return hookBucketConfig(ctx, c.hooked, VfsOpBucketConfig, "cors", func() ([]s3.CORSRule, error) {
+		return c.next.BucketCORS(ctx)
+	})
+}
+
+func (c *hookedBucketConfig) SetBucketCORS(ctx context.Context, rules []s3.CORSRule) (err error) {
+	_, err = hookBucketConfig(ctx, c.hooked, VfsOpSetBucketConfig, "cors", func() (struct{}, error) {
+		return struct{}{}, c.next.SetBucketCORS(ctx, rules)
+	})
+	return err
+}
+
+func (c *hookedBucketConfig) BucketPolicy(ctx context.Context) (policy *s3.BucketPolicy, err error) {
+	return hookBucketConfig(ctx, c.hooked, VfsOpBucketConfig, "policy", func() (*s3.BucketPolicy, error) {
+		return c.next.BucketPolicy(ctx)
+	})
+}
+
+func (c *hookedBucketConfig) SetBucketPolicy(ctx context.Context, policy *s3.BucketPolicy) (err error) {
+	_, err = hookBucketConfig(ctx, c.hooked, VfsOpSetBucketConfig, "policy", func() (struct{}, error) {
+		return struct{}{}, c.next.SetBucketPolicy(ctx, policy)
+	})
+	return err
+}
+
+func (c *hookedBucketConfig) BucketVersioning(ctx context.Context) (status string, err error) {
+	return hookBucketConfig(ctx, c.hooked, VfsOpBucketConfig, "versioning", func() (string, error) {
+		return c.next.BucketVersioning(ctx)
+	})
+}
+
+func (c *hookedBucketConfig) SetBucketVersioning(ctx context.Context, enabled bool) (err error) {
+	_, err = hookBucketConfig(ctx, c.hooked, VfsOpSetBucketConfig, "versioning", func() (struct{}, error) {
+		return struct{}{}, c.next.SetBucketVersioning(ctx, enabled)
+	})
+	return err
+}
+
+func (c *hookedBucketConfig) BucketLifecycle(ctx context.Context) (rules []s3.LifecycleRule, err error) {
+	return hookBucketConfig(ctx, c.hooked, VfsOpBucketConfig, "lifecycle", func() ([]s3.LifecycleRule, error) {
+		return c.next.BucketLifecycle(ctx)
+	})
+}
+
+func (c *hookedBucketConfig) SetBucketLifecycle(ctx context.Context, rules []s3.LifecycleRule) (err error) {
+	_, err = hookBucketConfig(ctx, c.hooked, VfsOpSetBucketConfig, "lifecycle", func() (struct{}, error) {
+		return struct{}{}, c.next.SetBucketLifecycle(ctx, rules)
+	})
+	return err
+}
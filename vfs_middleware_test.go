@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"git.lowcodeplatform.net/packages/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestVfs локальное хранилище во временной директории теста
+func newTestVfs(t *testing.T) Vfs {
+	t.Helper()
+
+	v := NewVfs("local", t.TempDir(), "", "", "", "bucket", "", "")
+	if err := v.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestChainVfsOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) VfsMiddleware {
+		return WithVfsHooks(VfsHooks{
+			Before: func(ctx context.Context, call *VfsCall) error {
+				order = append(order, name+":"+call.Op)
+				return nil
+			},
+		})
+	}
+
+	v := ChainVfs(newTestVfs(t), mark("outer"), nil, mark("inner"))
+	err := v.Write(context.Background(), "a.txt", []byte("data"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"outer:write", "inner:write"}, order)
+}
+
+func TestWithVfsHooks(t *testing.T) {
+	errDenied := errors.New("denied")
+	var calls []VfsCall
+	var results []error
+
+	v := ChainVfs(newTestVfs(t), WithVfsHooks(VfsHooks{
+		Before: func(ctx context.Context, call *VfsCall) error {
+			if call.Op == VfsOpDelete {
+				return errDenied
+			}
+			return nil
+		},
+		After: func(ctx context.Context, call *VfsCall, err error) {
+			calls = append(calls, *call)
+			results = append(results, err)
+		},
+	}))
+
+	ctx := context.WithValue(context.Background(), userUid, "u1")
+	ctx = context.WithValue(ctx, "logger."+models.RequestIDField, "req-1")
+
+	assert.NoError(t, v.Write(ctx, "dir/a.txt", []byte("hello")))
+	data, _, err := v.Read(ctx, "dir/a.txt", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.ErrorIs(t, v.Delete(ctx, "dir/a.txt"), errDenied)
+
+	if assert.Len(t, calls, 3) {
+		assert.Equal(t, VfsOpWrite, calls[0].Op)
+		assert.Equal(t, "dir/a.txt", calls[0].Path)
+		assert.Equal(t, 5, calls[0].Size)
+		assert.Equal(t, "u1", calls[0].Request.UserUid)
+		assert.Equal(t, "req-1", calls[0].Request.RequestID)
+		assert.Equal(t, VfsOpRead, calls[1].Op)
+		assert.Equal(t, VfsOpDelete, calls[2].Op)
+		assert.ErrorIs(t, results[2], errDenied)
+	}
+}
+
+func TestWithVfsHooksRestore(t *testing.T) {
+	errDenied := errors.New("denied")
+	var ops []string
+	v := ChainVfs(newTestVfs(t), WithVfsHooks(VfsHooks{
+		Before: func(ctx context.Context, call *VfsCall) error {
+			ops = append(ops, call.Op+":"+call.Path)
+			return errDenied
+		},
+	}))
+
+	// восстановление архивного файла не обходит хуки
+	assert.ErrorIs(t, Restore(context.Background(), v, "cold.txt", 1, ""), errDenied)
+	assert.Equal(t, []string{"restore:cold.txt"}, ops)
+}
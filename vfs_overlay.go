@@ -0,0 +1,269 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/graymeta/stow"
+)
+
+// VfsWhiteoutPrefix префикс файла-маркера, скрывающего одноименный файл нижних слоев OverlayVfs
+const VfsWhiteoutPrefix = ".wh."
+
+var ErrOverlayEmpty = errors.New("overlay vfs has no layers")
+
+// overlayVfs объединяет несколько хранилищ в одно (union fs)
+// layers[0] - верхний слой, в который идут все изменения
+type overlayVfs struct {
+	layers []Vfs
+}
+
+// NewOverlayVfs объединяет хранилища в слои, первый слой - верхний
+// чтение идет сверху вниз до первого найденного файла, List объединяет слои (верхние файлы перекрывают нижние),
+// запись идет в верхний слой, удаление оставляет в верхнем слое маркер (.wh.<имя>), скрывающий файлы нижних слоев
+// пример: NewOverlayVfs(tenantVfs, sharedVfs, NewFSVfs(templatesFS))
+func NewOverlayVfs(layers ...Vfs) Vfs {
+	o := &overlayVfs{}
+	for _, layer := range layers {
+		if layer != nil {
+			o.layers = append(o.layers, layer)
+		}
+	}
+
+	return o
+}
+
+// WhiteoutPath путь маркера удаления для файла
+func WhiteoutPath(file string) string {
+	dir, name := path.Split(strings.TrimPrefix(file, "/"))
+
+	return dir + VfsWhiteoutPrefix + name
+}
+
+func isWhiteout(file string) bool {
+	return strings.HasPrefix(path.Base(file), VfsWhiteoutPrefix)
+}
+
+// resolve выполняет fn по слоям сверху вниз
+// переходит к следующему слою только если файла нет в текущем и он не скрыт маркером удаления
+func (o *overlayVfs) resolve(ctx context.Context, file string, fn func(layer Vfs) error) (err error) {
+	if len(o.layers) == 0 {
+		return ErrOverlayEmpty
+	}
+
+	for _, layer := range o.layers {
+		err = fn(layer)
+		if err == nil || !IsVfsNotFound(err) {
+			return err
+		}
+
+		whiteout, err := vfsExists(ctx, layer, WhiteoutPath(file))
+		if err != nil {
+			return err
+		}
+		if whiteout {
+			break
+		}
+	}
+
+	return fmt.Errorf("error get file %s from overlay. err: %w", file, stow.ErrNotFound)
+}
+
+// vfsExists проверяет наличие файла в хранилище
+// часть хранилищ (local) возвращает Item без проверки существования - проверяем через Size
+func vfsExists(ctx context.Context, v Vfs, file string) (bool, error) {
+	item, err := v.Item(ctx, file)
+	if err == nil {
+		_, err = item.Size()
+	}
+	if err != nil {
+		if IsVfsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (o *overlayVfs) Item(ctx context.Context, file string) (item Item, err error) {
+	err = o.resolve(ctx, file, func(layer Vfs) error {
+		item, err = layer.Item(ctx, file)
+		if err == nil {
+			_, err = item.Size()
+		}
+		return err
+	})
+
+	return item, err
+}
+
+// List объединяет списки файлов всех слоев
+// файл верхнего слоя перекрывает одноименные файлы нижних, маркеры удаления скрывают файлы нижних слоев и в список не попадают
+func (o *overlayVfs) List(ctx context.Context, prefix string, pageSize int) (files []Item, err error) {
+	if len(o.layers) == 0 {
+		return nil, ErrOverlayEmpty
+	}
+
+	seen := map[string]bool{}
+	hidden := map[string]bool{}
+	for _, layer := range o.layers {
+		items, err := layer.List(ctx, prefix, pageSize)
+		if err != nil {
+			return nil, fmt.Errorf("error list prefix %s from overlay. err: %w", prefix, err)
+		}
+
+		var whiteouts []string
+		for _, item := range items {
+			name := strings.TrimPrefix(item.Name(), "/")
+			if isWhiteout(name) {
+				dir, base := path.Split(name)
+				whiteouts = append(whiteouts, dir+strings.TrimPrefix(base, VfsWhiteoutPrefix))
+				continue
+			}
+			if seen[name] || hidden[name] {
+				continue
+			}
+			seen[name] = true
+			files = append(files, item)
+		}
+
+		// маркер скрывает только файлы нижних слоев
+		for _, name := range whiteouts {
+			hidden[name] = true
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return strings.TrimPrefix(files[i].Name(), "/") < strings.TrimPrefix(files[j].Name(), "/")
+	})
+
+	return files, nil
+}
+
+func (o *overlayVfs) Read(ctx context.Context, file string, private_access bool) (data []byte, mimeType string, err error) {
+	err = o.resolve(ctx, file, func(layer Vfs) error {
+		data, mimeType, err = layer.Read(ctx, file, private_access)
+		return err
+	})
+
+	return data, mimeType, err
+}
+
+func (o *overlayVfs) ReadFromBucket(ctx context.Context, file, bucket string, private_access bool) (data []byte, mimeType string, err error) {
+	err = o.resolve(ctx, file, func(layer Vfs) error {
+		data, mimeType, err = layer.ReadFromBucket(ctx, file, bucket, private_access)
+		return err
+	})
+
+	return data, mimeType, err
+}
+
+func (o *overlayVfs) ReadCloser(ctx context.Context, file string, private_access bool) (reader io.ReadCloser, err error) {
+	err = o.resolve(ctx, file, func(layer Vfs) error {
+		reader, err = layer.ReadCloser(ctx, file, private_access)
+		return err
+	})
+
+	return reader, err
+}
+
+func (o *overlayVfs) ReadCloserFromBucket(ctx context.Context, file, bucket string, private_access bool) (reader io.ReadCloser, err error) {
+	err = o.resolve(ctx, file, func(layer Vfs) error {
+		reader, err = layer.ReadCloserFromBucket(ctx, file, bucket, private_access)
+		return err
+	})
+
+	return reader, err
+}
+
+// Write пишет файл в верхний слой и снимает маркер удаления, если он был
+func (o *overlayVfs) Write(ctx context.Context, file string, data []byte) (err error) {
+	if len(o.layers) == 0 {
+		return ErrOverlayEmpty
+	}
+	top := o.layers[0]
+
+	err = top.Write(ctx, file, data)
+	if err != nil {
+		return err
+	}
+
+	whiteout, err := vfsExists(ctx, top, WhiteoutPath(file))
+	if err != nil || !whiteout {
+		return err
+	}
+
+	return top.Delete(ctx, WhiteoutPath(file))
+}
+
+// Delete удаляет файл из верхнего слоя
+// если файл есть в нижних слоях, в верхнем слое создается маркер удаления, скрывающий их
+func (o *overlayVfs) Delete(ctx context.Context, file string) (err error) {
+	if len(o.layers) == 0 {
+		return ErrOverlayEmpty
+	}
+	top := o.layers[0]
+
+	exists, err := vfsExists(ctx, top, file)
+	if err != nil {
+		return err
+	}
+	if exists {
+		err = top.Delete(ctx, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, layer := range o.layers[1:] {
+		lower, err := vfsExists(ctx, layer, file)
+		if err != nil {
+			return err
+		}
+		if lower {
+			return top.Write(ctx, WhiteoutPath(file), []byte{})
+		}
+	}
+
+	if !exists {
+		return fmt.Errorf("error delete file %s from overlay. err: %w", file, stow.ErrNotFound)
+	}
+
+	return nil
+}
+
+func (o *overlayVfs) Connect() (err error) {
+	for _, layer := range o.layers {
+		if err = layer.Connect(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *overlayVfs) Close() (err error) {
+	for _, layer := range o.layers {
+		if errClose := layer.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}
+
+	return err
+}
+
+// Proxy отдает файлы через объединенное хранилище (проксирование напрямую в один из слоев не учитывало бы остальные)
+func (o *overlayVfs) Proxy(trimPrefix, newPrefix string) (http.Handler, error) {
+	if len(o.layers) == 0 {
+		return nil, ErrOverlayEmpty
+	}
+
+	return vfsHandler(o, trimPrefix, newPrefix), nil
+}
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverlayVfs(t *testing.T) {
+	ctx := context.Background()
+
+	tenant := newTestVfs(t)
+	shared := newTestVfs(t)
+	base := NewFSVfs(fstest.MapFS{
+		"tpl/page.html":   {Data: []byte("base page")},
+		"tpl/footer.html": {Data: []byte("base footer")},
+		"tpl/header.html": {Data: []byte("base header")},
+	})
+	assert.NoError(t, shared.Write(ctx, "tpl/header.html", []byte("shared header")))
+	assert.NoError(t, tenant.Write(ctx, "tpl/page.html", []byte("tenant page")))
+
+	v := NewOverlayVfs(tenant, shared, base)
+
+	read := func(file string) string {
+		data, _, err := v.Read(ctx, file, false)
+		if err != nil {
+			return err.Error()
+		}
+		return string(data)
+	}
+
+	assert.Equal(t, "tenant page", read("tpl/page.html"))
+	assert.Equal(t, "shared header", read("tpl/header.html"))
+	assert.Equal(t, "base footer", read("tpl/footer.html"))
+
+	names := func() (result []string) {
+		files, err := v.List(ctx, "tpl/", 100)
+		assert.NoError(t, err)
+		for _, f := range files {
+			result = append(result, f.Name())
+		}
+		return result
+	}
+	assert.Equal(t, []string{"tpl/footer.html", "tpl/header.html", "tpl/page.html"}, names())
+
+	// удаление файла нижнего слоя оставляет маркер в верхнем
+	assert.NoError(t, v.Delete(ctx, "tpl/footer.html"))
+	_, _, err := v.Read(ctx, "tpl/footer.html", false)
+	assert.True(t, IsVfsNotFound(err))
+	assert.Equal(t, []string{"tpl/header.html", "tpl/page.html"}, names())
+
+	exists, err := vfsExists(ctx, tenant, WhiteoutPath("tpl/footer.html"))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// удаление переопределенного файла скрывает и файлы нижних слоев, снятие маркера открывает их снова
+	assert.NoError(t, v.Delete(ctx, "tpl/page.html"))
+	_, _, err = v.Read(ctx, "tpl/page.html", false)
+	assert.True(t, IsVfsNotFound(err))
+	assert.NoError(t, tenant.Delete(ctx, WhiteoutPath("tpl/page.html")))
+	assert.Equal(t, "base page", read("tpl/page.html"))
+
+	// запись снимает маркер
+	assert.NoError(t, v.Write(ctx, "tpl/footer.html", []byte("tenant footer")))
+	assert.Equal(t, "tenant footer", read("tpl/footer.html"))
+	exists, err = vfsExists(ctx, tenant, WhiteoutPath("tpl/footer.html"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.True(t, IsVfsNotFound(v.Delete(ctx, "tpl/none.html")))
+
+	handler, err := v.Proxy("/tpl", "tpl")
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/tpl/header.html", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "shared header", w.Body.String())
+}
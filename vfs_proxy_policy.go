@@ -0,0 +1,284 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ProxyInline файл открывается в браузере
+	ProxyInline = "inline"
+	// ProxyAttachment файл скачивается с исходным именем
+	ProxyAttachment = "attachment"
+)
+
+// ErrProxyPolicy политика Proxy задана некорректно
+var ErrProxyPolicy = errors.New("proxy policy is not valid")
+
+// ProxyPolicy заголовки ответов Vfs.Proxy для файлов, подходящих под шаблон
+type ProxyPolicy struct {
+	// Pattern шаблон path.Match пути файла (без trimPrefix), шаблон без "/" сравнивается с именем файла ("*.css"),
+	// пустой шаблон подходит для всех файлов
+	Pattern string
+	// CacheControl значение Cache-Control, например "public, max-age=31536000, immutable"
+	CacheControl string
+	// Expires время жизни в кеше (заголовок Expires), если CacheControl пустой - выставляется и max-age
+	Expires time.Duration
+	// ETag пропускать ETag хранилища (условные запросы If-None-Match), иначе заголовок удаляется
+	ETag bool
+	// Disposition ProxyInline или ProxyAttachment, имя файла передается по RFC 6266
+	Disposition string
+	// ForceMIME Content-Type по расширению файла из реестра MIME вместо типа, сохраненного в хранилище
+	ForceMIME bool
+	// CORS заголовки CORS и ответ на preflight-запросы (nil - не выставляются)
+	CORS *ProxyCORS
+}
+
+// ProxyCORS правила CORS для ответов Vfs.Proxy
+type ProxyCORS struct {
+	// AllowOrigins разрешенные Origin, "*" - любой (нельзя совмещать с AllowCredentials)
+	AllowOrigins []string
+	// AllowMethods методы preflight-запросов (по умолчанию GET, HEAD)
+	AllowMethods []string
+	AllowHeaders []string
+	// ExposeHeaders заголовки ответа, доступные скрипту (например ETag, Content-Disposition)
+	ExposeHeaders    []string
+	MaxAge           time.Duration
+	AllowCredentials bool
+}
+
+// ProxyWithPolicies возвращает Proxy хранилища, выставляющий заголовки ответа по первой подходящей политике
+// работает для любого Vfs (s3, fs, overlay...), файлы без подходящей политики отдаются как есть
+func ProxyWithPolicies(v Vfs, trimPrefix, newPrefix string, policies ...ProxyPolicy) (http.Handler, error) {
+	for _, p := range policies {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	handler, err := v.Proxy(trimPrefix, newPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(policies) == 0 {
+		return handler, nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, trimPrefix), "/")
+		policy, ok := matchProxyPolicy(policies, name)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		origin := r.Header.Get("Origin")
+		if policy.CORS != nil && r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+			policy.CORS.preflight(w, origin)
+			return
+		}
+
+		handler.ServeHTTP(&proxyPolicyWriter{ResponseWriter: w, policy: policy, name: name, origin: origin}, r)
+	}), nil
+}
+
+// matchProxyPolicy первая политика, шаблон которой подходит к файлу
+func matchProxyPolicy(policies []ProxyPolicy, name string) (ProxyPolicy, bool) {
+	for _, p := range policies {
+		target := name
+		if !strings.Contains(p.Pattern, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(p.Pattern, target); ok || p.Pattern == "" {
+			return p, true
+		}
+	}
+
+	return ProxyPolicy{}, false
+}
+
+// proxyPolicyWriter выставляет заголовки политики перед отправкой статуса ответа
+type proxyPolicyWriter struct {
+	http.ResponseWriter
+	policy      ProxyPolicy
+	name        string
+	origin      string
+	wroteHeader bool
+}
+
+func (w *proxyPolicyWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.policy.apply(w.Header(), status, w.name, w.origin)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *proxyPolicyWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap для http.ResponseController (Flush из ReverseProxy)
+func (w *proxyPolicyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// validate "*" с AllowCredentials открыл бы ответы с куками любому сайту
+func (p ProxyPolicy) validate() error {
+	if p.CORS == nil || !p.CORS.AllowCredentials {
+		return nil
+	}
+	for _, o := range p.CORS.AllowOrigins {
+		if o == "*" {
+			return fmt.Errorf("%w: pattern %q allows any origin with credentials", ErrProxyPolicy, p.Pattern)
+		}
+	}
+
+	return nil
+}
+
+func (p ProxyPolicy) apply(h http.Header, status int, name, origin string) {
+	if p.CORS != nil && origin != "" {
+		p.CORS.apply(h, origin)
+	}
+
+	success := status == http.StatusOK || status == http.StatusPartialContent
+	if !success && status != http.StatusNotModified {
+		return
+	}
+
+	if p.CacheControl != "" {
+		h.Set("Cache-Control", p.CacheControl)
+	} else if p.Expires > 0 {
+		h.Set("Cache-Control", "public, max-age="+strconv.FormatInt(int64(p.Expires/time.Second), 10))
+	}
+	if p.Expires > 0 {
+		h.Set("Expires", time.Now().Add(p.Expires).UTC().Format(http.TimeFormat))
+	}
+	if !p.ETag {
+		h.Del("ETag")
+	}
+
+	if !success {
+		return
+	}
+	if p.ForceMIME {
+		h.Set("Content-Type", detectMIME(nil, name))
+	}
+	if p.Disposition != "" {
+		h.Set("Content-Disposition", contentDisposition(p.Disposition, path.Base(name)))
+	}
+}
+
+// allowOrigin значение Access-Control-Allow-Origin для Origin запроса ("" - не разрешен)
+func (c *ProxyCORS) allowOrigin(origin string) string {
+	for _, o := range c.AllowOrigins {
+		switch {
+		case o == "*" && !c.AllowCredentials:
+			return "*"
+		case o != "*" && strings.EqualFold(o, origin):
+			return origin
+		}
+	}
+
+	return ""
+}
+
+func (c *ProxyCORS) apply(h http.Header, origin string) {
+	h.Add("Vary", "Origin")
+	allowed := c.allowOrigin(origin)
+	if allowed == "" {
+		return
+	}
+
+	h.Set("Access-Control-Allow-Origin", allowed)
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+	}
+}
+
+// preflight отвечает на OPTIONS-запрос браузера без обращения к хранилищу
+func (c *ProxyCORS) preflight(w http.ResponseWriter, origin string) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	allowed := c.allowOrigin(origin)
+	if allowed == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	methods := c.AllowMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead}
+	}
+	h.Set("Access-Control-Allow-Origin", allowed)
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(c.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowHeaders, ", "))
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.FormatInt(int64(c.MaxAge/time.Second), 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// contentDisposition формирует заголовок по RFC 6266: filename - ASCII-вариант имени для старых клиентов,
+// filename* - полное имя в UTF-8 (RFC 5987)
+func contentDisposition(disposition, filename string) string {
+	ascii := make([]rune, 0, len(filename))
+	isASCII := true
+	for _, r := range filename {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			isASCII = false
+			continue
+		case r > 0x7e:
+			isASCII = false
+			r = '_'
+		case r == '"' || r == '\\':
+			r = '_'
+		}
+		ascii = append(ascii, r)
+	}
+
+	value := disposition + `; filename="` + string(ascii) + `"`
+	if !isASCII {
+		value += "; filename*=UTF-8''" + encodeRFC5987(filename)
+	}
+
+	return value
+}
+
+// encodeRFC5987 кодирует байты, не входящие в attr-char
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+
+	return b.String()
+}
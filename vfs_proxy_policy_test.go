@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3/s3test"
+)
+
+func TestProxyWithPolicies(t *testing.T) {
+	v := NewFSVfs(fstest.MapFS{
+		"static/app.css":       {Data: []byte("body{}")},
+		"files/отчет 2024.pdf": {Data: []byte("%PDF")},
+		"files/data.bin":       {Data: []byte("bin")},
+	})
+
+	h, err := ProxyWithPolicies(v, "/assets/", "",
+		ProxyPolicy{Pattern: "static/*", CacheControl: "public, max-age=31536000, immutable", ETag: true},
+		ProxyPolicy{Pattern: "*.pdf", Disposition: ProxyAttachment, Expires: time.Hour, CORS: &ProxyCORS{
+			AllowOrigins:  []string{"https://app.example.com"},
+			ExposeHeaders: []string{"Content-Disposition"},
+			MaxAge:        10 * time.Minute,
+		}},
+		ProxyPolicy{Pattern: "files/*.bin", ForceMIME: true, Disposition: ProxyInline},
+	)
+	assert.NoError(t, err)
+
+	serve := func(method, target string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(http.MethodGet, "/assets/static/app.css", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+
+	w = serve(http.MethodGet, "/assets/files/%D0%BE%D1%82%D1%87%D0%B5%D1%82%202024.pdf", map[string]string{"Origin": "https://app.example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `attachment; filename="_____ 2024.pdf"; filename*=UTF-8''%D0%BE%D1%82%D1%87%D0%B5%D1%82%202024.pdf`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "public, max-age=3600", w.Header().Get("Cache-Control"))
+	assert.NotEmpty(t, w.Header().Get("Expires"))
+	assert.Empty(t, w.Header().Get("ETag"))
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Content-Disposition", w.Header().Get("Access-Control-Expose-Headers"))
+
+	w = serve(http.MethodOptions, "/assets/files/a.pdf", map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "GET"})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "GET, HEAD", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+	w = serve(http.MethodOptions, "/assets/files/a.pdf", map[string]string{"Origin": "https://evil.example.com", "Access-Control-Request-Method": "GET"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// условный запрос через политику с ETag
+	etag := serve(http.MethodGet, "/assets/static/app.css", nil).Header().Get("ETag")
+	w = serve(http.MethodGet, "/assets/static/app.css", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+
+	// для отсутствующего файла кеш и имя не выставляются
+	w = serve(http.MethodGet, "/assets/files/none.pdf", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("Cache-Control"))
+	assert.Empty(t, w.Header().Get("Content-Disposition"))
+
+	w = serve(http.MethodGet, "/assets/files/data.bin", nil)
+	assert.Equal(t, `inline; filename="data.bin"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, detectMIME(nil, "data.bin"), w.Header().Get("Content-Type"))
+}
+
+func TestProxyWithPoliciesS3(t *testing.T) {
+	srv := s3test.NewServer(s3test.WithAnonymousRead())
+	defer srv.Close()
+	srv.Put("files", "css/app.css", []byte("body{}"))
+
+	h, err := ProxyWithPolicies(newS3TestVfs(t, srv), "/static/", "/files/",
+		ProxyPolicy{Pattern: "*.css", CacheControl: "public, max-age=60", ETag: true, ForceMIME: true},
+	)
+	assert.NoError(t, err)
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL + "/static/css/app.css")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "public, max-age=60", res.Header.Get("Cache-Control"))
+	assert.Equal(t, "text/css", res.Header.Get("Content-Type"))
+	etag := res.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/static/css/app.css", nil)
+	req.Header.Set("If-None-Match", etag)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	assert.Equal(t, "public, max-age=60", res.Header.Get("Cache-Control"))
+}
+
+func TestProxyCORSOrigin(t *testing.T) {
+	v := NewFSVfs(fstest.MapFS{"files/a.pdf": {Data: []byte("%PDF")}})
+
+	// любой Origin вместе с куками не допускается
+	_, err := ProxyWithPolicies(v, "/", "", ProxyPolicy{Pattern: "*.pdf", CORS: &ProxyCORS{
+		AllowOrigins:     []string{"https://app.example.com", "*"},
+		AllowCredentials: true,
+	}})
+	assert.ErrorIs(t, err, ErrProxyPolicy)
+
+	h, err := ProxyWithPolicies(v, "/", "", ProxyPolicy{Pattern: "*.pdf", CORS: &ProxyCORS{
+		AllowOrigins:     []string{"https://app.example.com"},
+		AllowCredentials: true,
+	}})
+	assert.NoError(t, err)
+
+	for origin, allowed := range map[string]string{
+		"https://app.example.com":  "https://app.example.com",
+		"https://evil.example.com": "",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/files/a.pdf", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, allowed, w.Header().Get("Access-Control-Allow-Origin"), origin)
+	}
+
+	// без кук "*" отдается как есть, а не эхом Origin
+	cors := &ProxyCORS{AllowOrigins: []string{"*"}}
+	assert.Equal(t, "*", cors.allowOrigin("https://evil.example.com"))
+}
@@ -0,0 +1,498 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Кворум записи ReplicatedVfs
+const (
+	ReplicaQuorumAll          = "all"           // запись успешна, если файл записан во все реплики
+	ReplicaQuorumAny          = "any"           // запись успешна, если файл записан хотя бы в одну реплику
+	ReplicaQuorumPrimaryAsync = "primary-async" // запись в основную реплику, в остальные - асинхронно через очередь
+)
+
+const (
+	defaultReplicaRepairRetries   = 5
+	defaultReplicaRepairDelay     = time.Second
+	defaultReplicaRepairQueueSize = 1000
+
+	// replicaFileLocks количество блокировок, упорядочивающих запись файлов на репликах
+	replicaFileLocks = 64
+)
+
+var (
+	ErrReplicaQuorum  = errors.New("replica quorum not reached")
+	ErrReplicaNone    = errors.New("replicated vfs has no replicas")
+	ErrReplicaUnknown = errors.New("unknown replica quorum")
+
+	// время от исходной записи до ее применения на реплике
+	vfs_replica_lag metrics.Gauge = kitprometheus.NewGaugeFrom(prometheus.GaugeOpts{
+		Name: "vfs_replica_lag_seconds",
+	}, []string{"replica"})
+
+	// количество операций в очереди на репликацию
+	vfs_replica_pending metrics.Gauge = kitprometheus.NewGaugeFrom(prometheus.GaugeOpts{
+		Name: "vfs_replica_pending",
+	}, []string{"replica"})
+
+	// количество операций, которые не удалось применить на реплике после всех попыток
+	vfs_replica_failed metrics.Counter = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Name: "vfs_replica_failed",
+	}, []string{"replica"})
+)
+
+// VfsReplica реплика хранилища
+type VfsReplica struct {
+	Name string
+	DC   string
+	Vfs  Vfs
+}
+
+// ReplicatedVfsConfig параметры репликации
+type ReplicatedVfsConfig struct {
+	Quorum string // ReplicaQuorumAll (по умолчанию), ReplicaQuorumAny, ReplicaQuorumPrimaryAsync
+	DC     string // dc сервиса, реплики этого dc используются для чтения в первую очередь
+
+	RepairRetries   int           // количество попыток применить операцию на отставшей реплике
+	RepairDelay     time.Duration // базовая задержка между попытками, растет экспоненциально (см. backoffDelay)
+	RepairQueueSize int           // размер очереди восстановления
+}
+
+type replicatedVfs struct {
+	cfg      ReplicatedVfsConfig
+	replicas []VfsReplica
+	// fileLocks не дают отложенной операции перезаписать более позднюю запись того же файла на реплике
+	// блокировка выбирается по реплике и файлу, поэтому чтение и запись разных файлов не ждут друг друга
+	fileLocks [replicaFileLocks]sync.Mutex
+	// порядок опроса реплик при чтении: реплики своего dc, затем остальные (основная первой в группе)
+	readOrder []int
+	pending   []int64
+	queue     chan *replicaTask
+
+	// seq порядковый номер операции записи, более поздняя операция над файлом отменяет отложенные ранние
+	seq uint64
+	mx  sync.Mutex
+	// latest последняя отложенная операция по реплике и файлу, остальные операции с этим файлом устарели
+	latest map[replicaKey]*replicaTask
+}
+
+// replicaKey реплика и файл отложенной операции
+type replicaKey struct {
+	replica int
+	file    string
+}
+
+// replicaTask отложенная операция для реплики
+type replicaTask struct {
+	replica  int
+	seq      uint64
+	op       string
+	file     string
+	data     []byte
+	created  time.Time
+	attempts int
+}
+
+func (t *replicaTask) key() replicaKey {
+	return replicaKey{replica: t.replica, file: t.file}
+}
+
+// NewReplicatedVfs хранилище, которое дублирует запись и удаление во все реплики и читает с переключением на следующую реплику при ошибке
+// первая реплика - основная. Неудачные записи в реплики ставятся в очередь восстановления,
+// которую разбирает фоновый обработчик до завершения ctx
+// операции над репликой выполняются одновременно, реплики должны это допускать (как хранилища NewVfs)
+func NewReplicatedVfs(ctx context.Context, cfg ReplicatedVfsConfig, replicas ...VfsReplica) (Vfs, error) {
+	if len(replicas) == 0 {
+		return nil, ErrReplicaNone
+	}
+
+	if cfg.Quorum == "" {
+		cfg.Quorum = ReplicaQuorumAll
+	}
+	switch cfg.Quorum {
+	case ReplicaQuorumAll, ReplicaQuorumAny, ReplicaQuorumPrimaryAsync:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrReplicaUnknown, cfg.Quorum)
+	}
+	if cfg.RepairRetries <= 0 {
+		cfg.RepairRetries = defaultReplicaRepairRetries
+	}
+	if cfg.RepairDelay <= 0 {
+		cfg.RepairDelay = defaultReplicaRepairDelay
+	}
+	if cfg.RepairQueueSize <= 0 {
+		cfg.RepairQueueSize = defaultReplicaRepairQueueSize
+	}
+
+	r := &replicatedVfs{
+		cfg:      cfg,
+		replicas: replicas,
+		pending:  make([]int64, len(replicas)),
+		queue:    make(chan *replicaTask, cfg.RepairQueueSize),
+		latest:   map[replicaKey]*replicaTask{},
+	}
+
+	var fallback []int
+	for i, replica := range replicas {
+		if replica.Vfs == nil {
+			return nil, fmt.Errorf("error replica %s. err: %w", replica.Name, ErrReplicaNone)
+		}
+		if cfg.DC == "" || replica.DC == cfg.DC {
+			r.readOrder = append(r.readOrder, i)
+			continue
+		}
+		fallback = append(fallback, i)
+	}
+	r.readOrder = append(r.readOrder, fallback...)
+
+	RunAsync(ctx, func() {
+		r.repair(ctx)
+	})
+
+	return r, nil
+}
+
+// fileLock блокировка записи файла на реплике
+func (r *replicatedVfs) fileLock(key replicaKey) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key.file))
+
+	return &r.fileLocks[(int(h.Sum32())+key.replica)%replicaFileLocks]
+}
+
+// read выполняет fn по репликам в порядке readOrder до первого успешного ответа
+func (r *replicatedVfs) read(ctx context.Context, fn func(v Vfs) error) (err error) {
+	for _, i := range r.readOrder {
+		err = fn(r.replicas[i].Vfs)
+		if err == nil {
+			return nil
+		}
+		// отказ в доступе и отмена запроса не зависят от реплики
+		if err.Error() == privateDirectory || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// write выполняет операцию на репликах в соответствии с кворумом
+// реплики, на которых операция не прошла, ставятся в очередь восстановления
+func (r *replicatedVfs) write(ctx context.Context, op, file string, data []byte, fn func(v Vfs) error) (err error) {
+	created := time.Now()
+	seq := atomic.AddUint64(&r.seq, 1)
+	// отложенная операция выполняется после возврата из write, поэтому хранит свою копию данных
+	var queued []byte
+	task := func(i int) *replicaTask {
+		if queued == nil && data != nil {
+			queued = append([]byte(nil), data...)
+		}
+		return &replicaTask{replica: i, seq: seq, op: op, file: file, data: queued, created: created}
+	}
+
+	if r.cfg.Quorum == ReplicaQuorumPrimaryAsync {
+		err = r.writeReplica(0, file, seq, fn)
+		if err != nil {
+			return err
+		}
+		vfs_replica_lag.With("replica", r.replicas[0].Name).Set(0)
+
+		for i := 1; i < len(r.replicas); i++ {
+			r.enqueue(task(i))
+		}
+
+		return nil
+	}
+
+	errs := make([]error, len(r.replicas))
+	var wg sync.WaitGroup
+	for i := range r.replicas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = r.writeReplica(i, file, seq, fn)
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []error
+	for i, e := range errs {
+		if e == nil {
+			vfs_replica_lag.With("replica", r.replicas[i].Name).Set(0)
+			continue
+		}
+		failed = append(failed, fmt.Errorf("replica %s: %w", r.replicas[i].Name, e))
+	}
+
+	// операция не прошла ни на одной реплике - восстанавливать нечего
+	if len(failed) == len(r.replicas) {
+		return fmt.Errorf("error %s %s. err: %w", op, file, errors.Join(failed...))
+	}
+
+	for i, e := range errs {
+		if e != nil {
+			r.enqueue(task(i))
+		}
+	}
+
+	if len(failed) > 0 && r.cfg.Quorum == ReplicaQuorumAll {
+		return fmt.Errorf("error %s %s. err: %w: %w", op, file, ErrReplicaQuorum, errors.Join(failed...))
+	}
+
+	return nil
+}
+
+// writeReplica выполняет операцию записи seq на реплике i
+// успешная операция отменяет отложенные более ранние операции с этим файлом на реплике
+func (r *replicatedVfs) writeReplica(i int, file string, seq uint64, fn func(v Vfs) error) error {
+	key := replicaKey{replica: i, file: file}
+	lock := r.fileLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err := fn(r.replicas[i].Vfs)
+	if err == nil {
+		r.mx.Lock()
+		if t, ok := r.latest[key]; ok && t.seq < seq {
+			delete(r.latest, key)
+		}
+		r.mx.Unlock()
+	}
+
+	return err
+}
+
+// enqueue ставит операцию в очередь восстановления вместо отложенных более ранних операций с этим файлом
+// при переполнении очереди операция считается потерянной
+func (r *replicatedVfs) enqueue(task *replicaTask) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	key := task.key()
+	if t, ok := r.latest[key]; ok && t.seq > task.seq {
+		return
+	}
+	r.push(task)
+}
+
+// retry повторно ставит операцию в очередь, если ее не заменила более поздняя
+func (r *replicatedVfs) retry(task *replicaTask) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.latest[task.key()] == task {
+		r.push(task)
+	}
+}
+
+// push добавляет операцию в очередь (вызывается под r.mx)
+func (r *replicatedVfs) push(task *replicaTask) {
+	name := r.replicas[task.replica].Name
+
+	select {
+	case r.queue <- task:
+		r.latest[task.key()] = task
+		vfs_replica_pending.With("replica", name).Set(float64(atomic.AddInt64(&r.pending[task.replica], 1)))
+	default:
+		// более ранние операции с файлом в очереди тоже не применяются - реплика остается отставшей, но не откатывается
+		delete(r.latest, task.key())
+		vfs_replica_failed.With("replica", name).Add(1)
+	}
+}
+
+// current операция не заменена более поздней
+func (r *replicatedVfs) current(task *replicaTask) bool {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return r.latest[task.key()] == task
+}
+
+// done операция применена
+func (r *replicatedVfs) done(task *replicaTask) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.latest[task.key()] == task {
+		delete(r.latest, task.key())
+	}
+}
+
+// repair фоновый обработчик очереди восстановления
+func (r *replicatedVfs) repair(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case task := <-r.queue:
+			r.apply(ctx, task)
+		}
+	}
+}
+
+func (r *replicatedVfs) apply(ctx context.Context, task *replicaTask) {
+	replica := r.replicas[task.replica]
+	pending := atomic.AddInt64(&r.pending[task.replica], -1)
+	vfs_replica_pending.With("replica", replica.Name).Set(float64(pending))
+
+	lock := r.fileLock(task.key())
+	lock.Lock()
+	// операция заменена более поздней записью или удалением файла - применять ее нельзя
+	if !r.current(task) {
+		lock.Unlock()
+		return
+	}
+	var err error
+	switch task.op {
+	case VfsOpWrite:
+		err = replica.Vfs.Write(ctx, task.file, task.data)
+	case VfsOpDelete:
+		err = replica.Vfs.Delete(ctx, task.file)
+		// файла на реплике уже нет - удалять нечего
+		if IsVfsNotFound(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		r.done(task)
+	}
+	lock.Unlock()
+
+	if err == nil {
+		vfs_replica_lag.With("replica", replica.Name).Set(time.Since(task.created).Seconds())
+		return
+	}
+
+	task.attempts++
+	if task.attempts >= r.cfg.RepairRetries {
+		r.done(task)
+		vfs_replica_failed.With("replica", replica.Name).Add(1)
+		return
+	}
+
+	// повторяем с задержкой, не блокируя обработку остальных операций
+	time.AfterFunc(backoffDelay(task.attempts, r.cfg.RepairDelay), func() {
+		if ctx.Err() == nil {
+			r.retry(task)
+		}
+	})
+}
+
+func (r *replicatedVfs) Item(ctx context.Context, path string) (file Item, err error) {
+	err = r.read(ctx, func(v Vfs) error {
+		file, err = v.Item(ctx, path)
+		if err == nil {
+			_, err = file.Size()
+		}
+		return err
+	})
+
+	return file, err
+}
+
+func (r *replicatedVfs) List(ctx context.Context, prefix string, pageSize int) (files []Item, err error) {
+	err = r.read(ctx, func(v Vfs) error {
+		files, err = v.List(ctx, prefix, pageSize)
+		return err
+	})
+
+	return files, err
+}
+
+func (r *replicatedVfs) Read(ctx context.Context, file string, private_access bool) (data []byte, mimeType string, err error) {
+	err = r.read(ctx, func(v Vfs) error {
+		data, mimeType, err = v.Read(ctx, file, private_access)
+		return err
+	})
+
+	return data, mimeType, err
+}
+
+func (r *replicatedVfs) ReadFromBucket(ctx context.Context, file, bucket string, private_access bool) (data []byte, mimeType string, err error) {
+	err = r.read(ctx, func(v Vfs) error {
+		data, mimeType, err = v.ReadFromBucket(ctx, file, bucket, private_access)
+		return err
+	})
+
+	return data, mimeType, err
+}
+
+func (r *replicatedVfs) ReadCloser(ctx context.Context, file string, private_access bool) (reader io.ReadCloser, err error) {
+	err = r.read(ctx, func(v Vfs) error {
+		reader, err = v.ReadCloser(ctx, file, private_access)
+		return err
+	})
+
+	return reader, err
+}
+
+func (r *replicatedVfs) ReadCloserFromBucket(ctx context.Context, file, bucket string, private_access bool) (reader io.ReadCloser, err error) {
+	err = r.read(ctx, func(v Vfs) error {
+		reader, err = v.ReadCloserFromBucket(ctx, file, bucket, private_access)
+		return err
+	})
+
+	return reader, err
+}
+
+func (r *replicatedVfs) Write(ctx context.Context, file string, data []byte) (err error) {
+	return r.write(ctx, VfsOpWrite, file, data, func(v Vfs) error {
+		return v.Write(ctx, file, data)
+	})
+}
+
+func (r *replicatedVfs) Delete(ctx context.Context, file string) (err error) {
+	return r.write(ctx, VfsOpDelete, file, nil, func(v Vfs) error {
+		return v.Delete(ctx, file)
+	})
+}
+
+// Connect подключается ко всем репликам
+// ошибка возвращается, только если без недоступных реплик кворум записи невозможен
+func (r *replicatedVfs) Connect() (err error) {
+	var failed []string
+	var errs []error
+	for i, replica := range r.replicas {
+		if errConnect := replica.Vfs.Connect(); errConnect != nil {
+			if i == 0 && r.cfg.Quorum == ReplicaQuorumPrimaryAsync {
+				return fmt.Errorf("error connect to primary replica %s. err: %w", replica.Name, errConnect)
+			}
+			failed = append(failed, replica.Name)
+			errs = append(errs, errConnect)
+		}
+	}
+
+	if len(failed) == len(r.replicas) || (len(failed) > 0 && r.cfg.Quorum == ReplicaQuorumAll) {
+		return fmt.Errorf("error connect to replicas %s. err: %w", strings.Join(failed, ", "), errors.Join(errs...))
+	}
+
+	return nil
+}
+
+func (r *replicatedVfs) Close() (err error) {
+	for _, replica := range r.replicas {
+		if errClose := replica.Vfs.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}
+
+	return err
+}
+
+// Proxy отдает файлы с переключением между репликами
+func (r *replicatedVfs) Proxy(trimPrefix, newPrefix string) (http.Handler, error) {
+	return vfsHandler(r, trimPrefix, newPrefix), nil
+}
@@ -0,0 +1,239 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errReplicaDown = errors.New("replica is down")
+
+// downVfs реплика, которую можно "выключить" в тесте
+type downVfs struct {
+	VfsWrapper
+	down atomic.Bool
+}
+
+func (d *downVfs) Read(ctx context.Context, file string, private_access bool) ([]byte, string, error) {
+	if d.down.Load() {
+		return nil, "", errReplicaDown
+	}
+	return d.Next.Read(ctx, file, private_access)
+}
+
+func (d *downVfs) Write(ctx context.Context, file string, data []byte) error {
+	if d.down.Load() {
+		return errReplicaDown
+	}
+	return d.Next.Write(ctx, file, data)
+}
+
+// newLocalVfs отдельное подключение к локальному хранилищу dir: тест проверяет реплики
+// в обход downVfs, через который ими пользуется ReplicatedVfs
+func newLocalVfs(t *testing.T, dir string) Vfs {
+	t.Helper()
+
+	v := NewVfs("local", dir, "", "", "", "bucket", "", "")
+	if err := v.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestReplicatedVfsQuorum(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secondaryDir := t.TempDir()
+	primary := &downVfs{VfsWrapper: VfsWrapper{Next: newTestVfs(t)}}
+	secondary := &downVfs{VfsWrapper: VfsWrapper{Next: newLocalVfs(t, secondaryDir)}}
+	secondaryCheck := newLocalVfs(t, secondaryDir)
+	replicas := []VfsReplica{
+		{Name: "primary", DC: "dc1", Vfs: primary},
+		{Name: "secondary", DC: "dc2", Vfs: secondary},
+	}
+	cfg := ReplicatedVfsConfig{RepairDelay: 10 * time.Millisecond}
+
+	_, err := NewReplicatedVfs(ctx, ReplicatedVfsConfig{Quorum: "most"}, replicas...)
+	assert.ErrorIs(t, err, ErrReplicaUnknown)
+
+	all, err := NewReplicatedVfs(ctx, cfg, replicas...)
+	assert.NoError(t, err)
+
+	secondary.down.Store(true)
+	assert.ErrorIs(t, all.Write(ctx, "a.txt", []byte("a")), ErrReplicaQuorum)
+
+	cfg.Quorum = ReplicaQuorumAny
+	anyVfs, err := NewReplicatedVfs(ctx, cfg, replicas...)
+	assert.NoError(t, err)
+	assert.NoError(t, anyVfs.Write(ctx, "b.txt", []byte("b")))
+
+	// реплика поднялась - очередь восстановления догоняет пропущенные записи
+	secondary.down.Store(false)
+	assert.Eventually(t, func() bool {
+		data, _, err := secondaryCheck.Read(ctx, "b.txt", false)
+		return err == nil && string(data) == "b"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// чтение переключается на живую реплику
+	primary.down.Store(true)
+	data, _, err := anyVfs.Read(ctx, "b.txt", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(data))
+
+	primary.down.Store(false)
+	secondary.down.Store(true)
+	assert.NoError(t, anyVfs.Write(ctx, "c.txt", []byte("c")))
+	primary.down.Store(true)
+	assert.ErrorIs(t, anyVfs.Write(ctx, "d.txt", []byte("d")), errReplicaDown)
+}
+
+func TestReplicatedVfsPrimaryAsync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primaryDir, secondaryDir := t.TempDir(), t.TempDir()
+	primary, secondary := newLocalVfs(t, primaryDir), newLocalVfs(t, secondaryDir)
+	primaryCheck, secondaryCheck := newLocalVfs(t, primaryDir), newLocalVfs(t, secondaryDir)
+
+	v, err := NewReplicatedVfs(ctx, ReplicatedVfsConfig{
+		Quorum: ReplicaQuorumPrimaryAsync,
+		DC:     "dc2",
+	},
+		VfsReplica{Name: "primary", DC: "dc1", Vfs: primary},
+		VfsReplica{Name: "secondary", DC: "dc2", Vfs: secondary},
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, v.Write(ctx, "dir/a.txt", []byte("async")))
+	data, _, err := primaryCheck.Read(ctx, "dir/a.txt", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "async", string(data))
+
+	assert.Eventually(t, func() bool {
+		data, _, err := secondaryCheck.Read(ctx, "dir/a.txt", false)
+		return err == nil && string(data) == "async"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// чтение идет из реплики своего dc
+	assert.NoError(t, secondaryCheck.Write(ctx, "dir/only-dc2.txt", []byte("dc2")))
+	data, _, err = v.Read(ctx, "dir/only-dc2.txt", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "dc2", string(data))
+
+	assert.NoError(t, v.Delete(ctx, "dir/a.txt"))
+	assert.Eventually(t, func() bool {
+		_, _, err := secondaryCheck.Read(ctx, "dir/a.txt", false)
+		return IsVfsNotFound(err)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplicatedVfsRepairOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secondaryDir := t.TempDir()
+	secondary := &downVfs{VfsWrapper: VfsWrapper{Next: newLocalVfs(t, secondaryDir)}}
+	secondaryCheck := newLocalVfs(t, secondaryDir)
+
+	v, err := NewReplicatedVfs(ctx, ReplicatedVfsConfig{Quorum: ReplicaQuorumAny, RepairDelay: 20 * time.Millisecond},
+		VfsReplica{Name: "primary", Vfs: newTestVfs(t)},
+		VfsReplica{Name: "secondary", Vfs: secondary},
+	)
+	assert.NoError(t, err)
+	r := v.(*replicatedVfs)
+
+	// ранние записи не прошли на реплику и ждут повтора
+	secondary.down.Store(true)
+	assert.NoError(t, v.Write(ctx, "a.txt", []byte("old")))
+	assert.NoError(t, v.Write(ctx, "b.txt", []byte("old")))
+	secondary.down.Store(false)
+
+	// более поздние запись и удаление отменяют отложенные операции
+	assert.NoError(t, v.Write(ctx, "a.txt", []byte("new")))
+	assert.NoError(t, v.Delete(ctx, "b.txt"))
+
+	assert.Eventually(t, func() bool {
+		r.mx.Lock()
+		defer r.mx.Unlock()
+		return len(r.latest) == 0 && atomic.LoadInt64(&r.pending[1]) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+
+	data, _, err := secondaryCheck.Read(ctx, "a.txt", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	_, _, err = secondaryCheck.Read(ctx, "b.txt", false)
+	assert.True(t, IsVfsNotFound(err), err)
+
+	// в очереди остается только последняя операция с файлом
+	secondary.down.Store(true)
+	r.enqueue(&replicaTask{replica: 1, seq: 100, op: VfsOpWrite, file: "c.txt", data: []byte("c100")})
+	r.enqueue(&replicaTask{replica: 1, seq: 99, op: VfsOpWrite, file: "c.txt", data: []byte("c99")})
+	r.mx.Lock()
+	assert.Equal(t, uint64(100), r.latest[replicaKey{replica: 1, file: "c.txt"}].seq)
+	r.mx.Unlock()
+}
+
+// blockingVfs реплика, чтение которой ждет, пока не начнется второе одновременное чтение
+type blockingVfs struct {
+	VfsWrapper
+	readers sync.WaitGroup
+}
+
+func (b *blockingVfs) Read(ctx context.Context, file string, private_access bool) ([]byte, string, error) {
+	b.readers.Done()
+	b.readers.Wait()
+	return b.Next.Read(ctx, file, private_access)
+}
+
+func TestReplicatedVfsConcurrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secondaryDir := t.TempDir()
+	secondary := &downVfs{VfsWrapper: VfsWrapper{Next: newLocalVfs(t, secondaryDir)}}
+	secondaryCheck := newLocalVfs(t, secondaryDir)
+	primary := &blockingVfs{VfsWrapper: VfsWrapper{Next: newTestVfs(t)}}
+
+	v, err := NewReplicatedVfs(ctx, ReplicatedVfsConfig{Quorum: ReplicaQuorumAny, RepairDelay: 10 * time.Millisecond},
+		VfsReplica{Name: "primary", Vfs: primary},
+		VfsReplica{Name: "secondary", Vfs: secondary},
+	)
+	assert.NoError(t, err)
+
+	// отложенная запись хранит копию данных: буфер вызывающего можно переиспользовать
+	secondary.down.Store(true)
+	buf := []byte("copy")
+	assert.NoError(t, v.Write(ctx, "a.txt", buf))
+	copy(buf, "lost")
+	secondary.down.Store(false)
+	assert.Eventually(t, func() bool {
+		data, _, err := secondaryCheck.Read(ctx, "a.txt", false)
+		return err == nil && string(data) == "copy"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// чтения одной реплики выполняются одновременно
+	primary.readers.Add(2)
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, err := v.Read(ctx, "a.txt", false)
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("reads of the replica are serialized")
+		}
+	}
+}
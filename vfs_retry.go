@@ -0,0 +1,266 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultVfsRetries    = 3
+	defaultVfsRetryDelay = 200 * time.Millisecond
+)
+
+var (
+	// количество повторных попыток операций Vfs
+	vfs_retries metrics.Counter = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Name: "vfs_retries",
+	}, []string{"op"})
+
+	// количество операций Vfs, завершившихся ошибкой после всех попыток
+	vfs_retries_exhausted metrics.Counter = kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+		Name: "vfs_retries_exhausted",
+	}, []string{"op"})
+
+	// признаки временных ошибок в тексте (ошибки хранилищ часто оборачиваются в строку)
+	vfsRetryableMarkers = []string{
+		"status code: 5", "StatusCode: 5",
+		"SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequests", "status code: 429",
+		"RequestTimeout", "InternalError", "ServiceUnavailable",
+		"connection reset", "connection refused", "broken pipe", "unexpected EOF",
+		"i/o timeout", "TLS handshake timeout", "timeout awaiting response headers",
+	}
+)
+
+// VfsRetryConfig параметры повторов операций Vfs
+type VfsRetryConfig struct {
+	// MaxRetries количество повторов после первой попытки (по умолчанию 3)
+	MaxRetries int
+	// Delay базовая задержка между попытками (по умолчанию 200ms), удваивается с каждой попыткой
+	// (не больше 60 базовых задержек) со случайным разбросом в половину задержки
+	Delay time.Duration
+	// DisableDelayProgression одинаковая задержка между всеми попытками
+	DisableDelayProgression bool
+	// Retryable классификатор ошибок (по умолчанию IsVfsRetryable)
+	Retryable func(err error) bool
+}
+
+// IsVfsRetryable проверяет, что ошибка временная и операцию можно повторить:
+// 5xx, 429 и throttling хранилища, таймауты и обрывы соединения
+// ошибки 4xx, отсутствие файла, запрет доступа и невыполненное условие записи не повторяются
+func IsVfsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if IsVfsNotFound(err) || errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrVfsReadOnly) || errors.Is(err, ErrVfsOptionsUnsupported) || errors.Is(err, ErrVfsArchived) || err.Error() == privateDirectory {
+		return false
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode() >= 500 || reqErr.StatusCode() == 429
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	msg := err.Error()
+	for _, marker := range vfsRetryableMarkers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WithVfsRetry мидлварь, повторяющая операции Vfs при временных ошибках
+// запись повторяется только для данных, которые можно отправить заново:
+// Write ([]byte) и WriteStream с io.Seeker (поток перематывается к исходной позиции), прочие потоки пишутся одной попыткой
+// Delete, получивший "не найден" на повторе, считается успешным (файл удален предыдущей попыткой)
+func WithVfsRetry(cfg VfsRetryConfig) VfsMiddleware {
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = defaultVfsRetries
+	}
+	if cfg.Delay <= 0 {
+		cfg.Delay = defaultVfsRetryDelay
+	}
+	if cfg.Retryable == nil {
+		cfg.Retryable = IsVfsRetryable
+	}
+
+	return func(next Vfs) Vfs {
+		return &retryVfs{
+			VfsWrapper: VfsWrapper{Next: next},
+			cfg:        cfg,
+		}
+	}
+}
+
+type retryVfs struct {
+	VfsWrapper
+	cfg VfsRetryConfig
+}
+
+// retry выполняет fn с повторами, учитывая попытки в метриках
+func retry[T any](ctx context.Context, r *retryVfs, op string, fn func(ctx context.Context, attempt int) (T, error)) (T, error) {
+	attempt := 0
+	res, err := RetrierCtx(ctx, r.cfg.MaxRetries+1, r.cfg.Delay, r.cfg.DisableDelayProgression, r.cfg.Retryable, func(ctx context.Context) (T, error) {
+		if attempt > 0 {
+			vfs_retries.With("op", op).Add(1)
+		}
+		res, err := fn(ctx, attempt)
+		attempt++
+		return res, err
+	})
+	// исчерпаны - все попытки сделаны, и последняя ошибка временная
+	if err != nil && attempt > r.cfg.MaxRetries && r.cfg.Retryable(err) {
+		vfs_retries_exhausted.With("op", op).Add(1)
+	}
+
+	return res, err
+}
+
+func (r *retryVfs) Item(ctx context.Context, path string) (file Item, err error) {
+	return retry(ctx, r, VfsOpItem, func(ctx context.Context, _ int) (Item, error) {
+		return r.Next.Item(ctx, path)
+	})
+}
+
+func (r *retryVfs) List(ctx context.Context, prefix string, pageSize int) (files []Item, err error) {
+	return retry(ctx, r, VfsOpList, func(ctx context.Context, _ int) ([]Item, error) {
+		return r.Next.List(ctx, prefix, pageSize)
+	})
+}
+
+func (r *retryVfs) ListDir(ctx context.Context, prefix string) (files []Item, dirs []string, err error) {
+	files, err = retry(ctx, r, VfsOpList, func(ctx context.Context, _ int) (f []Item, err error) {
+		f, dirs, err = ListDir(ctx, r.Next, prefix)
+		return f, err
+	})
+
+	return files, dirs, err
+}
+
+func (r *retryVfs) Read(ctx context.Context, file string, private_access bool) (data []byte, mimeType string, err error) {
+	data, err = retry(ctx, r, VfsOpRead, func(ctx context.Context, _ int) (d []byte, err error) {
+		d, mimeType, err = r.Next.Read(ctx, file, private_access)
+		return d, err
+	})
+
+	return data, mimeType, err
+}
+
+func (r *retryVfs) ReadWithOptions(ctx context.Context, file string, private_access bool, opts ReadOptions) (data []byte, mimeType string, err error) {
+	data, err = retry(ctx, r, VfsOpRead, func(ctx context.Context, _ int) (d []byte, err error) {
+		d, mimeType, err = ReadWithOptions(ctx, r.Next, file, private_access, opts)
+		return d, err
+	})
+
+	return data, mimeType, err
+}
+
+func (r *retryVfs) ReadFromBucket(ctx context.Context, file, bucket string, private_access bool) (data []byte, mimeType string, err error) {
+	data, err = retry(ctx, r, VfsOpReadFromBucket, func(ctx context.Context, _ int) (d []byte, err error) {
+		d, mimeType, err = r.Next.ReadFromBucket(ctx, file, bucket, private_access)
+		return d, err
+	})
+
+	return data, mimeType, err
+}
+
+// ReadCloser повторяется только открытие потока, ошибки чтения из открытого потока возвращаются как есть
+func (r *retryVfs) ReadCloser(ctx context.Context, file string, private_access bool) (reader io.ReadCloser, err error) {
+	return retry(ctx, r, VfsOpReadCloser, func(ctx context.Context, _ int) (io.ReadCloser, error) {
+		return r.Next.ReadCloser(ctx, file, private_access)
+	})
+}
+
+func (r *retryVfs) ReadCloserFromBucket(ctx context.Context, file, bucket string, private_access bool) (reader io.ReadCloser, err error) {
+	return retry(ctx, r, VfsOpReadCloserFromBucket, func(ctx context.Context, _ int) (io.ReadCloser, error) {
+		return r.Next.ReadCloserFromBucket(ctx, file, bucket, private_access)
+	})
+}
+
+func (r *retryVfs) Write(ctx context.Context, file string, data []byte) (err error) {
+	_, err = retry(ctx, r, VfsOpWrite, func(ctx context.Context, _ int) (struct{}, error) {
+		return struct{}{}, r.Next.Write(ctx, file, data)
+	})
+
+	return err
+}
+
+// WriteIf повторяет условную запись
+// если первая попытка дошла до хранилища, но ответ потерян, повтор может вернуть ErrPreconditionFailed
+func (r *retryVfs) WriteIf(ctx context.Context, file string, data []byte, conditions ...WriteCondition) (err error) {
+	_, err = retry(ctx, r, VfsOpWrite, func(ctx context.Context, _ int) (struct{}, error) {
+		return struct{}{}, WriteIf(ctx, r.Next, file, data, conditions...)
+	})
+
+	return err
+}
+
+func (r *retryVfs) WriteWithOptions(ctx context.Context, file string, data []byte, opts WriteOptions) (err error) {
+	_, err = retry(ctx, r, VfsOpWrite, func(ctx context.Context, _ int) (struct{}, error) {
+		return struct{}{}, WriteWithOptions(ctx, r.Next, file, data, opts)
+	})
+
+	return err
+}
+
+func (r *retryVfs) WriteStream(ctx context.Context, file string, reader io.Reader, size int64) (err error) {
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		return WriteStream(ctx, r.Next, file, reader, size)
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return WriteStream(ctx, r.Next, file, reader, size)
+	}
+
+	_, err = retry(ctx, r, VfsOpWrite, func(ctx context.Context, attempt int) (struct{}, error) {
+		if attempt > 0 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return struct{}{}, err
+			}
+		}
+		return struct{}{}, WriteStream(ctx, r.Next, file, reader, size)
+	})
+
+	return err
+}
+
+func (r *retryVfs) Delete(ctx context.Context, file string) (err error) {
+	_, err = retry(ctx, r, VfsOpDelete, func(ctx context.Context, attempt int) (struct{}, error) {
+		err := r.Next.Delete(ctx, file)
+		if attempt > 0 && IsVfsNotFound(err) {
+			return struct{}{}, nil
+		}
+		return struct{}{}, err
+	})
+
+	return err
+}
+
+func (r *retryVfs) Connect() (err error) {
+	_, err = retry(context.Background(), r, VfsOpConnect, func(ctx context.Context, _ int) (struct{}, error) {
+		return struct{}{}, r.Next.Connect()
+	})
+
+	return err
+}
@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/graymeta/stow"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyVfs возвращает заданную ошибку первые fails вызовов
+type flakyVfs struct {
+	VfsWrapper
+	fails int
+	err   error
+	calls int
+}
+
+func (f *flakyVfs) fail() error {
+	f.calls++
+	if f.calls <= f.fails {
+		return f.err
+	}
+	return nil
+}
+
+func (f *flakyVfs) Read(ctx context.Context, file string, private_access bool) ([]byte, string, error) {
+	if err := f.fail(); err != nil {
+		return nil, "", err
+	}
+	return f.Next.Read(ctx, file, private_access)
+}
+
+func (f *flakyVfs) Write(ctx context.Context, file string, data []byte) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.Next.Write(ctx, file, data)
+}
+
+func (f *flakyVfs) WriteStream(ctx context.Context, file string, r io.Reader, size int64) error {
+	// поток вычитывается до ошибки, как при обрыве соединения
+	data, _ := io.ReadAll(r)
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.Next.Write(ctx, file, data)
+}
+
+func TestIsVfsRetryable(t *testing.T) {
+	cases := map[error]bool{
+		nil: false,
+		errors.New("SlowDown: Please reduce your request rate. status code: 503"): true,
+		errors.New("error connect. err: read tcp: connection reset by peer"):      true,
+		fmt.Errorf("wrap: %w", io.ErrUnexpectedEOF):                               true,
+		errors.New("AccessDenied: Access Denied status code: 403"):                false,
+		fmt.Errorf("get: %w", stow.ErrNotFound):                                   false,
+		fmt.Errorf("write: %w", ErrPreconditionFailed):                            false,
+		errors.New(privateDirectory):                                              false,
+		context.Canceled:                                                          false,
+	}
+	for err, want := range cases {
+		assert.Equal(t, want, IsVfsRetryable(err), "%v", err)
+	}
+}
+
+func TestWithVfsRetry(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyVfs{VfsWrapper: VfsWrapper{Next: newTestVfs(t)}, fails: 2, err: errors.New("InternalError status code: 500")}
+	v := ChainVfs(flaky, WithVfsRetry(VfsRetryConfig{Delay: time.Millisecond}))
+
+	assert.NoError(t, v.Write(ctx, "a.txt", []byte("data")))
+	assert.Equal(t, 3, flaky.calls)
+
+	// 4xx не повторяется
+	flaky.calls, flaky.err = 0, errors.New("status code: 403")
+	_, _, err := v.Read(ctx, "a.txt", false)
+	assert.Error(t, err)
+	assert.Equal(t, 1, flaky.calls)
+
+	// попытки исчерпаны
+	flaky.calls, flaky.fails, flaky.err = 0, 10, errors.New("status code: 503")
+	_, _, err = v.Read(ctx, "a.txt", false)
+	assert.Error(t, err)
+	assert.Equal(t, 4, flaky.calls)
+
+	// поток с io.Seeker перематывается перед повтором
+	flaky.calls, flaky.fails = 0, 1
+	assert.NoError(t, WriteStream(ctx, v, "b.txt", bytes.NewReader([]byte("stream")), 6))
+	data, _, err := flaky.Next.Read(ctx, "b.txt", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "stream", string(data))
+
+	// поток без io.Seeker повторить нельзя
+	flaky.calls, flaky.fails = 0, 1
+	assert.Error(t, WriteStream(ctx, v, "c.txt", io.MultiReader(strings.NewReader("once")), -1))
+	assert.Equal(t, 1, flaky.calls)
+
+	// отмена контекста прерывает ожидание между попытками
+	flaky.calls, flaky.fails = 0, 10
+	slow := ChainVfs(flaky, WithVfsRetry(VfsRetryConfig{Delay: time.Hour}))
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, _, err = slow.Read(cctx, "a.txt", false)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+func TestBackoffDelay(t *testing.T) {
+	base := 10 * time.Millisecond
+	for attempt, want := range map[int]time.Duration{1: base, 2: 2 * base, 3: 4 * base, 5: 16 * base, 20: 60 * base} {
+		for i := 0; i < 20; i++ {
+			delay := backoffDelay(attempt, base)
+			assert.GreaterOrEqual(t, delay, want/2, "attempt %d", attempt)
+			assert.LessOrEqual(t, delay, want, "attempt %d", attempt)
+		}
+	}
+	assert.Equal(t, time.Duration(0), backoffDelay(1, 0))
+}
+
+// testCounter счетчик метрик для проверки в тестах
+type testCounter struct {
+	value *float64
+}
+
+func (c testCounter) With(...string) metrics.Counter { return c }
+func (c testCounter) Add(delta float64)              { *c.value += delta }
+
+func TestWithVfsRetryExhausted(t *testing.T) {
+	var exhausted float64
+	saved := vfs_retries_exhausted
+	vfs_retries_exhausted = testCounter{value: &exhausted}
+	defer func() { vfs_retries_exhausted = saved }()
+
+	ctx := context.Background()
+	flaky := &flakyVfs{VfsWrapper: VfsWrapper{Next: newTestVfs(t)}, fails: 10, err: errors.New("status code: 503")}
+	v := ChainVfs(flaky, WithVfsRetry(VfsRetryConfig{Delay: time.Millisecond}))
+
+	_, _, err := v.Read(ctx, "a.txt", false)
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), exhausted)
+
+	// после повтора получена постоянная ошибка - попытки не исчерпаны
+	flaky.calls, flaky.fails = 0, 1
+	_, _, err = v.Read(ctx, "none.txt", false)
+	assert.True(t, IsVfsNotFound(err))
+	assert.Equal(t, 2, flaky.calls)
+	assert.Equal(t, float64(1), exhausted)
+}
@@ -0,0 +1,268 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3"
+	"github.com/graymeta/stow"
+)
+
+var (
+	ErrVfsOptionsUnsupported = errors.New("vfs options are not supported by storage")
+	ErrVfsArchived           = s3.ErrArchived
+)
+
+// WriteOptions параметры шифрования и класса хранения записываемого файла (s3)
+// незаданные поля берутся из настроек бакета (VfsSSE, VfsStorageClass...)
+type WriteOptions struct {
+	// SSE шифрование на стороне хранилища: AES256 (SSE-S3) или aws:kms (SSE-KMS)
+	SSE string
+	// SSEKMSKeyID ключ KMS для aws:kms (пусто - ключ аккаунта по умолчанию)
+	SSEKMSKeyID string
+	// SSECustomerKey 32-байтовый ключ клиента (SSE-C), тот же ключ нужен для чтения файла
+	SSECustomerKey []byte
+	// StorageClass класс хранения, например STANDARD_IA или GLACIER
+	StorageClass string
+}
+
+// ReadOptions параметры чтения файла (s3)
+type ReadOptions struct {
+	// SSECustomerKey 32-байтовый ключ клиента (SSE-C), которым файл зашифрован при записи
+	// (пусто - ключ из настроек бакета VfsSSECustomerKey)
+	SSECustomerKey []byte
+}
+
+// OptionsWriter хранилище, которое умеет писать файл с параметрами шифрования и класса хранения
+type OptionsWriter interface {
+	WriteWithOptions(ctx context.Context, file string, data []byte, opts WriteOptions) (err error)
+}
+
+// OptionsReader хранилище, которое умеет читать файл с параметрами шифрования
+type OptionsReader interface {
+	ReadWithOptions(ctx context.Context, file string, private_access bool, opts ReadOptions) (data []byte, mimeType string, err error)
+}
+
+// Restorer хранилище, которое умеет восстанавливать файлы из архивного класса хранения (GLACIER, DEEP_ARCHIVE)
+type Restorer interface {
+	Restore(ctx context.Context, file string, days int64, tier string) (err error)
+}
+
+// WriteWithOptions пишет файл с параметрами, если хранилище реализует OptionsWriter
+// хранилища без поддержки параметров возвращают ErrVfsOptionsUnsupported (файл не пишется без требуемого шифрования)
+func WriteWithOptions(ctx context.Context, v Vfs, file string, data []byte, opts WriteOptions) (err error) {
+	if w, ok := v.(OptionsWriter); ok {
+		return w.WriteWithOptions(ctx, file, data, opts)
+	}
+
+	return ErrVfsOptionsUnsupported
+}
+
+// ReadWithOptions читает файл с параметрами, если хранилище реализует OptionsReader
+// (чтение файла, записанного с WriteOptions.SSECustomerKey), иначе возвращает ErrVfsOptionsUnsupported
+func ReadWithOptions(ctx context.Context, v Vfs, file string, private_access bool, opts ReadOptions) (data []byte, mimeType string, err error) {
+	if r, ok := v.(OptionsReader); ok {
+		return r.ReadWithOptions(ctx, file, private_access, opts)
+	}
+
+	return nil, "", ErrVfsOptionsUnsupported
+}
+
+// Restore запрашивает восстановление архивного файла на days дней с приоритетом tier
+// (Expedited, Standard, Bulk; пусто - Standard), файл доступен для чтения после завершения восстановления
+func Restore(ctx context.Context, v Vfs, file string, days int64, tier string) (err error) {
+	if r, ok := v.(Restorer); ok {
+		return r.Restore(ctx, file, days, tier)
+	}
+
+	return ErrVfsOptionsUnsupported
+}
+
+// IsVfsArchived проверяет, что файл хранится в архивном классе и должен быть восстановлен перед чтением
+func IsVfsArchived(item Item) bool {
+	archived, ok := item.(s3.ArchivedItem)
+
+	return ok && archived.Archived()
+}
+
+// WriteWithOptions создаем объект в s3 с параметрами шифрования и класса хранения
+func (v *vfs) WriteWithOptions(ctx context.Context, file string, data []byte, opts WriteOptions) (err error) {
+	if strings.ToLower(v.kind) != "s3" {
+		return fmt.Errorf("%w: %s", ErrVfsOptionsUnsupported, v.kind)
+	}
+
+	err = v.Connect()
+	if err != nil {
+		return fmt.Errorf("error connect to filestorage. err: %s cfg: VfsKind: %s, VfsEndpoint: %s, VfsBucket: %s", err, v.kind, v.endpoint, v.bucket)
+	}
+	defer v.Close()
+
+	_, container := v.conn()
+	putter, ok := container.(s3.OptionsPutter)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrVfsOptionsUnsupported, v.kind)
+	}
+
+	if v.comma != "" {
+		file = strings.Replace(file, sep, v.comma, -1)
+	}
+	if strings.Contains(file, "../") {
+		return fmt.Errorf("path file not valid")
+	}
+
+	chResult := make(chan error, 1)
+	go func() {
+		_, err := putter.PutWithOptions(file, bytes.NewReader(data), int64(len(data)), nil, s3.PutOptions{
+			ServerSideEncryption: opts.SSE,
+			SSEKMSKeyID:          opts.SSEKMSKeyID,
+			SSECustomerKey:       opts.SSECustomerKey,
+			StorageClass:         opts.StorageClass,
+		})
+		chResult <- err
+	}()
+
+	select {
+	case err = <-chResult:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("exec WriteWithOptions dead for context")
+	}
+}
+
+// ReadWithOptions читаем объект s3 с параметрами шифрования
+func (v *vfs) ReadWithOptions(ctx context.Context, file string, private_access bool, opts ReadOptions) (data []byte, mimeType string, err error) {
+	if strings.ToLower(v.kind) != "s3" {
+		return nil, "", fmt.Errorf("%w: %s", ErrVfsOptionsUnsupported, v.kind)
+	}
+	if opts.SSECustomerKey == nil {
+		return v.Read(ctx, file, private_access)
+	}
+
+	err = checkPrivateAccess(ctx, file, private_access)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = v.Connect()
+	if err != nil {
+		return nil, "", fmt.Errorf("error connect to filestorage. err: %s cfg: VfsKind: %s, VfsEndpoint: %s, VfsBucket: %s", err, v.kind, v.endpoint, v.bucket)
+	}
+	defer v.Close()
+
+	_, container := v.conn()
+	keyed, ok := container.(s3.KeyedContainer)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s", ErrVfsOptionsUnsupported, v.kind)
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	chResult := make(chan result, 1)
+	go func() {
+		var r result
+		item, err := keyed.ItemWithKey(strings.TrimPrefix(v.itemPath(file, v.bucket), sep), opts.SSECustomerKey)
+		if err != nil {
+			r.err = fmt.Errorf("error get Item for path: %s, err: %w", file, err)
+			chResult <- r
+			return
+		}
+		reader, err := item.Open()
+		if err != nil {
+			r.err = err
+			chResult <- r
+			return
+		}
+		defer reader.Close()
+		r.data, r.err = io.ReadAll(reader)
+		chResult <- r
+	}()
+
+	select {
+	case r := <-chResult:
+		if r.err != nil {
+			return nil, "", r.err
+		}
+		return r.data, detectMIME(r.data, file), nil
+	case <-ctx.Done():
+		return nil, "", fmt.Errorf("exec ReadWithOptions dead for context")
+	}
+}
+
+// Restore запрашиваем восстановление архивного объекта s3
+func (v *vfs) Restore(ctx context.Context, file string, days int64, tier string) (err error) {
+	if strings.ToLower(v.kind) != "s3" {
+		return fmt.Errorf("%w: %s", ErrVfsOptionsUnsupported, v.kind)
+	}
+
+	err = v.Connect()
+	if err != nil {
+		return fmt.Errorf("error connect to filestorage. err: %s cfg: VfsKind: %s, VfsEndpoint: %s, VfsBucket: %s", err, v.kind, v.endpoint, v.bucket)
+	}
+	defer v.Close()
+
+	_, container := v.conn()
+	archive, ok := container.(s3.ArchiveContainer)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrVfsOptionsUnsupported, v.kind)
+	}
+
+	if v.comma != "" {
+		file = strings.Replace(file, sep, v.comma, -1)
+	}
+
+	return archive.RestoreItem(file, days, tier)
+}
+
+// vfsSSE настройки шифрования и класса хранения бакета s3
+type vfsSSE struct {
+	sse, kmsKeyID, customerKey, storageClass string
+	listArchived                             bool
+}
+
+// apply добавляет настройки в конфиг подключения s3
+func (c vfsSSE) apply(config stow.ConfigMap) {
+	for key, value := range map[string]string{
+		s3.ConfigSSE:            c.sse,
+		s3.ConfigSSEKMSKeyID:    c.kmsKeyID,
+		s3.ConfigSSECustomerKey: c.customerKey,
+		s3.ConfigStorageClass:   c.storageClass,
+	} {
+		if value != "" {
+			config[key] = value
+		}
+	}
+	if c.listArchived {
+		config[s3.ConfigListArchived] = "true"
+	}
+}
+
+// vfsCredentials параметры получения ключей s3 (см. VfsAuthType)
+type vfsCredentials struct {
+	token, file, profile, provider                              string
+	roleARN, sessionName, externalID, roleDuration, stsEndpoint string
+}
+
+// apply добавляет параметры в конфиг подключения s3
+func (c vfsCredentials) apply(config stow.ConfigMap) {
+	for key, value := range map[string]string{
+		s3.ConfigToken:               c.token,
+		s3.ConfigCredentialsFile:     c.file,
+		s3.ConfigProfile:             c.profile,
+		s3.ConfigCredentialsProvider: c.provider,
+		s3.ConfigRoleARN:             c.roleARN,
+		s3.ConfigRoleSessionName:     c.sessionName,
+		s3.ConfigRoleExternalID:      c.externalID,
+		s3.ConfigRoleDuration:        c.roleDuration,
+		s3.ConfigSTSEndpoint:         c.stsEndpoint,
+	} {
+		if value != "" {
+			config[key] = value
+		}
+	}
+}
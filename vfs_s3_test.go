@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/graymeta/stow"
+	"github.com/stretchr/testify/assert"
+
+	"git.lowcodeplatform.net/packages/lib/pkg/s3/s3test"
+)
+
+// newS3TestVfs подключает хранилище к бакету files поддельного s3
+func newS3TestVfs(t *testing.T, srv *s3test.Server) Vfs {
+	t.Helper()
+
+	v, err := NewVfsFromConfig(VfsConfig{
+		VfsKind:        "s3",
+		VfsEndpoint:    srv.URL,
+		VfsAccessKeyID: srv.AccessKeyID,
+		VfsSecretKey:   srv.SecretKey,
+		VfsBucket:      "files",
+		VfsDisableSSL:  true,
+	})
+	assert.NoError(t, err)
+
+	return v
+}
+
+func TestVfsS3(t *testing.T) {
+	ctx := context.Background()
+	srv := s3test.NewServer()
+	defer srv.Close()
+	v := newS3TestVfs(t, srv)
+
+	// бакет создается при подключении
+	assert.NoError(t, v.Write(ctx, "pages/index.json", []byte(`{"v":1}`)))
+	assert.NoError(t, v.Write(ctx, "pages/about.json", []byte(`{"v":2}`)))
+	assert.Equal(t, []string{"pages/about.json", "pages/index.json"}, srv.Keys("files"))
+
+	data, _, err := v.Read(ctx, "pages/index.json", false)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"v":1}`, string(data))
+
+	files, err := v.List(ctx, "pages/", 1)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	assert.NoError(t, WriteIf(ctx, v, "lock", []byte("1"), IfNoneMatch("*")))
+	assert.ErrorIs(t, WriteIf(ctx, v, "lock", []byte("2"), IfNoneMatch("*")), ErrPreconditionFailed)
+
+	assert.NoError(t, v.Delete(ctx, "pages/index.json"))
+	_, _, err = v.Read(ctx, "pages/index.json", false)
+	assert.True(t, IsVfsNotFound(err), err)
+}
+
+func TestIsVfsNotFound(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		notFound bool
+	}{
+		{nil, false},
+		{fmt.Errorf("error get item. err: %w", stow.ErrNotFound), true},
+		{&fs.PathError{Op: "open", Path: "a.txt", Err: fs.ErrNotExist}, true},
+		{fmt.Errorf("read: %w", awserr.New("NoSuchKey", "The specified key does not exist.", nil)), true},
+		{awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "id"), true},
+		{awserr.New("AccessDenied", "resource not found in policy", nil), false},
+		// ошибки, обернутые в строку
+		{errors.New("error get Item for path: a.txt, err: error. location.ItemByURL is failled. urlPath: a.txt, err: not found"), true},
+		{errors.New("error read. err: NoSuchKey: The specified key does not exist. status code: 404"), true},
+		{errors.New("error connect to filestorage. err: credentials provider not found"), false},
+		{errors.New("error create container from config. err: bucket policy NotFoundError"), false},
+	} {
+		assert.Equal(t, tc.notFound, IsVfsNotFound(tc.err), "%v", tc.err)
+	}
+}
+
+func TestVfsS3Proxy(t *testing.T) {
+	srv := s3test.NewServer(s3test.WithAnonymousRead())
+	defer srv.Close()
+	srv.Put("files", "img/logo.png", []byte("png"))
+
+	h, err := newS3TestVfs(t, srv).Proxy("/static/", "/files/")
+	assert.NoError(t, err)
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL + "/static/img/logo.png")
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "png", string(data))
+
+	res, err = http.Get(proxy.URL + "/static/img/none.png")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.Equal(t, "0", res.Header.Get("Content-Length"))
+}
+
+func TestVfsS3ReadWithOptions(t *testing.T) {
+	// SDK заменяет корневые сертификаты клиента (ca_cert) на бандл из окружения
+	t.Setenv("AWS_CA_BUNDLE", "")
+	ctx := context.Background()
+	srv := s3test.NewServer(s3test.WithTLS())
+	defer srv.Close()
+
+	v, err := NewVfsFromConfig(VfsConfig{
+		VfsKind:        "s3",
+		VfsEndpoint:    srv.URL,
+		VfsAccessKeyID: srv.AccessKeyID,
+		VfsSecretKey:   srv.SecretKey,
+		VfsBucket:      "files",
+		VfsCertCA:      srv.Config()["ca_cert"],
+	})
+	assert.NoError(t, err)
+
+	key := bytes.Repeat([]byte{7}, 32)
+	assert.NoError(t, WriteWithOptions(ctx, v, "secret.txt", []byte("secret"), WriteOptions{SSECustomerKey: key}))
+
+	// файл SSE-C читается только с ключом, которым записан
+	_, _, err = v.Read(ctx, "secret.txt", false)
+	assert.Error(t, err)
+	_, _, err = ReadWithOptions(ctx, v, "secret.txt", false, ReadOptions{SSECustomerKey: bytes.Repeat([]byte{8}, 32)})
+	assert.Error(t, err)
+	data, _, err := ReadWithOptions(ctx, v, "secret.txt", false, ReadOptions{SSECustomerKey: key})
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(data))
+
+	// ключ передается через мидлвари
+	wrapped := ChainVfs(v, WithVfsRetry(VfsRetryConfig{Delay: time.Millisecond}), WithVfsHooks(VfsHooks{}))
+	data, _, err = ReadWithOptions(ctx, wrapped, "secret.txt", false, ReadOptions{SSECustomerKey: key})
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(data))
+
+	_, _, err = ReadWithOptions(ctx, newTestVfs(t), "secret.txt", false, ReadOptions{SSECustomerKey: key})
+	assert.ErrorIs(t, err, ErrVfsOptionsUnsupported)
+}
@@ -0,0 +1,381 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	"git.lowcodeplatform.net/packages/models"
+	"github.com/gabriel-vasile/mimetype"
+)
+
+const (
+	defaultUploadMaxSize  = 32 << 20 // 32Mb
+	defaultUploadMaxFiles = 10
+	uploadSniffSize       = 512
+	uploadMaxNameLength   = 200
+)
+
+var (
+	ErrUploadTooLarge = errors.New("upload size limit exceeded")
+	ErrUploadMIME     = errors.New("upload mime type is not allowed")
+	ErrUploadEmpty    = errors.New("upload has no files")
+	ErrUploadExists   = errors.New("upload file already exists")
+)
+
+// StreamWriter хранилище, которое умеет писать файл потоком (без чтения в память целиком)
+// size - размер данных, -1 если неизвестен
+type StreamWriter interface {
+	WriteStream(ctx context.Context, file string, r io.Reader, size int64) (err error)
+}
+
+// WriteStream пишет содержимое r в хранилище потоком, если хранилище реализует StreamWriter,
+// иначе вычитывает r в память и пишет через Write
+func WriteStream(ctx context.Context, v Vfs, file string, r io.Reader, size int64) (err error) {
+	if w, ok := v.(StreamWriter); ok {
+		return w.WriteStream(ctx, file, r, size)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return v.Write(ctx, file, data)
+}
+
+// WriteStream создаем объект в хранилище из потока
+// s3 принимает поток неизвестного размера (multipart upload), для остальных хранилищ
+// поток неизвестного размера предварительно сохраняется во временный файл
+func (v *vfs) WriteStream(ctx context.Context, file string, r io.Reader, size int64) (err error) {
+	if size < 0 && strings.ToLower(v.kind) != "s3" {
+		tmp, err := os.CreateTemp("", "vfs-stream-*")
+		if err != nil {
+			return fmt.Errorf("error create temp file. err: %w", err)
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		size, err = io.Copy(tmp, r)
+		if err != nil {
+			return err
+		}
+		if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = tmp
+	}
+
+	err = v.Connect()
+	if err != nil {
+		return fmt.Errorf("error connect to filestorage. err: %s cfg: VfsKind: %s, VfsEndpoint: %s, VfsBucket: %s", err, v.kind, v.endpoint, v.bucket)
+	}
+	defer v.Close()
+
+	// если передан разделитель, то заменяем / на него (возможно понадобится для совместимости плоских хранилищ)
+	if v.comma != "" {
+		file = strings.Replace(file, sep, v.comma, -1)
+	}
+
+	if strings.Contains(file, "../") {
+		return fmt.Errorf("path file not valid")
+	}
+
+	_, container := v.conn()
+	chResult := make(chan error, 1)
+	go func() {
+		_, err := container.Put(file, r, size, nil)
+		chResult <- err
+	}()
+
+	select {
+	case err = <-chResult:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("exec WriteStream dead for context")
+	}
+}
+
+// UploadConfig параметры обработчика загрузки файлов
+type UploadConfig struct {
+	// Prefix шаблон директории для файлов, поддерживает {user_uid}, {request_id}, {date} (2006-01-02), {uuid}
+	// например: users/{user_uid}/uploads/{date}
+	Prefix string
+	// FieldName имя поля формы с файлами (по умолчанию - все файлы формы)
+	FieldName string
+	// MaxSize максимальный размер одного файла (по умолчанию 32Mb)
+	MaxSize int64
+	// MaxFiles максимальное количество файлов в запросе (по умолчанию 10)
+	MaxFiles int
+	// AllowedMIME разрешенные типы файлов, допускается маска (image/*), пустой список - любые
+	AllowedMIME []string
+	// Overwrite разрешает перезапись существующих файлов (иначе - ErrUploadExists)
+	Overwrite bool
+}
+
+// UploadedFile результат загрузки файла
+type UploadedFile struct {
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	Original string `json:"original"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mime_type"`
+}
+
+// UploadHandler обработчик multipart-загрузки файлов в хранилище
+// файлы пишутся потоком, тип файла определяется по первым байтам (uploadMIME), имена файлов очищаются (SanitizeFileName)
+// ответ - ResponseJSON со списком загруженных файлов
+func UploadHandler(v Vfs, cfg UploadConfig) http.Handler {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultUploadMaxSize
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = defaultUploadMaxFiles
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		prefix, err := uploadPrefix(r.Context(), cfg.Prefix)
+		if err != nil {
+			ResponseJSON(w, nil, "Unauthorized", err, nil)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxSize*int64(cfg.MaxFiles)+(1<<20))
+		files, err := upload(r, v, prefix, cfg)
+		switch {
+		case err == nil:
+			ResponseJSON(w, files, "OK", nil, nil)
+		case errors.Is(err, ErrUploadEmpty):
+			ResponseJSON(w, nil, "ErrorUnprocessableEntity", err, nil)
+		case errors.Is(err, ErrUploadExists):
+			ResponseJSON(w, files, "ErrorRevElement", err, nil)
+		case errors.Is(err, ErrUploadTooLarge), errors.Is(err, ErrUploadMIME):
+			ResponseJSON(w, files, "ErrorUnprocessableEntity", err, nil)
+		default:
+			ResponseJSON(w, files, "ErrorGetData", err, nil)
+		}
+	})
+}
+
+func upload(r *http.Request, v Vfs, prefix string, cfg UploadConfig) (files []UploadedFile, err error) {
+	ctx := r.Context()
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUploadEmpty, err)
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return files, fmt.Errorf("%w: request is larger than %d bytes", ErrUploadTooLarge, maxBytesErr.Limit)
+			}
+			return files, fmt.Errorf("error read multipart form. err: %w", err)
+		}
+		if part.FileName() == "" || (cfg.FieldName != "" && part.FormName() != cfg.FieldName) {
+			part.Close()
+			continue
+		}
+		if len(files) >= cfg.MaxFiles {
+			part.Close()
+			return files, fmt.Errorf("%w: more than %d files", ErrUploadTooLarge, cfg.MaxFiles)
+		}
+
+		file, err := uploadPart(ctx, v, part, prefix, cfg)
+		part.Close()
+		if err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+
+	if len(files) == 0 {
+		return nil, ErrUploadEmpty
+	}
+
+	return files, nil
+}
+
+func uploadPart(ctx context.Context, v Vfs, part *multipart.Part, prefix string, cfg UploadConfig) (file UploadedFile, err error) {
+	original := part.FileName()
+	file.Original = original
+	file.Name = SanitizeFileName(original)
+	file.Path = strings.TrimPrefix(path.Join(prefix, file.Name), "/")
+
+	// определяем тип по содержимому, а не по переданному клиентом заголовку
+	head := make([]byte, uploadSniffSize)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return file, fmt.Errorf("error read file %s. err: %w", original, err)
+	}
+	head = head[:n]
+	file.MimeType = uploadMIME(head, file.Name)
+	if !mimeAllowed(file.MimeType, cfg.AllowedMIME) {
+		return file, fmt.Errorf("%w: %s (%s)", ErrUploadMIME, file.MimeType, original)
+	}
+
+	// в хранилище пишется только полностью принятый файл, поэтому неудачная загрузка
+	// не оставляет недописанный файл и не затрагивает существующий
+	body := &uploadLimitReader{r: io.MultiReader(bytes.NewReader(head), part), limit: cfg.MaxSize}
+	tooLarge := func() error {
+		return fmt.Errorf("%w: file %s is larger than %d bytes", ErrUploadTooLarge, original, cfg.MaxSize)
+	}
+
+	if !cfg.Overwrite {
+		// размер файла ограничен MaxSize - принимаем в память и создаем файл, только если его еще нет
+		data, err := io.ReadAll(body)
+		file.Size = body.read
+		if body.exceeded {
+			return file, tooLarge()
+		}
+		if err != nil {
+			return file, fmt.Errorf("error read file %s. err: %w", original, err)
+		}
+		err = WriteIf(ctx, v, file.Path, data, IfNoneMatch("*"))
+		if errors.Is(err, ErrPreconditionFailed) {
+			return file, fmt.Errorf("%w: %s", ErrUploadExists, file.Path)
+		}
+		if err != nil {
+			return file, fmt.Errorf("error write file %s. err: %w", file.Path, err)
+		}
+		return file, nil
+	}
+
+	tmp, err := os.CreateTemp("", "vfs-upload-*")
+	if err != nil {
+		return file, fmt.Errorf("error create temp file. err: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	file.Size, err = io.Copy(tmp, body)
+	if body.exceeded {
+		return file, tooLarge()
+	}
+	if err != nil {
+		return file, fmt.Errorf("error read file %s. err: %w", original, err)
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return file, err
+	}
+	if err = WriteStream(ctx, v, file.Path, tmp, file.Size); err != nil {
+		return file, fmt.Errorf("error write file %s. err: %w", file.Path, err)
+	}
+
+	return file, nil
+}
+
+// uploadPrefix подставляет значения в шаблон директории загрузки
+func uploadPrefix(ctx context.Context, template string) (string, error) {
+	user, _ := ctx.Value(userUid).(string)
+	if strings.Contains(template, "{user_uid}") && user == "" {
+		return "", errUnauthorized
+	}
+
+	return strings.NewReplacer(
+		"{user_uid}", user,
+		"{request_id}", getFieldCtx(ctx, models.RequestIDField),
+		"{date}", time.Now().Format("2006-01-02"),
+		"{uuid}", UUID(),
+	).Replace(template), nil
+}
+
+// uploadMIME определяет тип по содержимому (расширение может быть подменено),
+// для текстовых и нераспознанных файлов уточняет тип по расширению через detectMIME
+func uploadMIME(head []byte, name string) string {
+	base := func(mimeType string) string {
+		if parsed, _, err := mime.ParseMediaType(mimeType); err == nil {
+			return parsed
+		}
+		return mimeType
+	}
+
+	mimeType := base(mimetype.Detect(head).String())
+	if mimeType != "text/plain" && mimeType != "application/octet-stream" {
+		return mimeType
+	}
+
+	return base(detectMIME(head, name))
+}
+
+func mimeAllowed(mimeType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == mimeType || (strings.HasSuffix(a, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(a, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SanitizeFileName оставляет от имени файла только безопасные символы
+// (буквы, цифры, точка, дефис, подчеркивание), убирает путь и ведущие точки
+func SanitizeFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '.', r == '-', r == '_':
+			b.WriteRune(r)
+		case r == ' ', r == '\t':
+			b.WriteRune('_')
+		}
+	}
+
+	name = strings.TrimLeft(b.String(), ".")
+	if len(name) > uploadMaxNameLength {
+		ext := path.Ext(name)
+		if len(ext) > 20 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:uploadMaxNameLength-len(ext)], "") + ext
+	}
+	if name == "" || name == "." {
+		name = UUID()
+	}
+
+	return name
+}
+
+// uploadLimitReader прерывает чтение при превышении лимита размера файла
+type uploadLimitReader struct {
+	r        io.Reader
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (l *uploadLimitReader) Read(p []byte) (n int, err error) {
+	n, err = l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		l.exceeded = true
+		return n, ErrUploadTooLarge
+	}
+
+	return n, err
+}
@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pngHeader минимальная сигнатура png для определения типа по содержимому
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x02\x00\x00\x00")
+
+func uploadRequest(t *testing.T, files map[string][]byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	assert.NoError(t, mw.WriteField("comment", "skip"))
+	for name, data := range files {
+		fw, err := mw.CreateFormFile("file", name)
+		assert.NoError(t, err)
+		fw.Write(data)
+	}
+	assert.NoError(t, mw.Close())
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	return r.WithContext(context.WithValue(r.Context(), userUid, "u1"))
+}
+
+func TestUploadHandler(t *testing.T) {
+	ctx := context.WithValue(context.Background(), userUid, "u1")
+	v := newTestVfs(t)
+	handler := UploadHandler(v, UploadConfig{
+		Prefix:      "users/{user_uid}/{date}",
+		MaxSize:     1024,
+		AllowedMIME: []string{"image/*", "text/css"},
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, uploadRequest(t, map[string][]byte{
+		"../../logo.png":  pngHeader,
+		"site styles.css": []byte("body { color: red; }"),
+	}))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Data []UploadedFile `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Data, 2)
+
+	prefix := "users/u1/" + time.Now().Format("2006-01-02") + "/"
+	uploaded := map[string]UploadedFile{}
+	for _, f := range resp.Data {
+		uploaded[f.Path] = f
+	}
+	assert.Equal(t, "image/png", uploaded[prefix+"logo.png"].MimeType)
+	assert.Equal(t, "text/css", uploaded[prefix+"site_styles.css"].MimeType)
+	assert.Equal(t, int64(len(pngHeader)), uploaded[prefix+"logo.png"].Size)
+
+	data, _, err := v.Read(ctx, prefix+"site_styles.css", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "body { color: red; }", string(data))
+
+	// повторная загрузка без Overwrite
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, uploadRequest(t, map[string][]byte{"logo.png": pngHeader}))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// тип определяется по содержимому, а не по расширению
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, uploadRequest(t, map[string][]byte{"fake.png": []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff")}))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, uploadRequest(t, map[string][]byte{"big.css": []byte(strings.Repeat("a", 2048))}))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	exists, err := vfsExists(ctx, v, prefix+"big.css")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	w = httptest.NewRecorder()
+	r := uploadRequest(t, map[string][]byte{"logo.png": pngHeader})
+	handler.ServeHTTP(w, r.WithContext(context.Background()))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// запрос без файлов - ошибка клиента
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, uploadRequest(t, nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestUploadHandlerOverwrite(t *testing.T) {
+	ctx := context.Background()
+	v := newTestVfs(t)
+	handler := UploadHandler(v, UploadConfig{Prefix: "files", MaxSize: 1024, Overwrite: true})
+	assert.NoError(t, v.Write(ctx, "files/site.css", []byte("body{}")))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, uploadRequest(t, map[string][]byte{"site.css": []byte("p{}")}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	data, _, err := v.Read(ctx, "files/site.css", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "p{}", string(data))
+
+	// превышение размера при перезаписи не удаляет существующий файл
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, uploadRequest(t, map[string][]byte{"site.css": []byte(strings.Repeat("a", 2048))}))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	data, _, err = v.Read(ctx, "files/site.css", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "p{}", string(data))
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	cases := map[string]string{
+		"report.pdf":          "report.pdf",
+		"../../etc/passwd":    "passwd",
+		`C:\Users\me\a b.txt`: "a_b.txt",
+		".htaccess":           "htaccess",
+		"отчет <2024>.xlsx":   "отчет_2024.xlsx",
+		"name\x00\n.js":       "name.js",
+	}
+	for name, want := range cases {
+		assert.Equal(t, want, SanitizeFileName(name), name)
+	}
+
+	assert.NotEmpty(t, SanitizeFileName("..."))
+	assert.LessOrEqual(t, len(SanitizeFileName(strings.Repeat("я", 300)+".txt")), uploadMaxNameLength)
+}